@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// meter counts queries per second over a trailing window to find the peak rate.
+type meter struct {
+	secs   []int64 // the unix second each bucket is counting
+	counts []int64
+
+	sync.Mutex
+}
+
+// newMeter returns a meter with a window of w, rounded down to whole seconds.
+func newMeter(w time.Duration) *meter {
+	n := int(w / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &meter{secs: make([]int64, n), counts: make([]int64, n)}
+}
+
+// window returns the window of m.
+func (m *meter) window() time.Duration { return time.Duration(len(m.secs)) * time.Second }
+
+// mark counts a query at now.
+func (m *meter) mark(now time.Time) {
+	sec := now.Unix()
+	i := int(sec % int64(len(m.secs)))
+	m.Lock()
+	if m.secs[i] != sec {
+		m.secs[i], m.counts[i] = sec, 0
+	}
+	m.counts[i]++
+	m.Unlock()
+}
+
+// peak returns the highest number of queries counted in a single second of the window ending at now.
+func (m *meter) peak(now time.Time) int64 {
+	oldest := now.Unix() - int64(len(m.secs))
+	max := int64(0)
+	m.Lock()
+	for i := range m.secs {
+		if m.secs[i] > oldest && m.counts[i] > max {
+			max = m.counts[i]
+		}
+	}
+	m.Unlock()
+	return max
+}
+
+// accountingWindow is the default window over which the peak QPS is tracked.
+const accountingWindow = time.Minute
+
+// sent accounts for a query of size bytes sent to h.
+func (h *host) sent(size int) {
+	h.meter.mark(time.Now())
+	atomic.AddInt64(&h.queries, 1)
+	atomic.AddInt64(&h.bytesSent, int64(size))
+	BytesCount.WithLabelValues(h.id, h.addr, "sent").Add(float64(size))
+	expBytesSent.Add(h.expKey(), int64(size))
+}
+
+// received accounts for the reply ret received from h.
+func (h *host) received(ret *dns.Msg) {
+	size := ret.Len()
+	atomic.AddInt64(&h.bytesReceived, int64(size))
+	BytesCount.WithLabelValues(h.id, h.addr, "received").Add(float64(size))
+	ResponseSize.WithLabelValues(h.id, h.addr).Observe(float64(size))
+	if ret.Truncated {
+		TruncatedCount.WithLabelValues(h.id, h.addr).Add(1)
+	}
+	expBytesReceived.Add(h.expKey(), int64(size))
+}
+
+// updatePeak publishes the peak QPS of h.
+func (h *host) updatePeak() {
+	peak := h.meter.peak(time.Now())
+	PeakQPS.WithLabelValues(h.id, h.addr).Set(float64(peak))
+
+	v := new(expvar.Int)
+	v.Set(peak)
+	expPeakQPS.Set(h.expKey(), v)
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/miekg/dns"
+)
+
+func TestMeterPeak(t *testing.T) {
+	m := newMeter(3 * time.Second)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		m.mark(now)
+	}
+	m.mark(now.Add(time.Second))
+	if x := m.peak(now.Add(time.Second)); x != 5 {
+		t.Errorf("Expected peak of 5, got: %d", x)
+	}
+	// The busy second has left the window.
+	if x := m.peak(now.Add(3 * time.Second)); x != 1 {
+		t.Errorf("Expected peak of 1, got: %d", x)
+	}
+	if x := m.peak(now.Add(10 * time.Second)); x != 0 {
+		t.Errorf("Expected peak of 0, got: %d", x)
+	}
+}
+
+func TestExpvarKeys(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	// Nothing listens here anymore.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := pc.LocalAddr().String()
+	pc.Close()
+
+	f := New()
+	f.id = "exptest"
+	f.SetHealthCheck(0)
+	defer f.Close()
+	f.AddProxy(NewProxy(s.Addr))
+
+	get := func(name, key string) string {
+		v := expvar.Get("forward").(*expvar.Map).Get(name).(*expvar.Map).Get(key)
+		if v == nil {
+			return ""
+		}
+		return v.String()
+	}
+
+	if _, err := f.Forward(questionState("example.org.")); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	key := "exptest/" + s.Addr
+	if x := get("requests", key); x != "1" {
+		t.Errorf("Expected 1 request under %s, got %q", key, x)
+	}
+	if x := get("bytes_sent", key); x == "" || x == "0" {
+		t.Errorf("Expected bytes sent under %s, got %q", key, x)
+	}
+	if x := get("requests", s.Addr); x != "" {
+		t.Errorf("Expected nothing under the bare address, got %q", x)
+	}
+
+	dead := NewProxy(down)
+	f.AddProxy(dead)
+	dead.setHealthClient()
+	dead.host.Check()
+	key = "exptest/" + down
+	if x := get("healthcheck_failures", key); x != "1" {
+		t.Errorf("Expected 1 health check failure under %s, got %q", key, x)
+	}
+	// Healthy follows what the queries see: up with fewer than max_fails fails, then down.
+	if x := get("healthy", key); x != "1" {
+		t.Errorf("Expected %s to be healthy with %d fails, got %q", key, atomic.LoadUint32(&dead.host.fails), x)
+	}
+	dead.host.Check()
+	dead.Down(f.maxfails)
+	if x := get("healthy", key); x != "0" {
+		t.Errorf("Expected %s to be unhealthy, got %q", key, x)
+	}
+
+	// A successful check of a half-open upstream leaves it down.
+	p := f.proxies[0]
+	p.host.rise = 2
+	atomic.StoreUint32(&p.host.fails, f.maxfails+1)
+	p.Down(f.maxfails)
+	p.setHealthClient()
+	p.host.Check()
+	key = "exptest/" + s.Addr
+	if x := get("healthy", key); x != "0" || !p.Down(f.maxfails) {
+		t.Errorf("Expected %s to stay unhealthy while half-open, got %q", key, x)
+	}
+}
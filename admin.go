@@ -0,0 +1,162 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamStatus is how an upstream is shown by the admin endpoint.
+type upstreamStatus struct {
+	Addr     string  `json:"addr"`
+	Tag      string  `json:"tag,omitempty"`
+	Source   string  `json:"source,omitempty"`
+	Backup   bool    `json:"backup,omitempty"`
+	Down     bool    `json:"down"`
+	Inflight int64   `json:"inflight"`
+	Score    float64 `json:"score"`
+
+	Queries       int64 `json:"queries"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	PeakQPS       int64 `json:"peak_qps"` // over the accounting window
+}
+
+// splitStatus is how the split is shown by the admin endpoint.
+type splitStatus struct {
+	Group   string  `json:"group"`
+	Percent float64 `json:"percent"`
+}
+
+// AdminHandler returns an http.Handler to manage the upstreams of f at run time:
+//
+//	GET /upstreams               lists the upstreams as JSON
+//	POST /upstreams?to=TO        adds the upstreams TO, written as in the Corefile; to may be repeated
+//	DELETE /upstreams?to=ADDR    drains and removes the upstream with address ADDR
+//	GET /split                   shows the group and percentage of the split as JSON
+//	PUT /split?group=G&percent=P sends P percent of the queries to group G, see SetSplit
+//
+// The handler doesn't authenticate, only expose it on a trusted address.
+func (f *Forward) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			var list []upstreamStatus
+			for _, p := range f.snapshot() {
+				list = append(list, upstreamStatus{
+					Addr:     p.host.addr,
+					Tag:      p.host.tag,
+					Source:   p.source,
+					Backup:   p.backup,
+					Down:     p.Down(f.maxfails),
+					Inflight: atomic.LoadInt64(&p.inflight),
+					Score:    p.Score(),
+
+					Queries:       atomic.LoadInt64(&p.host.queries),
+					BytesSent:     atomic.LoadInt64(&p.host.bytesSent),
+					BytesReceived: atomic.LoadInt64(&p.host.bytesReceived),
+					PeakQPS:       p.host.meter.peak(time.Now()),
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case "POST":
+			to := r.URL.Query()["to"]
+			if len(to) == 0 {
+				http.Error(w, "no upstreams given", http.StatusBadRequest)
+				return
+			}
+			proxies, err := ParseProxies(to...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, p := range proxies {
+				if f.hasProxy(p.host.addr) {
+					http.Error(w, fmt.Sprintf("upstream %s already exists", p.host.addr), http.StatusConflict)
+					return
+				}
+			}
+			for _, p := range proxies {
+				f.AddProxy(p)
+				f.log.info(f.id, "upstream_added", fmt.Sprintf("Added upstream %s from admin", p.host.addr),
+					Field{"upstream", p.host.addr}, Field{"source", "admin"})
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			addr := r.URL.Query().Get("to")
+			if addr == "" {
+				http.Error(w, "no upstream given", http.StatusBadRequest)
+				return
+			}
+			if err := f.RemoveProxy(addr); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			f.log.info(f.id, "upstream_removed", fmt.Sprintf("Removed upstream %s from admin", addr),
+				Field{"upstream", addr}, Field{"source", "admin"})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/split", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			group, percent := f.Split()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(splitStatus{Group: group, Percent: percent})
+		case "PUT":
+			group := r.URL.Query().Get("group")
+			percent, err := strconv.ParseFloat(r.URL.Query().Get("percent"), 64)
+			if err != nil {
+				http.Error(w, "percent must be a number", http.StatusBadRequest)
+				return
+			}
+			if err := f.SetSplit(group, percent); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.log.info(f.id, "split_changed", fmt.Sprintf("Split %g%% of the queries to group %s from admin", percent, group),
+				Field{"group", group}, Field{"percent", percent}, Field{"source", "admin"})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// hasProxy returns true if f has an upstream with address addr.
+func (f *Forward) hasProxy(addr string) bool {
+	for _, p := range f.snapshot() {
+		if p.host.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// startAdmin serves the admin endpoint on f.admin.
+func (f *Forward) startAdmin() error {
+	ln, err := net.Listen("tcp", f.admin)
+	if err != nil {
+		return err
+	}
+	f.adminServer = &http.Server{Handler: f.AdminHandler()}
+	go f.adminServer.Serve(ln)
+	return nil
+}
+
+// stopAdmin stops serving the admin endpoint, if it's running.
+func (f *Forward) stopAdmin() {
+	if f.adminServer != nil {
+		f.adminServer.Close()
+		f.adminServer = nil
+	}
+}
@@ -0,0 +1,181 @@
+package forward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestAdminHandler(t *testing.T) {
+	f := New()
+	f.SetHealthCheck(0)
+	defer f.Close()
+	proxies, _ := ParseProxies("10.0.0.1")
+	f.AddProxy(proxies[0])
+
+	s := httptest.NewServer(f.AdminHandler())
+	defer s.Close()
+
+	do := func(method, query string) int {
+		req, _ := http.NewRequest(method, s.URL+"/upstreams"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("POST", "?to=10.0.0.2&to=tls://10.0.0.3"); code != http.StatusNoContent {
+		t.Errorf("Expected %d adding upstreams, got: %d", http.StatusNoContent, code)
+	}
+	if code := do("POST", "?to=10.0.0.2"); code != http.StatusConflict {
+		t.Errorf("Expected %d adding an upstream twice, got: %d", http.StatusConflict, code)
+	}
+	if code := do("POST", "?to=udp://10.0.0.4"); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for a bad upstream, got: %d", http.StatusBadRequest, code)
+	}
+	if code := do("DELETE", "?to=10.0.0.1:53"); code != http.StatusNoContent {
+		t.Errorf("Expected %d removing an upstream, got: %d", http.StatusNoContent, code)
+	}
+	if code := do("DELETE", "?to=10.0.0.1:53"); code != http.StatusNotFound {
+		t.Errorf("Expected %d removing an unknown upstream, got: %d", http.StatusNotFound, code)
+	}
+
+	resp, err := http.Get(s.URL + "/upstreams")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer resp.Body.Close()
+	var list []upstreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Expected JSON, got: %s", err)
+	}
+	if len(list) != 2 || list[0].Addr != "10.0.0.2:53" || list[1].Addr != "10.0.0.3:853" {
+		t.Errorf("Expected 10.0.0.2:53 and 10.0.0.3:853, got: %v", list)
+	}
+}
+
+func TestSetupAdmin(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nadmin localhost:8053\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.admin != "localhost:8053" {
+		t.Errorf("Expected admin address localhost:8053, got: %q", f.admin)
+	}
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nadmin\n}\n",
+		"forward . 127.0.0.1 {\nadmin localhost\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestAdminSplit(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 10.0.0.1 {\ngroup canary 10.0.0.2\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+
+	s := httptest.NewServer(f.AdminHandler())
+	defer s.Close()
+
+	do := func(method, query string) int {
+		req, _ := http.NewRequest(method, s.URL+"/split"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("PUT", "?group=canary&percent=12.5"); code != http.StatusNoContent {
+		t.Errorf("Expected %d setting the split, got: %d", http.StatusNoContent, code)
+	}
+	if group, percent := f.Split(); group != "canary" || percent != 12.5 {
+		t.Errorf("Expected 12.5%% to canary, got %g%% to %q", percent, group)
+	}
+	for _, query := range []string{"?group=nope&percent=10", "?group=canary&percent=101", "?group=canary&percent=ten", "?group=canary"} {
+		if code := do("PUT", query); code != http.StatusBadRequest {
+			t.Errorf("Expected %d for %s, got: %d", http.StatusBadRequest, query, code)
+		}
+	}
+	if code := do("POST", "?group=canary&percent=10"); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d for POST, got: %d", http.StatusMethodNotAllowed, code)
+	}
+
+	resp, err := http.Get(s.URL + "/split")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer resp.Body.Close()
+	var split splitStatus
+	if err := json.NewDecoder(resp.Body).Decode(&split); err != nil {
+		t.Fatalf("Expected JSON, got: %s", err)
+	}
+	if split.Group != "canary" || split.Percent != 12.5 {
+		t.Errorf("Expected 12.5%% to canary, got: %v", split)
+	}
+}
+
+func TestAdminAccounting(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetHealthCheck(0)
+	defer f.Close()
+	proxies, _ := ParseProxies(s.Addr)
+	f.AddProxy(proxies[0])
+
+	state := questionState("example.org.")
+	for i := 0; i < 3; i++ {
+		if _, err := f.Forward(state); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+	}
+
+	a := httptest.NewServer(f.AdminHandler())
+	defer a.Close()
+	resp, err := http.Get(a.URL + "/upstreams")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer resp.Body.Close()
+	var list []upstreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Expected JSON, got: %s", err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 upstream, got: %v", list)
+	}
+	u := list[0]
+	if u.Queries != 3 {
+		t.Errorf("Expected 3 queries, got %d", u.Queries)
+	}
+	if u.BytesSent != 3*int64(state.Req.Len()) {
+		t.Errorf("Expected %d bytes sent, got %d", 3*state.Req.Len(), u.BytesSent)
+	}
+	if u.BytesReceived <= u.BytesSent {
+		t.Errorf("Expected more bytes received than the %d sent, got %d", u.BytesSent, u.BytesReceived)
+	}
+	if u.PeakQPS < 1 || u.PeakQPS > 3 {
+		t.Errorf("Expected a peak QPS between 1 and 3, got %d", u.PeakQPS)
+	}
+}
@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// admission bounds the number of concurrent exchanges of a Forward. Queries that can't be sent
+// right away wait in a bounded queue, for at most timeout or until their context is done.
+type admission struct {
+	waiting int32 // number of queries in the queue, first for alignment
+
+	slots   chan struct{}
+	queue   int32
+	timeout time.Duration
+}
+
+func newAdmission(inflight, queue int, timeout time.Duration) *admission {
+	return &admission{slots: make(chan struct{}, inflight), queue: int32(queue), timeout: timeout}
+}
+
+// acquire returns nil when the query may proceed, release must then be called when it's done.
+func (a *admission) acquire(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt32(&a.waiting, 1) > a.queue {
+		atomic.AddInt32(&a.waiting, -1)
+		return errQueueFull
+	}
+	defer atomic.AddInt32(&a.waiting, -1)
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *admission) release() { <-a.slots }
+
+// shed writes a reply with rcode for r, with an extended DNS error if the client supports EDNS0.
+func shed(w dns.ResponseWriter, r *dns.Msg, rcode int, reason string) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if o := r.IsEdns0(); o != nil {
+		m.SetEdns0(o.UDPSize(), o.Do())
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, newEDE(edeOther, "forward: "+reason))
+	}
+	w.WriteMsg(m)
+}
+
+var (
+	errQueueFull    = errors.New("admission queue full")
+	errQueueTimeout = errors.New("admission queue timeout")
+)
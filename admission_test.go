@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(1, 1, 50*time.Millisecond)
+	ctx := context.TODO()
+
+	if err := a.acquire(ctx); err != nil {
+		t.Fatalf("Expected to acquire the only slot, got: %s", err)
+	}
+	// Slot taken, this one waits in the queue and times out.
+	if err := a.acquire(ctx); err != errQueueTimeout {
+		t.Errorf("Expected %s, got: %v", errQueueTimeout, err)
+	}
+
+	// Fill the queue, the next one doesn't fit.
+	done := make(chan error)
+	go func() { done <- a.acquire(ctx) }()
+	for atomic.LoadInt32(&a.waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := a.acquire(ctx); err != errQueueFull {
+		t.Errorf("Expected %s, got: %v", errQueueFull, err)
+	}
+
+	a.release()
+	if err := <-done; err != nil {
+		t.Errorf("Expected queued query to be admitted, got: %s", err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			<-release
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.maxConcurrent = 1
+	f.rejectRcode = dns.RcodeRefused
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	done := make(chan struct{})
+	go func() {
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+		close(done)
+	}()
+	for atomic.LoadInt64(&f.concurrent) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	before := counterValue(RejectCount, f.id)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req.Copy()); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED beyond the limit, got: %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+	if n := counterValue(RejectCount, f.id) - before; n != 1 {
+		t.Errorf("Expected 1 rejected query, got: %f", n)
+	}
+
+	close(release)
+	<-done
+	if n := atomic.LoadInt64(&f.concurrent); n != 0 {
+		t.Errorf("Expected no queries in flight, got: %d", n)
+	}
+}
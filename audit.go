@@ -0,0 +1,76 @@
+package forward
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// audit sends a copy of state to another upstream than the one that answered with ret, and compares
+// the two replies. This is done for roughly f.auditPercent of the queries. It doesn't block, when too
+// many audits are outstanding the query is not audited.
+func (f *Forward) audit(state request.Request, ret *dns.Msg, answered *Proxy, list []*Proxy) {
+	if f.auditPercent <= 0 || len(list) < 2 || rand.Float64()*100 >= f.auditPercent {
+		return
+	}
+
+	var other *Proxy
+	for _, i := range rand.Perm(len(list)) {
+		if list[i] != answered && !list[i].Down(f.maxfails) {
+			other = list[i]
+			break
+		}
+	}
+	if other == nil {
+		return
+	}
+
+	select {
+	case f.auditInflight <- struct{}{}:
+	default:
+		AuditCount.WithLabelValues(answered.host.id, answered.host.addr, other.host.addr, "dropped").Add(1)
+		return
+	}
+
+	// ret is done with once the reply is written to the client, so take what we need now.
+	rcode, answer := ret.Rcode, digest(ret.Answer)
+	state2, ctx, cancel := f.detach(state)
+	go func() {
+		defer func() { <-f.auditInflight }()
+		defer cancel()
+
+		ret2, err := other.connect(ctx, state2, f.forceTCP, false)
+		result := "match"
+		switch {
+		case err != nil:
+			result = "error"
+		case rcode != ret2.Rcode:
+			result = "rcode"
+		case answer != digest(ret2.Answer):
+			result = "answer"
+		}
+		AuditCount.WithLabelValues(answered.host.id, answered.host.addr, other.host.addr, result).Add(1)
+	}()
+}
+
+const maxAuditInflight = 100
+
+// digest returns a hash of rrs that ignores TTLs and ordering.
+func digest(rrs []dns.RR) uint64 {
+	s := make([]string, len(rrs))
+	for i, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		s[i] = rr.String()
+	}
+	sort.Strings(s)
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(s, "\n")))
+	return h.Sum64()
+}
@@ -0,0 +1,147 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestDigest(t *testing.T) {
+	a := []dns.RR{test.A("example.org. 300 IN A 127.0.0.1"), test.A("example.org. 300 IN A 127.0.0.2")}
+	b := []dns.RR{test.A("example.org. 60 IN A 127.0.0.2"), test.A("example.org. 5 IN A 127.0.0.1")}
+	if digest(a) != digest(b) {
+		t.Errorf("Expected the same digest when only TTLs and ordering differ")
+	}
+	if a[0].Header().Ttl != 300 {
+		t.Errorf("Expected digest to leave the TTLs alone, got %d", a[0].Header().Ttl)
+	}
+
+	c := []dns.RR{test.A("example.org. 300 IN A 127.0.0.1"), test.A("example.org. 300 IN A 127.0.0.3")}
+	if digest(a) == digest(c) {
+		t.Errorf("Expected another digest for other addresses")
+	}
+	if digest(a) == digest(a[:1]) {
+		t.Errorf("Expected another digest for fewer records")
+	}
+}
+
+func TestAuditCount(t *testing.T) {
+	// dnstest servers share a handler, it tells a and b apart by address.
+	var addrB, reply atomic.Value // reply is what b answers: "same", "nxdomain", "other" or "none"
+	addrB.Store("")
+	reply.Store("same")
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if w.LocalAddr().String() != addrB.Load().(string) {
+			ret.Answer = append(ret.Answer, test.A("example.org. 300 IN A 127.0.0.1"))
+			w.WriteMsg(ret)
+			return
+		}
+		switch reply.Load().(string) {
+		case "same":
+			ret.Answer = append(ret.Answer, test.A("example.org. 60 IN A 127.0.0.1"))
+		case "nxdomain":
+			ret.Rcode = dns.RcodeNameError
+		case "other":
+			ret.Answer = append(ret.Answer, test.A("example.org. 300 IN A 127.0.0.2"))
+		case "none":
+			return
+		}
+		w.WriteMsg(ret)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+	addrB.Store(b.Addr)
+
+	f := New()
+	f.SetHealthCheck(0)
+	f.auditPercent = 100
+	defer f.Close()
+	pa, pb := NewProxy(a.Addr), NewProxy(b.Addr)
+	f.AddProxy(pa)
+	f.AddProxy(pb)
+	list := []*Proxy{pa, pb}
+
+	state := questionState("example.org.")
+	ret, err := pa.connect(f.bg, state, false, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	wait := func(result string, before float64) {
+		for i := 0; i < 200; i++ {
+			if counterValue(AuditCount, f.id, a.Addr, b.Addr, result) > before {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("Expected an audit with result %q", result)
+	}
+
+	for reply2, result := range map[string]string{"same": "match", "nxdomain": "rcode", "other": "answer"} {
+		reply.Store(reply2)
+		before := counterValue(AuditCount, f.id, a.Addr, b.Addr, result)
+		f.audit(state, ret, pa, list)
+		wait(result, before)
+	}
+
+	// Audits of an upstream that doesn't reply end as soon as f shuts down, which cancels f.bg.
+	reply.Store("none")
+	pb.host.readTimeout = time.Minute
+	for i := 0; i < maxAuditInflight; i++ {
+		f.audit(state, ret, pa, list)
+	}
+	before := counterValue(AuditCount, f.id, a.Addr, b.Addr, "dropped")
+	f.audit(state, ret, pa, list)
+	if x := counterValue(AuditCount, f.id, a.Addr, b.Addr, "dropped"); x != before+1 {
+		t.Errorf("Expected an audit to be dropped when %d are outstanding", maxAuditInflight)
+	}
+	before = counterValue(AuditCount, f.id, a.Addr, b.Addr, "error")
+	f.bgCancel()
+	wait("error", before)
+}
+
+func TestAuditWriter(t *testing.T) {
+	f := New()
+	f.SetHealthCheck(0)
+	f.auditPercent = 100
+	defer f.Close()
+
+	tcp := make(chan bool, 1)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		_, ok := w.RemoteAddr().(*net.TCPAddr)
+		tcp <- ok
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	pa, pb := NewProxy("127.0.0.1:1"), NewProxy(s.Addr)
+	f.AddProxy(pa)
+	f.AddProxy(pb)
+
+	// The audit of a query that came in over TCP goes over TCP too, after w is gone.
+	state := questionState("example.org.")
+	state.W = &tcpResponseWriter{}
+	ret := new(dns.Msg)
+	ret.SetReply(state.Req)
+	f.audit(state, ret, pa, []*Proxy{pa, pb})
+
+	select {
+	case ok := <-tcp:
+		if !ok {
+			t.Errorf("Expected the audit over TCP")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected an audit")
+	}
+}
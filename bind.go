@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+)
+
+// bind is the local address, and network device, connections to the upstreams are made from.
+type bind struct {
+	v4, v6 net.IP // source address for IPv4 and IPv6 upstreams, nil lets the system pick one
+	device string // if not "", the network device to send through, with SO_BINDTODEVICE
+}
+
+// parseBind returns the bind for args: IP addresses, at most one of each family, optionally followed
+// by "device" and the name of a network device.
+func parseBind(args []string) (*bind, error) {
+	b := new(bind)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "device" {
+			if i != len(args)-2 {
+				return nil, fmt.Errorf("device needs one network device name, at the end")
+			}
+			if !bindDeviceSupported {
+				return nil, fmt.Errorf("binding to a network device is not supported on this platform")
+			}
+			b.device = args[i+1]
+			break
+		}
+		ip := net.ParseIP(args[i])
+		if ip == nil {
+			return nil, fmt.Errorf("not an IP address: '%s'", args[i])
+		}
+		if v4 := ip.To4(); v4 != nil {
+			if b.v4 != nil {
+				return nil, fmt.Errorf("more than one IPv4 address: '%s'", args[i])
+			}
+			b.v4 = v4
+			continue
+		}
+		if b.v6 != nil {
+			return nil, fmt.Errorf("more than one IPv6 address: '%s'", args[i])
+		}
+		b.v6 = ip
+	}
+	if b.v4 == nil && b.v6 == nil && b.device == "" {
+		return nil, fmt.Errorf("no address or device to bind to")
+	}
+	return b, nil
+}
+
+// dialer returns a net.Dialer for connections over proto to addr, which binds them to the source
+// address of b for the family of addr and to the device of b. A nil b binds nothing.
+func (b *bind) dialer(proto, addr string) *net.Dialer {
+	d := new(net.Dialer)
+	if b == nil {
+		return d
+	}
+	if b.device != "" {
+		d.Control = bindDevice(b.device)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return d
+	}
+	src := b.v6
+	if ip.To4() != nil {
+		src = b.v4
+	}
+	if src == nil {
+		return d
+	}
+	if proto == "udp" {
+		d.LocalAddr = &net.UDPAddr{IP: src}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return d
+}
@@ -0,0 +1,18 @@
+package forward
+
+import "syscall"
+
+const bindDeviceSupported = true
+
+// bindDevice returns a net.Dialer Control function that binds the socket to device.
+func bindDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
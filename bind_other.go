@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package forward
+
+import "syscall"
+
+const bindDeviceSupported = false
+
+// bindDevice is only supported on Linux, parseBind refuses devices elsewhere.
+func bindDevice(device string) func(network, address string, c syscall.RawConn) error { return nil }
@@ -0,0 +1,87 @@
+package forward
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestParseBind(t *testing.T) {
+	b, err := parseBind([]string{"192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if d := b.dialer("udp", "10.0.0.1:53"); d.LocalAddr.String() != "192.0.2.1:0" {
+		t.Errorf("Expected the IPv4 source address, got: %s", d.LocalAddr)
+	}
+	if d := b.dialer("tcp", "[2001:db8::53]:853"); d.LocalAddr.String() != "[2001:db8::1]:0" {
+		t.Errorf("Expected the IPv6 source address, got: %s", d.LocalAddr)
+	}
+	if _, ok := b.dialer("tcp-tls", "10.0.0.1:853").LocalAddr.(*net.TCPAddr); !ok {
+		t.Error("Expected a TCP source address for TLS")
+	}
+	if d := (&bind{v4: net.ParseIP("192.0.2.1").To4()}).dialer("udp", "[2001:db8::53]:53"); d.LocalAddr != nil {
+		t.Errorf("Expected no source address without one of the family, got: %s", d.LocalAddr)
+	}
+
+	for _, args := range [][]string{nil, {"nope"}, {"192.0.2.1", "192.0.2.2"}, {"2001:db8::1", "2001:db8::2"}, {"192.0.2.1", "device"}} {
+		if _, err := parseBind(args); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		from []string
+	)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		mu.Lock()
+		from = append(from, host)
+		mu.Unlock()
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		input := "forward . 127.0.0.1:" + port + " {\nbind 127.0.0.2\n}\n"
+		if proto == "tcp" {
+			input = "forward . 127.0.0.1:" + port + " {\nbind 127.0.0.2\nforce_tcp\n}\n"
+		}
+		f, err := parseForward(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		p := f.proxies[0]
+		p.setHealthClient()
+		if err := p.host.send(); err != nil {
+			t.Fatalf("Expected the health check to succeed, got: %s", err)
+		}
+		if _, err := p.connect(context.Background(), questionState("example.org."), false, false); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		p.close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(from) != 4 {
+		t.Fatalf("Expected 4 queries, got: %d", len(from))
+	}
+	for _, a := range from {
+		if a != "127.0.0.2" {
+			t.Errorf("Expected queries from 127.0.0.2, got: %s", a)
+		}
+	}
+}
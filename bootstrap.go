@@ -0,0 +1,354 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrap resolves the hostnames of upstreams with plain DNS resolvers. It caches the addresses
+// for the TTL of the records.
+type bootstrap struct {
+	servers []string // host:port of the resolvers
+
+	mu    sync.Mutex
+	cache map[string]resolved
+}
+
+type resolved struct {
+	addrs  []string
+	expire time.Time
+}
+
+func newBootstrap(servers []string) *bootstrap {
+	return &bootstrap{servers: servers, cache: make(map[string]resolved)}
+}
+
+// hostUpstream returns the hostname and host:port of upstream to if it is named by hostname,
+// i.e. tls://dns.quad9.net. Only TLS upstreams can be given this way, the name is needed to
+// verify the certificate anyway.
+func hostUpstream(to string) (string, string, bool) {
+	if !strings.HasPrefix(to, _tls+"://") {
+		return "", "", false
+	}
+	h := to[len(_tls)+3:]
+	port := defaultPort[TLS]
+	if host, p, err := net.SplitHostPort(h); err == nil {
+		h, port = host, p
+	}
+	h = strings.TrimSuffix(h, ".")
+	// A top level domain isn't numeric, this leaves IPv4 addresses and ranges alone.
+	i := strings.LastIndex(h, ".")
+	if i < 0 || !isHostname(h) || strings.Trim(h[i+1:], "0123456789-") == "" {
+		return "", "", false
+	}
+	return h, net.JoinHostPort(h, port), true
+}
+
+// isHostUpstream returns true if to is named by hostname, see hostUpstream.
+func isHostUpstream(to string) bool {
+	_, _, ok := hostUpstream(to)
+	return ok
+}
+
+// resolve returns the addresses of name, IPv4 first.
+func (b *bootstrap) resolve(name string) ([]string, error) {
+	b.mu.Lock()
+	r, ok := b.cache[name]
+	b.mu.Unlock()
+	if ok && time.Now().Before(r.expire) {
+		return r.addrs, nil
+	}
+
+	var err error
+	for _, s := range b.servers {
+		var addrs []string
+		ttl := uint32(maxBootstrapTTL / time.Second)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			var a []string
+			var t uint32
+			a, t, err = query(s, name, qtype)
+			if err != nil {
+				break
+			}
+			if len(a) > 0 && t < ttl {
+				ttl = t
+			}
+			addrs = append(addrs, a...)
+		}
+		if err != nil {
+			continue
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", name)
+		}
+
+		d := time.Duration(ttl) * time.Second
+		if d < minBootstrapTTL {
+			d = minBootstrapTTL
+		}
+		r = resolved{addrs: addrs, expire: time.Now().Add(d)}
+		b.mu.Lock()
+		b.cache[name] = r
+		b.mu.Unlock()
+		return r.addrs, nil
+	}
+	return nil, fmt.Errorf("failed to resolve %s: %s", name, err)
+}
+
+// query asks server for the records of type qtype of name and returns the addresses in them and
+// the lowest TTL.
+func query(server, name string, qtype uint16) ([]string, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	c := &dns.Client{Timeout: dialTimeout}
+	ret, _, err := c.Exchange(m, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ret.Rcode != dns.RcodeSuccess && ret.Rcode != dns.RcodeNameError {
+		return nil, 0, fmt.Errorf("%s from %s", rcodeString(ret.Rcode), server)
+	}
+
+	var (
+		addrs []string
+		ttl   uint32
+	)
+	for _, rr := range ret.Answer {
+		var ip net.IP
+		switch x := rr.(type) {
+		case *dns.A:
+			ip = x.A
+		case *dns.AAAA:
+			ip = x.AAAA
+		default:
+			continue
+		}
+		if len(addrs) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, ttl, nil
+}
+
+// resolveNames replaces the proxies with a hostname by one for each address of the preferred family
+// they resolve to, so each address is health checked on its own.
+func (f *Forward) resolveNames() error {
+	proxies := make([]*Proxy, 0, len(f.proxies))
+	for _, p := range f.proxies {
+		if d, ok := p.host.exch.(*doh); ok {
+			d.bootstrap = f.bootstrap // nil leaves the name to the system resolver
+		}
+		if p.hostname == "" {
+			proxies = append(proxies, p)
+			continue
+		}
+		if f.bootstrap == nil {
+			return fmt.Errorf("upstream %s needs a bootstrap resolver", p.hostname)
+		}
+		addrs, err := f.bootstrap.resolve(p.hostname)
+		if err != nil {
+			return err
+		}
+		picked := pickFamily(addrs, f.preferIP)
+		if len(picked) == 0 {
+			return fmt.Errorf("upstream %s has no addresses for prefer_ip %s", p.hostname, f.preferIP)
+		}
+		_, port, _ := net.SplitHostPort(p.host.addr)
+		var to []string
+		for _, a := range picked {
+			addr := net.JoinHostPort(a, port)
+			n := p.clone(addr)
+			n.tls = p.tls
+			if n.tlsServerName == "" {
+				n.tlsServerName = p.hostname
+			}
+			proxies = append(proxies, n)
+			to = append(to, addr)
+		}
+		f.swapRoutes(p.host.addr, to...)
+		p.close()
+	}
+	f.proxies = proxies
+	return nil
+}
+
+// pickFamily returns the addresses in addrs that prefer asks for: those of the family "v4" (also the
+// default) or "v6" asks for, falling back to all of them when there are none; only those of the family
+// with "v4only" or "v6only", which can be none; all of them with "any", in the order of addrs, or
+// "v6first", with the IPv6 addresses first.
+func pickFamily(addrs []string, prefer string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	switch prefer {
+	case "any":
+		return addrs
+	case "v6first":
+		return append(v6, v4...)
+	case "v4only":
+		return v4
+	case "v6only":
+		return v6
+	case "v6":
+		if len(v6) > 0 {
+			return v6
+		}
+	default:
+		if len(v4) > 0 {
+			return v4
+		}
+	}
+	return addrs
+}
+
+// hasNames returns true if there are proxies given by hostname.
+func (f *Forward) hasNames() bool {
+	for _, p := range f.snapshot() {
+		if p.hostname != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reresolve resolves the hostnames of the proxies again when their addresses have expired. The
+// proxies of a name follow its addresses: one whose address is no longer returned is swapped for one
+// with a new address, or removed, and new addresses get a proxy of their own. It returns when stop
+// is closed.
+func (f *Forward) reresolve(stop <-chan struct{}) {
+	tick := time.NewTicker(minBootstrapTTL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		for _, group := range f.byName() {
+			p := group[0]
+			_, port, _ := net.SplitHostPort(p.host.addr)
+			addrs, err := f.bootstrap.resolve(p.hostname)
+			if err != nil {
+				f.log.warning(f.id, "resolve_failed", fmt.Sprintf("Keeping %s for %s: %s", addrsOf(group), p.hostname, err),
+					Field{"upstream", p.host.addr}, Field{"hostname", p.hostname}, Field{"error", err})
+				continue
+			}
+			picked := pickFamily(addrs, f.preferIP)
+			if len(picked) == 0 {
+				// Removing them all would also stop the name from being resolved again.
+				f.log.warning(f.id, "resolve_failed", fmt.Sprintf("Keeping %s for %s: no addresses for prefer_ip %s", addrsOf(group), p.hostname, f.preferIP),
+					Field{"upstream", p.host.addr}, Field{"hostname", p.hostname}, Field{"error", "no addresses"})
+				continue
+			}
+			var want []string
+			for _, a := range picked {
+				want = append(want, net.JoinHostPort(a, port))
+			}
+			f.follow(group, want)
+		}
+	}
+}
+
+// byName returns the proxies given by hostname, grouped by hostname and port.
+func (f *Forward) byName() [][]*Proxy {
+	var groups [][]*Proxy
+	index := map[string]int{}
+	for _, p := range f.snapshot() {
+		if p.hostname == "" {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(p.host.addr)
+		key := net.JoinHostPort(p.hostname, port)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], p)
+	}
+	return groups
+}
+
+// follow makes the proxies in group, all for the same hostname, match the addresses in want.
+func (f *Forward) follow(group []*Proxy, want []string) {
+	have := map[string]bool{}
+	var stale []*Proxy
+	for _, p := range group {
+		have[p.host.addr] = true
+		if !contains(want, p.host.addr) {
+			stale = append(stale, p)
+		}
+	}
+	var fresh []string
+	for _, to := range want {
+		if !have[to] {
+			fresh = append(fresh, to)
+		}
+	}
+
+	// New proxies are added first, they take the routes of a proxy that may be swapped next.
+	name := group[0].hostname
+	for i := len(stale); i < len(fresh); i++ {
+		to := fresh[i]
+		if err := f.addClone(group[0], to); err != nil {
+			f.log.warning(f.id, "add_failed", fmt.Sprintf("Failed to add %s for %s: %s", to, name, err),
+				Field{"upstream", to}, Field{"hostname", name}, Field{"error", err})
+			continue
+		}
+		f.log.info(f.id, "upstream_added", fmt.Sprintf("Added upstream %s for %s", to, name),
+			Field{"upstream", to}, Field{"hostname", name})
+	}
+	for i := 0; i < len(fresh) && i < len(stale); i++ {
+		from, to := stale[i].host.addr, fresh[i]
+		if err := f.SwapProxy(from, to); err != nil {
+			f.log.warning(f.id, "move_failed", fmt.Sprintf("Failed to move %s to %s: %s", name, to, err),
+				Field{"upstream", from}, Field{"hostname", name}, Field{"to", to}, Field{"error", err})
+			continue
+		}
+		f.log.info(f.id, "upstream_moved", fmt.Sprintf("Moved %s from %s to %s", name, from, to),
+			Field{"upstream", from}, Field{"hostname", name}, Field{"to", to})
+	}
+	for i := len(fresh); i < len(stale); i++ {
+		from := stale[i].host.addr
+		if err := f.RemoveProxy(from); err != nil {
+			continue
+		}
+		f.log.info(f.id, "upstream_removed", fmt.Sprintf("Removed upstream %s, %s no longer resolves to it", from, name),
+			Field{"upstream", from}, Field{"hostname", name})
+	}
+}
+
+// addrsOf returns the addresses of proxies, separated by commas.
+func addrsOf(proxies []*Proxy) string {
+	addrs := make([]string, len(proxies))
+	for i, p := range proxies {
+		addrs[i] = p.host.addr
+	}
+	return strings.Join(addrs, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	minBootstrapTTL = 1 * time.Minute
+	maxBootstrapTTL = 1 * time.Hour
+)
@@ -0,0 +1,181 @@
+package forward
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestSetupBootstrap(t *testing.T) {
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer, test.A("dns.example.org. 300 IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	input := `forward . tls://dns.example.org:8853 tls://dns.example.org. {
+	bootstrap ` + s.Addr + `
+	route a.example.org tls://dns.example.org
+}`
+	c := caddy.NewTestController("dns", input)
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.proxies) != 2 {
+		t.Fatalf("Expected 2 proxies, got: %d", len(f.proxies))
+	}
+	for i, addr := range []string{"127.0.0.1:8853", "127.0.0.1:853"} {
+		p := f.proxies[i]
+		if p.host.addr != addr {
+			t.Errorf("Expected address %s, got: %s", addr, p.host.addr)
+		}
+		if p.host.tlsConfig == nil || p.host.tlsConfig.ServerName != "dns.example.org" {
+			t.Errorf("Expected TLS with server name dns.example.org for %s", p.host.addr)
+		}
+	}
+	if !f.routes[0].addrs["127.0.0.1:853"] {
+		t.Errorf("Expected route to the resolved address, got: %v", f.routes[0].addrs)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected 2 queries (A and AAAA, then cached), got: %d", n)
+	}
+
+	for _, input := range []string{
+		"forward . tls://dns.example.org",
+		"forward . tls://dns.example.org {\nbootstrap dns.google\n}",
+		"forward . tls://dns.example.org {\nbootstrap\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestHostUpstream(t *testing.T) {
+	tests := []struct {
+		to   string
+		addr string
+		ok   bool
+	}{
+		{"tls://dns.quad9.net", "dns.quad9.net:853", true},
+		{"tls://dns.quad9.net.:8853", "dns.quad9.net:8853", true},
+		{"tls://9.9.9.9", "", false},
+		{"tls://10.0.0.1-10.0.0.4", "", false},
+		{"tls://localhost", "", false},
+		{"dns.quad9.net", "", false},
+		{"/etc/resolv.conf", "", false},
+	}
+	for _, tc := range tests {
+		_, addr, ok := hostUpstream(tc.to)
+		if ok != tc.ok || addr != tc.addr {
+			t.Errorf("For %s expected %q %t, got %q %t", tc.to, tc.addr, tc.ok, addr, ok)
+		}
+	}
+}
+
+func TestPreferIP(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		name := r.Question[0].Name
+		if r.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer, test.A(name+" 300 IN A 127.0.0.1"), test.A(name+" 300 IN A 127.0.0.2"))
+		} else if name == "dns.example.org." {
+			ret.Answer = append(ret.Answer, test.AAAA(name+" 300 IN AAAA ::1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		prefer string
+		addrs  []string
+	}{
+		{"", []string{"127.0.0.1:853", "127.0.0.2:853"}},
+		{"prefer_ip v4", []string{"127.0.0.1:853", "127.0.0.2:853"}},
+		{"prefer_ip v6", []string{"[::1]:853"}},
+		{"prefer_ip any", []string{"127.0.0.1:853", "127.0.0.2:853", "[::1]:853"}},
+		{"prefer_ip v4only", []string{"127.0.0.1:853", "127.0.0.2:853"}},
+		{"prefer_ip v6only", []string{"[::1]:853"}},
+		{"prefer_ip v6first", []string{"[::1]:853", "127.0.0.1:853", "127.0.0.2:853"}},
+	}
+	for _, tc := range tests {
+		input := "forward . tls://dns.example.org {\nbootstrap " + s.Addr + "\n" + tc.prefer + "\nroute a.example.org tls://dns.example.org\n}"
+		f, err := parseForward(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatalf("%q: expected no error, got: %v", tc.prefer, err)
+		}
+		if x := addrsOf(f.proxies); x != strings.Join(tc.addrs, ", ") {
+			t.Errorf("%q: expected %v, got: %s", tc.prefer, tc.addrs, x)
+		}
+		for _, a := range tc.addrs {
+			if !f.routes[0].addrs[a] {
+				t.Errorf("%q: expected a route to %s, got: %v", tc.prefer, a, f.routes[0].addrs)
+			}
+		}
+	}
+
+	// v4.example.org has no IPv6 addresses: v6 falls back to IPv4, v6only fails.
+	for prefer, ok := range map[string]bool{"v6": true, "v4only": true, "v6first": true, "v6only": false} {
+		input := "forward . tls://v4.example.org {\nbootstrap " + s.Addr + "\nprefer_ip " + prefer + "\n}"
+		f, err := parseForward(caddy.NewTestController("dns", input))
+		if !ok {
+			if err == nil {
+				t.Errorf("%s: expected an error for a name without IPv6 addresses, got %s", prefer, addrsOf(f.proxies))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", prefer, err)
+		}
+		if x := addrsOf(f.proxies); x != "127.0.0.1:853, 127.0.0.2:853" {
+			t.Errorf("%s: expected the IPv4 addresses, got: %s", prefer, x)
+		}
+	}
+	if x := pickFamily([]string{"::1"}, "v4only"); len(x) != 0 {
+		t.Errorf("Expected no addresses for v4only, got: %v", x)
+	}
+
+	for _, input := range []string{"prefer_ip", "prefer_ip v5", "prefer_ip v4 v6", "prefer_ip V4ONLY"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	f := New()
+	f.routes = []*route{{zone: "a.example.org.", addrs: map[string]bool{"127.0.0.1:853": true, "127.0.0.2:853": true}}}
+	for _, addr := range []string{"127.0.0.1:853", "127.0.0.2:853"} {
+		p := NewProxy(addr)
+		p.hostname, p.hcInterval = "dns.example.org", 0
+		f.SetProxy(p)
+	}
+	defer f.Close()
+
+	f.follow(f.byName()[0], []string{"127.0.0.2:853", "127.0.0.3:853", "127.0.0.4:853"})
+	if x := addrsOf(f.proxies); x != "127.0.0.2:853, 127.0.0.4:853, 127.0.0.3:853" {
+		t.Errorf("Expected a proxy for each new address, got: %s", x)
+	}
+	if r := f.routes[0].addrs; len(r) != 3 || !r["127.0.0.3:853"] || !r["127.0.0.4:853"] || r["127.0.0.1:853"] {
+		t.Errorf("Expected the route to follow, got: %v", r)
+	}
+
+	f.follow(f.byName()[0], []string{"127.0.0.4:853"})
+	if x := addrsOf(f.proxies); x != "127.0.0.4:853" {
+		t.Errorf("Expected the proxies of the gone addresses to be removed, got: %s", x)
+	}
+}
@@ -0,0 +1,125 @@
+package forward
+
+import (
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// CheckReport is the outcome of Check.
+type CheckReport struct {
+	Problems  []error       // configuration problems, see the strict option
+	Upstreams []CheckResult // one per upstream, in the order of the configuration
+}
+
+// CheckResult is the outcome of checking one upstream.
+type CheckResult struct {
+	Upstream string // address, followed by the tag if the upstream has one
+	Proto    string // transport used: udp, tcp, tcp-tls, https, quic or mdns
+
+	Dial   error // nil if a connection could be made
+	Health error // nil if the health check passed
+	Query  error // nil if the sample query was answered
+
+	Rcode string        // rcode of the reply to the sample query
+	RTT   time.Duration // duration of the sample query
+}
+
+// OK returns true if nothing failed for this upstream.
+func (r CheckResult) OK() bool { return r.Dial == nil && r.Health == nil && r.Query == nil }
+
+// Check parses input, a forward stanza as it appears in a Corefile, and checks every upstream in it:
+// it dials the upstream over its configured transport, runs the health check and sends it a query
+// for name and qtype. An error is returned if input doesn't parse.
+func Check(input, name string, qtype uint16) (*CheckReport, error) {
+	f, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &CheckReport{Problems: f.validate("", "")}
+	for _, p := range f.proxies {
+		report.Upstreams = append(report.Upstreams, check(p, name, qtype))
+	}
+	return report, nil
+}
+
+// check dials p, health checks it and resolves name and qtype through it.
+func check(p *Proxy, name string, qtype uint16) CheckResult {
+	res := CheckResult{Upstream: p.host.String(), Proto: p.defaultProto()}
+	switch {
+	case p.mdns != nil:
+		res.Proto = "mdns"
+	case p.host.exch != nil:
+		res.Proto = p.host.exch.proto()
+		res.Health = p.host.send()
+	default:
+		c, err := p.Dial(res.Proto)
+		if err != nil {
+			res.Dial = err
+			return res
+		}
+		c.Close()
+
+		p.setHealthClient()
+		res.Health = p.host.send()
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	state := request.Request{W: nopWriter{}, Req: req}
+
+	start := time.Now()
+	ret, err := p.connect(context.Background(), state, false, false)
+	res.RTT = time.Since(start)
+	if err != nil {
+		res.Query = err
+		return res
+	}
+	res.Rcode = rcodeString(ret.Rcode)
+	return res
+}
+
+// nopWriter is the dns.ResponseWriter for the queries we make ourselves, e.g. in Check. It acts as a
+// UDP client on the loopback and discards replies.
+type nopWriter struct{}
+
+func (nopWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (nopWriter) RemoteAddr() net.Addr        { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (nopWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (nopWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (nopWriter) Close() error                { return nil }
+func (nopWriter) TsigStatus() error           { return nil }
+func (nopWriter) TsigTimersOnly(bool)         {}
+func (nopWriter) Hijack()                     {}
+
+// addrWriter is the dns.ResponseWriter for the queries we send for a client after its reply was
+// written, e.g. in audit. It has the addresses of the client, so the query goes over the same
+// transport, and discards replies.
+type addrWriter struct {
+	nopWriter
+	local, remote net.Addr
+}
+
+func (w addrWriter) LocalAddr() net.Addr  { return w.local }
+func (w addrWriter) RemoteAddr() net.Addr { return w.remote }
+
+// detach returns a copy of state, with an addrWriter, and a context for a query we send after the reply
+// to the client was written. The context ends after query_timeout, or detachTimeout, or when f shuts down.
+func (f *Forward) detach(state request.Request) (request.Request, context.Context, context.CancelFunc) {
+	w := addrWriter{local: state.W.LocalAddr(), remote: state.W.RemoteAddr()}
+	timeout := detachTimeout
+	if f.queryTimeout > 0 {
+		timeout = f.queryTimeout
+	}
+	ctx, cancel := context.WithTimeout(f.bg, timeout)
+	return request.Request{W: w, Req: state.Req.Copy()}, ctx, cancel
+}
+
+const detachTimeout = 5 * time.Second
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestCheck(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	report, err := Check("forward . "+s.Addr+" tls://127.0.0.1:1 "+s.Addr, "example.org", dns.TypeA)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(report.Problems) != 1 {
+		t.Errorf("Expected 1 problem (duplicate upstream), got: %v", report.Problems)
+	}
+	if len(report.Upstreams) != 3 {
+		t.Fatalf("Expected 3 results, got: %d", len(report.Upstreams))
+	}
+	if r := report.Upstreams[0]; !r.OK() || r.Proto != "udp" || r.Rcode != "NOERROR" {
+		t.Errorf("Expected %s to pass over udp with NOERROR, got: %+v", r.Upstream, r)
+	}
+	if r := report.Upstreams[1]; r.OK() || r.Dial == nil || r.Proto != "tcp-tls" {
+		t.Errorf("Expected dialing %s over tcp-tls to fail, got: %+v", r.Upstream, r)
+	}
+
+	if _, err := Check("forward .", "example.org", dns.TypeA); err == nil {
+		t.Errorf("Expected error for a stanza without upstreams")
+	}
+}
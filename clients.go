@@ -0,0 +1,52 @@
+package forward
+
+import (
+	"net"
+	"strings"
+)
+
+// clientNets is a list of client networks. With except_clients it holds the clients whose queries
+// aren't forwarded, with clients the only ones whose queries are.
+type clientNets []*net.IPNet
+
+// parseClientNet parses s as a CIDR or as an address, which is a network of one. It returns nil if
+// s is neither.
+func parseClientNet(s string) *net.IPNet {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// contains returns true if ip is in one of the networks of c.
+func (c clientNets) contains(ip net.IP) bool {
+	for _, n := range c {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedClient returns true if queries from the client at addr are forwarded.
+func (f *Forward) isAllowedClient(addr string) bool {
+	if len(f.clients) == 0 && len(f.exceptClients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if f.exceptClients.contains(ip) {
+		return false
+	}
+	return len(f.clients) == 0 || f.clients.contains(ip)
+}
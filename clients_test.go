@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestClients(t *testing.T) {
+	input := "forward . 127.0.0.1 {\nclients 10.0.0.0/8 fe80::/10\nclients 192.0.2.1\nexcept_clients 10.9.0.0/16 fe80::42:0:0:0/80\n}\n"
+	f, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.240.0.1", true},
+		{"10.9.1.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"fe80::1", true},
+		{"fe80::42:ff:feca:4c65", false},
+		{"2001:db8::1", false},
+	}
+	for _, tc := range tests {
+		if a := f.isAllowedClient(tc.addr); a != tc.allowed {
+			t.Errorf("Expected %s to be allowed %t, got %t", tc.addr, tc.allowed, a)
+		}
+	}
+
+	// Queries from clients that aren't forwarded go to the next plugin.
+	f.Next = test.ErrorHandler()
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected the next plugin to answer, got: %v", rec.Msg)
+	}
+
+	f, err = parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nexcept a.example\nexcept b.example\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	if f.isAllowedDomain("x.a.example.") || f.isAllowedDomain("x.b.example.") || !f.isAllowedClient("10.240.0.1") {
+		t.Errorf("Expected the names of both except lines to be excluded, got %v", f.ignored)
+	}
+
+	for _, input := range []string{"clients", "clients 10.0.0.0/33", "except_clients example.org"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Command forward-check validates a forward stanza and checks its upstreams. It reads the stanza,
+// as it appears in a Corefile, from the file given as its argument or from standard input:
+//
+//	forward-check -name example.org -type AAAA forward.conf
+//
+// For every upstream it prints whether it could be dialed, passed the health check and answered a
+// sample query. It exits with 1 when something failed, and 2 when the stanza doesn't parse.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fturib/forward"
+
+	"github.com/miekg/dns"
+)
+
+func main() {
+	name := flag.String("name", "example.org.", "name of the sample query")
+	typ := flag.String("type", "A", "type of the sample query")
+	flag.Parse()
+
+	qtype, ok := dns.StringToType[strings.ToUpper(*typ)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown type: %s\n", *typ)
+		os.Exit(2)
+	}
+
+	var (
+		input []byte
+		err   error
+	)
+	switch flag.NArg() {
+	case 0:
+		input, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		input, err = ioutil.ReadFile(flag.Arg(0))
+	default:
+		fmt.Fprintln(os.Stderr, "usage: forward-check [-name NAME] [-type TYPE] [FILE]")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	report, err := forward.Check(string(input), *name, qtype)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, p := range report.Problems {
+		fmt.Printf("WARNING %s\n", p)
+	}
+	for _, r := range report.Upstreams {
+		status := "OK  "
+		if !r.OK() {
+			status, failed = "FAIL", true
+		}
+		health, q := "skipped", "skipped"
+		if r.Dial == nil {
+			health, q = result(r.Health), result(r.Query)
+			if r.Query == nil {
+				q = fmt.Sprintf("%s in %s", r.Rcode, r.RTT)
+			}
+		}
+		fmt.Printf("%s %s (%s): dial %s, health %s, query %s\n", status, r.Upstream, r.Proto, result(r.Dial), health, q)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return "ok"
+}
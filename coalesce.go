@@ -0,0 +1,98 @@
+package forward
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// coalescer lets concurrent identical queries share one forwarded exchange.
+type coalescer struct {
+	sync.Mutex
+	calls map[string]*call
+}
+
+// call is an exchange in progress, or done when wg is.
+type call struct {
+	wg   sync.WaitGroup
+	ret  *dns.Msg
+	info Info
+	err  error
+	dups int // number of others waiting for this call
+}
+
+func newCoalescer() *coalescer { return &coalescer{calls: make(map[string]*call)} }
+
+// do calls fn, unless a call for key is already in progress, then it waits for that one and returns
+// its result. The returned bool is true when the result is shared.
+func (c *coalescer) do(key string, fn func() (*dns.Msg, Info, error)) (*dns.Msg, Info, error, bool) {
+	c.Lock()
+	if cl, ok := c.calls[key]; ok {
+		cl.dups++
+		c.Unlock()
+		cl.wg.Wait()
+		return cl.ret, cl.info, cl.err, true
+	}
+	cl := new(call)
+	cl.wg.Add(1)
+	c.calls[key] = cl
+	c.Unlock()
+
+	cl.ret, cl.info, cl.err = fn()
+
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	cl.wg.Done()
+
+	return cl.ret, cl.info, cl.err, false
+}
+
+// coalesceKey returns the key of the question in state: queries with the same key get the same reply
+// from the upstreams.
+func coalesceKey(state request.Request) string {
+	flags := ""
+	if state.Do() {
+		flags += "do"
+	}
+	if state.Req.CheckingDisabled {
+		flags += "cd"
+	}
+	if o := state.Req.IsEdns0(); o != nil {
+		if i := subnetIndex(o); i >= 0 {
+			flags += " " + o.Option[i].String()
+		}
+	}
+	return strings.ToLower(state.Name()) + " " + strconv.Itoa(int(state.QType())) + " " + strconv.Itoa(int(state.QClass())) + " " + state.Proto() + " " + flags
+}
+
+// coalesced is forward, but with coalescing enabled a query that is identical to one in progress waits
+// for that one's reply. Each query gets its own copy of the reply, with its own ID and question.
+func (f *Forward) coalesced(ctx context.Context, state request.Request) (*dns.Msg, Info, error) {
+	if f.coalesce == nil || state.Req.Opcode != dns.OpcodeQuery {
+		return f.forward(ctx, state)
+	}
+
+	ret, info, err, shared := f.coalesce.do(coalesceKey(state), func() (*dns.Msg, Info, error) {
+		return f.forward(ctx, state)
+	})
+	if shared {
+		if err == context.Canceled {
+			return f.forward(ctx, state) // the client of the first query went away, not ours
+		}
+		CoalescedCount.WithLabelValues(f.id).Add(1)
+	}
+	if ret == nil {
+		return ret, info, err
+	}
+	// Others may be reading ret, and the hooks and scrubbing after this change it.
+	ret = ret.Copy()
+	ret.Id = state.Req.Id
+	ret.Question = append([]dns.Question(nil), state.Req.Question...)
+	return ret, info, err
+}
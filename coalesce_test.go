@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestCoalesce(t *testing.T) {
+	var queries int32
+	release := make(chan struct{})
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.org." {
+			atomic.AddInt32(&queries, 1)
+			<-release
+			ret.Answer = append(ret.Answer, test.A("example.org. 300 IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.coalesce = newCoalescer()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	const n = 10
+	before := counterValue(CoalescedCount, f.id)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			req.Id = id
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			f.ServeDNS(context.TODO(), rec, req)
+			if rec.Msg == nil || rec.Msg.Id != id || len(rec.Msg.Answer) != 1 {
+				t.Errorf("Expected an answer with ID %d, got: %v", id, rec.Msg)
+			}
+		}(uint16(i + 1))
+	}
+
+	// Release the upstream once all others wait for the first query.
+	for {
+		f.coalesce.Lock()
+		cl := f.coalesce.calls[coalesceKey(questionState("example.org."))]
+		dups := 0
+		if cl != nil {
+			dups = cl.dups
+		}
+		f.coalesce.Unlock()
+		if dups == n-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Errorf("Expected 1 upstream query, got: %d", q)
+	}
+	if c := counterValue(CoalescedCount, f.id) - before; c != n-1 {
+		t.Errorf("Expected %d coalesced queries, got: %f", n-1, c)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	a := questionState("Example.ORG.")
+	b := questionState("example.org.")
+	if coalesceKey(a) != coalesceKey(b) {
+		t.Errorf("Expected the name to be compared ignoring case: %q != %q", coalesceKey(a), coalesceKey(b))
+	}
+	b.Req.SetEdns0(4096, true)
+	if coalesceKey(a) == coalesceKey(b) {
+		t.Errorf("Expected the DO bit to be part of the key: %q", coalesceKey(a))
+	}
+}
+
+func questionState(name string) request.Request {
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion(name, dns.TypeA)
+	return state
+}
+
+func TestSetupCoalesce(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\ncoalesce\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.coalesce == nil {
+		t.Error("Expected coalescing to be enabled")
+	}
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\ncoalesce yes\n}\n")); err == nil {
+		t.Error("Expected error for an argument to coalesce")
+	}
+}
@@ -5,7 +5,12 @@
 package forward
 
 import (
+	"fmt"
+	"net"
+	"os"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/coredns/coredns/request"
@@ -15,17 +20,84 @@ import (
 )
 
 func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
+	if !metric {
+		return p.send(ctx, state, forceTCP, metric)
+	}
+	transport := p.transportName(state, forceTCP)
+	ret, err := p.send(ctx, state, forceTCP, metric)
+	TransportRequestCount.WithLabelValues(p.host.id, p.host.addr, transport).Add(1)
+	if err != nil {
+		UpstreamErrorCount.WithLabelValues(p.host.id, p.host.addr, transport, errorClass(err)).Add(1)
+	}
+	return ret, err
+}
+
+// send sends state to p and returns the reply, connect counts the result.
+func (p *Proxy) send(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
 	start := time.Now()
 
-	proto := state.Proto()
-	if forceTCP {
-		proto = "tcp"
+	atomic.AddInt64(&p.inflight, 1)
+	defer atomic.AddInt64(&p.inflight, -1)
+
+	if p.mdns != nil {
+		ret, err := p.mdns.exchange(state.Req)
+		if err == nil && metric {
+			p.host.request(rcodeString(ret.Rcode), time.Since(start))
+			expRequests.Add(p.host.expKey(), 1)
+		}
+		return ret, err
 	}
-	if p.host.tlsConfig != nil {
-		proto = "tcp-tls"
+	if p.host.exch != nil {
+		req := state.Req
+		padded := p.host.padding > 0 && p.host.tlsConfig != nil
+		if padded {
+			req = withPadding(req, p.host.padding)
+		}
+		if metric {
+			p.host.sent(req.Len())
+		}
+		ret, err := p.host.exch.exchange(ctx, p.host, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkReply(req, ret); err != nil {
+			return nil, err
+		}
+		if padded {
+			stripPadding(ret)
+		}
+		if metric {
+			p.host.request(rcodeString(ret.Rcode), time.Since(start))
+			p.host.received(ret)
+			expRequests.Add(p.host.expKey(), 1)
+		}
+		return ret, nil
+	}
+
+	protos := []string{p.proto(state, forceTCP)}
+	if p.host.chain != nil {
+		protos = p.host.chain.candidates()
+	}
+	if p.mux != nil && p.host.chain == nil && (protos[0] == "tcp" || protos[0] == "tcp-tls") {
+		return p.muxed(ctx, state, protos[0], metric)
 	}
 
-	conn, err := p.Dial(proto)
+	var (
+		conn  *dns.Conn
+		proto string
+		err   error
+	)
+	for _, proto = range protos {
+		if conn, err = p.dialFor(ctx, state, proto); err == nil {
+			if p.host.chain != nil {
+				if from := p.host.chain.working(proto); from != "" {
+					p.host.log.info(p.host.id, "transport_switched", fmt.Sprintf("Switching transport of %s from %s to %s", p.host, from, proto),
+						Field{"upstream", p.host.addr}, Field{"from", from}, Field{"to", proto})
+				}
+			}
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -36,31 +108,185 @@ func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, me
 		conn.UDPSize = 512
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(timeout))
-	if err := conn.WriteMsg(state.Req); err != nil {
+	if done := ctx.Done(); done != nil {
+		// Interrupt the write or read when ctx is done, e.g. when the client went away.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				conn.SetDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+	}
+
+	req := state.Req
+	keepalive := p.host.ednsKeepalive && proto != "udp"
+	if keepalive {
+		req = withKeepalive(req)
+	}
+	randomized := p.host.randomCase && proto == "udp" && req.Opcode == dns.OpcodeQuery
+	if randomized {
+		req = withRandomCase(req)
+	}
+	padded := p.host.padding > 0 && proto == "tcp-tls"
+	if padded {
+		req = withPadding(req, p.host.padding)
+	}
+
+	conn.SetWriteDeadline(attemptDeadline(ctx, p.host.writeTimeout))
+	if err := writeMsg(conn, req); err != nil {
 		conn.Close() // not giving it back
-		return nil, err
+		return nil, ctxErr(ctx, err)
+	}
+	if metric {
+		p.host.sent(req.Len())
 	}
 
-	conn.SetReadDeadline(time.Now().Add(timeout))
-	ret, err := conn.ReadMsg()
-	if err != nil {
+	ret, retransmitted, err := p.read(conn, req, attemptDeadline(ctx, p.host.readTimeout), mismatchFromContext(ctx, p))
+	if err != nil && !(err == dns.ErrTruncated && ret != nil) {
 		conn.Close() // not giving it back
+		return nil, ctxErr(ctx, err)
+	}
+	if err := checkReply(req, ret); err != nil {
+		conn.Close() // the next read may be the real reply, don't hand that to someone else
 		return nil, err
 	}
+	if keepalive {
+		p.host.learnKeepalive(ret)
+	}
+	if randomized {
+		restoreCase(state.Req, req, ret)
+	}
+	if padded {
+		stripPadding(ret)
+	}
 
-	p.Yield(conn)
+	if retransmitted {
+		conn.Close() // the reply to the other copy may still come in
+	} else if p.host.proxyProtocol && proto != "udp" {
+		conn.Close() // its header names this client
+	} else {
+		p.Yield(conn)
+	}
 
+	// We used UDP for a TCP client, if that didn't fit, do what the client did. The retry is part of
+	// this request, connect counts it once.
+	retry := ret.Truncated && p.preferUDP && !forceTCP && !p.forceTCP && p.host.chain == nil && p.host.tlsConfig == nil && state.Proto() == "tcp"
 	if metric {
-		rc, ok := dns.RcodeToString[ret.Rcode]
-		if !ok {
-			rc = strconv.Itoa(ret.Rcode)
+		p.host.received(ret)
+		if !retry {
+			p.host.request(rcodeString(ret.Rcode), time.Since(start))
+			expRequests.Add(p.host.expKey(), 1)
 		}
-
-		RequestCount.WithLabelValues(p.host.addr).Add(1)
-		RcodeCount.WithLabelValues(rc, p.host.addr).Add(1)
-		RequestDuration.WithLabelValues(p.host.addr).Observe(time.Since(start).Seconds())
+	}
+	if retry {
+		return p.send(ctx, state, true, metric)
 	}
 
 	return ret, nil
 }
+
+// attemptDeadline returns when a write or read that starts now must be done: after timeout, or earlier
+// if that is the deadline of ctx.
+func attemptDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// ctxErr returns the error of ctx if it's done, as that is why the exchange failed with err, and err
+// otherwise.
+func ctxErr(ctx context.Context, err error) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	// A read deadline set to the deadline of ctx can pass before ctx says it's done.
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// isTimeout returns true if err is a timeout.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// errorClass returns the kind of failure err is, for the metrics: where the exchange failed and why,
+// to tell network problems from slow upstreams.
+func errorClass(err error) string {
+	switch err {
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "timeout" // the deadline of the query passed
+	}
+	op, ok := err.(*net.OpError)
+	if !ok {
+		if isTimeout(err) {
+			return "read_timeout" // of a multiplexed connection
+		}
+		return "other"
+	}
+	refused := false
+	if se, ok := op.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+		refused = true
+	}
+	switch {
+	case refused:
+		return "conn_refused" // for UDP, this shows on the read
+	case op.Op == "dial" && op.Timeout():
+		return "dial_timeout"
+	case op.Op == "dial":
+		return "dial_error"
+	case op.Op == "write":
+		return "write_error"
+	case op.Timeout():
+		return "read_timeout"
+	}
+	return "read_error"
+}
+
+// rcodeString returns the name of rcode, or its number if it has no name.
+func rcodeString(rcode int) string {
+	if rc, ok := dns.RcodeToString[rcode]; ok {
+		return rc
+	}
+	return strconv.Itoa(rcode)
+}
+
+// transportName returns the transport used to send state to p, as named in the metrics.
+func (p *Proxy) transportName(state request.Request, forceTCP bool) string {
+	if p.mdns != nil {
+		return _mdns
+	}
+	if proto := p.proto(state, forceTCP); proto != "tcp-tls" {
+		return proto
+	}
+	return _tls
+}
+
+// proto returns the transport used to send state to p.
+func (p *Proxy) proto(state request.Request, forceTCP bool) string {
+	if p.host.exch != nil {
+		return p.host.exch.proto()
+	}
+	if p.host.chain != nil {
+		return p.host.chain.current()
+	}
+	if p.host.tlsConfig != nil {
+		return "tcp-tls"
+	}
+	if forceTCP || p.forceTCP {
+		return "tcp"
+	}
+	if p.preferUDP {
+		return "udp"
+	}
+	return state.Proto()
+}
@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	refused := os.NewSyscallError("read", syscall.ECONNREFUSED)
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{context.Canceled, "canceled"},
+		{context.DeadlineExceeded, "timeout"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "dial_timeout"},
+		{&net.OpError{Op: "dial", Err: errors.New("no route to host")}, "dial_error"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "conn_refused"},
+		{&net.OpError{Op: "read", Err: refused}, "conn_refused"},
+		{&net.OpError{Op: "write", Err: errors.New("broken pipe")}, "write_error"},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, "read_timeout"},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, "read_error"},
+		{muxTimeoutError{}, "read_timeout"},
+		{dns.ErrSecret, "other"},
+	}
+	for _, tc := range tests {
+		if c := errorClass(tc.err); c != tc.class {
+			t.Errorf("Expected %q to be %s, got %s", tc.err, tc.class, c)
+		}
+	}
+}
+
+func TestTransportMetrics(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	defer p.close()
+	before := counterValue(TransportRequestCount, p.host.id, s.Addr, "tcp")
+	if _, err := p.connect(context.Background(), questionState("example.org."), true, true); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if x := counterValue(TransportRequestCount, p.host.id, s.Addr, "tcp"); x != before+1 {
+		t.Errorf("Expected a request over tcp, got %f", x-before)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	p = NewProxy(dead)
+	defer p.close()
+	before = counterValue(UpstreamErrorCount, p.host.id, dead, "tcp", "conn_refused")
+	if _, err := p.connect(context.Background(), questionState("example.org."), true, true); err == nil {
+		t.Fatalf("Expected an error from a closed port")
+	}
+	if x := counterValue(UpstreamErrorCount, p.host.id, dead, "tcp", "conn_refused"); x != before+1 {
+		t.Errorf("Expected a conn_refused error, got %f", x-before)
+	}
+}
+
+func TestResponseSizeMetrics(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Truncated = true
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	defer p.close()
+	size := func() (uint64, float64) {
+		m := new(dto.Metric)
+		ResponseSize.WithLabelValues(p.host.id, s.Addr).(prometheus.Metric).Write(m)
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	n, sum := size()
+	truncated := counterValue(TruncatedCount, p.host.id, s.Addr)
+	ret, err := p.connect(context.Background(), questionState("example.org."), false, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if n2, sum2 := size(); n2 != n+1 || sum2-sum != float64(ret.Len()) {
+		t.Errorf("Expected a reply of %d bytes to be observed, got %d of %f", ret.Len(), n2-n, sum2-sum)
+	}
+	if x := counterValue(TruncatedCount, p.host.id, s.Addr); x != truncated+1 {
+		t.Errorf("Expected a truncated reply, got %f", x-truncated)
+	}
+}
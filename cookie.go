@@ -0,0 +1,116 @@
+package forward
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// cookie holds the DNS cookies (RFC 7873) of the exchanges with an upstream. They belong to the
+// upstream, not to a connection, so they survive connections being cached and reused.
+type cookie struct {
+	client string // hex encoded client cookie, the same for all queries to the upstream
+
+	sync.Mutex
+	server string // hex encoded server cookie last sent by the upstream
+}
+
+// newCookie returns a cookie with a random client cookie.
+func newCookie() *cookie {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &cookie{client: hex.EncodeToString(b)}
+}
+
+// apply returns the state to send for state, with our cookie instead of the client's, and whether
+// an OPT RR was added to it. state itself is left alone.
+func (c *cookie) apply(state request.Request) (request.Request, bool) {
+	c.Lock()
+	opt := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.client + c.server}
+	c.Unlock()
+
+	req := state.Req.Copy()
+	addedOPT := false
+	o := req.IsEdns0()
+	if o == nil {
+		req.SetEdns0(4096, false)
+		o = req.IsEdns0()
+		addedOPT = true
+	}
+	o.Option = append(withoutCookie(o.Option), opt) // a new slice, req.Copy shares the options with state
+	return request.Request{W: state.W, Req: req}, addedOPT
+}
+
+// learn checks the cookie in ret, remembers the server cookie in it and removes it from ret: it's
+// of no use to our client. A reply without a cookie is fine, not every upstream does cookies.
+func (c *cookie) learn(ret *dns.Msg) error {
+	o := ret.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, s := range o.Option {
+		e, ok := s.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// A server cookie is 8 to 32 bytes.
+		if len(e.Cookie) < 32 || len(e.Cookie) > 80 || e.Cookie[:16] != c.client {
+			return &mismatchError{reason: "cookie", reply: ret}
+		}
+		c.Lock()
+		c.server = e.Cookie[16:]
+		c.Unlock()
+	}
+	o.Option = withoutCookie(o.Option)
+	return nil
+}
+
+// badCookie returns true if ret is a BADCOOKIE reply.
+func badCookie(ret *dns.Msg) bool {
+	o := ret.IsEdns0()
+	return o != nil && ret.Rcode == dns.RcodeBadCookie&0xF && o.ExtendedRcode() == dns.RcodeBadCookie>>4
+}
+
+// withoutCookie returns a copy of opts without cookie options.
+func withoutCookie(opts []dns.EDNS0) []dns.EDNS0 {
+	var rest []dns.EDNS0
+	for _, s := range opts {
+		if _, ok := s.(*dns.EDNS0_COOKIE); !ok {
+			rest = append(rest, s)
+		}
+	}
+	return rest
+}
+
+// cookied is connect, but with cookies enabled the query carries our cookie and the reply must carry
+// it too. When the upstream replies BADCOOKIE, the query is sent again with the server cookie from
+// that reply, see RFC 7873, section 5.3. The returned bool is true if an OPT RR was added to the
+// query, the caller must remove it from the reply.
+func (p *Proxy) cookied(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, bool, error) {
+	c := p.host.cookie
+	if c == nil {
+		ret, err := p.connect(ctx, state, forceTCP, metric)
+		return ret, false, err
+	}
+
+	upstream, addedOPT := c.apply(state)
+	ret, err := p.connect(ctx, upstream, forceTCP, metric)
+	if err == nil {
+		err = c.learn(ret)
+	}
+	if err == nil && badCookie(ret) {
+		upstream, addedOPT = c.apply(state)
+		if ret, err = p.connect(ctx, upstream, forceTCP, metric); err == nil {
+			err = c.learn(ret)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return ret, addedOPT, nil
+}
@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestCookies(t *testing.T) {
+	const server = "0102030405060708"
+	var (
+		mu   sync.Mutex
+		seen []string // cookies of the queries for example.org.
+	)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		o := r.IsEdns0()
+		if o == nil || r.Question[0].Name == "." {
+			w.WriteMsg(ret)
+			return
+		}
+		cookie := ""
+		for _, e := range o.Option {
+			if c, ok := e.(*dns.EDNS0_COOKIE); ok {
+				cookie = c.Cookie
+			}
+		}
+		mu.Lock()
+		seen = append(seen, cookie)
+		mu.Unlock()
+
+		ret.SetEdns0(4096, false)
+		switch {
+		case r.Question[0].Name == "spoof.example.org.":
+			cookie = "1111111111111111" + server
+		case len(cookie) == 16:
+			ret.Rcode = dns.RcodeBadCookie
+			cookie += server
+		}
+		ro := ret.IsEdns0()
+		ro.Option = append(ro.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.cookies = true
+	p := NewProxy(s.Addr)
+	f.configure(p)
+	f.SetProxy(p)
+	defer f.Close()
+	client := p.host.cookie.client
+
+	for i := 0; i < 2; i++ {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		if i == 1 {
+			state.Req.SetEdns0(4096, false)
+			o := state.Req.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "aaaaaaaaaaaaaaaa"})
+		}
+		ret, err := f.Forward(state)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if ret.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected NOERROR, got: %s", rcodeString(ret.Rcode))
+		}
+		if o := ret.IsEdns0(); i == 0 && o != nil {
+			t.Error("Expected no OPT RR in the reply to a query without one")
+		} else if i == 1 && (o == nil || len(o.Option) != 0) {
+			t.Errorf("Expected the cookie to be removed from the reply, got: %v", o)
+		}
+	}
+
+	// First without a server cookie, which gets BADCOOKIE, then twice with the one we got.
+	want := []string{client, client + server, client + server}
+	mu.Lock()
+	if len(seen) != len(want) {
+		t.Fatalf("Expected %d queries, got: %d", len(want), len(seen))
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("Expected cookie %q in query %d, got: %q", want[i], i, seen[i])
+		}
+	}
+	mu.Unlock()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("spoof.example.org.", dns.TypeA)
+	if _, err := f.Forward(state); err == nil {
+		t.Error("Expected an error for a reply with another client cookie")
+	}
+}
@@ -0,0 +1,151 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dhcp learns upstreams from the files DHCP clients and RA daemons keep their state in. Supported
+// are resolv.conf style files ("nameserver" lines, as written by udhcpc, rdnssd, NetworkManager
+// or systemd-resolved), systemd-networkd leases ("DNS=") and dhclient leases, of which the last
+// "domain-name-servers" or "dhcp6.name-servers" option is used.
+type dhcp struct {
+	files []string
+}
+
+// servers returns the addresses, as host:port, of the name servers in all files, without duplicates,
+// and the errors reading them. Files that don't exist, e.g. because there is no lease yet, are skipped.
+func (d *dhcp) servers() ([]string, []error) {
+	var (
+		addrs []string
+		errs  []error
+	)
+	seen := make(map[string]bool)
+	for _, name := range d.files {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, ip := range leaseServers(buf) {
+			a := net.JoinHostPort(ip, defaultPort[DNS])
+			if !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs, errs
+}
+
+// leaseServers returns the name server addresses in buf.
+func leaseServers(buf []byte) []string {
+	var resolv, networkd, dhclient []string
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "nameserver ") || strings.HasPrefix(line, "nameserver\t"):
+			resolv = append(resolv, ips(strings.Fields(line)[1:])...)
+		case strings.HasPrefix(line, "DNS="):
+			networkd = append(networkd, ips(strings.Fields(line[4:]))...)
+		case strings.HasPrefix(line, "option domain-name-servers "), strings.HasPrefix(line, "option dhcp6.name-servers "):
+			v := strings.TrimSuffix(strings.Join(strings.Fields(line)[2:], ""), ";")
+			dhclient = ips(strings.Split(v, ",")) // the last lease wins
+		}
+	}
+	return append(append(resolv, networkd...), dhclient...)
+}
+
+// ips returns the IP addresses in fields, an IPv6 address may have a zone.
+func ips(fields []string) []string {
+	var ips []string
+	for _, f := range fields {
+		ip := f
+		if i := strings.Index(f, "%"); i > 0 {
+			ip = f[:i]
+		}
+		if net.ParseIP(ip) != nil {
+			ips = append(ips, f)
+		}
+	}
+	return ips
+}
+
+// fingerprint returns a string that changes when one of the files changes.
+func (d *dhcp) fingerprint() string {
+	var b bytes.Buffer
+	for _, name := range d.files {
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&b, "%d/%d", fi.ModTime().UnixNano(), fi.Size())
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// watchDHCP keeps the upstreams learned from source, with the files of d, in sync with them, until
+// stop is closed. They are checked every dhcpPoll, last is the fingerprint of the files the upstreams
+// were last learned from.
+func (f *Forward) watchDHCP(stop <-chan struct{}, d *dhcp, source, last string) {
+	tick := time.NewTicker(dhcpPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if fp := d.fingerprint(); fp != last {
+				last = fp
+				f.learnDHCP(d, source)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// learnDHCP makes the name servers in the files of d the upstreams learned from source.
+func (f *Forward) learnDHCP(d *dhcp, source string) {
+	addrs, errs := d.servers()
+	for _, err := range errs {
+		f.log.warning(f.id, source+"_failed", fmt.Sprintf("Failed to read %s: %s", source, err), Field{"error", err})
+	}
+	f.setUpstreams(source, addrs, nil)
+}
+
+// resolvFiles returns the upstreams in to that are files, e.g. /etc/resolv.conf.
+func resolvFiles(to []string) []string {
+	var files []string
+	for _, t := range to {
+		if fi, err := os.Stat(t); err == nil && fi.Mode().IsRegular() {
+			files = append(files, t)
+		}
+	}
+	return files
+}
+
+// markSource sets the source of the proxies with an address in addrs.
+func markSource(proxies []*Proxy, addrs []string, source string) {
+	want := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		want[a] = true
+	}
+	for _, p := range proxies {
+		if want[p.host.addr] {
+			p.source = source
+		}
+	}
+}
+
+const (
+	dhcpPoll = 2 * time.Second
+
+	sourceResolvConf = "resolv.conf"
+)
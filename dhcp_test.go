@@ -0,0 +1,122 @@
+package forward
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestLeaseServers(t *testing.T) {
+	tests := []struct {
+		lease    string
+		expected []string
+	}{
+		{"# udhcpc\nnameserver 10.0.0.1\nnameserver fe80::1%eth0\nsearch lan\n", []string{"10.0.0.1", "fe80::1%eth0"}},
+		{"[Network]\nADDRESS=10.0.0.23\nDNS=10.0.0.1 10.0.0.2\n", []string{"10.0.0.1", "10.0.0.2"}},
+		{`lease {
+  interface "eth0";
+  option domain-name-servers 10.0.0.1,10.0.0.2;
+}
+lease {
+  interface "eth0";
+  option domain-name-servers 10.0.1.1, 10.0.1.2;
+}
+`, []string{"10.0.1.1", "10.0.1.2"}},
+		{"nameservers 10.0.0.1\nDNS=bogus\n", nil},
+	}
+	for i, tc := range tests {
+		if got := leaseServers([]byte(tc.lease)); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestSetupDHCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lease := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(lease, []byte("nameserver 10.0.0.1\nnameserver 10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "forward . 10.0.0.2 {\ndhcp "+lease+" "+filepath.Join(dir, "none")+"\nhealth_check 0s\n}")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.OnShutdown()
+
+	if addrs := proxyAddrs(f); !reflect.DeepEqual(addrs, []string{"10.0.0.2:53", "10.0.0.1:53"}) {
+		t.Fatalf("Expected the static upstream and one from the lease, got: %v", addrs)
+	}
+
+	f.setUpstreams("dhcp", nil, nil)
+	if addrs := proxyAddrs(f); !reflect.DeepEqual(addrs, []string{"10.0.0.2:53"}) {
+		t.Errorf("Expected the static upstream to stay, got: %v", addrs)
+	}
+
+	c = caddy.NewTestController("dns", "forward . {\ndhcp "+lease+"\n}")
+	if _, err := parseForward(c); err != nil {
+		t.Errorf("Expected no error for a block with only dhcp, got: %v", err)
+	}
+	c = caddy.NewTestController("dns", "forward . {\nhealth_check 1s\n}")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("Expected error for a block without upstreams")
+	}
+}
+
+func proxyAddrs(f *Forward) []string {
+	var addrs []string
+	for _, p := range f.snapshot() {
+		addrs = append(addrs, p.host.addr)
+	}
+	return addrs
+}
+
+func TestResolvConfUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resolv := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "forward . 10.0.0.2 "+resolv+" {\nhealth_check 0s\n}")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.resolvConf == nil || !reflect.DeepEqual(f.resolvConf.files, []string{resolv}) {
+		t.Fatalf("Expected %s to be watched", resolv)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.OnShutdown()
+
+	if addrs := proxyAddrs(f); !reflect.DeepEqual(addrs, []string{"10.0.0.2:53", "10.0.0.1:53"}) {
+		t.Fatalf("Expected the static upstream and the one from the file, got: %v", addrs)
+	}
+
+	// The runtime rewrites the file.
+	if err := ioutil.WriteFile(resolv, []byte("nameserver 10.0.0.3\nnameserver 10.0.0.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.learnDHCP(f.resolvConf, sourceResolvConf)
+	if addrs := proxyAddrs(f); !reflect.DeepEqual(addrs, []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.4:53"}) {
+		t.Errorf("Expected the upstreams to follow the file, got: %v", addrs)
+	}
+}
@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// Dialer makes the connections of a Proxy to its upstream, for tests with fake upstreams or for
+// transports this package doesn't have. Without one, a Proxy dials UDP, TCP and TLS connections
+// itself, honoring bind, via and the TLS config. DNS-over-HTTPS, gRPC and QUIC upstreams don't dial
+// through it.
+type Dialer interface {
+	// DialContext connects to addr for proto, "udp", "tcp" or "tcp-tls". A connection other than a
+	// *net.TCPConn or *tls.Conn carries one DNS message per Read and Write, without a length prefix,
+	// like a UDP one.
+	DialContext(ctx context.Context, proto, addr string) (net.Conn, error)
+}
+
+// SetDialer sets the Dialer in the lower p.host, nil goes back to the default.
+func (p *Proxy) SetDialer(d Dialer) { p.host.dialer = d }
+
+// dialedConn is a connection made by a Dialer that isn't one the transport can tell the protocol of.
+type dialedConn struct {
+	net.Conn
+	proto string
+}
+
+// dialWith makes a new connection of type proto to addr with the Dialer of h, before deadline. A TCP
+// connection starts with header.
+func (h *host) dialWith(proto, addr string, deadline time.Time, header []byte) (*dns.Conn, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	c, err := h.dialer.DialContext(ctx, proto, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 && proto == "tcp" {
+		c.SetWriteDeadline(deadline)
+		if _, err := c.Write(header); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetWriteDeadline(time.Time{})
+	}
+	switch c.(type) {
+	case *net.UDPConn, *net.TCPConn, *tls.Conn:
+		return &dns.Conn{Conn: c}, nil
+	}
+	return &dns.Conn{Conn: &dialedConn{c, proto}}, nil
+}
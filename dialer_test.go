@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// fakeDialer answers every query itself, over in-memory connections.
+type fakeDialer struct {
+	sync.Mutex
+	dialed []string
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	d.Lock()
+	d.dialed = append(d.dialed, proto)
+	d.Unlock()
+	c, upstream := net.Pipe()
+	go func() {
+		defer upstream.Close()
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			r := new(dns.Msg)
+			if r.Unpack(buf[:n]) != nil {
+				return
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 192.0.2.53"))
+			out, _ := ret.Pack()
+			if _, err := upstream.Write(out); err != nil {
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (d *fakeDialer) protos() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+func TestDialer(t *testing.T) {
+	d := new(fakeDialer)
+	p := NewProxy("fake.example:53")
+	p.SetDialer(d)
+	p.SetExpire(time.Minute)
+	p.host.SetClient()
+	defer p.close()
+
+	hits := counterValue(ConnCacheHits, p.host.id, "fake.example:53", "udp")
+	for i := 0; i < 2; i++ {
+		ret, err := p.connect(context.Background(), questionState("example.org."), false, true)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if len(ret.Answer) != 1 {
+			t.Fatalf("Expected the answer of the fake upstream, got: %v", ret)
+		}
+	}
+	if x := counterValue(ConnCacheHits, p.host.id, "fake.example:53", "udp"); x != hits+1 {
+		t.Errorf("Expected the second query to use the cached connection, got %f hits", x-hits)
+	}
+	if _, err := p.connect(context.Background(), questionState("example.org."), true, true); err != nil {
+		t.Fatalf("Expected no error over TCP, got: %s", err)
+	}
+	if err := p.host.send(); err != nil {
+		t.Errorf("Expected the health check to go to the fake upstream, got: %s", err)
+	}
+
+	want := []string{"udp", "tcp", "udp"}
+	got := d.protos()
+	if len(got) != len(want) {
+		t.Fatalf("Expected dials %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected dials %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package forward
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// discovers returns true if f learns upstreams once it runs: over dhcp, from srv:// names or from
+// watched resolv.conf files. Such a block may start without upstreams, its queries get SERVFAIL (or the
+// no_healthy_reply) until the first ones are learned.
+func (f *Forward) discovers() bool {
+	return f.dhcp != nil || f.resolvConf != nil || len(f.srv) > 0
+}
+
+// setUpstreams makes addrs the upstreams learned from source: proxies are added for new addresses
+// and the proxies source added earlier are removed when their address is gone. An address that is
+// already an upstream, i.e. a static one, isn't added twice. If weights isn't nil it has the weight
+// of each address; a proxy whose weight changed is replaced by one with the new weight.
+func (f *Forward) setUpstreams(source string, addrs []string, weights map[string]int) {
+	want := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		want[a] = true
+	}
+	weight := func(a string) int {
+		if w, ok := weights[a]; ok {
+			return w
+		}
+		return 1
+	}
+
+	f.Lock()
+	var proxies, added, gone []*Proxy
+	have := make(map[string]bool)
+	fails := make(map[string]uint32) // of the replaced proxies, so they don't start out down
+	for _, p := range f.proxies {
+		if p.source == source && (!want[p.host.addr] || p.weight != weight(p.host.addr)) {
+			if want[p.host.addr] {
+				fails[p.host.addr] = atomic.LoadUint32(&p.host.fails)
+			}
+			gone = append(gone, p)
+			continue
+		}
+		have[p.host.addr] = true
+		proxies = append(proxies, p)
+	}
+	for _, a := range addrs {
+		if have[a] {
+			continue
+		}
+		if len(proxies) >= max {
+			f.log.warning(f.id, "too_many_upstreams", fmt.Sprintf("Not adding %s from %s, already %d upstreams", a, source, max),
+				Field{"upstream", a}, Field{"source", source})
+			break
+		}
+		p := f.newDynamicProxy(a)
+		p.source = source
+		p.weight = weight(a)
+		if n, ok := fails[a]; ok {
+			p.host.fails = n
+		}
+		have[a] = true
+		proxies = append(proxies, p)
+		added = append(added, p)
+	}
+	f.proxies = proxies
+	f.Unlock()
+
+	for _, p := range gone {
+		f.log.info(f.id, "upstream_removed", fmt.Sprintf("Removed upstream %s from %s", p.host.addr, source),
+			Field{"upstream", p.host.addr}, Field{"source", source})
+		InstanceInfo.DeleteLabelValues(f.id, p.host.addr, p.host.tag)
+		go p.drain(drainTimeout)
+	}
+	for _, p := range added {
+		f.log.info(f.id, "upstream_added", fmt.Sprintf("Added upstream %s from %s", p.host.addr, source),
+			Field{"upstream", p.host.addr}, Field{"source", source})
+		InstanceInfo.WithLabelValues(f.id, p.host.addr, p.host.tag).Set(1)
+		if f.hcInterval > 0 {
+			p.startHealthCheck()
+		} else {
+			p.host.resetFails()
+		}
+	}
+}
+
+// newDynamicProxy returns a plain DNS proxy for addr with the settings of the block.
+func (f *Forward) newDynamicProxy(addr string) *Proxy {
+	p := NewProxy(addr)
+	p.host.id = f.id
+	p.host.exporter = f.exporter
+	p.host.log = f.log
+	p.host.probe = f.probe
+	p.host.hc = f.hc
+	p.host.rise = f.hcRise
+	if f.cookies {
+		p.host.cookie = newCookie()
+	}
+	if f.multiplex > 0 {
+		p.mux = newMux(p.host, f.multiplex)
+	}
+	p.host.ednsKeepalive = f.ednsKeepalive
+	p.host.padding = f.padding
+	p.host.proxyProtocol = f.proxyProtocol
+	p.host.randomCase = f.randomCase
+	p.host.servfails = f.servfailRate.clone()
+	p.host.failWindow = f.failWindow
+	if f.accountWindow > 0 {
+		p.host.meter = newMeter(f.accountWindow)
+	}
+	p.SetExpire(f.expire)
+	for proto, d := range f.protoExpire {
+		p.SetProtoExpire(proto, d)
+	}
+	p.SetMaxIdleConns(f.maxIdleConns)
+	p.SetTimeouts(f.dialTimeout, f.readTimeout, f.writeTimeout)
+	p.host.bind = f.bind
+	p.host.via = f.via
+	p.hcInterval = f.hcInterval
+	p.hcBackoff = f.hcBackoff
+	p.hcJitter = f.hcJitter
+	p.limit = newTokenBucket(f.maxQPS)
+	p.hcSkipActive = f.hcSkipActive
+	p.forceTCP = f.forceTCP || f.via != nil
+	p.preferUDP = f.preferUDP
+	p.noPoolUDP = f.noPoolUDP
+	p.warmConns = f.warmConns
+	return p
+}
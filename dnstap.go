@@ -0,0 +1,71 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/request"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+type tapperKey struct{}
+
+// withTapper returns ctx with the tapper of the dnstap plugin, if ctx is the context the dnstap plugin
+// passed. The contexts derived from it aren't a Tapper themselves, so it's kept as a value.
+func withTapper(ctx context.Context) context.Context {
+	t := dnstap.TapperFromContext(ctx)
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tapperKey{}, t)
+}
+
+// tap sends the query in state to p, sent at start over proto, and its reply ret if there is one, to
+// dnstap as FORWARDER_QUERY and FORWARDER_RESPONSE messages. It does nothing without the dnstap plugin.
+// With privacy or a dnstap_payload of metadata the messages have no packed query and reply, otherwise
+// their names and ECS addresses are hidden as in the logs.
+func (f *Forward) tap(ctx context.Context, p *Proxy, proto string, state request.Request, ret *dns.Msg, start time.Time) {
+	t, ok := ctx.Value(tapperKey{}).(dnstap.Tapper)
+	if !ok {
+		return
+	}
+	q, ok := f.tapData(t, p, proto, state.Req, start)
+	if !ok {
+		return
+	}
+	t.TapMessage(q.ToOutsideQuery(tap.Message_FORWARDER_QUERY))
+	if ret == nil {
+		return
+	}
+	// Not q, the messages point into their Data.
+	if r, ok := f.tapData(t, p, proto, ret, time.Now()); ok {
+		t.TapMessage(r.ToOutsideResponse(tap.Message_FORWARDER_RESPONSE))
+	}
+}
+
+// tapData returns the dnstap data of m, exchanged with p over proto at ts. It returns false for
+// upstreams without an address and port, such as those of DNS over HTTPS.
+func (f *Forward) tapData(t dnstap.Tapper, p *Proxy, proto string, m *dns.Msg, ts time.Time) (*msg.Builder, bool) {
+	b := t.TapBuilder()
+	if err := b.HostPort(p.host.addr); err != nil {
+		return nil, false
+	}
+	b.SocketProto = tap.SocketProtocol_UDP
+	if proto != "udp" {
+		b.SocketProto = tap.SocketProtocol_TCP
+	}
+	b.TimeSec = uint64(ts.Unix())
+	if f.tapPayload != "" {
+		b.Full = f.tapPayload == "full"
+	}
+	if b.Full && !f.privacy {
+		if err := b.Pack(f.redact.msg(m)); err != nil {
+			return nil, false
+		}
+	}
+	return &b, true
+}
@@ -0,0 +1,179 @@
+package forward
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// testTapper is the context the dnstap plugin passes on, it keeps the messages.
+type testTapper struct {
+	context.Context
+	full bool
+	msgs []*tap.Message
+}
+
+func (t *testTapper) TapMessage(m *tap.Message) error { t.msgs = append(t.msgs, m); return nil }
+func (t *testTapper) TapBuilder() msg.Builder         { return msg.Builder{Full: t.full} }
+
+func TestDnstap(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	host, port, _ := net.SplitHostPort(s.Addr)
+
+	for _, privacy := range []bool{false, true} {
+		f := New()
+		f.from = "."
+		f.privacy = privacy
+		f.SetProxy(NewProxy(s.Addr))
+
+		tt := &testTapper{Context: context.Background(), full: true}
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if _, err := f.ServeDNS(tt, &test.ResponseWriter{}, m); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		f.Close()
+
+		if len(tt.msgs) != 2 {
+			t.Fatalf("Expected a query and a response message, got %d messages", len(tt.msgs))
+		}
+		q, r := tt.msgs[0], tt.msgs[1]
+		if *q.Type != tap.Message_FORWARDER_QUERY || *r.Type != tap.Message_FORWARDER_RESPONSE {
+			t.Errorf("Expected FORWARDER_QUERY and FORWARDER_RESPONSE, got %s and %s", *q.Type, *r.Type)
+		}
+		if !net.IP(q.ResponseAddress).Equal(net.ParseIP(host)) || strconv.Itoa(int(*q.ResponsePort)) != port {
+			t.Errorf("Expected the upstream %s, got %s port %d", s.Addr, net.IP(q.ResponseAddress), *q.ResponsePort)
+		}
+		if *q.SocketProtocol != tap.SocketProtocol_UDP {
+			t.Errorf("Expected UDP, got %d", *q.SocketProtocol)
+		}
+		if privacy {
+			if q.QueryMessage != nil || r.ResponseMessage != nil {
+				t.Error("Expected no messages with privacy")
+			}
+			continue
+		}
+		reply := new(dns.Msg)
+		if err := reply.Unpack(r.ResponseMessage); err != nil || !reply.Response || reply.Question[0].Name != "example.org." {
+			t.Errorf("Expected the packed reply, got %v: %v", reply, err)
+		}
+		if q.QueryMessage == nil {
+			t.Error("Expected the packed query")
+		}
+	}
+}
+
+func TestDnstapRedacted(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.redact.qname = "hash"
+	f.redact.v4 = 24
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	tt := &testTapper{Context: context.Background(), full: true}
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.55").To4()})
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(tt, rec, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg.Answer[0].Header().Name != "example.org." {
+		t.Errorf("Expected the client to get the name as is, got: %s", rec.Msg.Answer[0].Header().Name)
+	}
+	if len(tt.msgs) != 2 {
+		t.Fatalf("Expected a query and a response message, got %d messages", len(tt.msgs))
+	}
+
+	hashed := dns.Fqdn(f.redact.name("example.org."))
+	q, r := new(dns.Msg), new(dns.Msg)
+	if err := q.Unpack(tt.msgs[0].QueryMessage); err != nil {
+		t.Fatalf("Expected the packed query, got: %s", err)
+	}
+	if err := r.Unpack(tt.msgs[1].ResponseMessage); err != nil {
+		t.Fatalf("Expected the packed reply, got: %s", err)
+	}
+	if q.Question[0].Name != hashed || r.Question[0].Name != hashed || r.Answer[0].Header().Name != hashed {
+		t.Errorf("Expected the name hashed to %s, got %s, %s and %s", hashed, q.Question[0].Name, r.Question[0].Name, r.Answer[0].Header().Name)
+	}
+	e := q.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+	if e.SourceNetmask != 24 || !e.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("Expected the ECS address masked to 192.0.2.0/24, got %s/%d", e.Address, e.SourceNetmask)
+	}
+	if x := o.Option[0].(*dns.EDNS0_SUBNET).SourceNetmask; x != 32 {
+		t.Errorf("Expected the query of the client left alone, got a netmask of %d", x)
+	}
+}
+
+func TestDnstapPayload(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\ndnstap_payload some\n}\n")); err == nil {
+		t.Errorf("Expected an error for an unknown dnstap_payload")
+	}
+
+	tests := []struct {
+		payload string
+		full    bool // of the dnstap plugin
+		packed  bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"metadata", true, false},
+		{"full", false, true},
+	}
+	for _, tc := range tests {
+		config := "forward . " + s.Addr
+		if tc.payload != "" {
+			config += " {\ndnstap_payload " + tc.payload + "\n}"
+		}
+		f, err := parseForward(caddy.NewTestController("dns", config+"\n"))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		tt := &testTapper{Context: context.Background(), full: tc.full}
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if _, err := f.ServeDNS(tt, &test.ResponseWriter{}, m); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		f.Close()
+
+		if len(tt.msgs) != 2 {
+			t.Fatalf("Expected a query and a response message, got %d messages", len(tt.msgs))
+		}
+		if packed := tt.msgs[0].QueryMessage != nil && tt.msgs[1].ResponseMessage != nil; packed != tc.packed {
+			t.Errorf("Expected packed messages %t with dnstap_payload %q and full %t, got %t", tc.packed, tc.payload, tc.full, packed)
+		}
+	}
+}
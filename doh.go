@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+// doh sends queries with DNS-over-HTTPS (RFC 8484): POSTed as application/dns-message over HTTP/2,
+// or with GET in the dns parameter. The http.Transport keeps the connections to the upstream.
+type doh struct {
+	url       string
+	get       bool                                  // send queries with GET instead of POST
+	bootstrap *bootstrap                            // if not nil, resolves the host in url
+	proxy     func(*http.Request) (*url.URL, error) // if not nil, overrides the proxy from the environment
+	header    http.Header                           // extra headers of every request
+	requestID string                                // if not empty, the header that carries a random ID of each request
+
+	mu     sync.Mutex
+	client *http.Client // created on first use, when the TLS config is known
+}
+
+// newDoHProxy returns a proxy for the DoH upstream at rawurl, an https:// URL or URI template. A
+// template with the dns variable, as in https://dns.example/dns-query{?dns}, makes it use GET.
+func newDoHProxy(rawurl string) (*Proxy, error) {
+	base, get := rawurl, false
+	for _, v := range []string{"{?dns}", "{&dns}"} {
+		if strings.HasSuffix(rawurl, v) {
+			base, get = strings.TrimSuffix(rawurl, v), true
+			break
+		}
+	}
+	if strings.ContainsAny(base, "{}") {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS URI template, only {?dns} or {&dns} at the end is supported: %s", rawurl)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != _https || u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS upstream: %s", rawurl)
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+
+	p := NewProxy(u.String())
+	p.host.exch = &doh{url: u.String(), get: get}
+	p.tls = true
+	return p, nil
+}
+
+// httpClient returns the HTTP client, set up with the TLS config of h.
+func (d *doh) httpClient(h *host) *http.Client {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client
+	}
+	cfg := h.tlsConfig
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	tr := &http.Transport{
+		TLSClientConfig:     cfg.Clone(),
+		TLSHandshakeTimeout: h.dialTimeout,
+		IdleConnTimeout:     h.expire,
+		MaxIdleConnsPerHost: 4,
+		DialContext:         d.dialer(h.dialTimeout),
+	}
+	switch {
+	case h.via != nil:
+		tr.DialContext = h.dialContextVia // the proxy resolves the name of the upstream
+	case d.proxy != nil:
+		tr.Proxy = d.proxy
+	default:
+		tr.Proxy = http.ProxyFromEnvironment
+	}
+	http2.ConfigureTransport(tr)
+	d.client = &http.Client{Transport: tr, Timeout: h.readTimeout}
+	return d.client
+}
+
+// dialer returns a dial function that connects to addr within timeout, when there are bootstrap
+// resolvers its host is resolved with those.
+func (d *doh) dialer(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || d.bootstrap == nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := d.bootstrap.resolve(host)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0], port))
+	}
+}
+
+// exchange sends req to the upstream of h and returns the reply.
+func (d *doh) exchange(ctx context.Context, h *host, req *dns.Msg) (*dns.Msg, error) {
+	// The ID is 0 on the wire, as RFC 8484 recommends for the benefit of HTTP caches.
+	id := req.Id
+	req.Id = 0
+	buf, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := d.request(buf)
+	if err != nil {
+		return nil, err
+	}
+	hreq = hreq.WithContext(ctx)
+	for k, v := range d.header {
+		hreq.Header[k] = v
+	}
+	if !d.get {
+		hreq.Header.Set("Content-Type", dohMimeType)
+	}
+	hreq.Header.Set("Accept", dohMimeType)
+	if d.requestID != "" {
+		correlate(ctx, hreq.Header, d.requestID)
+	}
+
+	resp, err := d.httpClient(h).Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected HTTP status from %s: %s", d.url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	ret.Id = id
+	return ret, nil
+}
+
+// request returns the HTTP request for the packed query buf: a POST with buf as the body, or a GET
+// with buf base64url encoded, without padding, in the dns parameter.
+func (d *doh) request(buf []byte) (*http.Request, error) {
+	if !d.get {
+		return http.NewRequest("POST", d.url, bytes.NewReader(buf))
+	}
+	sep := "?"
+	if strings.Contains(d.url, "?") {
+		sep = "&"
+	}
+	return http.NewRequest("GET", d.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+}
+
+func (d *doh) proto() string { return _https }
+
+func (d *doh) clone() exchanger {
+	return &doh{url: d.url, get: d.get, bootstrap: d.bootstrap, proxy: d.proxy, header: d.header, requestID: d.requestID}
+}
+
+// correlate sets the header name in header to a random request ID, so the logs of the upstream can
+// be matched with ours. With an active span in ctx the ID is tagged on that span and the span is
+// injected into header too, which gives the upstream e.g. a traceparent header.
+func correlate(ctx context.Context, header http.Header, name string) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	header.Set(name, id)
+
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	span.SetTag("doh.request_id", id)
+	span.Tracer().Inject(span.Context(), ot.HTTPHeaders, ot.HTTPHeadersCarrier(header))
+}
+
+// noProxy is the proxy function of doh_proxy none.
+func noProxy(*http.Request) (*url.URL, error) { return nil, nil }
+
+// close closes the idle connections to the upstream.
+func (d *doh) close() { d.reset() }
+
+// reset closes the idle connections to the upstream, the requests in flight keep theirs.
+func (d *doh) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return
+	}
+	if tr, ok := d.client.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+const dohMimeType = "application/dns-message"
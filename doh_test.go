@@ -0,0 +1,357 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+)
+
+func TestDoH(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohMimeType || r.ProtoMajor != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil || req.Id != 0 {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(req)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		out, _ := ret.Pack()
+		w.Header().Set("Content-Type", dohMimeType)
+		w.Write(out)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	p, err := newDoHProxy(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	f := New()
+	f.SetProxy(p)
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, info, err := f.ForwardWithInfo(state)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, got: %s", err)
+	}
+	if resp.Id != state.Req.Id {
+		t.Errorf("Expected ID %d, got: %d", state.Req.Id, resp.Id)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected one RR in the answer section, got: %s", resp)
+	}
+	if info.Proto != "https" || info.Upstream != s.URL+"/dns-query" {
+		t.Errorf("Expected https to %s/dns-query, got: %s to %s", s.URL, info.Proto, info.Upstream)
+	}
+
+	p.host.SetClient()
+	if err := p.host.send(); err != nil {
+		t.Errorf("Expected health check to succeed, got: %s", err)
+	}
+}
+
+func TestSetupDoH(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedURL string
+	}{
+		{"forward . https://dns.example.net", false, "https://dns.example.net/dns-query"},
+		{"forward . https://10.0.0.1:8443/resolve", false, "https://10.0.0.1:8443/resolve"},
+		{"forward . https://", true, ""},
+	}
+
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+			continue
+		}
+		p := f.proxies[0]
+		if p.host.exch == nil || p.host.addr != tc.expectedURL || p.host.tlsConfig == nil {
+			t.Errorf("Test %d: expected DoH proxy for %s, got: %s", i, tc.expectedURL, p.host.addr)
+		}
+		f.Close()
+	}
+}
+
+// dohAnswer is a DoH handler that answers every query, POSTed or with GET, with an A record.
+func dohAnswer(w http.ResponseWriter, r *http.Request) {
+	buf, _ := ioutil.ReadAll(r.Body)
+	if r.Method == "GET" {
+		buf, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(req)
+	ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+	out, _ := ret.Pack()
+	w.Header().Set("Content-Type", dohMimeType)
+	w.Write(out)
+}
+
+func TestDoHProxy(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(dohAnswer))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "not a tunnel", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(dst, conn)
+		io.Copy(conn, dst)
+	}))
+	defer proxy.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.URL+" {\ndoh_proxy "+proxy.URL+"\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	p := f.proxies[0]
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.host.resetFails()
+
+	if _, err := f.Forward(questionState("example.org.")); err != nil {
+		t.Fatalf("Expected a reply through the proxy, got: %s", err)
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("Expected 1 tunnel through the proxy, got %d", n)
+	}
+
+	for input, env := range map[string]bool{"forward . https://dns.example": true, "forward . https://dns.example {\ndoh_proxy none\n}": false} {
+		f, err := parseForward(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatalf("Expected no error for %q, got: %s", input, err)
+		}
+		d := f.proxies[0].host.exch.(*doh)
+		tr := d.httpClient(f.proxies[0].host).Transport.(*http.Transport)
+		req, _ := http.NewRequest("POST", "https://dns.example/dns-query", nil)
+		if u, _ := tr.Proxy(req); (d.proxy == nil) != env || (!env && u != nil) {
+			t.Errorf("Expected the proxy from the environment %t for %q, got %v", env, input, u)
+		}
+		f.Close()
+	}
+
+	for _, input := range []string{"doh_proxy", "doh_proxy proxy.example:3128", "doh_proxy socks5://proxy.example", "doh_proxy none now"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestDoHHeader(t *testing.T) {
+	got := make(chan http.Header, 1)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+		dohAnswer(w, r)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.URL+` {
+doh_header authorization "Bearer xyz"
+doh_header X-Tag a
+doh_header X-Tag b
+doh_header Content-Type text/plain
+}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	p := f.proxies[0]
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.host.resetFails()
+
+	if _, err := f.Forward(questionState("example.org.")); err != nil {
+		t.Fatalf("Expected a reply, got: %s", err)
+	}
+	h := <-got
+	if x := h.Get("Authorization"); x != "Bearer xyz" {
+		t.Errorf("Expected Authorization %q, got %q", "Bearer xyz", x)
+	}
+	if x := h["X-Tag"]; len(x) != 2 || x[0] != "a" || x[1] != "b" {
+		t.Errorf("Expected X-Tag a and b, got %v", x)
+	}
+	if x := h.Get("Content-Type"); x != dohMimeType {
+		t.Errorf("Expected Content-Type %q, got %q", dohMimeType, x)
+	}
+
+	for _, input := range []string{"doh_header", "doh_header X-Tag", "doh_header X-Tag a b"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestDoHRequestID(t *testing.T) {
+	got := make(chan http.Header, 2)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+		dohAnswer(w, r)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.URL+" {\ndoh_request_id\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	p := f.proxies[0]
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("connect")
+	ctx := ot.ContextWithSpan(context.Background(), span)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := p.host.exch.exchange(ctx, p.host, req); err != nil {
+		t.Fatalf("Expected a reply, got: %s", err)
+	}
+	if _, err := p.host.exch.exchange(context.Background(), p.host, req); err != nil {
+		t.Fatalf("Expected a reply, got: %s", err)
+	}
+	span.Finish()
+
+	traced, plain := <-got, <-got
+	id := traced.Get("X-Request-ID")
+	if len(id) != 16 {
+		t.Fatalf("Expected a request ID of 16 hex digits, got %q", id)
+	}
+	if x := plain.Get("X-Request-ID"); len(x) != 16 || x == id {
+		t.Errorf("Expected another request ID than %q, got %q", id, x)
+	}
+	if x := span.(*mocktracer.MockSpan).Tag("doh.request_id"); x != id {
+		t.Errorf("Expected the span to be tagged with %q, got %v", id, x)
+	}
+	if traced.Get("Mockpfx-Ids-Traceid") == "" {
+		t.Errorf("Expected the span context in the headers, got %v", traced)
+	}
+	if plain.Get("Mockpfx-Ids-Traceid") != "" {
+		t.Errorf("Expected no span context without a span, got %v", plain)
+	}
+
+	f, err = parseForward(caddy.NewTestController("dns", "forward . "+s.URL+" {\ndoh_request_id X-Correlation-ID\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	if x := f.proxies[0].host.exch.(*doh).requestID; x != "X-Correlation-ID" {
+		t.Errorf("Expected header X-Correlation-ID, got %q", x)
+	}
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\ndoh_request_id a b\n}\n")); err == nil {
+		t.Errorf("Expected error for two headers")
+	}
+}
+
+func TestDoHMethod(t *testing.T) {
+	type seen struct{ method, query string }
+	got := make(chan seen, 1)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Method, r.URL.RawQuery}
+		dohAnswer(w, r)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	tests := []struct {
+		to     string
+		method string
+		query  string // prefix of the query of the request
+	}{
+		{s.URL, "POST", ""},
+		{s.URL + " method=POST", "POST", ""},
+		{s.URL + " method=GET", "GET", "dns="},
+		{s.URL + "/dns-query{?dns}", "GET", "dns="},
+		{s.URL + "/dns-query?ct=1{&dns}", "GET", "ct=1&dns="},
+		{s.URL + "/dns-query{?dns} method=POST", "POST", ""},
+	}
+	for _, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", "forward . "+tc.to))
+		if err != nil {
+			t.Fatalf("Expected no error for %q, got: %s", tc.to, err)
+		}
+		p := f.proxies[0]
+		p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+		p.host.resetFails()
+
+		m, err := f.Forward(questionState("example.org."))
+		f.Close()
+		if err != nil {
+			t.Fatalf("Expected a reply for %q, got: %s", tc.to, err)
+		}
+		if len(m.Answer) != 1 {
+			t.Errorf("Expected 1 answer for %q, got %d", tc.to, len(m.Answer))
+		}
+		x := <-got
+		if x.method != tc.method || !strings.HasPrefix(x.query, tc.query) || (tc.query == "" && x.query != "") {
+			t.Errorf("Expected %s with query %q for %q, got %s with %q", tc.method, tc.query, tc.to, x.method, x.query)
+		}
+		if strings.Contains(x.query, "=&") || strings.HasSuffix(x.query, "=") {
+			t.Errorf("Expected the dns parameter without padding for %q, got %q", tc.to, x.query)
+		}
+	}
+
+	for _, input := range []string{"https://dns.example method=PUT", "10.0.0.1 method=GET", "https://dns.example/{?name}", "https://dns.example/{?dns}/q"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . "+input)); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
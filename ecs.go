@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// ecs says what to do with the EDNS Client Subnet option (RFC 7871) of the queries.
+type ecs struct {
+	add    bool // replace the option with one for the address of the client
+	strip  bool // remove the option
+	v4, v6 uint8
+}
+
+// Default prefix lengths of the added ECS options, as recommended by RFC 7871.
+const (
+	ecsV4 = 24
+	ecsV6 = 56
+)
+
+// apply returns the state to forward for state, and whether an OPT RR and an ECS option were
+// added to it, which must then be removed from the reply. state itself is left alone.
+func (e *ecs) apply(state request.Request) (request.Request, bool, bool) {
+	if e == nil {
+		return state, false, false
+	}
+	o := state.Req.IsEdns0()
+	if e.strip && (o == nil || subnetIndex(o) < 0) {
+		return state, false, false
+	}
+
+	req := state.Req.Copy()
+	addedOPT, addedECS := false, false
+	if o = req.IsEdns0(); o == nil {
+		if !e.add {
+			return state, false, false
+		}
+		req.SetEdns0(4096, false)
+		o = req.IsEdns0()
+		addedOPT = true
+	}
+	if subnetIndex(o) < 0 && e.add {
+		addedECS = true
+	}
+	o.Option = withoutSubnet(o.Option) // a new slice, req.Copy shares the options with state
+	if e.add {
+		if s := e.subnet(state.IP()); s != nil {
+			o.Option = append(o.Option, s)
+		}
+	}
+	return request.Request{W: state.W, Req: req}, addedOPT, addedECS
+}
+
+// subnet returns the ECS option for ip, truncated to the prefix length of its family.
+func (e *ecs) subnet(ip string) *dns.EDNS0_SUBNET {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	s := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if v4 := addr.To4(); v4 != nil {
+		s.Family, s.SourceNetmask = 1, e.v4
+		s.Address = v4.Mask(net.CIDRMask(int(e.v4), 32))
+		return s
+	}
+	s.Family, s.SourceNetmask = 2, e.v6
+	s.Address = addr.Mask(net.CIDRMask(int(e.v6), 128))
+	return s
+}
+
+// unapply removes from ret what apply added to the query: the client didn't ask for it.
+func unapply(ret *dns.Msg, addedOPT, addedECS bool) {
+	if !addedOPT && !addedECS {
+		return
+	}
+	for i, rr := range ret.Extra {
+		o, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		if addedOPT {
+			ret.Extra = append(ret.Extra[:i], ret.Extra[i+1:]...)
+			return
+		}
+		o.Option = withoutSubnet(o.Option)
+		return
+	}
+}
+
+// withoutSubnet returns a copy of opts without ECS options.
+func withoutSubnet(opts []dns.EDNS0) []dns.EDNS0 {
+	var rest []dns.EDNS0
+	for _, s := range opts {
+		if _, ok := s.(*dns.EDNS0_SUBNET); !ok {
+			rest = append(rest, s)
+		}
+	}
+	return rest
+}
+
+// subnetIndex returns the index of the ECS option in o, or -1 if it has none.
+func subnetIndex(o *dns.OPT) int {
+	for i, s := range o.Option {
+		if _, ok := s.(*dns.EDNS0_SUBNET); ok {
+			return i
+		}
+	}
+	return -1
+}
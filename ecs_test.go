@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestECS(t *testing.T) {
+	seen := make(chan string, 1) // the ECS option the upstream got, "" for none
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.org." {
+			subnet := ""
+			if o := r.IsEdns0(); o != nil {
+				if i := subnetIndex(o); i >= 0 {
+					subnet = o.Option[i].String()
+				}
+				ret.Extra = append(ret.Extra, o) // echo it, as a geo-aware upstream does
+			}
+			seen <- subnet
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	clientECS := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: []byte{192, 168, 1, 0}}
+	tests := []struct {
+		ecs       *ecs
+		clientOPT bool
+		clientECS bool
+		upstream  string // the ECS the upstream must get
+		replyOPT  bool
+	}{
+		{nil, true, true, clientECS.String(), true},
+		{&ecs{add: true, v4: 24, v6: 56}, false, false, "10.240.0.0/24/0", false},
+		{&ecs{add: true, v4: 16, v6: 56}, true, true, "10.240.0.0/16/0", true},
+		{&ecs{strip: true}, true, true, "", true},
+	}
+	for i, tc := range tests {
+		f := New()
+		f.from = "."
+		f.ecs = tc.ecs
+		f.SetProxy(NewProxy(s.Addr))
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		if tc.clientOPT {
+			req.SetEdns0(4096, false)
+			if tc.clientECS {
+				o := req.IsEdns0()
+				o.Option = append(o.Option, clientECS)
+			}
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if got := <-seen; got != tc.upstream {
+			t.Errorf("Test %d: expected the upstream to get ECS %q, got: %q", i, tc.upstream, got)
+		}
+		if o := rec.Msg.IsEdns0(); (o != nil) != tc.replyOPT {
+			t.Errorf("Test %d: expected an OPT RR in the reply to be %t", i, tc.replyOPT)
+		}
+		if o := req.IsEdns0(); tc.clientECS && (o == nil || subnetIndex(o) < 0) {
+			t.Errorf("Test %d: expected the query of the client to keep its ECS option", i)
+		}
+		f.Close()
+	}
+}
+
+func TestSetupECS(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *ecs
+		shouldErr bool
+	}{
+		{"forward . 127.0.0.1 {\necs pass\n}\n", nil, false},
+		{"forward . 127.0.0.1 {\necs strip\n}\n", &ecs{strip: true}, false},
+		{"forward . 127.0.0.1 {\necs add\n}\n", &ecs{add: true, v4: 24, v6: 56}, false},
+		{"forward . 127.0.0.1 {\necs add 20 48\n}\n", &ecs{add: true, v4: 20, v6: 48}, false},
+		{"forward . 127.0.0.1 {\necs add 33\n}\n", nil, true},
+		{"forward . 127.0.0.1 {\necs drop\n}\n", nil, true},
+		{"forward . 127.0.0.1 {\necs strip 24\n}\n", nil, true},
+		{"forward . 127.0.0.1 {\necs\n}\n", nil, true},
+	}
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if (f.ecs == nil) != (tc.expected == nil) || (f.ecs != nil && *f.ecs != *tc.expected) {
+			t.Errorf("Test %d: expected %v, got: %v", i, tc.expected, f.ecs)
+		}
+	}
+}
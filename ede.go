@@ -0,0 +1,24 @@
+package forward
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// newEDE returns an Extended DNS Error (RFC 8914) option with info code and extra text. It is not
+// supported by our version of the dns library, so it's packed as a local option.
+func newEDE(code uint16, text string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	return &dns.EDNS0_LOCAL{Code: edeOption, Data: data}
+}
+
+const (
+	edeOption = 15 // EDNS0 option code of Extended DNS Errors
+
+	// EDE info codes.
+	edeOther        = 0
+	edeNetworkError = 23
+)
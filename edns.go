@@ -0,0 +1,136 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// query sends state to p like connect does, but copes with upstreams that don't speak EDNS: when one
+// replies with FORMERR or NOTIMP and no OPT RR to a query with one, the query is sent again without
+// it, and for noEDNSDuration p gets no OPT RRs at all. This includes those added for cookies.
+func (p *Proxy) query(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
+	if p.host.noEDNS() {
+		if state.Req.IsEdns0() != nil {
+			state = withoutEDNS(state)
+		}
+		return p.connect(ctx, state, forceTCP, metric)
+	}
+	if state.Req.IsEdns0() == nil && p.host.cookie == nil {
+		return p.connect(ctx, state, forceTCP, metric)
+	}
+
+	ret, addedOPT, err := p.cookied(ctx, state, forceTCP, metric)
+	if err != nil || (ret.Rcode != dns.RcodeFormatError && ret.Rcode != dns.RcodeNotImplemented) || ret.IsEdns0() != nil {
+		if err == nil {
+			unapply(ret, addedOPT, false)
+		}
+		return ret, err
+	}
+	atomic.StoreInt64(&p.host.noEDNSUntil, time.Now().Add(noEDNSDuration).UnixNano())
+	EDNSFallbackCount.WithLabelValues(p.host.id, p.host.addr).Add(1)
+	p.host.log.info(p.host.id, "edns_disabled", fmt.Sprintf("Not sending EDNS to %s after %s", p.host, rcodeString(ret.Rcode)),
+		Field{"upstream", p.host.addr}, Field{"rcode", rcodeString(ret.Rcode)})
+	return p.connect(ctx, withoutEDNS(state), forceTCP, metric)
+}
+
+// noEDNS returns true if h recently showed it doesn't speak EDNS.
+func (h *host) noEDNS() bool { return time.Now().UnixNano() < atomic.LoadInt64(&h.noEDNSUntil) }
+
+// withoutEDNS returns state with a copy of its query without the OPT RR.
+func withoutEDNS(state request.Request) request.Request {
+	req := state.Req.Copy()
+	extra := req.Extra[:0]
+	for _, rr := range req.Extra {
+		if _, ok := rr.(*dns.OPT); !ok {
+			extra = append(extra, rr)
+		}
+	}
+	req.Extra = extra
+	return request.Request{W: state.W, Req: req}
+}
+
+// withBufsize returns state with a copy of its query that advertises size as its EDNS0 UDP payload
+// size, or state itself when the query has no OPT RR or already advertises size. The reply is
+// still cut to what the client can take.
+func withBufsize(state request.Request, size uint16) request.Request {
+	if o := state.Req.IsEdns0(); o == nil || o.UDPSize() == size {
+		return state
+	}
+	req := state.Req.Copy()
+	req.IsEdns0().SetUDPSize(size)
+	return request.Request{W: state.W, Req: req}
+}
+
+// ednsOptions maps the names edns_strip takes to EDNS0 option codes.
+var ednsOptions = map[string]uint16{
+	"llq":       dns.EDNS0LLQ,
+	"ul":        dns.EDNS0UL,
+	"nsid":      dns.EDNS0NSID,
+	"dau":       dns.EDNS0DAU,
+	"dhu":       dns.EDNS0DHU,
+	"n3u":       dns.EDNS0N3U,
+	"subnet":    dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+}
+
+// ednsCode returns the EDNS0 option code of s, a name from ednsOptions or a number.
+func ednsCode(s string) (uint16, error) {
+	if code, ok := ednsOptions[strings.ToLower(s)]; ok {
+		return code, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown EDNS0 option: '%s'", s)
+	}
+	return uint16(n), nil
+}
+
+// hasOption returns true if o has an option with a code in codes.
+func hasOption(o *dns.OPT, codes map[uint16]bool) bool {
+	for _, e := range o.Option {
+		if codes[e.Option()] {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutOptions returns state with a copy of its query without the EDNS0 options with a code in
+// codes, or state itself when it has none of them.
+func withoutOptions(state request.Request, codes map[uint16]bool) request.Request {
+	if o := state.Req.IsEdns0(); o == nil || !hasOption(o, codes) {
+		return state
+	}
+	req := state.Req.Copy()
+	stripOptions(req, codes)
+	return request.Request{W: state.W, Req: req}
+}
+
+// stripOptions removes the EDNS0 options with a code in codes from m.
+func stripOptions(m *dns.Msg, codes map[uint16]bool) {
+	o := m.IsEdns0()
+	if o == nil || !hasOption(o, codes) {
+		return
+	}
+	var rest []dns.EDNS0
+	for _, e := range o.Option {
+		if !codes[e.Option()] {
+			rest = append(rest, e)
+		}
+	}
+	o.Option = rest
+}
+
+// noEDNSDuration is how long an upstream that doesn't speak EDNS gets queries without it.
+const noEDNSDuration = 30 * time.Minute
@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestNoEDNSFallback(t *testing.T) {
+	var withOPT int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.org." && r.IsEdns0() != nil {
+			atomic.AddInt32(&withOPT, 1)
+			ret.Rcode = dns.RcodeFormatError // an ancient server
+			ret.Extra = nil
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	p := NewProxy(s.Addr)
+	f.SetProxy(p)
+	defer f.Close()
+
+	before := counterValue(EDNSFallbackCount, p.host.id, p.host.addr)
+	for i := 0; i < 2; i++ {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		state.Req.SetEdns0(4096, true)
+		ret, err := f.Forward(state)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if ret.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected the query without EDNS to succeed, got: %s", rcodeString(ret.Rcode))
+		}
+		if state.Req.IsEdns0() == nil {
+			t.Error("Expected the query of the client to keep its OPT RR")
+		}
+	}
+	// Only the first query had an OPT RR, the second one went without.
+	if n := atomic.LoadInt32(&withOPT); n != 1 {
+		t.Errorf("Expected 1 query with an OPT RR, got: %d", n)
+	}
+	if n := counterValue(EDNSFallbackCount, p.host.id, p.host.addr) - before; n != 1 {
+		t.Errorf("Expected 1 fallback, got: %f", n)
+	}
+}
+
+func TestBufsize(t *testing.T) {
+	var size int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if o := r.IsEdns0(); o != nil {
+			atomic.StoreInt32(&size, int32(o.UDPSize()))
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nbufsize 1232\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	f.proxies[0].host.resetFails()
+
+	for _, client := range []uint16{4096, 512} {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.SetEdns0(client, false)
+		if _, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, m); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if n := atomic.LoadInt32(&size); n != 1232 {
+			t.Errorf("Expected the upstream to see a bufsize of 1232 for a client with %d, got: %d", client, n)
+		}
+		if m.IsEdns0().UDPSize() != client {
+			t.Errorf("Expected the query of the client to keep its bufsize")
+		}
+	}
+
+	for _, input := range []string{"bufsize", "bufsize 511", "bufsize 70000", "bufsize 1232 1232"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestEDNSStrip(t *testing.T) {
+	var seen int32 // bit 0: padding, bit 1: NSID, bit 2: local option
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		bits := int32(0)
+		if o := r.IsEdns0(); o != nil {
+			for _, e := range o.Option {
+				switch e.Option() {
+				case dns.EDNS0PADDING:
+					bits |= 1
+				case dns.EDNS0NSID:
+					bits |= 2
+				case 65001:
+					bits |= 4
+				}
+			}
+		}
+		atomic.StoreInt32(&seen, bits)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(4096, false)
+		o := ret.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73"}, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}})
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nedns_strip query padding 65001\nedns_strip reply NSID\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	f.proxies[0].host.resetFails()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 8)}, &dns.EDNS0_NSID{Code: dns.EDNS0NSID}, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}})
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if bits := atomic.LoadInt32(&seen); bits != 2 {
+		t.Errorf("Expected the upstream to see only the NSID option, got: %b", bits)
+	}
+	if len(m.IsEdns0().Option) != 3 {
+		t.Errorf("Expected the query of the client to keep its options")
+	}
+	if rec.Msg == nil || rec.Msg.IsEdns0() == nil {
+		t.Fatalf("Expected a reply with EDNS0, got: %v", rec.Msg)
+	}
+	if opts := rec.Msg.IsEdns0().Option; len(opts) != 1 || opts[0].Option() != 65001 {
+		t.Errorf("Expected only the local option in the reply, got: %v", opts)
+	}
+
+	for _, input := range []string{"edns_strip", "edns_strip query", "edns_strip both nsid", "edns_strip reply foo", "edns_strip query 70000"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ParseProxies returns the proxies for the upstreams in to, written as in the Corefile, e.g.
+// "tls://9.9.9.9" or "8.8.8.8" followed by "weight=2". They can be given to AddProxy.
+func ParseProxies(to ...string) ([]*Proxy, error) { return parseUpstreams(to) }
+
+// AddProxy configures p with the settings of f and adds it to the upstreams. When f is started p is
+// health checked right away, otherwise that happens in OnStartup. Settings of f that are changed after
+// this don't apply to p.
+func (f *Forward) AddProxy(p *Proxy) {
+	f.configure(p)
+	p.host.id = f.id
+	p.host.exporter = f.exporter
+	p.host.log = f.log
+
+	f.Lock()
+	f.proxies = append(f.proxies[:len(f.proxies):len(f.proxies)], p)
+	if f.maxConnMem > 0 {
+		p.SetMaxConnMemory(f.maxConnMem / int64(len(f.proxies)))
+	}
+	running := f.running
+	f.Unlock()
+
+	if !running {
+		return
+	}
+	InstanceInfo.WithLabelValues(f.id, p.host.addr, p.host.tag).Set(1)
+	if p.hcInterval > 0 {
+		p.startHealthCheck()
+	} else {
+		p.host.resetFails()
+	}
+}
+
+// RemoveProxy removes the upstream with address addr. Its connections are closed once its exchanges
+// in progress are done.
+func (f *Forward) RemoveProxy(addr string) error {
+	f.Lock()
+	var proxies, gone []*Proxy
+	for _, p := range f.proxies {
+		if p.host.addr == addr {
+			gone = append(gone, p)
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+	if len(gone) > 0 {
+		f.proxies = proxies
+		for _, r := range f.routes {
+			delete(r.addrs, addr)
+		}
+	}
+	f.Unlock()
+
+	if len(gone) == 0 {
+		return fmt.Errorf("no proxy for %s", addr)
+	}
+	for _, p := range gone {
+		InstanceInfo.DeleteLabelValues(f.id, p.host.addr, p.host.tag)
+		go p.drain(drainTimeout)
+	}
+	return nil
+}
+
+// configure applies the settings of f to p.
+func (f *Forward) configure(p *Proxy) {
+	if _, ok := p.host.exch.(*grpcExchanger); ok {
+		p.tls = f.grpcTLS()
+	}
+	if d, ok := p.host.exch.(*doh); ok {
+		d.proxy = f.dohProxy
+		d.header = f.dohHeader
+		d.requestID = f.dohReqID
+	}
+	// Only set this for proxies that need it.
+	if p.tls {
+		cfg := f.tlsConfig
+		ca := f.tlsCA
+		if p.tlsCA != nil {
+			ca = p.tlsCA
+		}
+		cfg = cfg.Clone()
+		if cfg.ClientSessionCache == nil {
+			// Shared by the connections to p, so a new one can resume the TLS session of an earlier one.
+			cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		if p.tlsServerName != "" {
+			cfg.ServerName = p.tlsServerName
+		}
+		if p.tlsCert != nil {
+			cfg.Certificates, cfg.GetClientCertificate = nil, p.tlsCert.get
+		}
+		var verify func([][]byte, [][]*x509.Certificate) error
+		if len(p.tlsHashes) > 0 {
+			verify = verifyHashes(p.tlsHashes)
+		}
+		if ca != nil {
+			name := cfg.ServerName
+			if name == "" {
+				name, _, _ = net.SplitHostPort(p.host.addr)
+			}
+			cfg.InsecureSkipVerify = true // ca verifies, with the CA certificates as they are at the handshake
+			verify = ca.verify(name, verify)
+		}
+		if verify != nil {
+			cfg.VerifyPeerCertificate = verify
+		}
+		p.SetTLSConfig(cfg)
+	}
+	p.SetExpire(f.expire)
+	for proto, d := range f.protoExpire {
+		p.SetProtoExpire(proto, d)
+	}
+	p.SetMaxIdleConns(f.maxIdleConns)
+	p.SetTimeouts(f.dialTimeout, f.readTimeout, f.writeTimeout)
+	p.host.bind = f.bind
+	p.host.via = f.via
+	if f.preferUDP {
+		p.preferUDP = true
+	}
+	if f.noPoolUDP {
+		p.noPoolUDP = true
+	}
+	p.warmConns = f.warmConns
+	if f.forceTCP || f.via != nil {
+		p.forceTCP = true // UDP can't go through the proxy
+	}
+	if !p.ownLimit {
+		p.limit = newTokenBucket(f.maxQPS)
+	}
+	if !p.ownHcInterval {
+		p.hcInterval = f.hcInterval
+	}
+	p.hcBackoff = f.hcBackoff
+	p.hcJitter = f.hcJitter
+	p.hcSkipActive = f.hcSkipActive
+	p.host.probe = f.probe
+	p.host.hc = f.hc
+	p.host.rise = f.hcRise
+	if f.cookies {
+		p.host.cookie = newCookie()
+	}
+	if f.multiplex > 0 {
+		p.mux = newMux(p.host, f.multiplex)
+	}
+	p.host.ednsKeepalive = f.ednsKeepalive
+	p.host.padding = f.padding
+	p.host.proxyProtocol = f.proxyProtocol
+	p.host.randomCase = f.randomCase
+	p.host.servfails = f.servfailRate.clone()
+	p.host.failWindow = f.failWindow
+	if f.accountWindow > 0 {
+		p.host.meter = newMeter(f.accountWindow)
+	}
+}
+
+// SetTLSConfig sets the TLS config for the upstreams added after this that use TLS, e.g. tls://.
+func (f *Forward) SetTLSConfig(cfg *tls.Config) { f.tlsConfig = cfg }
+
+// SetMaxFails sets the number of failed health checks after which an upstream is down, 0 means never.
+func (f *Forward) SetMaxFails(n uint32) { f.maxfails = n }
+
+// SetExpire sets after how long cached connections of the upstreams added after this expire.
+func (f *Forward) SetExpire(expire time.Duration) { f.expire = expire }
+
+// SetTimeouts sets the dial, read and write timeouts of the upstreams added after this.
+func (f *Forward) SetTimeouts(dial, read, write time.Duration) {
+	f.dialTimeout, f.readTimeout, f.writeTimeout = dial, read, write
+}
+
+// SetHealthCheck sets the health check interval of the upstreams added after this, 0 disables health
+// checking.
+func (f *Forward) SetHealthCheck(interval time.Duration) { f.hcInterval = interval }
+
+// SetLogger makes f, and its upstreams, log to l instead of the CoreDNS log, at level and above.
+// Lines of the same event for the same upstream are logged at most once per rate, if rate is not 0.
+func (f *Forward) SetLogger(l Logger, level Level, rate time.Duration) {
+	if f.log == nil {
+		f.log = &logger{}
+	}
+	f.log.custom, f.log.level, f.log.rate = l, level, rate
+	if f.reporter != nil {
+		f.reporter.log = f.log
+	}
+	for _, p := range f.snapshot() {
+		p.host.log = f.log
+	}
+}
+
+// SetForceTCP makes f use TCP for all upstreams, even when the client used UDP.
+func (f *Forward) SetForceTCP(force bool) { f.forceTCP = force }
@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestEmbed(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetTimeouts(time.Second, 500*time.Millisecond, 500*time.Millisecond)
+	f.SetHealthCheck(100 * time.Millisecond)
+	proxies, err := ParseProxies(s.Addr, "tls://127.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	f.AddProxy(proxies[0])
+	if f.Len() != 1 {
+		t.Fatalf("Expected 1 upstream, got: %d", f.Len())
+	}
+	if h := proxies[0].host; h.readTimeout != 500*time.Millisecond || h.dialTimeout != time.Second {
+		t.Errorf("Expected the timeouts of the Forward, got: %s and %s", h.dialTimeout, h.readTimeout)
+	}
+
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// The health check brings the upstream up.
+	for i := 0; proxies[0].Down(f.maxfails); i++ {
+		if i > 100 {
+			t.Fatal("Expected the upstream to come up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.Forward(state); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	f.AddProxy(proxies[1])
+	if proxies[1].host.tlsConfig == nil {
+		t.Error("Expected the TLS upstream to get the TLS config of the Forward")
+	}
+	if f.Len() != 2 {
+		t.Errorf("Expected 2 upstreams, got: %d", f.Len())
+	}
+
+	if err := f.RemoveProxy(s.Addr); err != nil {
+		t.Errorf("Expected no error, got: %s", err)
+	}
+	if err := f.RemoveProxy(s.Addr); err == nil {
+		t.Error("Expected an error removing an unknown upstream")
+	}
+	if f.Len() != 1 {
+		t.Errorf("Expected 1 upstream, got: %d", f.Len())
+	}
+}
@@ -0,0 +1,120 @@
+package forward
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// errReporter sends DNS error reports (RFC 9567): a TXT query for
+// _er.QTYPE.QNAME.EDE._er.AGENT, resolved through the upstreams like any other query. Reports go to
+// the agent an upstream names in the Report-Channel option of a reply with an Extended DNS Error, and
+// for the failures we generate ourselves to agent, if set.
+type errReporter struct {
+	agent string // agent domain for our own failures, "" to only relay upstream channels
+
+	mu   sync.Mutex
+	sent map[string]time.Time // reports sent recently, not sent again until errReportHold has passed
+}
+
+func newErrReporter(agent string) *errReporter {
+	return &errReporter{agent: agent, sent: make(map[string]time.Time)}
+}
+
+// reportQname returns the name of the report for state with EDE code, to agent. It returns "" if
+// the name would be too long.
+func reportQname(state request.Request, code uint16, agent string) string {
+	qname := "_er." + strconv.Itoa(int(state.QType())) + "." + strings.ToLower(state.Name()) +
+		strconv.Itoa(int(code)) + "._er." + dns.Fqdn(agent)
+	if len(qname) > 254 {
+		return ""
+	}
+	return qname
+}
+
+// isReport returns true if state is an error report itself, these are never reported on.
+func isReport(state request.Request) bool {
+	return strings.HasPrefix(strings.ToLower(state.Name()), "_er.")
+}
+
+// fromReply reports the Extended DNS Error in ret, when ret also has a Report-Channel option.
+func (f *Forward) fromReply(state request.Request, ret *dns.Msg) {
+	opt := ret.IsEdns0()
+	if opt == nil || isReport(state) {
+		return
+	}
+	var (
+		agent string
+		code  = -1
+	)
+	for _, o := range opt.Option {
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok {
+			continue
+		}
+		switch l.Code {
+		case edeOption:
+			if len(l.Data) >= 2 && code < 0 {
+				code = int(binary.BigEndian.Uint16(l.Data))
+			}
+		case reportChannelOption:
+			if name, _, err := dns.UnpackDomainName(l.Data, 0); err == nil && name != "." {
+				agent = name
+			}
+		}
+	}
+	if agent == "" || code < 0 {
+		return
+	}
+	f.sendReport(state, uint16(code), agent, "upstream")
+}
+
+// ownFailure reports a failure we generated for state, with EDE code, to our own agent.
+func (f *Forward) ownFailure(state request.Request, code uint16) {
+	if f.errReport.agent == "" || isReport(state) {
+		return
+	}
+	f.sendReport(state, code, f.errReport.agent, "local")
+}
+
+// sendReport sends the report for state to agent in the background, unless it was sent recently.
+func (f *Forward) sendReport(state request.Request, code uint16, agent, source string) {
+	qname := reportQname(state, code, agent)
+	if qname == "" {
+		return
+	}
+
+	r := f.errReport
+	now := time.Now()
+	r.mu.Lock()
+	if t, ok := r.sent[qname]; ok && now.Sub(t) < errReportHold {
+		r.mu.Unlock()
+		return
+	}
+	if len(r.sent) >= maxErrReports {
+		r.sent = make(map[string]time.Time)
+	}
+	r.sent[qname] = now
+	r.mu.Unlock()
+
+	ErrorReportCount.WithLabelValues(f.id, source).Add(1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeTXT)
+		f.forward(context.Background(), request.Request{W: nopWriter{}, Req: req})
+	}()
+}
+
+const (
+	reportChannelOption = 18 // EDNS0 option code of the Report-Channel (RFC 9567)
+
+	errReportHold = 10 * time.Minute
+	maxErrReports = 1024
+)
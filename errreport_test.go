@@ -0,0 +1,73 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestErrorReporting(t *testing.T) {
+	reports := make(chan string, 10)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeTXT {
+			reports <- r.Question[0].Name
+			w.WriteMsg(ret)
+			return
+		}
+		ret.Rcode = dns.RcodeServerFailure
+		ret.SetEdns0(4096, false)
+		agent := make([]byte, 32)
+		n, _ := dns.PackDomainName("agent.example.net.", agent, 0, nil, false)
+		opt := ret.IsEdns0()
+		opt.Option = append(opt.Option, newEDE(6, "DNSSEC Bogus"), &dns.EDNS0_LOCAL{Code: reportChannelOption, Data: agent[:n]})
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.errReport = newErrReporter("")
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("Bogus.example.org.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		f.ServeDNS(context.TODO(), &test.ResponseWriter{}, m)
+	}
+
+	select {
+	case q := <-reports:
+		if expected := "_er.1.bogus.example.org.6._er.agent.example.net."; q != expected {
+			t.Errorf("Expected report %s, got %s", expected, q)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a report")
+	}
+	select {
+	case q := <-reports:
+		t.Errorf("Expected one report, got another: %s", q)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReportQname(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeAAAA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	if q, expected := reportQname(state, edeNetworkError, "agent.example.net"), "_er.28.example.org.23._er.agent.example.net."; q != expected {
+		t.Errorf("Expected %s, got %s", expected, q)
+	}
+
+	m.SetQuestion("_er.1.example.org.6._er.agent.example.net.", dns.TypeTXT)
+	if !isReport(state) {
+		t.Errorf("Expected %s to be a report", m.Question[0].Name)
+	}
+}
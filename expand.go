@@ -0,0 +1,71 @@
+package forward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// expandTo expands environment variables and IPv4 address ranges in the upstreams in to. A
+// variable may hold several upstreams separated by spaces or commas. A range is written as
+// 10.0.0.1-10.0.0.4, optionally with a scheme and a port: tls://10.0.0.1-10.0.0.4:853.
+func expandTo(to []string) ([]string, error) {
+	var out []string
+	for _, t := range to {
+		if strings.Contains(t, "$") {
+			t = os.ExpandEnv(t)
+		}
+		for _, u := range strings.FieldsFunc(t, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			addrs, err := expandRange(u)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, addrs...)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no upstreams after expanding: %v", to)
+	}
+	return out, nil
+}
+
+// expandRange returns the upstreams in the range in s, or s itself if it isn't a range.
+func expandRange(s string) ([]string, error) {
+	scheme, rest := "", s
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, rest = s[:i+3], s[i+3:]
+	}
+	addr, port := rest, ""
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		addr, port = rest[:i], rest[i:]
+	}
+	i := strings.Index(addr, "-")
+	if i < 0 {
+		return []string{s}, nil
+	}
+	first, last := net.ParseIP(addr[:i]).To4(), net.ParseIP(addr[i+1:]).To4()
+	if first == nil || last == nil {
+		return []string{s}, nil // a name with a dash
+	}
+
+	from, to := binary.BigEndian.Uint32(first), binary.BigEndian.Uint32(last)
+	if to < from {
+		return nil, fmt.Errorf("invalid address range: %s", s)
+	}
+	if to-from >= maxRange {
+		return nil, fmt.Errorf("address range larger than %d: %s", maxRange, s)
+	}
+
+	addrs := make([]string, 0, to-from+1)
+	for a := from; a <= to; a++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, a)
+		addrs = append(addrs, scheme+ip.String()+port)
+	}
+	return addrs, nil
+}
+
+// maxRange is the maximum number of addresses a range may expand to.
+const maxRange = 256
@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Exporter receives the key measurements of the forwarder. The Prometheus metrics are always
+// updated, exporters can be added with SetExporter to feed different telemetry stacks.
+type Exporter interface {
+	// Request is called for every completed exchange with upstream to of the Forward with ID id.
+	Request(id, to, rcode string, d time.Duration)
+	// HealthcheckFailure is called for every failed health check of upstream to.
+	HealthcheckFailure(id, to string)
+	// Sockets is called with the number of cached connections to upstream to when that changes.
+	Sockets(id, to string, n int)
+}
+
+// request records an exchange with h that returned rcode after d, in the Prometheus metrics under the
+// ID of the Forward of h and in the exporters of h.
+func (h *host) request(rcode string, d time.Duration) {
+	RequestCount.WithLabelValues(h.id, h.addr).Add(1)
+	RcodeCount.WithLabelValues(h.id, rcode, h.addr).Add(1)
+	RequestDuration.WithLabelValues(h.id, h.addr).Observe(d.Seconds())
+	h.exporter.Request(h.id, h.addr, rcode, d)
+}
+
+// healthcheckFailure records a failed health check of h.
+func (h *host) healthcheckFailure() {
+	HealthcheckFailureCount.WithLabelValues(h.id, h.addr).Add(1)
+	h.exporter.HealthcheckFailure(h.id, h.addr)
+}
+
+// sockets records that h has n cached connections.
+func (h *host) sockets(n int) {
+	SocketGauge.WithLabelValues(h.id, h.addr).Set(float64(n))
+	h.exporter.Sockets(h.id, h.addr, n)
+}
+
+// multiExporter sends to all its exporters.
+type multiExporter []Exporter
+
+func (m multiExporter) Request(id, to, rcode string, d time.Duration) {
+	for _, e := range m {
+		e.Request(id, to, rcode, d)
+	}
+}
+
+func (m multiExporter) HealthcheckFailure(id, to string) {
+	for _, e := range m {
+		e.HealthcheckFailure(id, to)
+	}
+}
+
+func (m multiExporter) Sockets(id, to string, n int) {
+	for _, e := range m {
+		e.Sockets(id, to, n)
+	}
+}
+
+// SetExporter adds e to the exporters of f, the Prometheus metrics are still updated.
+func (f *Forward) SetExporter(e Exporter) {
+	f.addExporter(e)
+	for _, p := range f.snapshot() {
+		p.host.exporter = f.exporter
+	}
+}
+
+// addExporter adds e to the exporters of f.
+func (f *Forward) addExporter(e Exporter) {
+	if m, ok := f.exporter.(multiExporter); ok {
+		f.exporter = append(m[:len(m):len(m)], e)
+		return
+	}
+	f.exporter = multiExporter{f.exporter, e}
+}
+
+// statsdExporter sends metrics in the StatsD line protocol over UDP.
+type statsdExporter struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsdExporter returns an Exporter that sends to the StatsD server at addr. Metric names are
+// prefixed with prefix and end in the ID of the Forward and the upstream, as in
+// prefix.request_count.ID.TO.
+func NewStatsdExporter(addr, prefix string) (Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdExporter{conn: conn, prefix: prefix}, nil
+}
+
+func (s *statsdExporter) Request(id, to, rcode string, d time.Duration) {
+	to = statsdName(id) + "." + statsdName(to)
+	s.send(fmt.Sprintf("%s.request_count.%s:1|c\n%s.rcode_count.%s.%s:1|c\n%s.request_duration.%s:%d|ms",
+		s.prefix, to, s.prefix, to, statsdName(rcode), s.prefix, to, d/time.Millisecond))
+}
+
+func (s *statsdExporter) HealthcheckFailure(id, to string) {
+	s.send(fmt.Sprintf("%s.healthcheck_failure_count.%s.%s:1|c", s.prefix, statsdName(id), statsdName(to)))
+}
+
+func (s *statsdExporter) Sockets(id, to string, n int) {
+	s.send(fmt.Sprintf("%s.socket_count.%s.%s:%d|g", s.prefix, statsdName(id), statsdName(to), n))
+}
+
+// send writes line, errors are ignored, metrics are best effort.
+func (s *statsdExporter) send(line string) { s.conn.Write([]byte(line)) }
+
+// statsdName makes s usable as a component in a StatsD metric name.
+func statsdName(s string) string { return statsdReplacer.Replace(s) }
+
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", "[", "", "]", "")
@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdExporter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	e, err := NewStatsdExporter(pc.LocalAddr().String(), "coredns.forward")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	read := func() string {
+		buf := make([]byte, 1500)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected a datagram, got: %s", err)
+		}
+		return string(buf[:n])
+	}
+
+	e.Request("main", "10.0.0.1:53", "NOERROR", 12*time.Millisecond)
+	want := "coredns.forward.request_count.main.10_0_0_1_53:1|c\n" +
+		"coredns.forward.rcode_count.main.10_0_0_1_53.NOERROR:1|c\n" +
+		"coredns.forward.request_duration.main.10_0_0_1_53:12|ms"
+	if x := read(); x != want {
+		t.Errorf("Expected %q, got %q", want, x)
+	}
+
+	e.HealthcheckFailure("other.zone", "[::1]:853")
+	if x, want := read(), "coredns.forward.healthcheck_failure_count.other_zone.__1_853:1|c"; x != want {
+		t.Errorf("Expected %q, got %q", want, x)
+	}
+
+	e.Sockets("main", "10.0.0.1:53", 3)
+	if x, want := read(), "coredns.forward.socket_count.main.10_0_0_1_53:3|g"; x != want {
+		t.Errorf("Expected %q, got %q", want, x)
+	}
+}
@@ -0,0 +1,99 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// happyEyeballsDelay is the default delay of happy_eyeballs, the connection attempt delay of RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// eyeball returns the proxy to send state to. That's proxy, unless it has no cached connection and
+// dialing one takes longer than the happy_eyeballs delay: then the next upstream in rest that is up
+// is dialed as well, and so on after each delay, or right away when a dial fails. The first to
+// connect wins, its connection is cached for the exchange and the other dials are canceled. If all
+// fail, the error of the first is returned.
+func (f *Forward) eyeball(ctx context.Context, state request.Request, proxy *Proxy, rest []*Proxy, forceTCP bool) (*Proxy, error) {
+	proto := proxy.proto(state, forceTCP)
+	if !proxy.canRace(proto) || proxy.transport.has(proto) {
+		return proxy, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // the losers' connections go to their caches if they still come up
+	type dialed struct {
+		p   *Proxy
+		c   *dns.Conn
+		err error
+	}
+	results := make(chan dialed, len(rest)+1) // buffered, the losers don't block
+	dial := func(p *Proxy, proto string) {
+		go func() {
+			c, err := p.DialContext(ctx, proto)
+			results <- dialed{p, c, err}
+		}()
+	}
+	// next starts the dial of the next upstream in rest that can be raced, and returns false if there
+	// is none.
+	next := func() bool {
+		for len(rest) > 0 {
+			p := rest[0]
+			rest = rest[1:]
+			if proto := p.proto(state, forceTCP); p.canRace(proto) && !p.Down(f.maxfails) && !p.throttled() {
+				dial(p, proto)
+				return true
+			}
+		}
+		return false
+	}
+
+	dial(proxy, proto)
+	pending := 1
+	timer := time.NewTimer(f.happyEyeballs)
+	defer timer.Stop()
+	var first error
+	for {
+		select {
+		case <-timer.C:
+			if next() {
+				pending++
+				timer.Reset(f.happyEyeballs)
+			}
+		case d := <-results:
+			pending--
+			if d.err == nil {
+				d.p.Yield(d.c)
+				return d.p, nil
+			}
+			if first == nil {
+				first = d.err
+			}
+			if next() {
+				pending++
+				timer.Reset(f.happyEyeballs)
+			}
+			if pending == 0 {
+				return proxy, first
+			}
+		}
+	}
+}
+
+// canRace returns true if p makes connections of type proto that eyeball can dial ahead of the
+// exchange: over TCP or TLS, cached, and one per query.
+func (p *Proxy) canRace(proto string) bool {
+	return proto != "udp" && p.host.exch == nil && p.mdns == nil && p.mux == nil && p.host.chain == nil &&
+		!p.stateless && !p.host.proxyProtocol
+}
+
+// has returns true if t has a cached conn of type proto.
+func (t *transport) has(proto string) bool {
+	s := t.shard(proto)
+	s.Lock()
+	defer s.Unlock()
+	return len(s.conns) > 0
+}
@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// blackhole is a Dialer whose dials never connect, as when the SYNs are dropped.
+type blackhole struct{}
+
+func (blackhole) DialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, errors.New("dial " + addr + ": i/o timeout")
+}
+
+// refuse is a Dialer whose dials fail right away.
+type refuse int
+
+func (r refuse) DialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("refused %d", r)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 192.0.2.1 "+s.Addr+" {\npolicy sequential\nforce_tcp\nhappy_eyeballs 50ms\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	if f.happyEyeballs != 50*time.Millisecond {
+		t.Fatalf("Expected a delay of 50ms, got %s", f.happyEyeballs)
+	}
+	f.proxies[0].SetDialer(blackhole{})
+	for _, p := range f.proxies {
+		p.host.resetFails()
+	}
+
+	start := time.Now()
+	_, info, err := f.ForwardWithInfo(questionState("example.org."))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if info.Upstream != s.Addr {
+		t.Errorf("Expected %s to answer, got %s", s.Addr, info.Upstream)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the query not to wait for the dial timeout, took %s", d)
+	}
+
+	// When all dials fail, the next one is dialed right away and the error of the first is returned.
+	g, err := parseForward(caddy.NewTestController("dns", "forward . 192.0.2.1 192.0.2.2 {\nhappy_eyeballs 1h\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer g.Close()
+	for i, p := range g.proxies {
+		p.SetDialer(refuse(i))
+		p.host.resetFails()
+	}
+	if _, err := g.eyeball(context.Background(), questionState("example.org."), g.proxies[0], g.proxies[1:], true); err == nil || err.Error() != "refused 0" {
+		t.Errorf("Expected the error of the first dial, got: %v", err)
+	}
+
+	for _, input := range []string{"happy_eyeballs 0s", "happy_eyeballs 1s 2s"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// fallback is an ordered list of transports for an upstream. When the preferred transport can't
+// connect, the next one is tried. The one that works is used until we re-probe the one above it.
+type fallback struct {
+	protos []string // "tcp-tls", "tcp" or "udp", most preferred first
+
+	sync.Mutex
+	cur    int       // index in protos of the transport in use
+	probed time.Time // last time we tried to move up
+}
+
+// newFallback returns a fallback for the transports in names, which are "tls", "tcp" or "udp".
+func newFallback(names []string) (*fallback, error) {
+	fb := &fallback{}
+	for _, n := range names {
+		proto := n
+		switch n {
+		case "tls":
+			proto = "tcp-tls"
+		case "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("unsupported transport in fallback: %s", n)
+		}
+		if fb.has(proto) {
+			return nil, fmt.Errorf("duplicate transport in fallback: %s", n)
+		}
+		fb.protos = append(fb.protos, proto)
+	}
+	return fb, nil
+}
+
+func (fb *fallback) has(proto string) bool {
+	for _, p := range fb.protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the transport in use.
+func (fb *fallback) current() string {
+	fb.Lock()
+	defer fb.Unlock()
+	return fb.protos[fb.cur]
+}
+
+// candidates returns the transports to try, in order. Every fallbackReprobe this includes the
+// transport above the one in use.
+func (fb *fallback) candidates() []string {
+	fb.Lock()
+	defer fb.Unlock()
+
+	start := fb.cur
+	if fb.cur > 0 && time.Since(fb.probed) > fallbackReprobe {
+		fb.probed = time.Now()
+		start--
+	}
+	return fb.protos[start:]
+}
+
+// working records that proto could connect. If that is a switch, the transport used until now is
+// returned, otherwise "".
+func (fb *fallback) working(proto string) string {
+	fb.Lock()
+	defer fb.Unlock()
+
+	for i, p := range fb.protos {
+		if p != proto || i == fb.cur {
+			continue
+		}
+		from := fb.protos[fb.cur]
+		fb.cur = i
+		fb.probed = time.Now()
+		return from
+	}
+	return ""
+}
+
+// dialAddr returns the address to dial for proto. With a fallback the TLS and plain DNS ports differ,
+// so 853 and 53 are swapped as needed.
+func (h *host) dialAddr(proto string) string {
+	if h.chain == nil {
+		return h.addr
+	}
+	host, port, err := net.SplitHostPort(h.addr)
+	if err != nil {
+		return h.addr
+	}
+	switch {
+	case proto == "tcp-tls" && port == "53":
+		port = "853"
+	case proto != "tcp-tls" && port == "853":
+		port = "53"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+const fallbackReprobe = 30 * time.Second
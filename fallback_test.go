@@ -0,0 +1,48 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFallback(t *testing.T) {
+	fb, err := newFallback([]string{"tls", "tcp", "udp"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if x := fb.current(); x != "tcp-tls" {
+		t.Errorf("Expected tcp-tls, got: %s", x)
+	}
+
+	fb.working("tcp")
+	if x := fb.current(); x != "tcp" {
+		t.Errorf("Expected tcp, got: %s", x)
+	}
+	if c := fb.candidates(); len(c) != 2 || c[0] != "tcp" {
+		t.Errorf("Expected to try tcp and udp, got: %v", c)
+	}
+
+	fb.probed = time.Now().Add(-2 * fallbackReprobe)
+	if c := fb.candidates(); len(c) != 3 || c[0] != "tcp-tls" {
+		t.Errorf("Expected to re-probe tcp-tls, got: %v", c)
+	}
+
+	if _, err := newFallback([]string{"quic", "tcp"}); err == nil {
+		t.Errorf("Expected error for unsupported transport, got none")
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	h := newHost("9.9.9.9:853")
+	if x := h.dialAddr("tcp"); x != "9.9.9.9:853" {
+		t.Errorf("Expected address to be unchanged without fallback, got: %s", x)
+	}
+
+	h.chain, _ = newFallback([]string{"tls", "tcp"})
+	if x := h.dialAddr("tcp"); x != "9.9.9.9:53" {
+		t.Errorf("Expected 9.9.9.9:53, got: %s", x)
+	}
+	if x := h.dialAddr("tcp-tls"); x != "9.9.9.9:853" {
+		t.Errorf("Expected 9.9.9.9:853, got: %s", x)
+	}
+}
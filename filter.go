@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The opcodes and classes forwarded when opcodes or classes aren't set.
+var (
+	defaultOpcodes = map[int]bool{dns.OpcodeQuery: true}
+	defaultClasses = map[uint16]bool{dns.ClassINET: true}
+)
+
+// filtered returns the rcode to answer r with instead of forwarding it and why, or false if r is
+// forwarded. Opcodes without opcodes get NOTIMP, classes not in classes get REFUSED.
+func (f *Forward) filtered(r *dns.Msg) (int, string, bool) {
+	opcodes := f.opcodes
+	if opcodes == nil {
+		opcodes = defaultOpcodes
+	}
+	if !opcodes[r.Opcode] {
+		return dns.RcodeNotImplemented, "opcode", true
+	}
+	if len(r.Question) == 0 {
+		return 0, "", false
+	}
+	classes := f.classes
+	if classes == nil {
+		classes = defaultClasses
+	}
+	if !classes[r.Question[0].Qclass] {
+		return dns.RcodeRefused, "class", true
+	}
+	return 0, "", false
+}
+
+// parseOpcode returns the opcode named s, which may also be a number.
+func parseOpcode(s string) (int, error) {
+	if op, ok := dns.StringToOpcode[strings.ToUpper(s)]; ok {
+		return op, nil
+	}
+	op, err := strconv.Atoi(s)
+	if err != nil || op < 0 || op > 15 {
+		return 0, fmt.Errorf("unknown opcode: %s", s)
+	}
+	return op, nil
+}
+
+// parseClass returns the class named s, which may also be a number.
+func parseClass(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if s == "CHAOS" {
+		s = "CH"
+	}
+	if cl, ok := dns.StringToClass[s]; ok {
+		return cl, nil
+	}
+	cl, err := strconv.ParseUint(strings.TrimPrefix(s, "CLASS"), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown class: %s", s)
+	}
+	return uint16(cl), nil
+}
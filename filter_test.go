@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestFiltered(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	update := new(dns.Msg)
+	update.SetUpdate("example.org.")
+	notify := new(dns.Msg)
+	notify.SetNotify("example.org.")
+	chaos := new(dns.Msg)
+	chaos.SetQuestion("version.bind.", dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	in := new(dns.Msg)
+	in.SetQuestion("example.org.", dns.TypeA)
+
+	tests := []struct {
+		options string
+		req     *dns.Msg
+		rcode   int
+	}{
+		{"", in, dns.RcodeSuccess},
+		{"", update, dns.RcodeNotImplemented},
+		{"", notify, dns.RcodeNotImplemented},
+		{"", chaos, dns.RcodeRefused},
+		{"opcodes QUERY NOTIFY", notify, dns.RcodeSuccess},
+		{"opcodes QUERY NOTIFY", update, dns.RcodeNotImplemented},
+		{"classes IN CHAOS", chaos, dns.RcodeSuccess},
+		{"classes CH", in, dns.RcodeRefused},
+	}
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\n"+tc.options+"\n}\n"))
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		f.proxies[0].host.resetFails()
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, tc.req); err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Errorf("Test %d: expected %s, got: %v", i, dns.RcodeToString[tc.rcode], rec.Msg)
+		}
+		f.Close()
+	}
+
+	for _, input := range []string{"opcodes", "opcodes QUERY FOO", "opcodes 16", "classes", "classes IN FOO"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
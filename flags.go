@@ -0,0 +1,21 @@
+package forward
+
+import "github.com/miekg/dns"
+
+// normalizeFlags makes the header of ret, the reply to req, what the RFCs ask of a resolver that
+// doesn't validate: RD (RFC 1035) and CD (RFC 4035) are those of req, AD is only kept when req has AD
+// or DO set (RFC 6840), and the DO bit of the OPT RR is that of req (RFC 3225).
+func normalizeFlags(req, ret *dns.Msg) {
+	ret.RecursionDesired = req.RecursionDesired
+	ret.CheckingDisabled = req.CheckingDisabled
+	do := false
+	if o := req.IsEdns0(); o != nil {
+		do = o.Do()
+	}
+	if !req.AuthenticatedData && !do {
+		ret.AuthenticatedData = false
+	}
+	if o := ret.IsEdns0(); o != nil {
+		o.SetDo(do)
+	}
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestNormalizeFlags(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.RecursionDesired = true
+		ret.CheckingDisabled = true
+		ret.AuthenticatedData = true
+		ret.SetEdns0(4096, true)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nreply_flags normalize\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	f.proxies[0].host.resetFails()
+
+	tests := []struct {
+		rd, ad, do bool
+		wantAD     bool
+	}{
+		{false, false, false, false},
+		{true, true, false, true},
+		{true, false, true, true},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.RecursionDesired = tc.rd
+		m.AuthenticatedData = tc.ad
+		m.SetEdns0(4096, tc.do)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		ret := rec.Msg
+		if ret.Id != m.Id || ret.RecursionDesired != tc.rd || ret.CheckingDisabled || ret.AuthenticatedData != tc.wantAD {
+			t.Errorf("Test %d: expected ID %d, RD %t, no CD and AD %t, got: %s", i, m.Id, tc.rd, tc.wantAD, ret)
+		}
+		if o := ret.IsEdns0(); o == nil || o.Do() != tc.do {
+			t.Errorf("Test %d: expected DO %t, got: %v", i, tc.do, o)
+		}
+	}
+
+	for _, input := range []string{"reply_flags", "reply_flags strict", "reply_flags normalize preserve"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestPooledConnID(t *testing.T) {
+	// The first query gets its reply twice, the second copy is still on the cached socket when the
+	// next query is sent over it.
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+		if atomic.AddInt32(&queries, 1) == 1 {
+			w.WriteMsg(ret)
+		}
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	p.host.expire = time.Minute
+	defer p.close()
+	hits := counterValue(ConnCacheHits, p.host.id, s.Addr, "udp")
+
+	for i, id := range []uint16{1000, 2000} {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		state.Req.Id = id
+		ret, err := p.connect(context.Background(), state, false, false)
+		if err != nil {
+			t.Fatalf("Query %d: expected no error, got: %s", i, err)
+		}
+		if ret.Id != id {
+			t.Errorf("Query %d: expected ID %d, got: %d", i, id, ret.Id)
+		}
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond) // let the second copy arrive
+		}
+	}
+	if x := counterValue(ConnCacheHits, p.host.id, s.Addr, "udp"); x != hits+1 {
+		t.Errorf("Expected the second query to use the cached socket, got %f hits", x-hits)
+	}
+}
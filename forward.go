@@ -7,11 +7,16 @@ package forward
 import (
 	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
@@ -22,36 +27,193 @@ import (
 // Forward represents a plugin instance that can proxy requests to another (DNS) server. It has a list
 // of proxies each representing one upstream proxy.
 type Forward struct {
+	concurrent int64 // number of queries being forwarded, first for 64 bit alignment
+
 	proxies []*Proxy
 
-	from    string
-	ignored []string
+	id string // identifies this instance in logs and metrics
+
+	from          string
+	ignored       []string
+	exceptClients clientNets // queries from these clients aren't forwarded
+	clients       clientNets // if not empty, only queries from these clients are forwarded
+
+	opcodes map[int]bool    // the opcodes forwarded, nil for defaultOpcodes
+	classes map[uint16]bool // the classes forwarded, nil for defaultClasses
 
 	tlsConfig     *tls.Config
 	tlsServerName string
+	tlsCA         *caFile // if not nil, verify the upstreams with these CA certificates instead of tlsConfig.RootCAs
 	maxfails      uint32
 	expire        time.Duration
+	dialTimeout   time.Duration
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	bind          *bind                    // if not nil, where connections to the upstreams are made from
+	via           *via                     // if not nil, the proxy server connections to the upstreams go through
+	maxConnMem    int64                    // cap for all cached connections, split evenly over the proxies
+	maxIdleConns  int                      // cap for the cached connections per proxy and protocol
+	protoExpire   map[string]time.Duration // overrides expire per protocol
+	accountWindow time.Duration            // window for the peak QPS, 0 means accountingWindow
+
+	dohProxy  func(*http.Request) (*url.URL, error) // if not nil, the HTTP proxy of the DoH upstreams instead of HTTPS_PROXY
+	dohHeader http.Header                           // extra headers of the requests to the DoH upstreams
+	dohReqID  string                                // if not empty, the header with a request ID sent to the DoH upstreams
+
+	forceTCP     bool          // also here for testing
+	preferUDP    bool          // query the upstreams over UDP even when the client used TCP
+	noPoolUDP    bool          // don't cache UDP sockets, every query gets a new source port
+	warmConns    int           // connections kept dialed to each upstream, 0 for none
+	hcInterval   time.Duration // also here for testing
+	hc           *hcQuery      // if not nil, the health check query of the upstreams
+	hcBackoff    time.Duration // if set, back off health checks of failing upstreams up to this interval
+	hcJitter     float64       // fraction by which health check intervals are randomly spread
+	hcSkipActive bool          // skip the health checks of upstreams that answer queries
+	hcStartup    time.Duration // if > 0, OnStartup waits at most this long for the first health checks
+	hcRise       uint32        // if > 1, successful checks in a row needed to bring an upstream back
+	failWindow   time.Duration // if > 0, fails older than this don't count
+
+	servfailRate *servfailRate // if not nil, upstreams replying with too many SERVFAILs are down
+
+	prefetchTTL uint32 // if > 0, answers with a lower TTL trigger a prefetch hint
+	minTTL      uint32 // if > 0, lower TTLs in the replies are raised to this
+	maxTTL      uint32 // if > 0, higher TTLs in the replies are lowered to this
+	prefetch    PrefetchFunc
+
+	preForward    PreForwardFunc
+	postForward   PostForwardFunc
+	responseHooks []ResponseHook
+	queryFunc     QueryFunc
+
+	exporter Exporter
+	reporter *reporter
+	probe    *probe
+
+	auditPercent  float64       // percentage of queries that are also sent to another upstream for comparison
+	auditInflight chan struct{} // bounds the number of outstanding audits
+	canary        *canary
+
+	bg       context.Context // canceled on shutdown, for the work that outlives a query, e.g. audits
+	bgCancel context.CancelFunc
+
+	splitGroup   string // group that receives splitPercent of the queries, protected by the mutex
+	splitPercent float64
+
+	admission *admission
+
+	maxConcurrent int64 // if > 0, queries beyond this many in flight are answered with rejectRcode
+	rejectRcode   int
+
+	maxQPS        float64 // if > 0, queries per second each upstream gets at most
+	throttleRcode int     // the answer when all upstreams are at their max_qps
+
+	noHealthyRcode int    // the answer when no upstream is healthy
+	noHealthyTTL   uint32 // with NOERROR, the negative TTL of the SOA record in the answer
+
+	coalesce *coalescer // if not nil, identical queries in flight share one exchange
+	ecs      *ecs       // if not nil, what to do with the EDNS Client Subnet option of the queries
+	bufsize  uint16     // if > 0, the EDNS0 UDP payload size advertised to the upstreams
+	cookies  bool       // send DNS cookies to the upstreams
+
+	stripQuery map[uint16]bool // EDNS0 options of the clients removed from the queries
+	stripReply map[uint16]bool // EDNS0 options of the upstreams removed from the replies
+
+	normalize bool // make the RD, CD, AD and DO flags of the replies follow the queries
+
+	multiplex     int  // if > 0, multiplex TCP and TLS queries over at most this many connections per upstream
+	ednsKeepalive bool // send the edns-tcp-keepalive option over TCP and TLS, and honor the reply
+	padding       int  // if > 0, pad the queries over encrypted transports to a multiple of this
+	proxyProtocol bool // send the client's address to the upstreams in a PROXY protocol v2 header
+	randomCase    bool // randomize the case of the query names over UDP (0x20)
+
+	routes []*route // subdomains of from that go to a subset of the upstreams
+	policy Policy   // orders the upstreams for each query, protected by the mutex
+
+	buckets []float64 // bounds in seconds of the request_duration_seconds histogram, nil for the default
+
+	netWatch   bool          // flush connections when the network changes
+	bootstrap  *bootstrap    // resolves upstreams given by hostname
+	preferIP   string        // family of the addresses used for upstreams given by hostname: "v4", "v6" or "any"
+	dhcp       *dhcp         // if not nil, upstreams are also learned from DHCP leases
+	srv        []string      // names of the srv:// upstreams, their targets are learned at run time
+	resolvConf *dhcp         // if not nil, the resolv.conf files given as upstreams, which are watched
+	stop       chan struct{} // closed on shutdown to stop the network watcher and re-resolution
+
+	rcodes        map[int]string // what to do with replies with these rcodes, see rcodeAction
+	fallThrough   fall.F         // names handed to the next plugin when no upstream could answer them
+	hedge         time.Duration  // if not 0, also ask the next upstream when no reply came within this time
+	happyEyeballs time.Duration  // if not 0, also dial the next upstream when a dial takes longer than this
+
+	maxRetries   int           // times an exchange with an upstream that timed out is tried again
+	queryTimeout time.Duration // if not 0, the time all exchanges of a query must be done in
 
-	forceTCP   bool          // also here for testing
-	hcInterval time.Duration // also here for testing
+	strict bool // reject configuration problems instead of warning about them
+
+	log     *logger  // nil logs text
+	redact  redactor // what to hide of queries and clients in logs
+	privacy bool     // keep no query names or client addresses, only aggregates
+
+	tapPayload string // "full" or "metadata" to override whether the dnstap plugin packs messages
+
+	errReport *errReporter // if not nil, send DNS error reports
+
+	spoofLog  uint64 // log every spoofLog-th mismatched reply, 0 disables logging
+	spoofSeen uint64
 
 	Next plugin.Handler
+
+	admin       string       // address of the admin endpoint, "" if there is none
+	adminServer *http.Server // serves the admin endpoint while running
+
+	running   bool     // OnStartup was called and OnShutdown wasn't, protected by the mutex
+	successor *Forward // if not nil, the instance that adopted this one, protected by the mutex
+
+	sync.RWMutex // protects proxies, which is replaced, not modified, on update
 }
 
 // New returns a new Forward.
 func New() *Forward {
-	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: 10 * time.Second, hcInterval: hcDuration}
+	f := &Forward{id: "forward", exporter: multiExporter{}, maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire,
+		dialTimeout: dialTimeout, readTimeout: timeout, writeTimeout: timeout, hcInterval: hcDuration, redact: defaultRedactor, policy: random{},
+		throttleRcode: dns.RcodeRefused, noHealthyRcode: dns.RcodeServerFailure,
+		auditInflight: make(chan struct{}, maxAuditInflight)}
+	f.bg, f.bgCancel = context.WithCancel(context.Background())
 	return f
 }
 
+// ID returns the identifier of f.
+func (f *Forward) ID() string { return f.id }
+
 // SetProxy appends p to the proxy list and starts healthchecking.
 func (f *Forward) SetProxy(p *Proxy) {
-	f.proxies = append(f.proxies, p)
-	go p.healthCheck()
+	p.host.id = f.id
+	p.host.exporter = f.exporter
+	p.host.log = f.log
+	f.Lock()
+	f.proxies = append(f.proxies[:len(f.proxies):len(f.proxies)], p)
+	f.Unlock()
+	p.startHealthCheck()
+}
+
+// Reset closes all cached upstream connections and forgets the failed health checks of the upstreams:
+// the next queries will use freshly dialed connections and may go to any upstream. This is useful
+// when the caller knows the network has changed.
+func (f *Forward) Reset() {
+	for _, p := range f.snapshot() {
+		p.Reset()
+		p.host.resetFails()
+	}
 }
 
 // Len returns the number of configured proxies.
-func (f *Forward) Len() int { return len(f.proxies) }
+func (f *Forward) Len() int { return len(f.snapshot()) }
+
+// snapshot returns the current proxies, the returned slice must not be modified.
+func (f *Forward) snapshot() []*Proxy {
+	f.RLock()
+	defer f.RUnlock()
+	return f.proxies
+}
 
 // Name implements plugin.Handler.
 func (f *Forward) Name() string { return "forward" }
@@ -63,21 +225,155 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 	if !f.match(state) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 	}
+	ctx = withTapper(ctx)
+
+	if rcode, reason, ok := f.filtered(r); ok {
+		FilteredCount.WithLabelValues(f.id, reason).Add(1)
+		shed(w, r, rcode, reason+" not forwarded")
+		return 0, nil // already written
+	}
+
+	if f.maxConcurrent > 0 {
+		if atomic.AddInt64(&f.concurrent, 1) > f.maxConcurrent {
+			atomic.AddInt64(&f.concurrent, -1)
+			RejectCount.WithLabelValues(f.id).Add(1)
+			shed(w, r, f.rejectRcode, "max concurrent queries reached")
+			return 0, nil // already written
+		}
+		defer atomic.AddInt64(&f.concurrent, -1)
+	}
+
+	if f.admission != nil {
+		if err := f.admission.acquire(ctx); err != nil {
+			ShedCount.WithLabelValues(f.id, err.Error()).Add(1)
+			shed(w, r, dns.RcodeServerFailure, err.Error())
+			if f.errReport != nil {
+				f.ownFailure(state, edeOther)
+			}
+			return 0, nil // already written
+		}
+		defer f.admission.release()
+	}
+
+	if isTransfer(state) {
+		return f.transfer(ctx, w, state)
+	}
+
+	upstream := state
+	addedOPT, addedECS := false, false
+	// A NOTIFY or UPDATE goes to the upstream as the client sent it.
+	if r.Opcode == dns.OpcodeQuery {
+		if f.stripQuery != nil {
+			upstream = withoutOptions(upstream, f.stripQuery)
+		}
+		upstream, addedOPT, addedECS = f.ecs.apply(upstream)
+		if f.bufsize > 0 {
+			upstream = withBufsize(upstream, f.bufsize)
+		}
+	}
+	ret, info, err := f.coalesced(ctx, upstream)
+	if f.log.logQueries() {
+		f.logQuery(state, ret, info, err)
+	}
+	if reason := f.fallReason(ret, err); reason != "" && f.fallThrough.Through(state.Name()) {
+		FallthroughCount.WithLabelValues(f.id, reason).Add(1)
+		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
+	}
+	if err == errThrottled {
+		shed(w, r, f.throttleRcode, "max_qps reached")
+		return 0, nil // already written
+	}
+	if err == errNoHealthy && f.noHealthyRcode != dns.RcodeServerFailure {
+		f.noHealthyReply(w, r)
+		return 0, nil // already written
+	}
+	if err != nil {
+		if f.errReport != nil {
+			f.ownFailure(state, edeNetworkError)
+		}
+		return dns.RcodeServerFailure, err
+	}
+	unapply(ret, addedOPT, addedECS)
+	if f.stripReply != nil {
+		stripOptions(ret, f.stripReply)
+	}
 
+	if f.minTTL > 0 || f.maxTTL > 0 {
+		clampTTL(ret, f.minTTL, f.maxTTL)
+	}
+	ret = f.onResponse(state, ret)
+
+	if f.normalize {
+		normalizeFlags(r, ret)
+	}
+	// Whatever the upstream or a hook did, the client gets its own ID back.
+	ret.Id = r.Id
+
+	// The upstream may have been asked over TCP, make sure the reply fits what the client can take.
+	ret, _ = state.Scrub(ret)
+	w.WriteMsg(ret)
+
+	return 0, nil
+}
+
+// forward sends state to the upstreams, trying the next one if an exchange fails, and returns the first reply
+// together with how it was obtained.
+func (f *Forward) forward(ctx context.Context, state request.Request) (*dns.Msg, Info, error) {
 	fails := 0
 	var span, child ot.Span
 	span = ot.SpanFromContext(ctx)
 
-	for _, proxy := range f.list() {
+	md := MetadataFromContext(ctx)
+	ctx = f.mismatchContext(ctx, state)
+	var info, lastInfo Info
+	var last *dns.Msg  // reply skipped because of its rcode
+	throttled := false // an upstream was skipped because of its max_qps
+
+	f.mirror(state)
+
+	list := f.routed(state)
+	if list == nil {
+		list = f.list(state)
+	}
+	if f.preForward != nil {
+		var reply *dns.Msg
+		if list, reply = applyVerdict(state, f.preForward(state), list); reply != nil {
+			return reply, info, nil
+		}
+	}
+
+	forceTCP := f.forceTCP
+	switch transportFromContext(ctx) {
+	case "tcp":
+		forceTCP = true
+	case "tcp-tls":
+		list = onlyTLS(list)
+	}
+
+	if f.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.queryTimeout)
+		defer cancel()
+	}
+
+	for i, proxy := range list {
+		if ctxErr(ctx, nil) != nil {
+			break
+		}
 		if proxy.Down(f.maxfails) {
 			fails++
-			if fails < len(f.proxies) {
+			if fails < len(list) {
 				continue
 			}
 			// All upstream proxies are dead, assume healtcheck is complete broken and randomly
 			// select an upstream to connect to.
-			proxy = f.list()[0]
-			log.Printf("[WARNING] All upstreams down, picking random one to connect to %s", proxy.host.addr)
+			proxy = list[rand.Intn(len(list))]
+			f.log.warning(f.id, "all_down", fmt.Sprintf("All upstreams down, picking random one to connect to %s", proxy.host),
+				Field{"upstream", proxy.host.addr})
+		}
+		if proxy.throttled() {
+			throttled = true
+			continue
 		}
 
 		if span != nil {
@@ -85,32 +381,93 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			ctx = ot.ContextWithSpan(ctx, child)
 		}
 
-		ret, err := proxy.connect(ctx, state, f.forceTCP, true)
+		var (
+			ret    *dns.Msg
+			winner *Proxy
+			rtt    time.Duration
+			err    error
+		)
+		for try := 0; ; try++ {
+			info.Attempts++
+			ret, winner, rtt, err = f.exchange(ctx, state, proxy, list[i+1:], forceTCP)
+			// Only a timeout, likely a lost UDP packet, is worth trying again at the same upstream.
+			if err == nil || try >= f.maxRetries || !isTimeout(err) || ctxErr(ctx, nil) != nil {
+				break
+			}
+		}
+		proxy = winner
 
 		if child != nil {
 			child.Finish()
 		}
 
 		if err != nil {
-			log.Printf("[WARNING] Failed to connect to %s: %s", proxy.host.addr, err)
-			if fails < len(f.proxies) {
+			if merr, ok := err.(*mismatchError); ok {
+				f.spoofed(state, proxy, merr)
+			}
+			f.log.warning(f.id, "upstream_failed", fmt.Sprintf("Failed to connect to %s: %s", proxy.host, err),
+				Field{"upstream", proxy.host.addr}, Field{"tag", proxy.host.tag}, Field{"error", err})
+			expFailures.Add(proxy.host.expKey(), 1)
+			if f.reporter != nil {
+				f.reporter.failover(proxy.host.addr)
+			}
+			if fails < len(list) {
 				continue
 			}
 			break
 		}
+		proxy.host.servfails.mark(time.Now(), ret.Rcode == dns.RcodeServerFailure)
+		proxy.host.answered(ret.Rcode)
 
-		w.WriteMsg(ret)
+		if f.queryFunc != nil {
+			restore(state, ret)
+		}
+
+		switch f.rcodeAction(ret) {
+		case rcodeServfail:
+			m := new(dns.Msg)
+			m.SetRcode(state.Req, dns.RcodeServerFailure)
+			ret = m
+		case rcodeNext, rcodeFallthrough:
+			last = ret
+			lastInfo = Info{Upstream: proxy.host.addr, Proto: proxy.proto(state, forceTCP), RTT: rtt}
+			continue
+		}
+
+		info.Upstream, info.Proto, info.RTT = proxy.host.addr, proxy.proto(state, forceTCP), rtt
+		info.set(md)
+
+		f.prefetchHint(state, ret)
+		f.audit(state, ret, proxy, list)
+		if f.errReport != nil {
+			f.fromReply(state, ret)
+		}
 
-		return 0, nil
+		return ret, info, nil
 	}
 
-	return dns.RcodeServerFailure, errNoHealthy
+	if last != nil {
+		// All upstreams gave an rcode we wanted to skip, relay the last one.
+		lastInfo.Attempts = info.Attempts
+		lastInfo.set(md)
+		return last, lastInfo, nil
+	}
+	switch err := ctxErr(ctx, nil); err {
+	case context.DeadlineExceeded:
+		return nil, info, errDeadline
+	case context.Canceled:
+		return nil, info, err
+	}
+	if throttled {
+		return nil, info, errThrottled
+	}
+	return nil, info, errNoHealthy
 }
 
 func (f *Forward) match(state request.Request) bool {
 	from := f.from
 
-	if !plugin.Name(from).Matches(state.Name()) || !f.isAllowedDomain(state.Name()) {
+	if !(plugin.Name(from).Matches(state.Name()) || f.inRoute(state.Name())) || !f.isAllowedDomain(state.Name()) || !f.isAllowedClient(state.IP()) {
 		return false
 	}
 
@@ -130,25 +487,35 @@ func (f *Forward) isAllowedDomain(name string) bool {
 	return true
 }
 
-// list returns a randomized set of proxies to be used for this client. If the client was
-// know to any of the proxies it will be put first.
-func (f *Forward) list() []*Proxy {
-	switch len(f.proxies) {
+// list returns the proxies to be used for this client, ordered by the policy.
+func (f *Forward) list(state request.Request) []*Proxy {
+	f.RLock()
+	policy := f.policy
+	f.RUnlock()
+	return order(policy, state, f.rotation())
+}
+
+// shuffle returns proxies in random order, taking their weights into account.
+func shuffle(proxies []*Proxy) []*Proxy {
+	if rnd := weighted(proxies); rnd != nil {
+		return rnd
+	}
+	switch len(proxies) {
 	case 1:
-		return f.proxies
+		return proxies
 	case 2:
 		if rand.Int()%2 == 0 {
-			return []*Proxy{f.proxies[1], f.proxies[0]} // swap
+			return []*Proxy{proxies[1], proxies[0]} // swap
 
 		}
-		return f.proxies // normal
+		return proxies // normal
 	}
 
-	perms := rand.Perm(len(f.proxies))
-	rnd := make([]*Proxy, len(f.proxies))
+	perms := rand.Perm(len(proxies))
+	rnd := make([]*Proxy, len(proxies))
 
 	for i, p := range perms {
-		rnd[i] = f.proxies[p]
+		rnd[i] = proxies[p]
 	}
 	return rnd
 }
@@ -157,4 +524,7 @@ var (
 	errInvalidDomain = errors.New("invalid domain for proxy")
 	errNoHealthy     = errors.New("no healthy proxies")
 	errNoForward     = errors.New("no forwarder defined")
+	errStopped       = errors.New("proxy stopped")
+	errDeadline      = errors.New("query deadline exceeded")
+	errThrottled     = errors.New("upstreams at their max_qps")
 )
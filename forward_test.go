@@ -1,12 +1,21 @@
 package forward
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
 )
 
 func TestForward(t *testing.T) {
@@ -40,3 +49,328 @@ func TestForward(t *testing.T) {
 		t.Errorf("Expected 127.0.0.1, got: %s", resp.Answer[0].(*dns.A).A.String())
 	}
 }
+
+func TestForwardMetricsID(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	before := map[string]float64{}
+	for _, id := range []string{"internal", "external"} {
+		before[id] = counterValue(RequestCount, id, s.Addr)
+	}
+	for i, id := range []string{"internal", "external", "external"} {
+		f := New()
+		f.id = id
+		f.SetProxy(NewProxy(s.Addr))
+		if _, err := f.Forward(questionState("example.org.")); err != nil {
+			t.Fatalf("Query %d: expected no error, got: %s", i, err)
+		}
+		f.Close()
+	}
+	for id, want := range map[string]float64{"internal": 1, "external": 2} {
+		if x := counterValue(RequestCount, id, s.Addr) - before[id]; x != want {
+			t.Errorf("Expected %f requests to %s from %s, got %f", want, s.Addr, id, x)
+		}
+	}
+}
+
+func TestForwardShutdown(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	f := New()
+	f.SetExpire(defaultExpire)
+	f.AddProxy(p)
+	f.OnStartup()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.Forward(state); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	value := func(g *prometheus.GaugeVec, labels ...string) float64 {
+		m := new(dto.Metric)
+		g.WithLabelValues(labels...).Write(m)
+		return m.GetGauge().GetValue()
+	}
+	if n := value(GoroutineGauge, p.host.id, s.Addr, "healthcheck"); n != 1 {
+		t.Errorf("Expected the health check to run, got %f goroutines", n)
+	}
+
+	f.OnShutdown()
+	// All of it must be done when OnShutdown returns, not some time later.
+	for _, kind := range []string{"healthcheck", "transport"} {
+		if n := value(GoroutineGauge, p.host.id, s.Addr, kind); n != 0 {
+			t.Errorf("Expected no %s goroutines after shutdown, got: %f", kind, n)
+		}
+	}
+	if n := value(ConnCacheSize, p.host.id, s.Addr, "udp"); n != 0 {
+		t.Errorf("Expected no cached connections after shutdown, got: %f", n)
+	}
+	if _, err := p.Dial("udp"); err != errStopped {
+		t.Errorf("Expected %s, got: %v", errStopped, err)
+	}
+}
+
+func TestForwardPrefetchHint(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. 5 IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	f := New()
+	f.SetProxy(p)
+	defer f.Close()
+
+	hint := uint32(0)
+	f.SetPrefetchTTL(10)
+	f.SetPrefetchFunc(func(state request.Request, ttl uint32) { hint = ttl })
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.Forward(state); err != nil {
+		t.Fatal("Expected to receive reply, but didn't")
+	}
+	if hint != 5 {
+		t.Errorf("Expected prefetch hint with TTL 5, got: %d", hint)
+	}
+}
+
+func TestForwardMetadata(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	ctx, md := NewMetadataContext(context.TODO())
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.ServeDNS(ctx, &test.ResponseWriter{}, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	if md["forward/upstream"] != s.Addr {
+		t.Errorf("Expected upstream %s, got: %q", s.Addr, md["forward/upstream"])
+	}
+	if md["forward/proto"] != "udp" {
+		t.Errorf("Expected proto udp, got: %q", md["forward/proto"])
+	}
+	if md["forward/attempts"] != "1" {
+		t.Errorf("Expected 1 attempt, got: %q", md["forward/attempts"])
+	}
+}
+
+func TestForwardTruncate(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		for i := 0; i < 50; i++ {
+			ret.Answer = append(ret.Answer, test.A(fmt.Sprintf("example.org. IN A 127.0.0.%d", i)))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.forceTCP = true
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	if !rec.Msg.Truncated {
+		t.Errorf("Expected truncated reply for UDP client")
+	}
+	if rec.Msg.Len() > 512 {
+		t.Errorf("Expected reply to fit in 512 bytes, got %d", rec.Msg.Len())
+	}
+}
+
+type tcpResponseWriter struct{ test.ResponseWriter }
+
+func (t *tcpResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.240.0.1"), Port: 40212}
+}
+
+func TestForwardPreferUDP(t *testing.T) {
+	var udp, tcp int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name != "example.org." {
+			w.WriteMsg(ret) // health check
+			return
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.AddInt32(&udp, 1)
+			ret.Truncated = true
+		} else {
+			atomic.AddInt32(&tcp, 1)
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	p := NewProxy(s.Addr)
+	p.preferUDP = true
+	f.SetProxy(p)
+	defer f.Close()
+	requests := counterValue(RequestCount, p.host.id, s.Addr)
+	transports := counterValue(TransportRequestCount, p.host.id, s.Addr, "udp") + counterValue(TransportRequestCount, p.host.id, s.Addr, "tcp")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&tcpResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	if rec.Msg.Truncated {
+		t.Errorf("Expected the truncated reply to be retried over TCP")
+	}
+	if atomic.LoadInt32(&udp) != 1 || atomic.LoadInt32(&tcp) != 1 {
+		t.Errorf("Expected one UDP and one TCP query, got %d and %d", udp, tcp)
+	}
+	if x := counterValue(RequestCount, p.host.id, s.Addr) - requests; x != 1 {
+		t.Errorf("Expected the retry to count as 1 request, got %.0f", x)
+	}
+	x := counterValue(TransportRequestCount, p.host.id, s.Addr, "udp") + counterValue(TransportRequestCount, p.host.id, s.Addr, "tcp") - transports
+	if x != 1 {
+		t.Errorf("Expected the retry to count as 1 transport request, got %.0f", x)
+	}
+}
+
+func TestForwardTransportContext(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	ctx, md := NewMetadataContext(context.TODO())
+	ctx = NewTransportContext(ctx, "tcp")
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.ServeDNS(ctx, &test.ResponseWriter{}, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if md["forward/proto"] != "tcp" {
+		t.Errorf("Expected proto tcp, got: %q", md["forward/proto"])
+	}
+
+	// There are no TLS upstreams.
+	ctx = NewTransportContext(context.TODO(), "tcp-tls")
+	if _, err := f.ServeDNS(ctx, &test.ResponseWriter{}, req); err != errNoHealthy {
+		t.Errorf("Expected %s, got: %v", errNoHealthy, err)
+	}
+}
+
+func TestForwardReset(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	s2 := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s2.Close()
+
+	var dohConns int32
+	d := httptest.NewUnstartedServer(http.HandlerFunc(dohAnswer))
+	d.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&dohConns, 1)
+		}
+	}
+	d.EnableHTTP2 = true
+	d.StartTLS()
+	defer d.Close()
+
+	f := New()
+	f.SetHealthCheck(0)
+	defer f.Close()
+	for _, addr := range []string{s.Addr, s2.Addr} {
+		f.AddProxy(NewProxy(addr))
+	}
+	doh, err := newDoHProxy(d.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddProxy(doh)
+	doh.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+
+	state := questionState("example.org.")
+	for _, p := range f.proxies {
+		for i := 0; i < 2; i++ {
+			if _, err := p.connect(context.Background(), state, false, false); err != nil {
+				t.Fatalf("Expected no error, got: %s", err)
+			}
+		}
+		atomic.StoreUint32(&p.host.fails, 5)
+		if p.transport.Len() == 0 && p != doh {
+			t.Fatalf("Expected a cached connection to %s", p.host.addr)
+		}
+	}
+	if x := atomic.LoadInt32(&dohConns); x != 1 {
+		t.Fatalf("Expected the DoH queries to share 1 connection, got %d", x)
+	}
+
+	// The connection of the DoH upstream is closed as well, the next query makes a new one.
+	f.Reset()
+	if _, err := doh.connect(context.Background(), state, false, false); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if x := atomic.LoadInt32(&dohConns); x != 2 {
+		t.Errorf("Expected a new DoH connection after a reset, got %d connections", x)
+	}
+	for _, p := range f.proxies {
+		if x := p.transport.Len(); x != 0 {
+			t.Errorf("Expected no cached connections to %s, got %d", p.host.addr, x)
+		}
+		if x := atomic.LoadUint32(&p.host.fails); x != 0 {
+			t.Errorf("Expected no fails for %s, got %d", p.host.addr, x)
+		}
+		if p.Down(f.maxfails) {
+			t.Errorf("Expected %s to be up", p.host.addr)
+		}
+	}
+}
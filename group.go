@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// SetSplit sends percent of the queries to the upstreams in group, the other queries go to the
+// default group. It can be called while f is serving queries. A percent of 0 disables the split.
+func (f *Forward) SetSplit(group string, percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("percentage must be between 0 and 100: %f", percent)
+	}
+	if !f.hasGroup(group) {
+		return fmt.Errorf("unknown group: %s", group)
+	}
+
+	f.Lock()
+	f.splitGroup, f.splitPercent = group, percent
+	f.Unlock()
+	return nil
+}
+
+// Split returns the group and percentage of the current split.
+func (f *Forward) Split() (string, float64) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.splitGroup, f.splitPercent
+}
+
+// hasGroup returns true if any of the proxies belongs to group.
+func (f *Forward) hasGroup(group string) bool {
+	for _, p := range f.snapshot() {
+		if p.group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// rotation returns the proxies that take part in the selection for a query. These are the proxies of
+// the default group, unless the query is split off to another group.
+func (f *Forward) rotation() []*Proxy {
+	f.RLock()
+	proxies, group, percent := f.proxies, f.splitGroup, f.splitPercent
+	f.RUnlock()
+
+	want := ""
+	if percent > 0 && rand.Float64()*100 < percent {
+		want = group
+	}
+
+	n := 0
+	for _, p := range proxies {
+		if p.group == want {
+			n++
+		}
+	}
+	if n == len(proxies) {
+		return proxies
+	}
+
+	rot := make([]*Proxy, 0, n)
+	for _, p := range proxies {
+		if p.group == want {
+			rot = append(rot, p)
+		}
+	}
+	return rot
+}
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestSetupSplit(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\ngroup new 127.0.0.2 127.0.0.3\nsplit new 100\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.Len() != 3 {
+		t.Fatalf("Expected 3 proxies, got: %d", f.Len())
+	}
+
+	for _, p := range f.list(questionState("example.org.")) {
+		if p.group != "new" {
+			t.Errorf("Expected only proxies of group new, got %s in group %q", p.host.addr, p.group)
+		}
+	}
+
+	if err := f.SetSplit("new", 0); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if l := f.list(questionState("example.org.")); len(l) != 1 || l[0].host.addr != "127.0.0.1:53" {
+		t.Errorf("Expected only the default upstream, got: %v", l)
+	}
+
+	if err := f.SetSplit("old", 10); err == nil {
+		t.Errorf("Expected error for unknown group, got none")
+	}
+
+	c = caddy.NewTestController("dns", "forward . 127.0.0.1 {\nsplit new 10\n}\n")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("Expected error for unknown group, got none")
+	}
+}
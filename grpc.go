@@ -0,0 +1,110 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/pb"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcExchanger sends queries to a dns.DnsService gRPC endpoint, such as CoreDNS' grpc:// server.
+// Every query is a unary call on one connection, in which gRPC multiplexes the streams.
+type grpcExchanger struct {
+	addr string
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn // created on first use, when the TLS config is known
+	client pb.DnsServiceClient
+}
+
+// newGRPCProxy returns a proxy for the gRPC upstream in to, grpc://HOST[:PORT].
+func newGRPCProxy(to string) (*Proxy, error) {
+	addr := strings.TrimPrefix(to, _grpc+"://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), grpcPort)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid gRPC upstream: %s", to)
+	}
+
+	p := NewProxy(_grpc + "://" + addr)
+	p.host.exch = &grpcExchanger{addr: addr}
+	return p, nil
+}
+
+// dnsClient returns the client for the upstream, connecting with TLS if h has a TLS config.
+func (g *grpcExchanger) dnsClient(h *host) (pb.DnsServiceClient, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.client != nil {
+		return g.client, nil
+	}
+
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if h.tlsConfig != nil {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(h.tlsConfig.Clone()))}
+	}
+	conn, err := grpc.Dial(g.addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	g.conn, g.client = conn, pb.NewDnsServiceClient(conn)
+	return g.client, nil
+}
+
+func (g *grpcExchanger) exchange(ctx context.Context, h *host, req *dns.Msg) (*dns.Msg, error) {
+	client, err := g.dnsClient(h)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.readTimeout)
+	defer cancel()
+	reply, err := client.Query(ctx, &pb.DnsPacket{Msg: buf})
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply.Msg); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (g *grpcExchanger) proto() string { return _grpc }
+
+func (g *grpcExchanger) clone() exchanger { return &grpcExchanger{addr: g.addr} }
+
+// reset closes the connection to the upstream, the next query dials a new one.
+func (g *grpcExchanger) reset() { g.close() }
+
+// close closes the connection to the upstream.
+func (g *grpcExchanger) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn, g.client = nil, nil
+	}
+}
+
+// grpcTLS returns true if the TLS settings of f ask for TLS to the gRPC upstreams: they use plain
+// HTTP/2 unless the block has tls or tls_servername, like the grpc:// server of CoreDNS.
+func (f *Forward) grpcTLS() bool {
+	return f.tlsServerName != "" || f.tlsConfig.RootCAs != nil || len(f.tlsConfig.Certificates) > 0 ||
+		f.tlsConfig.GetClientCertificate != nil
+}
+
+const grpcPort = "443"
@@ -0,0 +1,104 @@
+package forward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type dnsService struct{}
+
+func (dnsService) Query(ctx context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(in.Msg); err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(req)
+	ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+	buf, err := ret.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: buf}, nil
+}
+
+func TestGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterDnsServiceServer(s, dnsService{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	p, err := newGRPCProxy("grpc://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New()
+	f.SetProxy(p)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		resp, info, err := f.ForwardWithInfo(state)
+		if err != nil {
+			t.Fatalf("Expected to receive reply, got: %s", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Expected one RR in the answer section, got: %s", resp)
+		}
+		if info.Proto != "grpc" {
+			t.Errorf("Expected grpc, got: %s", info.Proto)
+		}
+	}
+	if err := p.host.send(); err != nil {
+		t.Errorf("Expected health check to succeed, got: %s", err)
+	}
+}
+
+func TestSetupGRPC(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		expectedAddr string
+		expectedTLS  bool
+	}{
+		{"forward . grpc://10.0.0.1", false, "grpc://10.0.0.1:443", false},
+		{"forward . grpc://[::1]:8443", false, "grpc://[::1]:8443", false},
+		{"forward . grpc://10.0.0.1 {\ntls_servername dns.example.net\n}", false, "grpc://10.0.0.1:443", true},
+		{"forward . grpc://", true, "", false},
+	}
+
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+			continue
+		}
+		p := f.proxies[0]
+		if p.host.addr != tc.expectedAddr {
+			t.Errorf("Test %d: expected %s, got: %s", i, tc.expectedAddr, p.host.addr)
+		}
+		if (p.host.tlsConfig != nil) != tc.expectedTLS {
+			t.Errorf("Test %d: expected TLS %t, got: %t", i, tc.expectedTLS, p.host.tlsConfig != nil)
+		}
+		f.Close()
+	}
+}
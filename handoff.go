@@ -0,0 +1,135 @@
+package forward
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// retiring holds the instances of a server being reloaded, by id, until the instances of the new
+// Corefile adopt them.
+var retiring = struct {
+	sync.Mutex
+	m map[string]*Forward
+}{m: make(map[string]*Forward)}
+
+// retire makes f available to the instance with its id in the next Corefile.
+func retire(f *Forward) {
+	retiring.Lock()
+	retiring.m[f.id] = f
+	retiring.Unlock()
+}
+
+// retired returns the retiring instance with id, and forgets it, or nil if there is none.
+func retired(id string) *Forward {
+	retiring.Lock()
+	defer retiring.Unlock()
+	old := retiring.m[id]
+	delete(retiring.m, id)
+	return old
+}
+
+// forget removes f from the retiring instances, when no new instance adopted it.
+func forget(f *Forward) {
+	retiring.Lock()
+	if retiring.m[f.id] == f {
+		delete(retiring.m, f.id)
+	}
+	retiring.Unlock()
+}
+
+// Adopt takes over what it can from old, the instance f replaces, and must be called before f starts.
+// The upstreams both have keep their health, so they don't wait for a health check again, and f
+// takes the UDP and TCP connections old has cached to them, instead of dialing all of them anew.
+// When old is shut down after this, it closes its upstreams once their exchanges in progress are
+// done, or after drainTimeout, instead of right away.
+func (f *Forward) Adopt(old *Forward) {
+	if old == nil || old == f {
+		return
+	}
+	byAddr := make(map[string]*Proxy)
+	for _, q := range old.snapshot() {
+		byAddr[q.host.addr] = q
+	}
+	for _, p := range f.snapshot() {
+		q := byAddr[p.host.addr]
+		if q == nil {
+			continue
+		}
+		p.host.adoptHealth(q.host)
+		if p.host.exch == nil && q.host.exch == nil && p.mdns == nil && !p.stateless && sameDial(p.host, q.host) {
+			p.transport.adopt(q.transport, "udp")
+			p.transport.adopt(q.transport, "tcp")
+		}
+	}
+
+	old.Lock()
+	old.successor = f
+	old.Unlock()
+}
+
+// adoptHealth sets the health of h to that of old.
+func (h *host) adoptHealth(old *host) {
+	atomic.StoreUint32(&h.fails, atomic.LoadUint32(&old.fails))
+	atomic.StoreUint32(&h.successes, atomic.LoadUint32(&old.successes))
+	atomic.StoreInt64(&h.lastFail, atomic.LoadInt64(&old.lastFail))
+	atomic.StoreInt64(&h.lastAnswer, atomic.LoadInt64(&old.lastAnswer))
+	atomic.StoreInt64(&h.keepalive, atomic.LoadInt64(&old.keepalive))
+	atomic.StoreInt64(&h.noEDNSUntil, atomic.LoadInt64(&old.noEDNSUntil))
+	h.updateHealth()
+}
+
+// sameDial returns true if the UDP and TCP connections of p and q are made the same way, so one can
+// use those of the other.
+func sameDial(p, q *host) bool {
+	if p.via != nil || q.via != nil || p.proxyProtocol || q.proxyProtocol || p.dialer != q.dialer {
+		return false
+	}
+	if p.bind == nil || q.bind == nil {
+		return p.bind == q.bind
+	}
+	return p.bind.v4.Equal(q.bind.v4) && p.bind.v6.Equal(q.bind.v6) && p.bind.device == q.bind.device
+}
+
+// adopt moves the conns of type proto cached in old to t, as far as the caps of t leave room for them.
+// The others are closed.
+func (t *transport) adopt(old *transport, proto string) {
+	size := connSize(proto)
+	src := old.shard(proto)
+	src.Lock()
+	conns := src.conns
+	src.conns = nil
+	old.account(-int64(len(conns)), -int64(len(conns))*size)
+	src.Unlock()
+
+	var extra []*persistConn
+	dst := t.shard(proto)
+	dst.Lock()
+	for _, pc := range conns {
+		if atomic.LoadInt32(&t.stopped) == 1 || (t.maxIdle > 0 && len(dst.conns) >= t.maxIdle) {
+			extra = append(extra, pc)
+			continue
+		}
+		dst.conns = append(dst.conns, pc)
+		t.account(1, size)
+	}
+	n := len(dst.conns)
+	dst.Unlock()
+
+	for _, pc := range extra {
+		pc.c.Close()
+	}
+	if t.maxMem > 0 {
+		t.shrink()
+	}
+	t.updateGauges(proto, n)
+}
+
+// hasUpstream returns true if f has an upstream addr with tag.
+func (f *Forward) hasUpstream(addr, tag string) bool {
+	for _, p := range f.snapshot() {
+		if p.host.addr == addr && p.host.tag == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestAdopt(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	input := "forward . " + s.Addr + " {\nname main\nhealth_check 1h\n}\n"
+	old, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	q := old.proxies[0]
+	q.host.resetFails()
+	if _, err := q.connect(context.Background(), questionState("example.org."), false, true); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if q.transport.Len() != 1 {
+		t.Fatalf("Expected a cached connection, got %d", q.transport.Len())
+	}
+
+	f, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	retire(old)
+	f.Adopt(retired(old.id))
+	p := f.proxies[0]
+	if fails := atomic.LoadUint32(&p.host.fails); fails != 0 {
+		t.Errorf("Expected the upstream to keep its health, got %d fails", fails)
+	}
+	if p.transport.Len() != 1 || q.transport.Len() != 0 {
+		t.Errorf("Expected the cached connection to be handed over, got %d and %d", p.transport.Len(), q.transport.Len())
+	}
+	if retired(old.id) != nil {
+		t.Errorf("Expected the old instance to be adopted once")
+	}
+
+	// An exchange in progress keeps the old upstream open after the old instance is shut down.
+	atomic.AddInt64(&q.inflight, 1)
+	done := make(chan struct{})
+	go func() {
+		old.OnShutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnShutdown not to wait for the drain")
+	}
+	select {
+	case <-q.stop:
+		t.Fatalf("Expected the old upstream to stay open while it has an exchange in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.AddInt64(&q.inflight, -1)
+	select {
+	case <-q.stop:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the old upstream to be closed after its exchange")
+	}
+}
+
+func TestSameDial(t *testing.T) {
+	b, _ := parseBind([]string{"127.0.0.1"})
+	b2, _ := parseBind([]string{"127.0.0.1"})
+	b3, _ := parseBind([]string{"127.0.0.2"})
+	h := func(b *bind) *host {
+		h := newHost("127.0.0.1:53")
+		h.bind = b
+		return h
+	}
+	if !sameDial(h(nil), h(nil)) || !sameDial(h(b), h(b2)) {
+		t.Errorf("Expected the same binds to dial the same way")
+	}
+	if sameDial(h(b), h(b3)) || sameDial(h(nil), h(b)) {
+		t.Errorf("Expected other binds not to dial the same way")
+	}
+	p := h(nil)
+	p.proxyProtocol = true
+	if sameDial(p, h(nil)) {
+		t.Errorf("Expected the PROXY protocol not to dial the same way")
+	}
+}
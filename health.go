@@ -1,14 +1,19 @@
 package forward
 
 import (
-	"log"
+	"expvar"
+	"fmt"
 	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 // For HC we send to . IN NS +norec message to the upstream. Dial timeouts and empty
 // replies are considered fails, basically anything else constitutes a healthy upstream.
+// With health_check zone the SOA (or NS) of the zone is asked instead, and the reply must be NOERROR.
+// Health_query and health_rcodes set the query and the rcodes that count as healthy explicitly.
 
 func (h *host) Check() {
 	h.Lock()
@@ -21,17 +26,38 @@ func (h *host) Check() {
 	h.checking = true
 	h.Unlock()
 
+	h.decay(time.Now())
 	err := h.send()
 	if err != nil {
-		log.Printf("[INFO] healtheck of %s failed with %s", h.addr, err)
+		h.log.info(h.id, "health_check_failed", fmt.Sprintf("healtheck of %s failed with %s", h, err),
+			Field{"upstream", h.addr}, Field{"tag", h.tag}, Field{"error", err})
+		if atomic.LoadUint32(&h.fails) == 0 {
+			h.log.warning(h.id, "upstream_unhealthy", fmt.Sprintf("%s is unhealthy", h), Field{"upstream", h.addr}, Field{"tag", h.tag})
+		}
 
-		HealthcheckFailureCount.WithLabelValues(h.addr).Add(1)
+		h.healthcheckFailure()
+		expHealthchecks.Add(h.expKey(), 1)
 
+		atomic.StoreInt64(&h.lastFail, time.Now().UnixNano())
 		atomic.AddUint32(&h.fails, 1)
-	} else {
-		atomic.StoreUint32(&h.fails, 0)
+		atomic.StoreUint32(&h.successes, 0)
+		h.updateHealth()
+	} else if !h.halfOpen() {
+		atomic.StoreUint32(&h.successes, 0)
+		fails := atomic.SwapUint32(&h.fails, 0)
+		h.updateHealth()
+		if fails > 0 {
+			h.log.info(h.id, "upstream_healthy", fmt.Sprintf("%s is healthy", h), Field{"upstream", h.addr}, Field{"tag", h.tag})
+		}
+		if h.probe != nil {
+			h.runProbe()
+		}
 	}
 
+	h.publishHealthy()
+	HealthScore.WithLabelValues(h.id, h.addr).Set(h.Score())
+	h.updatePeak()
+
 	h.Lock()
 	h.checking = false
 	h.Unlock()
@@ -39,12 +65,94 @@ func (h *host) Check() {
 	return
 }
 
+// hcQuery is the query a health check sends, and the rcodes of the replies that count as healthy.
+type hcQuery struct {
+	name    string
+	qtype   uint16
+	rd      bool
+	healthy map[int]bool // nil means any reply will do
+}
+
+var defaultHealthQuery = &hcQuery{name: ".", qtype: dns.TypeNS}
+
+// check returns an error if m doesn't count as a healthy reply.
+func (hc *hcQuery) check(m *dns.Msg) error {
+	if hc.healthy == nil || hc.healthy[m.Rcode] {
+		return nil
+	}
+	return fmt.Errorf("%s for %s %s", rcodeString(m.Rcode), hc.name, dns.Type(hc.qtype))
+}
+
+// healthQuery returns the health check query of f, creating the default one if there is none yet.
+func (f *Forward) healthQuery() *hcQuery {
+	if f.hc == nil {
+		f.hc = &hcQuery{name: ".", qtype: dns.TypeNS}
+	}
+	return f.hc
+}
+
+// HealthChecker checks an upstream instead of the health check query, e.g. over HTTP or by only
+// connecting to it.
+type HealthChecker interface {
+	// Check returns an error if the upstream at addr, host:port, isn't healthy.
+	Check(addr string) error
+}
+
+// SetHealthChecker sets the HealthChecker in the lower p.host, nil goes back to the health check query.
+func (p *Proxy) SetHealthChecker(c HealthChecker) { p.host.checker = c }
+
+// noCheck is the HealthChecker of health=none: the upstream is always healthy.
+type noCheck struct{}
+
+func (noCheck) Check(string) error { return nil }
+
+// tcpCheck is the HealthChecker of health=tcp: the upstream is healthy when it accepts a TCP
+// connection, which is made as those for queries are.
+type tcpCheck struct{ h *host }
+
+func (c *tcpCheck) Check(string) error {
+	conn, err := c.h.dial("tcp")
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func (h *host) send() error {
+	if h.checker != nil {
+		return h.checker.Check(h.addr)
+	}
+	hc := h.hc
+	if hc == nil {
+		hc = defaultHealthQuery
+	}
 	hcping := new(dns.Msg)
-	hcping.SetQuestion(".", dns.TypeNS)
-	hcping.RecursionDesired = false
+	hcping.SetQuestion(hc.name, hc.qtype)
+	hcping.RecursionDesired = hc.rd
+
+	if h.exch != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), h.readTimeout)
+		defer cancel()
+		m, err := h.exch.exchange(ctx, h, hcping)
+		if err == nil {
+			err = hc.check(m)
+		}
+		return err
+	}
 
-	m, _, err := h.client.Exchange(hcping, h.addr)
+	client, addr := h.client, h.addr
+	if h.chain != nil {
+		// Check the transport we're using now.
+		proto := h.chain.current()
+		client = &dns.Client{Net: proto, ReadTimeout: h.client.ReadTimeout, WriteTimeout: h.client.WriteTimeout}
+		if proto == "tcp-tls" {
+			client.TLSConfig = h.tlsConfig
+		}
+		addr = h.dialAddr(proto)
+		client.Dialer = h.bind.dialer(proto, addr)
+	}
+
+	m, err := h.exchangeOnce(client, hcping, addr)
 	// If we got a header, we're alright, basically only care about I/O errors 'n stuff
 	if err != nil && m != nil {
 		// Silly check, something sane came back
@@ -52,16 +160,139 @@ func (h *host) send() error {
 			err = nil
 		}
 	}
+	if err == nil {
+		err = hc.check(m)
+	}
 
 	return err
 }
 
+// hcStartupTimeout is how long OnStartup waits for the first health checks with health_startup.
+const hcStartupTimeout = 5 * time.Second
+
+// awaitChecks waits until the first health check of each of proxies is done, or timeout has passed.
+// An upstream that failed it is down right away, instead of after max_fails checks, so the first
+// queries aren't sent to it. One that wasn't checked in time is left as is.
+func (f *Forward) awaitChecks(proxies []*Proxy, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for i, p := range proxies {
+		select {
+		case <-p.checked:
+		case <-timer.C:
+			f.log.warning(f.id, "startup_check_timeout", fmt.Sprintf("Serving before %d upstreams were health checked, waited %s", len(proxies)-i, timeout),
+				Field{"unchecked", len(proxies) - i}, Field{"timeout", timeout.String()})
+			return
+		}
+		maxfails := f.maxfails
+		if p.ownMaxfails {
+			maxfails = p.maxfails
+		}
+		if fails := atomic.LoadUint32(&p.host.fails); fails > 0 && fails <= maxfails {
+			atomic.CompareAndSwapUint32(&p.host.fails, fails, maxfails+1)
+			p.host.updateHealth()
+		}
+	}
+}
+
+// resetFails marks h as healthy, for upstreams that aren't health checked.
+func (h *host) resetFails() {
+	atomic.StoreUint32(&h.fails, 0)
+	h.updateHealth()
+}
+
+// publishHealthy sets the healthy expvar of h to 1 if the queries see it as up, and 0 if they see it
+// as down: a host that is half-open or has a few fails is still down, or up, until Proxy.Down says so.
+func (h *host) publishHealthy() {
+	healthy := new(expvar.Int)
+	if atomic.LoadUint32(&h.wasDown) == 0 {
+		healthy.Set(1)
+	}
+	expHealthy.Set(h.expKey(), healthy)
+}
+
+// updateHealth sets the health gauges of h to its current fails.
+func (h *host) updateHealth() {
+	fails := atomic.LoadUint32(&h.fails)
+	healthy := 0.0
+	if fails == 0 {
+		healthy = 1
+	}
+	HealthyGauge.WithLabelValues(h.id, h.addr).Set(healthy)
+	FailsGauge.WithLabelValues(h.id, h.addr).Set(float64(fails))
+}
+
+// halfOpen counts a successful check of h while it has fails. It returns true as long as fewer than
+// rise checks in a row succeeded, h then keeps its fails.
+func (h *host) halfOpen() bool {
+	if h.rise <= 1 || atomic.LoadUint32(&h.fails) == 0 {
+		return false
+	}
+	return atomic.AddUint32(&h.successes, 1) < h.rise
+}
+
+// nextCheck returns the time until the next health check of h: interval, doubled for every failed
+// check in a row up to max when max is set. Once a check succeeds again the interval is used.
+func (h *host) nextCheck(interval, max time.Duration) time.Duration {
+	fails := atomic.LoadUint32(&h.fails)
+	if max <= interval || fails <= 1 || atomic.LoadUint32(&h.successes) > 0 {
+		return interval
+	}
+	next := interval
+	for i := uint32(1); i < fails && next < max; i++ {
+		next *= 2
+	}
+	if next > max {
+		return max
+	}
+	return next
+}
+
+// decay forgets the fails of h when its last failed check is more than the fail window of h before
+// now. The fails h starts out with, before its first check, are kept.
+func (h *host) decay(now time.Time) {
+	if h.failWindow == 0 {
+		return
+	}
+	last := atomic.LoadInt64(&h.lastFail)
+	if last == 0 || now.Sub(time.Unix(0, last)) <= h.failWindow {
+		return
+	}
+	fails := atomic.LoadUint32(&h.fails)
+	if fails == 0 || !atomic.CompareAndSwapUint32(&h.fails, fails, 0) {
+		return
+	}
+	atomic.StoreUint32(&h.successes, 0)
+	h.updateHealth()
+	h.log.info(h.id, "fails_expired", fmt.Sprintf("Forgetting %d fails of %s, none in the last %s", fails, h, h.failWindow),
+		Field{"upstream", h.addr}, Field{"tag", h.tag}, Field{"fails", fails})
+}
+
+// answered notes that h answered a client's query with rcode. Anything but SERVFAIL and REFUSED
+// shows it's working.
+func (h *host) answered(rcode int) {
+	if rcode != dns.RcodeServerFailure && rcode != dns.RcodeRefused {
+		atomic.StoreInt64(&h.lastAnswer, time.Now().UnixNano())
+	}
+}
+
+// active returns true if h is healthy and answered a client's query within the last d, which says
+// as much as a health check would. A host with a probe isn't active, the probe needs the check.
+func (h *host) active(d time.Duration) bool {
+	if h.probe != nil || atomic.LoadUint32(&h.fails) > 0 {
+		return false
+	}
+	last := atomic.LoadInt64(&h.lastAnswer)
+	return last > 0 && time.Since(time.Unix(0, last)) < d
+}
+
 // down returns true is this host has more than maxfails fails.
 func (h *host) down(maxfails uint32) bool {
 	if maxfails == 0 {
 		return false
 	}
 
+	h.decay(time.Now())
 	fails := atomic.LoadUint32(&h.fails)
 	return fails > maxfails
 }
@@ -0,0 +1,471 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHealthCheckZone(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name != "example.org." || r.Question[0].Qtype != dns.TypeSOA || r.RecursionDesired {
+			ret.Rcode = dns.RcodeRefused
+		} else {
+			ret.Answer = append(ret.Answer, test.SOA("example.org. IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 300"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	for _, tc := range []struct {
+		input string
+		fails uint32
+	}{
+		{"forward example.org " + s.Addr + " {\nhealth_check 1s zone\n}", 0},
+		{"forward example.net " + s.Addr + " {\nhealth_check 1s zone\n}", 1},
+		{"forward example.org " + s.Addr + " {\nhealth_check 1s zone NS\n}", 1},
+		{"forward example.net " + s.Addr, 0}, // . IN NS, any reply will do
+	} {
+		c := caddy.NewTestController("dns", tc.input)
+		f, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		h := f.proxies[0].host
+		h.SetClient()
+		atomic.StoreUint32(&h.fails, 0)
+		h.Check()
+		if fails := atomic.LoadUint32(&h.fails); fails != tc.fails {
+			t.Errorf("For %q expected %d fails, got %d", tc.input, tc.fails, fails)
+		}
+	}
+}
+
+func TestHealthQuery(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "." {
+			ret.Rcode = dns.RcodeRefused
+		} else if r.Question[0].Name != "health.example.org." || r.Question[0].Qtype != dns.TypeA || !r.RecursionDesired {
+			ret.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	for _, tc := range []struct {
+		input string
+		fails uint32
+	}{
+		{"forward . " + s.Addr, 0}, // REFUSED is a reply
+		{"forward . " + s.Addr + " {\nhealth_rcodes NOERROR NXDOMAIN\n}", 1},
+		{"forward . " + s.Addr + " {\nhealth_query health.example.org A recursion\nhealth_rcodes NOERROR\n}", 0},
+		{"forward . " + s.Addr + " {\nhealth_query health.example.org A\nhealth_rcodes NOERROR\n}", 1},
+		{"forward . " + s.Addr + " {\nhealth_query health.example.org AAAA recursion\nhealth_rcodes NOERROR\n}", 1},
+	} {
+		c := caddy.NewTestController("dns", tc.input)
+		f, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		h := f.proxies[0].host
+		h.SetClient()
+		atomic.StoreUint32(&h.fails, 0)
+		h.Check()
+		if fails := atomic.LoadUint32(&h.fails); fails != tc.fails {
+			t.Errorf("For %q expected %d fails, got %d", tc.input, tc.fails, fails)
+		}
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nhealth_query example.org\n}",
+		"forward . 127.0.0.1 {\nhealth_query example.org NOPE\n}",
+		"forward . 127.0.0.1 {\nhealth_query example.org A norec\n}",
+		"forward . 127.0.0.1 {\nhealth_rcodes\n}",
+		"forward . 127.0.0.1 {\nhealth_rcodes NOPE\n}",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestHealthCheckTransport(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if _, tcp := w.RemoteAddr().(*net.TCPAddr); !tcp {
+			ret.Rcode = dns.RcodeRefused // "firewalled" UDP
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	for _, tc := range []struct {
+		input string
+		fails uint32
+	}{
+		{"forward . " + s.Addr + " {\nhealth_rcodes NOERROR\n}", 1},
+		{"forward . " + s.Addr + " {\nforce_tcp\nhealth_rcodes NOERROR\n}", 0},
+	} {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		p := f.proxies[0]
+		p.setHealthClient()
+		atomic.StoreUint32(&p.host.fails, 0)
+		p.host.Check()
+		if fails := atomic.LoadUint32(&p.host.fails); fails != tc.fails {
+			t.Errorf("For %q expected %d fails, got %d", tc.input, tc.fails, fails)
+		}
+	}
+}
+
+type errChecker struct{ addr string }
+
+func (c *errChecker) Check(addr string) error {
+	c.addr = addr
+	return errors.New("unhealthy")
+}
+
+func TestHealthChecker(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Rcode = dns.RcodeRefused
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.LocalAddr().String()
+	l.Close()
+
+	for _, tc := range []struct {
+		input string
+		fails uint32
+	}{
+		{"forward . " + s.Addr + " health=tcp {\nhealth_rcodes NOERROR\n}", 0},
+		{"forward . " + dead + " health=tcp", 1},
+		{"forward . " + dead + " health=none", 0},
+		{"forward . " + s.Addr + " health=dns {\nhealth_rcodes NOERROR\n}", 1},
+	} {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		p := f.proxies[0]
+		p.setHealthClient()
+		atomic.StoreUint32(&p.host.fails, 0)
+		p.host.Check()
+		if fails := atomic.LoadUint32(&p.host.fails); fails != tc.fails {
+			t.Errorf("For %q expected %d fails, got %d", tc.input, tc.fails, fails)
+		}
+		f.Close()
+	}
+
+	c := new(errChecker)
+	p := NewProxy(s.Addr)
+	p.SetHealthChecker(c)
+	p.host.resetFails()
+	p.host.Check()
+	if fails := atomic.LoadUint32(&p.host.fails); fails != 1 || c.addr != s.Addr {
+		t.Errorf("Expected the HealthChecker to check %s and fail, got %d fails for %q", s.Addr, fails, c.addr)
+	}
+	if n := p.clone(s.Addr); n.host.checker != c {
+		t.Errorf("Expected the HealthChecker to be kept by a clone")
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 health=http")); err == nil {
+		t.Errorf("Expected error for health=http")
+	}
+}
+
+func TestHealthBackoff(t *testing.T) {
+	h := newHost("127.0.0.1:53")
+	for _, tc := range []struct {
+		fails    uint32
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{10, 30 * time.Second},
+	} {
+		atomic.StoreUint32(&h.fails, tc.fails)
+		if next := h.nextCheck(time.Second, 30*time.Second); next != tc.expected {
+			t.Errorf("With %d fails expected %s, got: %s", tc.fails, tc.expected, next)
+		}
+	}
+	if next := h.nextCheck(time.Second, 0); next != time.Second {
+		t.Errorf("Expected no backoff without a maximum, got: %s", next)
+	}
+
+	// Half-open: three successes in a row are needed to reset the fails.
+	h.rise = 3
+	atomic.StoreUint32(&h.fails, 5)
+	for i := 0; i < 2; i++ {
+		if !h.halfOpen() {
+			t.Fatalf("Expected check %d to keep the host half-open", i+1)
+		}
+	}
+	if next := h.nextCheck(time.Second, 30*time.Second); next != time.Second {
+		t.Errorf("Expected the normal interval while half-open, got: %s", next)
+	}
+	if h.halfOpen() {
+		t.Errorf("Expected the third check to close the host")
+	}
+}
+
+func TestSetupHealthBackoff(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nhealth_backoff 30s 3\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p := f.proxies[0]
+	if p.hcBackoff != 30*time.Second || p.host.rise != 3 {
+		t.Errorf("Expected backoff 30s and rise 3, got: %s and %d", p.hcBackoff, p.host.rise)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nhealth_backoff\n}",
+		"forward . 127.0.0.1 {\nhealth_backoff 0s\n}",
+		"forward . 127.0.0.1 {\nhealth_backoff 30s 0\n}",
+		"forward . 127.0.0.1 {\nhealth_backoff 30s 3 4\n}",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestFailWindow(t *testing.T) {
+	h := newHost("127.0.0.1:53")
+	h.failWindow = 10 * time.Second
+	h.decay(time.Now())
+	if fails := atomic.LoadUint32(&h.fails); fails != 1 {
+		t.Errorf("Expected the fail before the first check to be kept, got: %d", fails)
+	}
+
+	atomic.StoreUint32(&h.fails, 3)
+	atomic.StoreInt64(&h.lastFail, time.Now().Add(-5*time.Second).UnixNano())
+	if !h.down(2) {
+		t.Errorf("Expected fails within the window to count")
+	}
+	atomic.StoreInt64(&h.lastFail, time.Now().Add(-11*time.Second).UnixNano())
+	if h.down(2) {
+		t.Errorf("Expected fails older than the window to be forgotten")
+	}
+	if fails := atomic.LoadUint32(&h.fails); fails != 0 {
+		t.Errorf("Expected 0 fails, got: %d", fails)
+	}
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nfail_window 1m\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if w := f.proxies[0].host.failWindow; w != time.Minute {
+		t.Errorf("Expected a fail window of 1m, got: %s", w)
+	}
+	for _, input := range []string{"fail_window", "fail_window 0s", "fail_window 1m 2m", "fail_window 100ms", "fail_window 10s\nhealth_backoff 30s"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}")); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestHealthJitter(t *testing.T) {
+	p := NewProxy("127.0.0.1:53")
+	defer p.close()
+	if d := p.jitter(time.Second); d != time.Second {
+		t.Errorf("Expected no jitter by default, got: %s", d)
+	}
+	p.hcJitter = 0.2
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		d := p.jitter(time.Second)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("Expected within 20%% of 1s, got: %s", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected random intervals, got: %v", seen)
+	}
+}
+
+func TestHealthSkipActive(t *testing.T) {
+	h := newHost("127.0.0.1:53")
+	h.answered(dns.RcodeSuccess)
+	if h.active(time.Second) {
+		t.Errorf("Expected a host with fails not to be active")
+	}
+	atomic.StoreUint32(&h.fails, 0)
+	if !h.active(time.Second) {
+		t.Errorf("Expected a host that just answered to be active")
+	}
+	atomic.StoreInt64(&h.lastAnswer, time.Now().Add(-2*time.Second).UnixNano())
+	h.answered(dns.RcodeServerFailure)
+	if h.active(time.Second) {
+		t.Errorf("Expected a SERVFAIL not to count as an answer")
+	}
+}
+
+func TestSetupHealthInterval(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 127.0.0.2 health_check=10s {\nhealth_check 1s\nhealth_jitter 10%\nhealth_skip_active\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if a, b := f.proxies[0].hcInterval, f.proxies[1].hcInterval; a != time.Second || b != 10*time.Second {
+		t.Errorf("Expected intervals 1s and 10s, got: %s and %s", a, b)
+	}
+	if p := f.proxies[0]; p.hcJitter != 0.1 || !p.hcSkipActive {
+		t.Errorf("Expected jitter 0.1 and skipping active upstreams, got: %f and %t", p.hcJitter, p.hcSkipActive)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 health_check=0s",
+		"forward . 127.0.0.1 {\nhealth_jitter\n}",
+		"forward . 127.0.0.1 {\nhealth_jitter 60%\n}",
+		"forward . 127.0.0.1 {\nhealth_skip_active yes\n}",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestHealthGauges(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	h := newHost(s.Addr)
+	h.SetClient()
+	h.Check()
+	if x := gaugeValue(HealthyGauge, h.id, s.Addr); x != 1 {
+		t.Errorf("Expected healthy 1, got: %f", x)
+	}
+	if x := gaugeValue(FailsGauge, h.id, s.Addr); x != 0 {
+		t.Errorf("Expected 0 fails, got: %f", x)
+	}
+
+	h = newHost("127.0.0.1:0") // nothing listens there
+	h.SetClient()
+	h.client.ReadTimeout = 100 * time.Millisecond
+	h.Check()
+	if x := gaugeValue(HealthyGauge, h.id, h.addr); x != 0 {
+		t.Errorf("Expected healthy 0, got: %f", x)
+	}
+	if x := gaugeValue(FailsGauge, h.id, h.addr); x != 2 {
+		t.Errorf("Expected 2 fails, got: %f", x)
+	}
+}
+
+func gaugeValue(g *prometheus.GaugeVec, labels ...string) float64 {
+	m := new(dto.Metric)
+	g.WithLabelValues(labels...).Write(m)
+	return m.GetGauge().GetValue()
+}
+
+func TestHealthStartup(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" "+deadAddr+" {\nhealth_startup 3s\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.hcStartup != 3*time.Second {
+		t.Errorf("Expected to wait 3s for the startup checks, got: %s", f.hcStartup)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.OnShutdown()
+
+	if f.proxies[0].Down(f.maxfails) {
+		t.Errorf("Expected %s to be up after its startup check", s.Addr)
+	}
+	if !f.proxies[1].Down(f.maxfails) {
+		t.Errorf("Expected %s to be down after failing its startup check", deadAddr)
+	}
+
+	for _, input := range []string{"health_startup 0s", "health_startup x", "health_startup 1s 2s"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}")); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+	if f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nhealth_startup\n}")); err != nil || f.hcStartup != hcStartupTimeout {
+		t.Errorf("Expected health_startup to default to %s, got: %v", hcStartupTimeout, err)
+	}
+}
+
+func TestDownCount(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.id = "downcount"
+	f.policy = sequential{}
+	f.SetHealthCheck(0)
+	defer f.Close()
+	down, up := NewProxy("127.0.0.1:1"), NewProxy(s.Addr)
+	f.AddProxy(down)
+	f.AddProxy(up)
+	up.host.resetFails()
+	atomic.StoreUint32(&down.host.fails, f.maxfails+1)
+
+	// Every query skips the upstream that is down, it went down once.
+	before := counterValue(DownCount, f.id, down.host.addr, "health")
+	for i := 0; i < 10; i++ {
+		if _, err := f.Forward(questionState("example.org.")); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+	}
+	if x := counterValue(DownCount, f.id, down.host.addr, "health"); x != before+1 {
+		t.Errorf("Expected 1 more down, got %.0f", x-before)
+	}
+
+	// Once it's up again, going down is counted again.
+	down.host.resetFails()
+	f.Forward(questionState("example.org."))
+	atomic.StoreUint32(&down.host.fails, f.maxfails+1)
+	f.Forward(questionState("example.org."))
+	if x := counterValue(DownCount, f.id, down.host.addr, "health"); x != before+2 {
+		t.Errorf("Expected 2 more down after it came up and went down again, got %.0f", x-before)
+	}
+}
@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// exchange sends state to proxy and returns the reply, the proxy that sent it and how long that took.
+// With hedge set, when proxy hasn't replied after the hedge delay the query also goes to the first
+// upstream in rest that is up, and the first reply wins. The other exchange is canceled. With
+// happy_eyeballs, a proxy that is slow to connect may be passed over for one in rest before that.
+func (f *Forward) exchange(ctx context.Context, state request.Request, proxy *Proxy, rest []*Proxy, forceTCP bool) (*dns.Msg, *Proxy, time.Duration, error) {
+	if f.happyEyeballs > 0 {
+		first := proxy
+		var err error
+		if proxy, err = f.eyeball(ctx, state, proxy, rest, forceTCP); err != nil {
+			return nil, proxy, 0, err
+		}
+		if proxy != first {
+			rest = without(rest, proxy)
+		}
+	}
+	if f.hedge == 0 {
+		start := time.Now()
+		upstream := f.upstreamState(state, proxy)
+		proxy.spend()
+		ret, err := proxy.query(ctx, upstream, forceTCP, true)
+		rtt := time.Since(start)
+		proxy.host.observe(ret, err, rtt)
+		f.tap(ctx, proxy, proxy.proto(upstream, forceTCP), upstream, ret, start)
+		return ret, proxy, rtt, err
+	}
+
+	type result struct {
+		ret   *dns.Msg
+		err   error
+		proxy *Proxy
+		rtt   time.Duration
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2) // buffered, the loser doesn't block
+	run := func(p *Proxy, state request.Request) {
+		go func() {
+			start := time.Now()
+			upstream := f.upstreamState(state, p)
+			p.spend()
+			ret, err := p.query(ctx, upstream, forceTCP, true)
+			rtt := time.Since(start)
+			p.host.observe(ret, err, rtt)
+			f.tap(ctx, p, p.proto(upstream, forceTCP), upstream, ret, start)
+			results <- result{ret, err, p, rtt}
+		}()
+	}
+
+	run(proxy, state)
+	pending := 1
+	timer := time.NewTimer(f.hedge)
+	defer timer.Stop()
+	fire := timer.C
+	for {
+		select {
+		case <-fire:
+			fire = nil
+			next := f.nextUp(rest)
+			if next == nil {
+				continue
+			}
+			HedgeCount.WithLabelValues(next.host.id, next.host.addr, "sent").Add(1)
+			// The exchanges mustn't share the message, a transport may change it while sending.
+			run(next, request.Request{W: state.W, Req: state.Req.Copy()})
+			pending++
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				continue // the other exchange may still succeed
+			}
+			if r.proxy != proxy && r.err == nil {
+				HedgeCount.WithLabelValues(r.proxy.host.id, r.proxy.host.addr, "won").Add(1)
+			}
+			return r.ret, r.proxy, r.rtt, r.err
+		}
+	}
+}
+
+// without returns list without p.
+func without(list []*Proxy, p *Proxy) []*Proxy {
+	ret := make([]*Proxy, 0, len(list))
+	for _, q := range list {
+		if q != p {
+			ret = append(ret, q)
+		}
+	}
+	return ret
+}
+
+// nextUp returns the first proxy in list that isn't down or at its max_qps, or nil if there is none.
+func (f *Forward) nextUp(list []*Proxy) *Proxy {
+	for _, p := range list {
+		if !p.Down(f.maxfails) && !p.throttled() {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestHedge(t *testing.T) {
+	// The first query for example.org. is slow, the hedged one gets an answer right away.
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.org." {
+			if atomic.AddInt32(&queries, 1) == 1 {
+				time.Sleep(500 * time.Millisecond)
+			}
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.hedge = 20 * time.Millisecond
+	f.SetPolicy(sequential{})
+	f.SetProxy(NewProxy(s.Addr))
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+	for _, p := range f.proxies {
+		p.host.fails = 0
+	}
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	resp, info, err := f.ForwardWithInfo(state)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, got: %s", err)
+	}
+	if len(resp.Answer) != 1 || resp.Id != state.Req.Id {
+		t.Errorf("Expected the answer to the query, got: %s", resp)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("Expected the hedged reply within 250ms, took: %s", d)
+	}
+	if info.Attempts != 1 {
+		t.Errorf("Expected a single attempt, got: %d", info.Attempts)
+	}
+	if x := atomic.LoadInt32(&queries); x != 2 {
+		t.Errorf("Expected 2 queries, got: %d", x)
+	}
+}
+
+func TestSetupHedge(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  time.Duration
+	}{
+		{"forward . 127.0.0.1 {\nhedge 20ms\n}\n", false, 20 * time.Millisecond},
+		{"forward . 127.0.0.1\n", false, 0},
+		{"forward . 127.0.0.1 {\nhedge 0s\n}\n", true, 0},
+		{"forward . 127.0.0.1 {\nhedge 3s\n}\n", true, 0},
+		{"forward . 127.0.0.1 {\nhedge\n}\n", true, 0},
+	}
+
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+			continue
+		}
+		if f.hedge != tc.expected {
+			t.Errorf("Test %d: expected %s, got: %s", i, tc.expected, f.hedge)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package forward
+
+import (
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// PreForwardFunc is called for every request before it is forwarded. The request's qname, qtype and
+// client are available from state. The returned Verdict decides what happens with the request.
+type PreForwardFunc func(state request.Request) Verdict
+
+// Verdict is the outcome of a PreForwardFunc.
+type Verdict struct {
+	Action Action
+
+	// Upstreams, with ActionForward, restricts the upstreams used to these addresses. Empty
+	// means all upstreams.
+	Upstreams []string
+	// Reply, with ActionReply, is the response sent to the client.
+	Reply *dns.Msg
+	// Rcode, with ActionReject, is the rcode sent to the client. Zero means REFUSED.
+	Rcode int
+}
+
+// Action is what to do with a request.
+type Action int
+
+const (
+	// ActionForward forwards the request.
+	ActionForward Action = iota
+	// ActionReply answers the request with Verdict.Reply.
+	ActionReply
+	// ActionReject answers the request with Verdict.Rcode.
+	ActionReject
+)
+
+// SetPreForward sets the function called before a request is forwarded.
+func (f *Forward) SetPreForward(fn PreForwardFunc) { f.preForward = fn }
+
+// QueryFunc is called for every attempt with a copy of the query, before it is sent to the upstream
+// with address upstream. It may modify req, e.g. add EDNS0 options or change flags, or return another
+// message. If it returns nil, req is sent. The reply is given the ID and question of the original query.
+type QueryFunc func(state request.Request, upstream string, req *dns.Msg) *dns.Msg
+
+// SetQueryFunc sets the function that can modify the query sent to each upstream.
+func (f *Forward) SetQueryFunc(fn QueryFunc) { f.queryFunc = fn }
+
+// upstreamState returns the state to send to p, after applying the QueryFunc of f.
+func (f *Forward) upstreamState(state request.Request, p *Proxy) request.Request {
+	if f.queryFunc == nil {
+		return state
+	}
+	req := state.Req.Copy()
+	if m := f.queryFunc(state, p.host.addr, req); m != nil {
+		req = m
+	}
+	return request.Request{W: state.W, Req: req}
+}
+
+// restore makes ret a reply to the client's query in state, undoing what a QueryFunc did to the
+// ID and question.
+func restore(state request.Request, ret *dns.Msg) {
+	ret.Id = state.Req.Id
+	if len(ret.Question) == len(state.Req.Question) {
+		copy(ret.Question, state.Req.Question)
+	}
+}
+
+// PostForwardFunc is called with the reply of the upstream before it is written to the client. It
+// may modify resp or return another message. If it returns nil, resp is written.
+type PostForwardFunc func(state request.Request, resp *dns.Msg) *dns.Msg
+
+// SetPostForward sets the function called with the upstream's reply before it is written.
+func (f *Forward) SetPostForward(fn PostForwardFunc) { f.postForward = fn }
+
+// ResponseHook can change the reply of an upstream before it is written to the client, e.g. to drop
+// the upstream's NSID, clamp TTLs or rewrite a CNAME chain.
+type ResponseHook interface {
+	// OnResponse may modify resp or return another message. If it returns nil, resp is written.
+	OnResponse(state request.Request, resp *dns.Msg) *dns.Msg
+}
+
+// OnResponse calls fn, a PostForwardFunc is a ResponseHook.
+func (fn PostForwardFunc) OnResponse(state request.Request, resp *dns.Msg) *dns.Msg {
+	return fn(state, resp)
+}
+
+// AddResponseHook adds h to the hooks called with the upstream's reply before it is written. They
+// are called in the order they were added, after the PostForwardFunc, each with the reply of the one
+// before. It must be called before f serves queries.
+func (f *Forward) AddResponseHook(h ResponseHook) { f.responseHooks = append(f.responseHooks, h) }
+
+// onResponse returns the reply to write for ret, after the PostForwardFunc and response hooks of f.
+func (f *Forward) onResponse(state request.Request, ret *dns.Msg) *dns.Msg {
+	if f.postForward != nil {
+		if m := f.postForward(state, ret); m != nil {
+			ret = m
+		}
+	}
+	for _, h := range f.responseHooks {
+		if m := h.OnResponse(state, ret); m != nil {
+			ret = m
+		}
+	}
+	return ret
+}
+
+// applyVerdict returns the proxies to use for v, or the reply to send when the request isn't forwarded.
+func applyVerdict(state request.Request, v Verdict, list []*Proxy) ([]*Proxy, *dns.Msg) {
+	switch v.Action {
+	case ActionReply:
+		if v.Reply != nil {
+			v.Reply.Id = state.Req.Id
+			return nil, v.Reply
+		}
+		fallthrough
+	case ActionReject:
+		rcode := v.Rcode
+		if rcode == 0 {
+			rcode = dns.RcodeRefused
+		}
+		m := new(dns.Msg)
+		m.SetRcode(state.Req, rcode)
+		return nil, m
+	}
+
+	if len(v.Upstreams) == 0 {
+		return list, nil
+	}
+	subset := make([]*Proxy, 0, len(v.Upstreams))
+	for _, p := range list {
+		for _, addr := range v.Upstreams {
+			if p.host.addr == addr {
+				subset = append(subset, p)
+				break
+			}
+		}
+	}
+	return subset, nil
+}
@@ -0,0 +1,199 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestPreForward(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	f.SetPreForward(func(state request.Request) Verdict {
+		switch state.Name() {
+		case "blocked.org.":
+			return Verdict{Action: ActionReject, Rcode: dns.RcodeNameError}
+		case "elsewhere.org.":
+			return Verdict{Upstreams: []string{"127.0.0.1:1"}}
+		}
+		return Verdict{}
+	})
+
+	tests := []struct {
+		qname         string
+		expectedErr   bool
+		expectedRcode int
+	}{
+		{"example.org.", false, dns.RcodeSuccess},
+		{"blocked.org.", false, dns.RcodeNameError},
+		{"elsewhere.org.", true, 0},
+	}
+
+	for i, tc := range tests {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion(tc.qname, dns.TypeA)
+		resp, err := f.Forward(state)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if resp.Rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got: %d", i, tc.expectedRcode, resp.Rcode)
+		}
+	}
+}
+
+func TestPostForward(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 10.0.0.1"), test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	// Filter out the private address.
+	f.SetPostForward(func(state request.Request, resp *dns.Msg) *dns.Msg {
+		rrs := resp.Answer[:0]
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok && a.A.IsLoopback() {
+				rrs = append(rrs, rr)
+			}
+		}
+		resp.Answer = rrs
+		return nil
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected 1 answer after filtering, got: %d", len(rec.Msg.Answer))
+	}
+}
+
+// nsidScrubber drops the NSID option from the replies.
+type nsidScrubber struct{}
+
+func (nsidScrubber) OnResponse(state request.Request, resp *dns.Msg) *dns.Msg {
+	stripOptions(resp, map[uint16]bool{dns.EDNS0NSID: true})
+	return nil
+}
+
+func TestResponseHook(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(4096, false)
+		ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7570"})
+		ret.Rcode = dns.RcodeNameError
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.from = "."
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	var order []string
+	f.SetPostForward(func(state request.Request, resp *dns.Msg) *dns.Msg {
+		order = append(order, "post")
+		return nil
+	})
+	f.AddResponseHook(nsidScrubber{})
+	f.AddResponseHook(PostForwardFunc(func(state request.Request, resp *dns.Msg) *dns.Msg {
+		order = append(order, "rcode")
+		if resp.IsEdns0() == nil || len(resp.IsEdns0().Option) != 0 {
+			t.Errorf("Expected the hooks to be called in order, got options: %v", resp.IsEdns0())
+		}
+		m := resp.Copy()
+		m.Rcode = dns.RcodeSuccess
+		return m
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the rewritten rcode, got: %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+	if len(order) != 2 || order[0] != "post" || order[1] != "rcode" {
+		t.Errorf("Expected the PostForwardFunc before the hooks, got: %v", order)
+	}
+}
+
+func TestQueryFunc(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.CheckingDisabled {
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	var upstream string
+	f.SetQueryFunc(func(state request.Request, up string, req *dns.Msg) *dns.Msg {
+		upstream = up
+		req.Id++
+		req.Question[0].Name = "eXaMpLe.OrG."
+		req.CheckingDisabled = true
+		return nil
+	})
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, err := f.Forward(state)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if upstream != s.Addr {
+		t.Errorf("Expected upstream %s, got: %s", s.Addr, upstream)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("Expected the modified query to be sent")
+	}
+	if resp.Id != state.Req.Id || resp.Question[0].Name != "example.org." {
+		t.Errorf("Expected the ID and question of the client's query, got: %d %s", resp.Id, resp.Question[0].Name)
+	}
+	if state.Req.CheckingDisabled {
+		t.Errorf("Expected the client's query to be left alone")
+	}
+}
@@ -6,32 +6,98 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 type host struct {
+	noEDNSUntil int64 // unix nanoseconds until which queries are sent without EDNS, first for 64 bit alignment
+	keepalive   int64 // idle timeout of TCP connections advertised by the upstream, -1 for none, 0 if unknown
+
+	queries       int64 // queries sent, for the admin endpoint
+	bytesSent     int64
+	bytesReceived int64
+
 	addr   string
+	id     string // ID of the Forward this host belongs to
+	tag    string // free-form label set in the Corefile, e.g. vendor=quad9
 	client *dns.Client
 
-	tlsConfig *tls.Config
-	expire    time.Duration
+	exporter Exporter
+	log      *logger
+
+	tlsConfig   *tls.Config
+	expire      time.Duration
+	protoExpire map[string]time.Duration // overrides expire for a protocol, "udp", "tcp" or "tcp-tls"
+
+	bind         *bind         // if not nil, the local address and device to connect from
+	via          *via          // if not nil, the proxy server TCP connections are tunneled through
+	dialer       Dialer        // if not nil, makes the connections instead
+	dialTimeout  time.Duration // for setting up a connection, including the TLS handshake
+	readTimeout  time.Duration // for the reply, after the query was written
+	writeTimeout time.Duration // for writing the query
+
+	chain *fallback // if not nil, the transports to use in order of preference
+	exch  exchanger // if not nil, send queries with this instead of over a dns.Conn, e.g. with DoH
+	probe *probe
+
+	cookie        *cookie // if not nil, send DNS cookies
+	ednsKeepalive bool    // send the edns-tcp-keepalive option over TCP and TLS
+	padding       int     // if > 0, pad queries over TLS, HTTPS and QUIC to a multiple of this many bytes
+	proxyProtocol bool    // start TCP and TLS connections with a PROXY protocol v2 header
+	randomCase    bool    // randomize the case of the query name over UDP, and check the reply has it
+
+	hc        *hcQuery      // health check query, nil is defaultHealthQuery
+	checker   HealthChecker // if not nil, checks the host instead of hc
+	untrusted uint32        // set to 1 when the probe doesn't match
+
+	servfails *servfailRate // if not nil, the host is down when too many replies are SERVFAIL
 
-	fails uint32
+	score score
+	meter *meter // queries per second, for the peak QPS
+
+	fails     uint32
+	successes uint32 // checks in a row that succeeded while fails > 0
+	wasDown   uint32 // 1 while the queries see the host as down, see Proxy.Down
+	rise      uint32 // if > 1, the number of successful checks needed to reset fails
+
+	failWindow time.Duration // if > 0, fails are forgotten when the last one is older than this
+	lastFail   int64         // unix nano of the last failed check
+	lastAnswer int64         // unix nano of the last working reply to a client's query
 	sync.RWMutex
 	checking bool
 }
 
+// exchanger sends queries over a transport that isn't a dns.Conn.
+type exchanger interface {
+	exchange(ctx context.Context, h *host, req *dns.Msg) (*dns.Msg, error)
+	proto() string    // name of the transport, e.g. "https"
+	clone() exchanger // a new exchanger to the same upstream, not sharing connections
+	reset()           // close the connections, the next query makes new ones
+	close()           // close the connections
+}
+
 // newHost returns a new host, the fails are set to 1, i.e.
 // the first healthcheck must succeed before we use this host.
 func newHost(addr string) *host {
-	return &host{addr: addr, fails: 1}
+	return &host{addr: addr, id: "forward", exporter: multiExporter{}, meter: newMeter(accountingWindow), fails: 1,
+		dialTimeout: dialTimeout, readTimeout: timeout, writeTimeout: timeout}
+}
+
+// String returns the address of h, followed by its tag if it has one.
+func (h *host) String() string {
+	if h.tag == "" {
+		return h.addr
+	}
+	return h.addr + " [" + h.tag + "]"
 }
 
 // setClient sets and configures the dns.Client in host.
 func (h *host) SetClient() {
 	c := new(dns.Client)
 	c.Net = "udp"
-	c.ReadTimeout = 2 * time.Second
-	c.WriteTimeout = 2 * time.Second
+	c.DialTimeout = h.dialTimeout
+	c.ReadTimeout = h.readTimeout
+	c.WriteTimeout = h.writeTimeout
 
 	if h.tlsConfig != nil {
 		c.Net = "tcp-tls"
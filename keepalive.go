@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// withKeepalive returns a copy of req with an edns-tcp-keepalive option (RFC 7828), instead of the
+// client's, so the upstream tells us how long it keeps idle connections open. A query without an
+// OPT RR is returned as is.
+func withKeepalive(req *dns.Msg) *dns.Msg {
+	if req.IsEdns0() == nil {
+		return req
+	}
+	r := req.Copy()
+	o := r.IsEdns0()
+	// EDNS0_TCP_KEEPALIVE of miekg/dns doesn't pack to the format of the RFC, send the option ourselves.
+	o.Option = append(withoutKeepalive(o.Option), &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	return r
+}
+
+// learnKeepalive remembers the idle timeout in the edns-tcp-keepalive option of ret, if it has one,
+// and removes the option from ret: it's about our connection, not the client's.
+func (h *host) learnKeepalive(ret *dns.Msg) {
+	o := ret.IsEdns0()
+	if o == nil {
+		return
+	}
+	for _, e := range o.Option {
+		timeout, ok := keepaliveTimeout(e)
+		if !ok {
+			continue
+		}
+		d := int64(timeout) * int64(100*time.Millisecond)
+		if d == 0 {
+			d = -1 // the upstream wants us to close idle connections
+		}
+		atomic.StoreInt64(&h.keepalive, d)
+	}
+	o.Option = withoutKeepalive(o.Option)
+}
+
+// idle returns how long a connection of type proto to h may be idle before we close it: the expire
+// duration of proto, or for TCP and TLS just under the idle timeout h advertised, if it did.
+func (h *host) idle(proto string) time.Duration {
+	k := atomic.LoadInt64(&h.keepalive)
+	switch {
+	case proto == "udp" || k == 0:
+		if d, ok := h.protoExpire[proto]; ok {
+			return d
+		}
+		return h.expire
+	case k < 0:
+		return 0
+	}
+	return time.Duration(k - k/10)
+}
+
+// keepaliveTimeout returns the timeout in units of 100 milliseconds of e, if e is an edns-tcp-keepalive
+// option with a timeout.
+func keepaliveTimeout(e dns.EDNS0) (uint16, bool) {
+	switch k := e.(type) {
+	case *dns.EDNS0_TCP_KEEPALIVE:
+		return k.Timeout, k.Length == 2
+	case *dns.EDNS0_LOCAL:
+		if k.Code == dns.EDNS0TCPKEEPALIVE && len(k.Data) == 2 {
+			return binary.BigEndian.Uint16(k.Data), true
+		}
+	}
+	return 0, false
+}
+
+// withoutKeepalive returns a copy of opts without edns-tcp-keepalive options.
+func withoutKeepalive(opts []dns.EDNS0) []dns.EDNS0 {
+	var rest []dns.EDNS0
+	for _, e := range opts {
+		if e.Option() != dns.EDNS0TCPKEEPALIVE {
+			rest = append(rest, e)
+		}
+	}
+	return rest
+}
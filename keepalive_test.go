@@ -0,0 +1,69 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestEDNSKeepalive(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if o := r.IsEdns0(); o != nil {
+			ret.SetEdns0(4096, false)
+			for _, e := range o.Option {
+				if e.Option() == dns.EDNS0TCPKEEPALIVE {
+					ro := ret.IsEdns0()
+					ro.Option = append(ro.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 20}})
+				}
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	p.SetExpire(defaultExpire)
+	p.host.ednsKeepalive = true
+	defer p.close()
+
+	query := func(forceTCP bool) *dns.Msg {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		state.Req.SetEdns0(4096, false)
+		ret, err := p.connect(context.Background(), state, forceTCP, false)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if len(state.Req.IsEdns0().Option) != 0 {
+			t.Error("Expected the query of the client to be left alone")
+		}
+		return ret
+	}
+
+	ret := query(false)
+	if len(ret.IsEdns0().Option) != 0 {
+		t.Error("Expected no edns-tcp-keepalive over UDP")
+	}
+	if d := p.host.idle("tcp"); d != defaultExpire {
+		t.Errorf("Expected an idle timeout of %s before any TCP query, got: %s", defaultExpire, d)
+	}
+
+	ret = query(true)
+	if len(ret.IsEdns0().Option) != 0 {
+		t.Errorf("Expected the edns-tcp-keepalive option to be removed from the reply, got: %v", ret.IsEdns0().Option)
+	}
+	if d := p.host.idle("tcp"); d != 1800*time.Millisecond {
+		t.Errorf("Expected an idle timeout of 1.8s, got: %s", d)
+	}
+	if d := p.host.idle("udp"); d != defaultExpire {
+		t.Errorf("Expected the UDP idle timeout to be %s, got: %s", defaultExpire, d)
+	}
+}
@@ -0,0 +1,227 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// The levels, from least to most severe. The zero Level is LevelInfo.
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	}
+	return "error"
+}
+
+// parseLevel returns the level named s.
+func parseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: '%s'", s)
+}
+
+// Logger receives the log lines of a Forward, instead of the CoreDNS log, see SetLogger. Event is a
+// stable name of what happened, e.g. "upstream_failed", fields are its details.
+type Logger interface {
+	Log(level Level, id, event, msg string, fields ...Field)
+}
+
+// Field is a key and value of a log line, such as "upstream" and its address.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// logger writes the log lines of a Forward. They are text, "[LEVEL] [id] msg", unless json is set,
+// then every line is a JSON object with the fields time, level, id, event and msg, followed by the
+// fields of the event. Lines below level are dropped, and with rate set an event, per upstream, is
+// logged at most once per rate. A nil logger writes text at level info, as does the zero logger.
+type logger struct {
+	json    bool
+	queries bool      // also log every forwarded query
+	out     io.Writer // where JSON lines go, nil is standard output, where CoreDNS logs to
+	custom  Logger    // if not nil, gets the lines instead
+	level   Level
+
+	rate    time.Duration
+	mu      sync.Mutex
+	limited map[string]*limit // by event and upstream
+}
+
+// limit is when an event was last logged, and how often it was dropped since.
+type limit struct {
+	last       time.Time
+	suppressed int
+}
+
+// enabled returns true if lines at level are logged.
+func (l *logger) enabled(level Level) bool {
+	if l == nil {
+		return level >= LevelInfo
+	}
+	return level >= l.level
+}
+
+// allow returns whether the event with fields may be logged now, and how many times it was dropped
+// since it was last logged.
+func (l *logger) allow(event string, fields []Field) (bool, int) {
+	if l.rate <= 0 || event == "query" {
+		return true, 0
+	}
+	key := event
+	for _, f := range fields {
+		if f.Key == "upstream" {
+			key += " " + fmt.Sprint(f.Value)
+		}
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limited == nil {
+		l.limited = make(map[string]*limit)
+	}
+	lim, ok := l.limited[key]
+	if !ok {
+		l.limited[key] = &limit{last: now}
+		return true, 0
+	}
+	if now.Sub(lim.last) < l.rate {
+		lim.suppressed++
+		return false, 0
+	}
+	n := lim.suppressed
+	lim.last, lim.suppressed = now, 0
+	return true, n
+}
+
+// print logs msg at level for the Forward with id.
+func (l *logger) print(level Level, id, event, msg string, fields ...Field) {
+	if !l.enabled(level) {
+		return
+	}
+	if l == nil {
+		log.Printf("[%s] [%s] %s", strings.ToUpper(level.String()), id, msg)
+		return
+	}
+	ok, suppressed := l.allow(event, fields)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar lines suppressed)", msg, suppressed)
+		fields = append(fields[:len(fields):len(fields)], Field{"suppressed", suppressed})
+	}
+	if l.custom != nil {
+		l.custom.Log(level, id, event, msg, fields...)
+		return
+	}
+	if !l.json {
+		log.Printf("[%s] [%s] %s", strings.ToUpper(level.String()), id, msg)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	add := func(key string, value interface{}) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(err.Error())
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	add("time", time.Now().UTC().Format(time.RFC3339Nano))
+	add("level", level.String())
+	add("id", id)
+	add("event", event)
+	add("msg", msg)
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			f.Value = err.Error()
+		}
+		add(f.Key, f.Value)
+	}
+	b.WriteString("}\n")
+
+	out := l.out
+	if out == nil {
+		out = os.Stdout
+	}
+	logMu.Lock()
+	out.Write(b.Bytes())
+	logMu.Unlock()
+}
+
+func (l *logger) debug(id, event, msg string, fields ...Field) {
+	l.print(LevelDebug, id, event, msg, fields...)
+}
+
+func (l *logger) info(id, event, msg string, fields ...Field) {
+	l.print(LevelInfo, id, event, msg, fields...)
+}
+
+func (l *logger) warning(id, event, msg string, fields ...Field) {
+	l.print(LevelWarning, id, event, msg, fields...)
+}
+
+func (l *logger) error(id, event, msg string, fields ...Field) {
+	l.print(LevelError, id, event, msg, fields...)
+}
+
+// logQueries returns true if every forwarded query is logged: with log_queries, or at level debug.
+func (l *logger) logQueries() bool { return l != nil && (l.queries || l.level == LevelDebug) }
+
+// logQuery logs the forwarding of state, which resulted in ret or err.
+func (f *Forward) logQuery(state request.Request, ret *dns.Msg, info Info, err error) {
+	client, qname, qtype := f.redact.ip(state.IP()), f.redact.name(state.Name()), state.Type()
+	level := LevelDebug
+	if f.log.queries {
+		level = LevelInfo
+	}
+	if err != nil {
+		f.log.print(level, f.id, "query", fmt.Sprintf("%s %s %s failed after %d attempts: %s", client, qname, qtype, info.Attempts, err),
+			Field{"client", client}, Field{"qname", qname}, Field{"qtype", qtype}, Field{"attempts", info.Attempts}, Field{"error", err})
+		return
+	}
+	rcode := rcodeString(ret.Rcode)
+	f.log.print(level, f.id, "query", fmt.Sprintf("%s %s %s %s from %s over %s in %s", client, qname, qtype, rcode, info.Upstream, info.Proto, info.RTT),
+		Field{"client", client}, Field{"qname", qname}, Field{"qtype", qtype}, Field{"rcode", rcode},
+		Field{"upstream", info.Upstream}, Field{"proto", info.Proto}, Field{"rtt_ms", float64(info.RTT) / float64(time.Millisecond)},
+		Field{"attempts", info.Attempts})
+}
+
+var logMu sync.Mutex
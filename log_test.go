@@ -0,0 +1,129 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{json: true, out: &buf}
+	l.warning("example.org.#0", "upstream_failed", "Failed to connect to 10.0.0.1:53: timeout",
+		Field{"upstream", "10.0.0.1:53"}, Field{"error", errors.New("timeout")})
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %s", buf.String(), err)
+	}
+	for k, v := range map[string]string{"level": "warning", "id": "example.org.#0", "event": "upstream_failed", "upstream": "10.0.0.1:53", "error": "timeout"} {
+		if m[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, m[k])
+		}
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":`) {
+		t.Errorf("Expected time to be the first field, got %q", buf.String())
+	}
+}
+
+func TestLogQueries(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	var buf bytes.Buffer
+	f := New()
+	f.from = "."
+	f.log = &logger{json: true, queries: true, out: &buf}
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	logMu.Lock() // the health checks log too
+	out := buf.String()
+	logMu.Unlock()
+
+	var line map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		json.Unmarshal([]byte(l), &line)
+		if line["event"] == "query" {
+			break
+		}
+	}
+	if line["event"] != "query" {
+		t.Fatalf("Expected a query log line, got: %q", out)
+	}
+	for k, v := range map[string]interface{}{"qname": "example.org.", "qtype": "A", "rcode": "NOERROR", "upstream": s.Addr, "proto": "udp", "attempts": 1.0} {
+		if line[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, line[k])
+		}
+	}
+}
+
+type testLogger struct{ lines []string }
+
+func (l *testLogger) Log(level Level, id, event, msg string, fields ...Field) {
+	l.lines = append(l.lines, level.String()+" "+event+" "+msg)
+}
+
+func TestLoggerLevelAndRate(t *testing.T) {
+	tl := &testLogger{}
+	l := &logger{custom: tl, level: LevelWarning, rate: time.Hour}
+	l.info("test", "upstream_healthy", "10.0.0.1:53 is healthy", Field{"upstream", "10.0.0.1:53"})
+	for i := 0; i < 3; i++ {
+		l.warning("test", "upstream_unhealthy", "10.0.0.1:53 is unhealthy", Field{"upstream", "10.0.0.1:53"})
+	}
+	l.warning("test", "upstream_unhealthy", "10.0.0.2:53 is unhealthy", Field{"upstream", "10.0.0.2:53"})
+	l.error("test", "upstream_unhealthy", "10.0.0.1:53 is unhealthy", Field{"upstream", "10.0.0.1:53"})
+
+	expected := []string{"warning upstream_unhealthy 10.0.0.1:53 is unhealthy", "warning upstream_unhealthy 10.0.0.2:53 is unhealthy"}
+	if strings.Join(tl.lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected %q, got %q", expected, tl.lines)
+	}
+
+	// Once the rate allows it again, the line says how many were dropped.
+	l.limited["upstream_unhealthy 10.0.0.1:53"].last = time.Now().Add(-2 * time.Hour)
+	l.warning("test", "upstream_unhealthy", "10.0.0.1:53 is unhealthy", Field{"upstream", "10.0.0.1:53"})
+	if last := tl.lines[len(tl.lines)-1]; last != "warning upstream_unhealthy 10.0.0.1:53 is unhealthy (3 similar lines suppressed)" {
+		t.Errorf("Expected the suppressed lines to be counted, got %q", last)
+	}
+
+	if (&logger{}).logQueries() || !(&logger{level: LevelDebug}).logQueries() {
+		t.Error("Expected queries to be logged at level debug only")
+	}
+}
+
+func TestSetupLogLevel(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nlog_level warning\nlog_ratelimit 1m\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.log.level != LevelWarning || f.log.rate != time.Minute {
+		t.Errorf("Expected level warning and rate 1m, got %s and %s", f.log.level, f.log.rate)
+	}
+	for _, input := range []string{"log_level", "log_level verbose", "log_ratelimit -1s", "log_ratelimit often"} {
+		c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
@@ -5,8 +5,6 @@
 package forward
 
 import (
-	"crypto/tls"
-	"log"
 	"time"
 
 	"github.com/coredns/coredns/request"
@@ -22,32 +20,26 @@ func (f *Forward) Forward(state request.Request) (*dns.Msg, error) {
 		return nil, errNoForward
 	}
 
-	fails := 0
-	for _, proxy := range f.list() {
-		if proxy.Down(f.maxfails) {
-			fails++
-			if fails < len(f.proxies) {
-				continue
-			}
-			// All upstream proxies are dead, assume healtcheck is complete broken and randomly
-			// select an upstream to connect to.
-			proxy = f.list()[0]
-			log.Printf("[WARNING] All upstreams down, picking random one to connect to %s", proxy.host.addr)
-		}
-
-		ret, err := proxy.connect(context.Background(), state, f.forceTCP, true)
-		if err != nil {
-			log.Printf("[WARNING] Failed to connect to %s: %s", proxy.host.addr, err)
-			if fails < len(f.proxies) {
-				continue
-			}
-			break
+	ret, _, err := f.forward(context.Background(), state)
+	return ret, err
+}
 
-		}
+// Info describes how a reply was obtained.
+type Info struct {
+	Upstream string        // address of the upstream that answered
+	Proto    string        // transport used: udp, tcp, tcp-tls, https or quic
+	RTT      time.Duration // duration of the exchange with Upstream
+	Attempts int           // number of upstreams tried
+}
 
-		return ret, nil
+// ForwardWithInfo is like Forward, but also returns how the reply was obtained. On error only
+// Attempts is set.
+func (f *Forward) ForwardWithInfo(state request.Request) (*dns.Msg, Info, error) {
+	if f == nil {
+		return nil, Info{}, errNoForward
 	}
-	return nil, errNoHealthy
+
+	return f.forward(context.Background(), state)
 }
 
 // Lookup will use name and type to forge a new message and will send that upstream. It will
@@ -58,18 +50,28 @@ func (f *Forward) Lookup(state request.Request, name string, typ uint16) (*dns.M
 		return nil, errNoForward
 	}
 
+	ret, _, err := f.LookupWithInfo(state, name, typ)
+	return ret, err
+}
+
+// LookupWithInfo is like Lookup, but also returns how the reply was obtained.
+func (f *Forward) LookupWithInfo(state request.Request, name string, typ uint16) (*dns.Msg, Info, error) {
+	if f == nil {
+		return nil, Info{}, errNoForward
+	}
+
 	req := new(dns.Msg)
 	req.SetQuestion(name, typ)
 	state.SizeAndDo(req)
 
 	state2 := request.Request{W: state.W, Req: req}
 
-	return f.Forward(state2)
+	return f.ForwardWithInfo(state2)
 }
 
 // NewLookup returns a Forward that can be used for plugin that need an upstream to resolve external names.
 func NewLookup(addr []string) *Forward {
-	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: 10 * time.Second, hcInterval: hcDuration}
+	f := New()
 	for i := range addr {
 		p := NewProxy(addr[i])
 		f.SetProxy(p)
@@ -39,3 +39,35 @@ func TestLookup(t *testing.T) {
 		t.Errorf("Expected 127.0.0.1, got: %s", resp.Answer[0].(*dns.A).A.String())
 	}
 }
+
+func TestLookupWithInfo(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	_, info, err := f.LookupWithInfo(state, "example.org.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if info.Upstream != s.Addr {
+		t.Errorf("Expected upstream %s, got %s", s.Addr, info.Upstream)
+	}
+	if info.Proto != "udp" {
+		t.Errorf("Expected proto udp, got %s", info.Proto)
+	}
+	if info.Attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", info.Attempts)
+	}
+	if info.RTT <= 0 {
+		t.Errorf("Expected a positive RTT, got %s", info.RTT)
+	}
+}
@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// window is a recurring period during which an upstream is administratively down. It starts
+// whenever the cron-like schedule matches and lasts for duration.
+type window struct {
+	sched    schedule
+	duration time.Duration
+}
+
+// schedule holds the minute, hour, day of month, month and day of week fields of a cron spec
+// as bitsets.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+}
+
+// maintenance holds the windows of one proxy, and caches the outcome per minute because Down is
+// called for every query.
+type maintenance struct {
+	windows []window
+
+	sync.Mutex
+	minute int64
+	active bool
+}
+
+func (m *maintenance) add(w window) {
+	m.Lock()
+	m.windows = append(m.windows, w)
+	m.minute = 0
+	m.Unlock()
+}
+
+// down returns true if t falls in any of the windows.
+func (m *maintenance) down(t time.Time) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.windows) == 0 {
+		return false
+	}
+	minute := t.Unix() / 60
+	if minute == m.minute {
+		return m.active
+	}
+
+	m.minute = minute
+	m.active = false
+	for _, w := range m.windows {
+		if w.active(t) {
+			m.active = true
+			break
+		}
+	}
+	return m.active
+}
+
+// active returns true if a window started within duration before t.
+func (w window) active(t time.Time) bool {
+	t = t.Truncate(time.Minute)
+	for d := time.Duration(0); d < w.duration; d += time.Minute {
+		if w.sched.match(t.Add(-d)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s schedule) match(t time.Time) bool {
+	return s.minute&(1<<uint(t.Minute())) != 0 &&
+		s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.dom&(1<<uint(t.Day())) != 0 &&
+		s.month&(1<<uint(t.Month())) != 0 &&
+		s.dow&(1<<uint(t.Weekday())) != 0
+}
+
+// parseSchedule parses a 5 field cron spec: minute, hour, day of month, month and day of
+// week. Each field is a '*', a number, a range 'N-M' or a list of those separated by commas. A
+// step may be added with '/S'.
+func parseSchedule(spec string) (schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return schedule{}, fmt.Errorf("expected 5 fields in schedule, got %d: %q", len(fields), spec)
+	}
+
+	s := schedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return s, err
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return s, err
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return s, err
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return s, err
+	}
+	if s.dow, err = parseField(fields[4], 0, 6); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func parseField(field string, min, max int) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in schedule: %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in schedule: %q", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in schedule: %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range [%d, %d] in schedule: %q", min, max, part)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
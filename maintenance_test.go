@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	sched, err := parseSchedule("30 3 * * 0")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	w := window{sched: sched, duration: 2 * time.Hour}
+
+	tests := []struct {
+		t      time.Time
+		active bool
+	}{
+		{time.Date(2018, 2, 4, 3, 29, 0, 0, time.Local), false}, // Sunday
+		{time.Date(2018, 2, 4, 3, 30, 0, 0, time.Local), true},
+		{time.Date(2018, 2, 4, 5, 29, 59, 0, time.Local), true},
+		{time.Date(2018, 2, 4, 5, 30, 0, 0, time.Local), false},
+		{time.Date(2018, 2, 5, 4, 0, 0, 0, time.Local), false}, // Monday
+	}
+	for i, test := range tests {
+		if x := w.active(test.t); x != test.active {
+			t.Errorf("Test %d: expected %t for %s, got %t", i, test.active, test.t, x)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec      string
+		shouldErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 0-6 1,15 * 1-5", false},
+		{"0 3 * *", true},
+		{"60 * * * *", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+	}
+	for i, test := range tests {
+		_, err := parseSchedule(test.spec)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error for %q, got none", i, test.spec)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error for %q, got: %s", i, test.spec, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// mdns resolves queries with multicast DNS (RFC 6762) on the link of an interface. It sends
+// "legacy unicast" queries: from an ephemeral port, so responders reply over unicast to us only.
+type mdns struct {
+	ifi *net.Interface // nil means the system's default multicast interface
+}
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// newMDNSProxy returns a proxy that resolves over mDNS on the interface named iface, which may
+// be empty.
+func newMDNSProxy(iface string) (*Proxy, error) {
+	m := &mdns{}
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		if ifi.Flags&net.FlagMulticast == 0 {
+			return nil, fmt.Errorf("interface %s can't do multicast", iface)
+		}
+		m.ifi = ifi
+	}
+
+	p := NewProxy(_mdns + "://" + iface)
+	p.mdns = m
+	p.host.resetFails() // there is nothing to health check
+	return p, nil
+}
+
+// exchange sends req to the mDNS group and returns the first reply. When nobody replies within
+// mdnsTimeout the name doesn't exist on the link and a NXDOMAIN is returned.
+func (m *mdns) exchange(req *dns.Msg) (*dns.Msg, error) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if m.ifi != nil {
+		if err := ipv4.NewPacketConn(c).SetMulticastInterface(m.ifi); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.WriteTo(buf, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	c.SetReadDeadline(time.Now().Add(mdnsTimeout))
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				ret := new(dns.Msg)
+				ret.SetRcode(req, dns.RcodeNameError)
+				return ret, nil
+			}
+			return nil, err
+		}
+
+		ret := new(dns.Msg)
+		if ret.Unpack(b[:n]) != nil || checkReply(req, ret) != nil {
+			continue // someone else's traffic
+		}
+		return unicast(ret), nil
+	}
+}
+
+// unicast makes ret look like a reply from a unicast server: mDNS uses the top bit of the class as
+// the cache flush bit, which must not leak to regular clients.
+func unicast(ret *dns.Msg) *dns.Msg {
+	for _, s := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range s {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Class &^= 1 << 15
+			}
+		}
+	}
+	ret.Authoritative = false
+	ret.RecursionAvailable = true
+	return ret
+}
+
+const mdnsTimeout = time.Second
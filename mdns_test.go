@@ -0,0 +1,44 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestSetupMDNS(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward local mdns:// 10.0.0.1")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.proxies) != 2 || f.proxies[0].mdns == nil || f.proxies[1].mdns != nil {
+		t.Fatalf("Expected one mDNS and one regular proxy")
+	}
+	if f.proxies[0].Down(f.maxfails) {
+		t.Errorf("Expected mDNS proxy to be up")
+	}
+
+	c = caddy.NewTestController("dns", "forward local mdns://no-such-interface0")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("Expected error for unknown interface")
+	}
+}
+
+func TestUnicast(t *testing.T) {
+	ret := new(dns.Msg)
+	rr := test.A("printer.local. 120 IN A 192.168.1.9")
+	rr.Header().Class |= 1 << 15 // cache flush
+	ret.Answer = append(ret.Answer, rr)
+	ret.Authoritative = true
+
+	unicast(ret)
+	if rr.Header().Class != dns.ClassINET {
+		t.Errorf("Expected class IN, got: %d", rr.Header().Class)
+	}
+	if ret.Authoritative {
+		t.Errorf("Expected the authoritative bit to be cleared")
+	}
+}
@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// Metadata holds values describing how a request was forwarded. Keys are prefixed with "forward/":
+//
+//	forward/upstream - address of the upstream that answered
+//	forward/proto    - transport used: udp, tcp or tcp-tls
+//	forward/rtt      - duration of the successful exchange
+//	forward/attempts - number of upstreams tried
+//
+// A plugin earlier in the chain, or an embedder, installs a Metadata in the context with
+// NewMetadataContext and reads it after the request has been handled.
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// set copies i into m, m may be nil.
+func (i Info) set(m Metadata) {
+	if m == nil {
+		return
+	}
+	m["forward/upstream"] = i.Upstream
+	m["forward/proto"] = i.Proto
+	m["forward/rtt"] = i.RTT.String()
+	m["forward/attempts"] = strconv.Itoa(i.Attempts)
+}
+
+// NewMetadataContext returns a context carrying an empty Metadata, and that Metadata.
+func NewMetadataContext(ctx context.Context) (context.Context, Metadata) {
+	m := Metadata{}
+	return context.WithValue(ctx, metadataKey{}, m), m
+}
+
+// MetadataFromContext returns the Metadata in ctx, or nil if there is none.
+func MetadataFromContext(ctx context.Context) Metadata {
+	m, _ := ctx.Value(metadataKey{}).(Metadata)
+	return m
+}
+
+type transportKey struct{}
+
+// NewTransportContext returns a context that makes forward send the request over proto, overriding
+// the configuration for this one request. Proto is "tcp", or "tcp-tls" to use only the upstreams
+// that are configured for TLS.
+func NewTransportContext(ctx context.Context, proto string) context.Context {
+	return context.WithValue(ctx, transportKey{}, proto)
+}
+
+// transportFromContext returns the transport set with NewTransportContext, or "".
+func transportFromContext(ctx context.Context) string {
+	proto, _ := ctx.Value(transportKey{}).(string)
+	return proto
+}
+
+// onlyTLS returns the proxies in list that use TLS.
+func onlyTLS(list []*Proxy) []*Proxy {
+	tls := make([]*Proxy, 0, len(list))
+	for _, p := range list {
+		if p.host.chain != nil {
+			if p.host.chain.current() == "tcp-tls" {
+				tls = append(tls, p)
+			}
+			continue
+		}
+		if p.host.tlsConfig != nil {
+			tls = append(tls, p)
+		}
+	}
+	return tls
+}
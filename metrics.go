@@ -1,6 +1,9 @@
 package forward
 
 import (
+	"expvar"
+	"fmt"
+	"reflect"
 	"sync"
 
 	"github.com/coredns/coredns/plugin"
@@ -15,32 +18,299 @@ var (
 		Subsystem: "forward",
 		Name:      "request_count_total",
 		Help:      "Counter of requests made per upstream.",
-	}, []string{"to"})
+	}, []string{"id", "to"})
 	RcodeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
 		Name:      "response_rcode_count_total",
 		Help:      "Counter of requests made per upstream.",
-	}, []string{"rcode", "to"})
-	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: plugin.Namespace,
-		Subsystem: "forward",
-		Name:      "request_duration_seconds",
-		Buckets:   plugin.TimeBuckets,
-		Help:      "Histogram of the time each request took.",
-	}, []string{"to"})
+	}, []string{"id", "rcode", "to"})
+	RequestDuration         = newRequestDuration(plugin.TimeBuckets)
 	HealthcheckFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
 		Name:      "healthcheck_failure_count_total",
 		Help:      "Counter of the number of failed healtchecks.",
-	}, []string{"to"})
+	}, []string{"id", "to"})
 	SocketGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
 		Name:      "socket_count_total",
 		Help:      "Guage of open sockets per upstream.",
-	}, []string{"to"})
+	}, []string{"id", "to"})
+	ConnCacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_bytes",
+		Help:      "Gauge of the approximate memory held by cached connections per upstream.",
+	}, []string{"id", "to"})
+	ConnCacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_size",
+		Help:      "Gauge of the cached connections per upstream and transport.",
+	}, []string{"id", "to", "proto"})
+	ConnCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_hits_total",
+		Help:      "Counter of connections taken from the cache per upstream and transport.",
+	}, []string{"id", "to", "proto"})
+	ConnCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_misses_total",
+		Help:      "Counter of new connections dialed because none was cached, per upstream and transport.",
+	}, []string{"id", "to", "proto"})
+	GoroutineGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "goroutines",
+		Help:      "Gauge of running goroutines per upstream and kind.",
+	}, []string{"id", "to", "kind"})
+	DownCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "down_count_total",
+		Help:      "Counter of the number of times an upstream went down.",
+	}, []string{"id", "to", "reason"})
+	PrefetchHintCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "prefetch_hint_count_total",
+		Help:      "Counter of answers seen with a TTL below the prefetch threshold.",
+	}, []string{"id"})
+	UntrustedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "untrusted",
+		Help:      "Gauge that is 1 when an upstream returned an unexpected answer to the probe.",
+	}, []string{"id", "to"})
+	AuditCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "audit_count_total",
+		Help:      "Counter of audited queries per pair of upstreams and result of the comparison.",
+	}, []string{"id", "to", "other", "result"})
+	MirrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "mirror_count_total",
+		Help:      "Counter of queries mirrored to the canary upstream per result.",
+	}, []string{"id", "to", "result"})
+	ShedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "shed_count_total",
+		Help:      "Counter of queries answered with SERVFAIL because the admission queue overflowed.",
+	}, []string{"id", "reason"})
+	ThrottleCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "throttled_count_total",
+		Help:      "Counter of queries not sent to an upstream because it was at its max_qps.",
+	}, []string{"id", "to"})
+	RejectCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "rejected_count_total",
+		Help:      "Counter of queries rejected because max_concurrent queries were in flight.",
+	}, []string{"id"})
+	FilteredCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "filtered_count_total",
+		Help:      "Counter of queries answered locally because their opcode or class isn't forwarded.",
+	}, []string{"id", "reason"})
+	FallthroughCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "fallthrough_count_total",
+		Help:      "Counter of queries handed to the next plugin, by reason.",
+	}, []string{"id", "reason"})
+	CoalescedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "coalesced_count_total",
+		Help:      "Counter of queries answered with the reply of an identical query in flight.",
+	}, []string{"id"})
+	EDNSFallbackCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "edns_fallback_count_total",
+		Help:      "Counter of upstreams found not to speak EDNS, after which queries were retried without it.",
+	}, []string{"id", "to"})
+	ErrorReportCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "error_report_count_total",
+		Help:      "Counter of DNS error reports sent, for a failure of an upstream or of our own.",
+	}, []string{"id", "source"})
+	SpoofCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "spoof_count_total",
+		Help:      "Counter of replies discarded because they did not match the query.",
+	}, []string{"id", "to", "subnet", "reason"})
+	HealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "healthy",
+		Help:      "Gauge of the health of each upstream, 1 if its last health check succeeded, 0 otherwise.",
+	}, []string{"id", "to"})
+	FailsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "consecutive_fails",
+		Help:      "Gauge of the number of health checks in a row that failed per upstream.",
+	}, []string{"id", "to"})
+	HealthScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "health_score",
+		Help:      "Gauge of the health score, between 0 and 1, of each upstream.",
+	}, []string{"id", "to"})
+	BytesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "bytes_total",
+		Help:      "Counter of bytes sent to and received from each upstream.",
+	}, []string{"id", "to", "direction"})
+	PeakQPS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "peak_qps",
+		Help:      "Gauge of the highest queries per second sent to each upstream in the accounting window.",
+	}, []string{"id", "to"})
+	RetransmitCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "retransmit_count_total",
+		Help:      "Counter of UDP queries sent again to the same upstream after no reply came within twice its RTT.",
+	}, []string{"id", "to"})
+	HedgeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "hedge_count_total",
+		Help:      "Counter of hedged queries sent to an upstream, and of those that answered first.",
+	}, []string{"id", "to", "result"})
+	TLSHandshakeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "tls_handshake_count_total",
+		Help:      "Counter of TLS handshakes with each upstream, and whether the session was resumed.",
+	}, []string{"id", "to", "resumed"})
+	TLSHandshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "tls_handshake_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time the TLS handshakes with each upstream took.",
+	}, []string{"id", "to"})
+	ResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "response_size_bytes",
+		Buckets:   []float64{0, 100, 200, 300, 400, 511, 1023, 2047, 4095, 8291, 16e3, 32e3, 48e3, 64e3},
+		Help:      "Histogram of the size of the replies of each upstream.",
+	}, []string{"id", "to"})
+	TruncatedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "truncated_count_total",
+		Help:      "Counter of replies with the TC bit set per upstream.",
+	}, []string{"id", "to"})
+	TransportRequestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "transport_request_count_total",
+		Help:      "Counter of requests made per upstream and transport.",
+	}, []string{"id", "to", "transport"})
+	UpstreamErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_error_count_total",
+		Help:      "Counter of failed requests per upstream, transport and class of error.",
+	}, []string{"id", "to", "transport", "class"})
+	InstanceInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "instance_info",
+		Help:      "Info metric (always 1) linking a forward instance to its upstreams and their tags.",
+	}, []string{"id", "to", "tag"})
 )
 
+// Expvar mirrors of the key counters, published under "forward" on /debug/vars, for embedders that
+// don't run a Prometheus registry. Each is keyed by upstream, see expKey.
+var (
+	expRequests     = new(expvar.Map).Init()
+	expFailures     = new(expvar.Map).Init()
+	expHealthchecks = new(expvar.Map).Init()
+	expHealthy      = new(expvar.Map).Init()
+
+	expBytesSent     = new(expvar.Map).Init()
+	expBytesReceived = new(expvar.Map).Init()
+	expPeakQPS       = new(expvar.Map).Init()
+	expTags          = new(expvar.Map).Init()
+)
+
+// expKey returns the key of h in the expvar maps, the ID of its Forward and its address, as in
+// main/10.0.0.1:53, so blocks with the same upstream can be told apart.
+func (h *host) expKey() string { return h.id + "/" + h.addr }
+
+// tagVar returns tag as an expvar.
+func tagVar(tag string) expvar.Var {
+	v := new(expvar.String)
+	v.Set(tag)
+	return v
+}
+
+func init() {
+	m := expvar.NewMap("forward")
+	m.Set("requests", expRequests)
+	m.Set("failures", expFailures)
+	m.Set("healthcheck_failures", expHealthchecks)
+	m.Set("healthy", expHealthy)
+	m.Set("bytes_sent", expBytesSent)
+	m.Set("bytes_received", expBytesReceived)
+	m.Set("peak_qps", expPeakQPS)
+	m.Set("tags", expTags)
+}
+
 var once sync.Once
+
+func newRequestDuration(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "request_duration_seconds",
+		Buckets:   buckets,
+		Help:      "Histogram of the time each request took.",
+	}, []string{"id", "to"})
+}
+
+var (
+	bucketsMu  sync.Mutex
+	buckets    []float64 // set with latency_buckets, nil means plugin.TimeBuckets
+	registered bool      // the metrics have been registered, RequestDuration can't be replaced anymore
+)
+
+// setBuckets replaces RequestDuration with a histogram with buckets b. The metrics are shared by all
+// forward blocks, so they must agree on the buckets, and they can't change on reload.
+func setBuckets(b []float64) error {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+
+	if buckets != nil {
+		if !reflect.DeepEqual(buckets, b) {
+			return fmt.Errorf("latency_buckets differ from those of another forward block or the running config")
+		}
+		return nil
+	}
+	if registered {
+		return fmt.Errorf("latency_buckets can't be set on reload, a restart is needed")
+	}
+	buckets = b
+	RequestDuration = newRequestDuration(b)
+	return nil
+}
@@ -0,0 +1,49 @@
+package forward
+
+import (
+	"math/rand"
+
+	"github.com/coredns/coredns/request"
+)
+
+// canary is an upstream that receives a copy of a percentage of the queries. Its replies are discarded.
+type canary struct {
+	proxy   *Proxy
+	percent float64
+
+	inflight chan struct{} // bounds the number of outstanding mirrored queries
+}
+
+func newCanary(p *Proxy, percent float64) *canary {
+	return &canary{proxy: p, percent: percent, inflight: make(chan struct{}, maxMirrorInflight)}
+}
+
+// mirror sends a copy of state to the canary, if this query is sampled. It doesn't block, when too
+// many mirrored queries are outstanding the query is not mirrored.
+func (f *Forward) mirror(state request.Request) {
+	m := f.canary
+	if m == nil || rand.Float64()*100 >= m.percent {
+		return
+	}
+
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		MirrorCount.WithLabelValues(m.proxy.host.id, m.proxy.host.addr, "dropped").Add(1)
+		return
+	}
+
+	state2, ctx, cancel := f.detach(state)
+	go func() {
+		defer func() { <-m.inflight }()
+		defer cancel()
+
+		result := "success"
+		if _, err := m.proxy.connect(ctx, state2, f.forceTCP, false); err != nil {
+			result = "error"
+		}
+		MirrorCount.WithLabelValues(m.proxy.host.id, m.proxy.host.addr, result).Add(1)
+	}()
+}
+
+const maxMirrorInflight = 100
@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// mirrored returns the number of queries mirrored to the canary of f, whatever their result.
+func mirrored(f *Forward) float64 {
+	h := f.canary.proxy.host
+	n := 0.0
+	for _, result := range []string{"success", "error", "dropped"} {
+		n += counterValue(MirrorCount, h.id, h.addr, result)
+	}
+	return n
+}
+
+func TestMirrorReplyDiscarded(t *testing.T) {
+	// dnstest servers share a handler, it tells the upstream and the canary apart by address.
+	var canary atomic.Value
+	canary.Store("")
+	got := make(chan struct{}, 1)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if w.LocalAddr().String() == canary.Load().(string) {
+			ret.Rcode = dns.RcodeNameError
+			w.WriteMsg(ret)
+			got <- struct{}{}
+			return
+		}
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	}
+	s := dnstest.NewServer(handler)
+	defer s.Close()
+	c := dnstest.NewServer(handler)
+	defer c.Close()
+	canary.Store(c.Addr)
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nmirror "+c.Addr+" 100\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the reply of the upstream, got: %v", rec.Msg)
+	}
+
+	select {
+	case <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the query to be mirrored to the canary")
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the canary's reply to be discarded, got rcode %d", rec.Msg.Rcode)
+	}
+}
+
+func TestMirrorShare(t *testing.T) {
+	c := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer c.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nmirror "+c.Addr+" 30\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+
+	const n = 2000
+	before := mirrored(f)
+	state := questionState("example.org.")
+	for i := 0; i < n; i++ {
+		f.mirror(state)
+	}
+	for i := 0; i < 200 && len(f.canary.inflight) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 30% of 2000 is 600, with a standard deviation of about 20.
+	if x := mirrored(f) - before; x < 500 || x > 700 {
+		t.Errorf("Expected about %d mirrored queries, got %.0f", n*30/100, x)
+	}
+}
+
+func TestMirrorInflight(t *testing.T) {
+	var received int32
+	c := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&received, 1) // and never reply
+	})
+	defer c.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nmirror "+c.Addr+" 100\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	h := f.canary.proxy.host
+
+	dropped := counterValue(MirrorCount, h.id, h.addr, "dropped")
+	state := questionState("example.org.")
+	for i := 0; i < maxMirrorInflight+10; i++ {
+		f.mirror(state)
+	}
+	if x := counterValue(MirrorCount, h.id, h.addr, "dropped") - dropped; x != 10 {
+		t.Errorf("Expected 10 dropped queries with %d outstanding, got %.0f", maxMirrorInflight, x)
+	}
+	for i := 0; i < 200 && atomic.LoadInt32(&received) < maxMirrorInflight; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if x := atomic.LoadInt32(&received); x != maxMirrorInflight {
+		t.Errorf("Expected the canary to get %d queries, got %d", maxMirrorInflight, x)
+	}
+}
+
+func TestMirrorStopped(t *testing.T) {
+	// The canary never replies, and its read timeout is longer than the test.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nmirror "+c.LocalAddr().String()+" 100\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	h := f.canary.proxy.host
+	h.readTimeout = time.Minute
+	state := questionState("example.org.")
+
+	wait := func(before float64, within time.Duration) bool {
+		for end := time.Now().Add(within); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+			if counterValue(MirrorCount, h.id, h.addr, "error") > before {
+				return true
+			}
+		}
+		return false
+	}
+
+	f.queryTimeout = 100 * time.Millisecond
+	before := counterValue(MirrorCount, h.id, h.addr, "error")
+	f.mirror(state)
+	if !wait(before, time.Second) {
+		t.Errorf("Expected the mirrored query to end after the query_timeout")
+	}
+
+	f.queryTimeout = 0
+	before = counterValue(MirrorCount, h.id, h.addr, "error")
+	f.mirror(state)
+	time.Sleep(50 * time.Millisecond)
+	f.Close()
+	if !wait(before, time.Second) {
+		t.Errorf("Expected the mirrored query to end when f shuts down")
+	}
+}
@@ -0,0 +1,296 @@
+package forward
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// mux multiplexes the queries to an upstream over a few TCP or TLS connections: each connection
+// carries many queries at the same time, their replies are matched by ID and can come in any order,
+// see RFC 7766, section 6.2.1.1.
+type mux struct {
+	host *host
+	max  int // connections per transport
+
+	sync.Mutex
+	conns   map[string][]*muxConn
+	dialing map[string]int // connections being dialed, they count toward max
+	stopped bool
+}
+
+func newMux(h *host, max int) *mux {
+	return &mux{host: h, max: max, conns: make(map[string][]*muxConn), dialing: make(map[string]int)}
+}
+
+// muxConn is a connection that carries many queries at the same time.
+type muxConn struct {
+	c   *dns.Conn
+	wmu sync.Mutex // one writer at a time
+
+	sync.Mutex
+	pending map[uint16]chan *dns.Msg // by the ID of the query we sent
+	dead    bool
+}
+
+// get returns the connection of type proto with the fewest queries in flight. A new one is dialed when
+// there is none, or when all are busy and there are fewer than m.max. The dial is done without holding
+// the lock, the queries on the other connections don't wait for it.
+func (m *mux) get(proto string) (*muxConn, error) {
+	m.Lock()
+	if m.stopped {
+		m.Unlock()
+		return nil, errStopped
+	}
+
+	var (
+		live []*muxConn
+		best *muxConn
+	)
+	for _, mc := range m.conns[proto] {
+		if mc.closed() {
+			continue
+		}
+		live = append(live, mc)
+		if best == nil || mc.load() < best.load() {
+			best = mc
+		}
+	}
+	m.conns[proto] = live
+	if best != nil && (best.load() < muxPending || len(live)+m.dialing[proto] >= m.max) {
+		m.Unlock()
+		return best, nil
+	}
+	m.dialing[proto]++
+	m.Unlock()
+
+	c, err := m.host.dial(proto)
+
+	m.Lock()
+	defer m.Unlock()
+	m.dialing[proto]--
+	if m.stopped {
+		if err == nil {
+			c.Close()
+		}
+		return nil, errStopped
+	}
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	mc := &muxConn{c: c, pending: make(map[uint16]chan *dns.Msg)}
+	m.conns[proto] = append(m.conns[proto], mc)
+	GoroutineGauge.WithLabelValues(m.host.id, m.host.addr, "mux").Inc()
+	go mc.read(m.host, proto)
+	return mc, nil
+}
+
+// reset closes all connections, the queries in flight on them fail.
+func (m *mux) reset() {
+	m.Lock()
+	for proto, conns := range m.conns {
+		for _, mc := range conns {
+			mc.fail()
+		}
+		delete(m.conns, proto)
+	}
+	m.Unlock()
+}
+
+// close closes all connections, after which get fails.
+func (m *mux) close() {
+	m.reset()
+	m.Lock()
+	m.stopped = true
+	m.Unlock()
+}
+
+// read hands the replies coming in on mc, of type proto, to the queries waiting for them. It closes mc
+// when it has been idle for as long as h allows, or on an error.
+func (mc *muxConn) read(h *host, proto string) {
+	defer GoroutineGauge.WithLabelValues(h.id, h.addr, "mux").Dec()
+
+	for {
+		idle := h.idle(proto)
+		if idle < h.readTimeout && mc.load() > 0 {
+			idle = h.readTimeout
+		}
+		mc.c.SetReadDeadline(time.Now().Add(idle))
+		ret, err := readMsg(mc.c)
+		if err != nil {
+			if ret != nil {
+				continue // a reply we can't parse, its query times out
+			}
+			if isTimeout(err) && mc.load() > 0 {
+				continue // the waiting queries time out themselves
+			}
+			mc.fail()
+			return
+		}
+
+		mc.Lock()
+		ch, ok := mc.pending[ret.Id]
+		delete(mc.pending, ret.Id)
+		mc.Unlock()
+		if ok {
+			ch <- ret
+		}
+	}
+}
+
+// exchange sends req over mc and waits for its reply, until the read timeout of h or until ctx is done.
+// The query is sent with an ID that is unique on mc, the reply gets the ID of req back.
+func (mc *muxConn) exchange(ctx context.Context, h *host, req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	mc.Lock()
+	if mc.dead {
+		mc.Unlock()
+		return nil, errMuxClosed
+	}
+	id := dns.Id()
+	for _, ok := mc.pending[id]; ok; _, ok = mc.pending[id] {
+		id = dns.Id()
+	}
+	mc.pending[id] = ch
+	mc.Unlock()
+
+	q := *req // only the ID differs, the rest is shared with req
+	q.Id = id
+	b := bufPool.Get().(*[]byte)
+	out, err := q.PackBuffer(*b)
+	if err != nil {
+		bufPool.Put(b)
+		mc.forget(id)
+		return nil, err
+	}
+	// Not WriteMsg, it sets a field that ReadMsg reads in the reader goroutine.
+	mc.wmu.Lock()
+	mc.c.SetWriteDeadline(attemptDeadline(ctx, h.writeTimeout))
+	_, err = mc.c.Write(out)
+	mc.wmu.Unlock()
+	bufPool.Put(b)
+	if err != nil {
+		mc.fail() // part of the query may have been written, the stream is broken
+		return nil, ctxErr(ctx, err)
+	}
+
+	timer := time.NewTimer(time.Until(attemptDeadline(ctx, h.readTimeout)))
+	defer timer.Stop()
+	select {
+	case ret, ok := <-ch:
+		if !ok {
+			return nil, ctxErr(ctx, errMuxClosed)
+		}
+		ret.Id = req.Id
+		return ret, nil
+	case <-timer.C:
+		mc.forget(id)
+		return nil, errMuxTimeout
+	case <-ctx.Done():
+		mc.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// forget stops waiting for the reply to the query with id; when it comes in after all, it's dropped.
+func (mc *muxConn) forget(id uint16) {
+	mc.Lock()
+	delete(mc.pending, id)
+	mc.Unlock()
+}
+
+// load returns the number of queries in flight on mc.
+func (mc *muxConn) load() int {
+	mc.Lock()
+	defer mc.Unlock()
+	return len(mc.pending)
+}
+
+// closed returns true if mc can't be used anymore.
+func (mc *muxConn) closed() bool {
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.dead
+}
+
+// fail closes mc, the queries waiting for a reply on it fail.
+func (mc *muxConn) fail() {
+	mc.Lock()
+	if mc.dead {
+		mc.Unlock()
+		return
+	}
+	mc.dead = true
+	for id, ch := range mc.pending {
+		close(ch)
+		delete(mc.pending, id)
+	}
+	mc.Unlock()
+	mc.c.Close()
+}
+
+// muxed is connect for the multiplexed transport proto.
+func (p *Proxy) muxed(ctx context.Context, state request.Request, proto string, metric bool) (*dns.Msg, error) {
+	start := time.Now()
+	mc, err := p.mux.get(proto)
+	if err != nil {
+		return nil, err
+	}
+	req := state.Req
+	if p.host.ednsKeepalive {
+		req = withKeepalive(req)
+	}
+	padded := p.host.padding > 0 && proto == "tcp-tls"
+	if padded {
+		req = withPadding(req, p.host.padding)
+	}
+	if metric {
+		p.host.sent(req.Len())
+	}
+	ret, err := mc.exchange(ctx, p.host, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReply(req, ret); err != nil {
+		return nil, err
+	}
+	if p.host.ednsKeepalive {
+		p.host.learnKeepalive(ret)
+	}
+	if padded {
+		stripPadding(ret)
+	}
+	if metric {
+		p.host.request(rcodeString(ret.Rcode), time.Since(start))
+		p.host.received(ret)
+		expRequests.Add(p.host.expKey(), 1)
+	}
+	return ret, nil
+}
+
+// muxTimeoutError is returned when no reply came in on a multiplexed connection in time. Like a read
+// timeout of a connection of our own, it's a net.Error with Timeout true.
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "timeout waiting for multiplexed reply" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+var (
+	errMuxClosed  = errors.New("multiplexed connection closed")
+	errMuxTimeout = muxTimeoutError{}
+)
+
+const (
+	muxPending    = 100 // queries in flight on a connection before another one is dialed
+	muxConns      = 2   // default maximum connections per transport
+	defaultExpire = 10 * time.Second
+)
@@ -0,0 +1,214 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// pipeliningServer answers the queries on each TCP connection as they come in, in any order. Queries
+// for names starting with "slow." are answered after a delay.
+func pipeliningServer(t *testing.T) (addr string, conns *int32, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns = new(int32)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				co := &dns.Conn{Conn: c}
+				defer co.Close()
+				var mu sync.Mutex
+				for {
+					r, err := co.ReadMsg()
+					if err != nil {
+						return
+					}
+					go func() {
+						if len(r.Question[0].Name) > 5 && r.Question[0].Name[:5] == "slow." {
+							time.Sleep(200 * time.Millisecond)
+						}
+						ret := new(dns.Msg)
+						ret.SetReply(r)
+						out, _ := ret.Pack()
+						mu.Lock()
+						co.Write(out)
+						mu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), conns, func() { ln.Close() }
+}
+
+func TestMultiplex(t *testing.T) {
+	addr, conns, stop := pipeliningServer(t)
+	defer stop()
+
+	p := NewProxy(addr)
+	p.SetExpire(defaultExpire)
+	p.mux = newMux(p.host, 1)
+	defer p.close()
+
+	query := func(name string, id uint16) (*dns.Msg, error) {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion(name, dns.TypeA)
+		state.Req.Id = id
+		return p.connect(context.Background(), state, true, false)
+	}
+
+	slow := make(chan time.Time)
+	go func() {
+		if _, err := query("slow.example.org.", 1); err != nil {
+			t.Errorf("Expected no error, got: %s", err)
+		}
+		slow <- time.Now()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The same ID as the slow query, and many of them: each must get its own reply.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%d.example.org.", i)
+			ret, err := query(name, 1)
+			if err != nil {
+				t.Errorf("Expected no error, got: %s", err)
+				return
+			}
+			if ret.Id != 1 || ret.Question[0].Name != name {
+				t.Errorf("Expected the reply to query 1 for %s, got: %d for %s", name, ret.Id, ret.Question[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fast := time.Now()
+
+	if s := <-slow; s.Before(fast) {
+		t.Error("Expected the fast queries to be answered before the slow one")
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("Expected 1 connection, got: %d", n)
+	}
+}
+
+func TestMultiplexClosed(t *testing.T) {
+	addr, _, stop := pipeliningServer(t)
+	defer stop()
+
+	p := NewProxy(addr)
+	p.SetExpire(defaultExpire)
+	p.mux = newMux(p.host, 1)
+	defer p.close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	if _, err := p.connect(context.Background(), state, true, false); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	// A connection that breaks is replaced for the next query.
+	p.Reset()
+	if _, err := p.connect(context.Background(), state, true, false); err != nil {
+		t.Errorf("Expected no error after a reset, got: %s", err)
+	}
+
+	p.mux.close()
+	if _, err := p.connect(context.Background(), state, true, false); err != errStopped {
+		t.Errorf("Expected %s, got: %v", errStopped, err)
+	}
+}
+
+// stallingDialer dials TCP connections right away, its TLS dials stall until release is closed.
+type stallingDialer struct {
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (d *stallingDialer) DialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	if proto == "tcp-tls" {
+		close(d.stalled)
+		<-d.release
+		c, upstream := net.Pipe()
+		upstream.Close()
+		return c, nil
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, "tcp", addr)
+}
+
+func TestMultiplexDialUnlocked(t *testing.T) {
+	addr, _, stop := pipeliningServer(t)
+	defer stop()
+
+	d := &stallingDialer{stalled: make(chan struct{}), release: make(chan struct{})}
+	p := NewProxy(addr)
+	p.SetExpire(defaultExpire)
+	p.SetDialer(d)
+	p.mux = newMux(p.host, 2)
+	defer p.close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	query := func() error {
+		mc, err := p.mux.get("tcp")
+		if err != nil {
+			return err
+		}
+		_, err = mc.exchange(context.Background(), p.host, req)
+		return err
+	}
+	if err := query(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	tls := make(chan error, 1)
+	go func() {
+		_, err := p.mux.get("tcp-tls")
+		tls <- err
+	}()
+	<-d.stalled
+
+	// The TCP connection is used while the TLS dial stalls.
+	done := make(chan error, 1)
+	go func() { done <- query() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error, got: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the query on the live connection not to wait for the stalled dial")
+	}
+
+	// A connection that's dialed after the mux is closed isn't kept.
+	p.mux.close()
+	close(d.release)
+	if err := <-tls; err != errStopped {
+		t.Errorf("Expected %s, got: %v", errStopped, err)
+	}
+	p.mux.Lock()
+	n := len(p.mux.conns["tcp-tls"])
+	p.mux.Unlock()
+	if n != 0 {
+		t.Errorf("Expected no TLS connection after close, got %d", n)
+	}
+}
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// named holds the upstreams of each named forward block, so other blocks can refer to them as @NAME.
+var named = struct {
+	to map[string][]string
+	sync.Mutex
+}{to: make(map[string][]string)}
+
+// resolveNamed replaces each @NAME in to with the upstreams of the forward block named NAME.
+func resolveNamed(to []string) ([]string, error) {
+	named.Lock()
+	defer named.Unlock()
+
+	var out []string
+	for _, t := range to {
+		if !strings.HasPrefix(t, "@") {
+			out = append(out, t)
+			continue
+		}
+		up, ok := named.to[t[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstreams %s, the block named %s must come first", t, t[1:])
+		}
+		out = append(out, up...)
+	}
+	return out, nil
+}
+
+// setNamed records to as the upstreams of the forward block name.
+func setNamed(name string, to []string) {
+	named.Lock()
+	named.to[name] = to
+	named.Unlock()
+}
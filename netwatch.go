@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"time"
+)
+
+// onNetworkChange closes the cached connections of all proxies and health checks them again, the
+// network they were made on may be gone.
+func (f *Forward) onNetworkChange() {
+	f.log.info(f.id, "network_changed", "Network changed, flushing upstream connections")
+	for _, p := range f.snapshot() {
+		p.Reset()
+		if p.hcInterval > 0 && p.mdns == nil {
+			go p.host.Check()
+		}
+	}
+}
+
+// watchNetwork calls changed after the interfaces, addresses or routes of the host changed, until
+// stop is closed. Bursts of changes result in one call. If the changes can't be watched, warn is
+// called and the interface addresses are polled instead.
+func watchNetwork(stop <-chan struct{}, changed func(), warn func(error)) {
+	events := make(chan struct{}, 1)
+	go networkEvents(stop, events, warn)
+	settle(stop, events, changed)
+}
+
+// settle calls changed once things are quiet after one or more events, until stop is closed.
+func settle(stop <-chan struct{}, events <-chan struct{}, changed func()) {
+	for {
+		select {
+		case <-events:
+		case <-stop:
+			return
+		}
+		// Wait for things to settle.
+		timer := time.NewTimer(networkSettle)
+	Settle:
+		for {
+			select {
+			case <-events:
+				timer.Reset(networkSettle)
+			case <-timer.C:
+				break Settle
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+		changed()
+	}
+}
+
+// notify sends on events without blocking.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+const networkSettle = 500 * time.Millisecond
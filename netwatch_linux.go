@@ -0,0 +1,61 @@
+package forward
+
+import (
+	"syscall"
+)
+
+// networkEvents sends on events when the kernel reports a link, address or route change over
+// netlink, until stop is closed.
+func networkEvents(stop <-chan struct{}, events chan<- struct{}, warn func(error)) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		warn(err)
+		pollNetwork(stop, events)
+		return
+	}
+	defer syscall.Close(fd)
+
+	groups := uint32(rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		warn(err)
+		pollNetwork(stop, events)
+		return
+	}
+	// Wake up every second to see if we should stop.
+	tv := syscall.Timeval{Sec: 1}
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	buf := make([]byte, 1<<16)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.ENOBUFS {
+				notify(events) // we lost messages, something surely changed
+				continue
+			}
+			warn(err)
+			pollNetwork(stop, events)
+			return
+		}
+		if n > 0 {
+			notify(events)
+		}
+	}
+}
+
+// Netlink multicast groups, from linux/rtnetlink.h.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package forward
+
+// networkEvents sends on events when the addresses of the host changed, until stop is closed.
+func networkEvents(stop <-chan struct{}, events chan<- struct{}, warn func(error)) {
+	pollNetwork(stop, events)
+}
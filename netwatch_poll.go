@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pollNetwork sends on events when the addresses of the host changed, until stop is closed. It
+// checks every networkPoll.
+func pollNetwork(stop <-chan struct{}, events chan<- struct{}) {
+	last := addrFingerprint()
+	tick := time.NewTicker(networkPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if fp := addrFingerprint(); fp != last {
+				last = fp
+				notify(events)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// addrFingerprint returns a string that changes when the interface addresses change.
+func addrFingerprint() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+const networkPoll = 2 * time.Second
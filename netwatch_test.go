@@ -0,0 +1,33 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchNetworkSettles(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	events := make(chan struct{}, 1)
+	changed := make(chan struct{}, 10)
+	go func() {
+		// Drive the settling loop directly with a burst of events.
+		for i := 0; i < 5; i++ {
+			notify(events)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	go settle(stop, events, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a change")
+	}
+	select {
+	case <-changed:
+		t.Error("Expected one change for a burst of events")
+	case <-time.After(2 * networkSettle):
+	}
+}
@@ -0,0 +1,36 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// noHealthyReply answers r when no upstream is healthy, with the rcode of no_healthy_reply. A NOERROR
+// answer is empty and has an SOA record for the zone of f, so clients cache it for noHealthyTTL
+// instead of retrying right away.
+func (f *Forward) noHealthyReply(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, f.noHealthyRcode)
+	m.RecursionAvailable = true
+	if f.noHealthyRcode == dns.RcodeSuccess {
+		m.Ns = []dns.RR{&dns.SOA{
+			Hdr:     dns.RR_Header{Name: dns.Fqdn(f.from), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: f.noHealthyTTL},
+			Ns:      "localhost.",
+			Mbox:    "invalid.",
+			Serial:  1,
+			Refresh: f.noHealthyTTL,
+			Retry:   f.noHealthyTTL,
+			Expire:  f.noHealthyTTL,
+			Minttl:  f.noHealthyTTL,
+		}}
+	}
+	if o := r.IsEdns0(); o != nil {
+		m.SetEdns0(o.UDPSize(), o.Do())
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, newEDE(edeNetworkError, "forward: no healthy upstreams"))
+	}
+	w.WriteMsg(m)
+}
+
+const defaultNoHealthyTTL = 5 * time.Second
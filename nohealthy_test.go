@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestNoHealthyReply(t *testing.T) {
+	tests := []struct {
+		option string
+		rcode  int
+		ttl    uint32
+	}{
+		{"no_healthy_reply REFUSED", dns.RcodeRefused, 0},
+		{"no_healthy_reply NOERROR", dns.RcodeSuccess, 5},
+		{"no_healthy_reply NOERROR 30s", dns.RcodeSuccess, 30},
+	}
+	for _, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", "forward example.org 127.0.0.1 {\n"+tc.option+"\n}\n"))
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tc.option, err)
+		}
+		defer f.Close()
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.org.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		// There are no TLS upstreams, so none is healthy.
+		if _, err := f.ServeDNS(NewTransportContext(context.TODO(), "tcp-tls"), rec, req); err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tc.option, err)
+		}
+		if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Fatalf("%s: expected %s, got: %v", tc.option, dns.RcodeToString[tc.rcode], rec.Msg)
+		}
+		if tc.rcode != dns.RcodeSuccess {
+			if len(rec.Msg.Ns) != 0 {
+				t.Errorf("%s: expected no SOA, got: %v", tc.option, rec.Msg.Ns)
+			}
+			continue
+		}
+		if len(rec.Msg.Answer) != 0 || len(rec.Msg.Ns) != 1 {
+			t.Fatalf("%s: expected an empty answer with an SOA, got: %v", tc.option, rec.Msg)
+		}
+		soa, ok := rec.Msg.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "example.org." || soa.Hdr.Ttl != tc.ttl || soa.Minttl != tc.ttl {
+			t.Errorf("%s: expected an SOA for example.org. with TTL %d, got: %v", tc.option, tc.ttl, rec.Msg.Ns[0])
+		}
+		if opt := rec.Msg.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != edeOption {
+			t.Errorf("%s: expected an Extended DNS Error, got: %v", tc.option, opt)
+		}
+	}
+
+	for _, input := range []string{"no_healthy_reply", "no_healthy_reply NXDOMAIN", "no_healthy_reply REFUSED 5s", "no_healthy_reply NOERROR 10ms", "no_healthy_reply NOERROR 5s 6s"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
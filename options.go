@@ -0,0 +1,187 @@
+package forward
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseUpstreams returns the proxies for the upstreams in to. An upstream may be followed by
+// key=value options, these apply to all proxies the upstream expands to:
+//
+//	forward . 10.0.0.1 weight=2 tls://9.9.9.9 tls_servername=dns.quad9.net
+func parseUpstreams(to []string) ([]*Proxy, error) {
+	var proxies, last []*Proxy
+	for _, t := range to {
+		if i := strings.Index(t, "="); i > 0 && !strings.Contains(t, "://") {
+			if last == nil {
+				return nil, fmt.Errorf("option without upstream: %s", t)
+			}
+			for _, p := range last {
+				if err := p.setOption(t[:i], t[i+1:]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		ps, err := parseTo([]string{t})
+		if err != nil {
+			return nil, err
+		}
+		last = ps
+		proxies = append(proxies, ps...)
+	}
+	return proxies, nil
+}
+
+// setOption sets the upstream option key to value in p.
+func (p *Proxy) setOption(key, value string) error {
+	switch key {
+	case "weight":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("weight must be positive: %s", value)
+		}
+		p.weight = n
+	case "max_fails":
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		p.maxfails, p.ownMaxfails = uint32(n), true
+	case "max_qps":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("max_qps must be positive: %s", value)
+		}
+		p.limit, p.ownLimit = newTokenBucket(n), true
+	case "health_check":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("health_check must be positive: %s", value)
+		}
+		p.hcInterval, p.ownHcInterval = d, true
+	case "health":
+		switch value {
+		case "dns":
+			p.host.checker = nil
+		case "tcp":
+			p.host.checker = &tcpCheck{p.host}
+		case "none":
+			p.host.checker = noCheck{}
+		default:
+			return fmt.Errorf("health must be dns, tcp or none: %s", value)
+		}
+	case "tls_servername":
+		if value == "" {
+			return fmt.Errorf("empty tls_servername")
+		}
+		p.tlsServerName = value
+	case "tls_ca":
+		ca, err := newCAFile(value)
+		if err != nil {
+			return err
+		}
+		p.tlsCA = ca
+	case "tls_cert":
+		files := strings.Split(value, ",")
+		if len(files) != 2 {
+			return fmt.Errorf("tls_cert must be CERT,KEY: %s", value)
+		}
+		cert, err := newCertFile(files[0], files[1])
+		if err != nil {
+			return err
+		}
+		p.tlsCert = cert
+	case "force_tcp":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if b && p.preferUDP {
+			return fmt.Errorf("force_tcp and prefer_udp can't both be set")
+		}
+		p.forceTCP = b
+	case "prefer_udp":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if b && p.forceTCP {
+			return fmt.Errorf("force_tcp and prefer_udp can't both be set")
+		}
+		p.preferUDP = b
+	case "no_pool_udp":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		p.noPoolUDP = b
+	case "stateless":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		p.stateless = b
+	case "tag":
+		p.host.tag = value
+	case "method":
+		d, ok := p.host.exch.(*doh)
+		if !ok {
+			return fmt.Errorf("method only applies to https:// upstreams: %s", p.host.addr)
+		}
+		switch value {
+		case "GET":
+			d.get = true
+		case "POST":
+			d.get = false
+		default:
+			return fmt.Errorf("method must be GET or POST: %s", value)
+		}
+	default:
+		return fmt.Errorf("unknown upstream option: %s", key)
+	}
+	return nil
+}
+
+// weighted returns proxies in a random order where proxies with a higher weight are more likely to
+// come first. It returns nil if all weights are equal.
+func weighted(proxies []*Proxy) []*Proxy {
+	equal := true
+	for _, p := range proxies {
+		if p.weight != proxies[0].weight {
+			equal = false
+			break
+		}
+	}
+	if equal {
+		return nil
+	}
+
+	// Efraimidis-Spirakis: sort on u^(1/w) with u uniform in (0,1).
+	keys := make([]float64, len(proxies))
+	rnd := make([]*Proxy, len(proxies))
+	perm := make([]int, len(proxies))
+	for i, p := range proxies {
+		keys[i] = math.Pow(rand.Float64(), 1/float64(p.weight))
+		perm[i] = i
+	}
+	sort.Slice(perm, func(i, j int) bool { return keys[perm[i]] > keys[perm[j]] })
+	for i, j := range perm {
+		rnd[i] = proxies[j]
+	}
+	return rnd
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestWeighted(t *testing.T) {
+	a, b := NewProxy("10.0.0.1:53"), NewProxy("10.0.0.2:53")
+	if weighted([]*Proxy{a, b}) != nil {
+		t.Fatal("Expected nil for equal weights")
+	}
+
+	a.weight = 9
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if weighted([]*Proxy{a, b})[0] == a {
+			first++
+		}
+	}
+	// a should come first about 90% of the time.
+	if first < 800 || first > 970 {
+		t.Errorf("Expected the heavy proxy first about 900 times, got: %d", first)
+	}
+}
+
+func TestStateless(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	p.stateless = true
+	defer p.close()
+
+	c1, err := p.Dial("udp")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	addr := c1.LocalAddr().String()
+	p.Yield(c1)
+
+	c2, err := p.Dial("udp")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer c2.Close()
+	if c2.LocalAddr().String() == addr {
+		t.Errorf("Expected a fresh connection, got the cached one")
+	}
+}
+
+func TestNoPoolUDP(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nno_pool_udp\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	p := f.proxies[0]
+	if !p.noPoolUDP {
+		t.Fatalf("Expected no_pool_udp to apply to the upstream")
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		c, err := p.Dial(proto)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		p.Yield(c)
+	}
+	if p.transport.Len() != 1 || p.transport.shard("tcp").conns == nil {
+		t.Errorf("Expected only the TCP connection to be cached, got %d", p.transport.Len())
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nno_pool_udp yes\n}\n")); err == nil {
+		t.Errorf("Expected error for an argument to no_pool_udp")
+	}
+	f, err = parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 no_pool_udp=true 127.0.0.2"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	if !f.proxies[0].noPoolUDP || f.proxies[1].noPoolUDP {
+		t.Errorf("Expected no_pool_udp=true to apply to its upstream only")
+	}
+}
+
+func TestForceTCPPreferUDP(t *testing.T) {
+	for _, config := range []string{
+		"forward . 127.0.0.1 force_tcp=true prefer_udp=true",
+		"forward . 127.0.0.1 prefer_udp=true force_tcp=true",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", config)); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 force_tcp=true 127.0.0.2 prefer_udp=true")); err != nil {
+		t.Errorf("Expected no error for different upstreams, got: %s", err)
+	}
+}
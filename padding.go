@@ -0,0 +1,41 @@
+package forward
+
+import "github.com/miekg/dns"
+
+// padBlock is the block size queries are padded to by default, as RFC 8467 recommends.
+const padBlock = 128
+
+// withPadding returns a copy of req with an EDNS0 padding option (RFC 7830), instead of the client's,
+// that makes it a multiple of block bytes long. A query without an OPT RR is returned as is.
+func withPadding(req *dns.Msg, block int) *dns.Msg {
+	if req.IsEdns0() == nil {
+		return req
+	}
+	r := req.Copy()
+	o := r.IsEdns0()
+	padding := &dns.EDNS0_PADDING{}
+	o.Option = append(withoutPadding(o.Option), padding)
+	// Len isn't exact, so pack to see how long it is.
+	if buf, err := r.Pack(); err == nil && len(buf)%block > 0 {
+		padding.Padding = make([]byte, block-len(buf)%block)
+	}
+	return r
+}
+
+// stripPadding removes the padding options from ret, they're about our connection, not the client's.
+func stripPadding(ret *dns.Msg) {
+	if o := ret.IsEdns0(); o != nil {
+		o.Option = withoutPadding(o.Option)
+	}
+}
+
+// withoutPadding returns a copy of opts without padding options.
+func withoutPadding(opts []dns.EDNS0) []dns.EDNS0 {
+	var rest []dns.EDNS0
+	for _, e := range opts {
+		if e.Option() != dns.EDNS0PADDING {
+			rest = append(rest, e)
+		}
+	}
+	return rest
+}
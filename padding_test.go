@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestWithPadding(t *testing.T) {
+	for _, name := range []string{"a.", "example.org.", "a-rather-long-name-that-takes-more-room.example.org."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if withPadding(m, 128) != m {
+			t.Errorf("Expected a query without EDNS0 to be left alone")
+		}
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 3)})
+
+		padded := withPadding(m, 128)
+		buf, err := padded.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf)%128 != 0 {
+			t.Errorf("Expected %s to be padded to a multiple of 128, got %d bytes", name, len(buf))
+		}
+		if n := len(padded.IsEdns0().Option); n != 1 {
+			t.Errorf("Expected one padding option, got %d", n)
+		}
+		if len(m.IsEdns0().Option[0].(*dns.EDNS0_PADDING).Padding) != 3 {
+			t.Errorf("Expected the query of the client to be left alone")
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "dns.test")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var size int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					var l [2]byte
+					if _, err := io.ReadFull(c, l[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(c, buf); err != nil {
+						return
+					}
+					atomic.StoreInt32(&size, int32(len(buf)))
+					r := new(dns.Msg)
+					if err := r.Unpack(buf); err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(r)
+					ret.SetEdns0(4096, false)
+					ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+					out, _ := ret.Pack()
+					binary.BigEndian.PutUint16(l[:], uint16(len(out)))
+					c.Write(append(l[:], out...))
+				}
+			}()
+		}
+	}()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . tls://"+ln.Addr().String()+" {\ntls "+caFile+"\ntls_servername dns.test\npadding 64\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	state.Req.SetEdns0(4096, false)
+	ret, err := p.connect(context.Background(), state, false, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if n := atomic.LoadInt32(&size); n%64 != 0 {
+		t.Errorf("Expected the query to be padded to a multiple of 64, got %d bytes", n)
+	}
+	if o := ret.IsEdns0(); o == nil || len(o.Option) != 0 {
+		t.Errorf("Expected the padding to be removed from the reply, got: %v", ret)
+	}
+
+	for _, input := range []string{"padding 0", "padding 5000", "padding 128 128", "padding x"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+	if f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\npadding\n}\n")); err != nil || f.padding != padBlock {
+		t.Errorf("Expected padding to default to %d, got: %v", padBlock, err)
+	}
+}
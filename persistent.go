@@ -1,10 +1,15 @@
 package forward
 
 import (
+	"crypto/tls"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 type persistConn struct {
@@ -17,104 +22,350 @@ type connErr struct {
 	err error
 }
 
+// cacheProtos are the protocols of the cached conns, each has a shard of the cache.
+var cacheProtos = [...]string{"udp", "tcp", "tcp-tls"}
+
+// connShard holds the cached conns of one protocol, in the order they were yielded. Dialing and
+// yielding conns of different protocols don't contend for the same lock.
+type connShard struct {
+	sync.Mutex
+	conns []*persistConn
+}
+
 // transport hold the persistent cache.
 type transport struct {
-	conns map[string][]*persistConn //  Buckets for udp, tcp and tcp-tls
-	host  *host
+	mem  int64 // approximate memory held by the cached conns, first for 64 bit alignment
+	idle int64 // number of cached conns
+
+	shards [len(cacheProtos)]connShard
+	host   *host
 
-	dial  chan string
-	yield chan connErr
-	ret   chan connErr
+	maxMem  int64 // if > 0, cap on mem
+	maxIdle int   // if > 0, cap on the number of conns per protocol
 
-	stop chan bool
+	taken chan struct{} // signaled when a conn is dialed, cached or not, see keepWarm
+
+	stopped int32 // set to 1 by Stop
 }
 
-func newTransport(h *host) *transport {
-	t := &transport{
-		conns: make(map[string][]*persistConn),
-		host:  h,
-		dial:  make(chan string),
-		yield: make(chan connErr),
-		ret:   make(chan connErr),
-		stop:  make(chan bool),
+func newTransport(h *host) *transport { return &transport{host: h, taken: make(chan struct{}, 1)} }
+
+// Len returns the number of cached conns.
+func (t *transport) Len() int { return int(atomic.LoadInt64(&t.idle)) }
+
+// shard returns the shard for conns of type proto.
+func (t *transport) shard(proto string) *connShard {
+	switch proto {
+	case "tcp":
+		return &t.shards[1]
+	case "tcp-tls":
+		return &t.shards[2]
 	}
-	go t.connManager()
-	return t
+	return &t.shards[0]
 }
 
-func (t *transport) Len() int {
-	l := 0
-	for _, conns := range t.conns {
-		l += len(conns)
-	}
-	return l
+// account adds n conns taking size bytes to the totals of t.
+func (t *transport) account(n, size int64) {
+	atomic.AddInt64(&t.idle, n)
+	atomic.AddInt64(&t.mem, size)
 }
 
-func (t *transport) connManager() {
+// cached returns a cached conn of type proto that hasn't been idle for too long, or nil. The ones that
+// have are closed.
+func (t *transport) cached(proto string) *dns.Conn {
+	s := t.shard(proto)
+	size := connSize(proto)
+	idle := t.host.idle(proto)
 
-Wait:
-	for {
-		select {
-		case proto := <-t.dial:
-			// Yes O(n), shouldn't put millions in here.
-			i := 0
-			for i = 0; i < len(t.conns[proto]); i++ {
-				pc := t.conns[proto][i]
-				if time.Since(pc.used) < t.host.expire {
-					t.conns[proto] = t.conns[proto][i+1:]
-					t.ret <- connErr{pc.c, nil}
-					continue Wait
-				}
+	var (
+		c       *dns.Conn
+		expired []*dns.Conn
+	)
+	s.Lock()
+	// Yes O(n), shouldn't put millions in here.
+	for len(s.conns) > 0 && c == nil {
+		pc := s.conns[0]
+		s.conns[0] = nil
+		s.conns = s.conns[1:]
+		t.account(-1, -size)
+		if time.Since(pc.used) < idle {
+			c = pc.c
+		} else {
+			expired = append(expired, pc.c)
+		}
+	}
+	n := len(s.conns)
+	s.Unlock()
 
-				pc.c.Close()
-			}
+	for _, e := range expired {
+		e.Close()
+	}
+	t.updateGauges(proto, n)
+	return c
+}
 
-			t.conns[proto] = t.conns[proto][i:]
-			SocketGauge.WithLabelValues(t.host.addr).Set(float64(t.Len()))
+// dial makes a new connection of type proto to h.
+func (h *host) dial(proto string) (*dns.Conn, error) { return h.dialHeader(proto, nil) }
 
-			go func() {
-				if proto != "tcp-tls" {
-					c, err := dns.DialTimeout(proto, t.host.addr, dialTimeout)
-					t.ret <- connErr{c, err}
-					return
-				}
+// dialHeader is dial, but a TCP connection starts with header, e.g. a PROXY protocol header, which
+// for TLS is sent before the handshake.
+func (h *host) dialHeader(proto string, header []byte) (*dns.Conn, error) {
+	addr := h.dialAddr(proto)
+	deadline := time.Now().Add(h.dialTimeout)
+	if h.dialer != nil {
+		return h.dialWith(proto, addr, deadline, header)
+	}
+	switch proto {
+	case "tcp":
+		c, err := h.dialTCP(addr, deadline, header)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: c}, nil
+	case "tcp-tls":
+		return h.dialTLS(addr, deadline, header)
+	}
+	d := h.bind.dialer(proto, addr)
+	d.Deadline = deadline
+	c, err := d.Dial(proto, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: c}, nil
+}
 
-				c, err := dns.DialTimeoutWithTLS("tcp", t.host.addr, t.host.tlsConfig, dialTimeout)
-				t.ret <- connErr{c, err}
-			}()
+// dialTCP makes a new TCP connection to addr before deadline, through the proxy server of h if it
+// has one, and writes header to it.
+func (h *host) dialTCP(addr string, deadline time.Time, header []byte) (net.Conn, error) {
+	var (
+		c   net.Conn
+		err error
+	)
+	if h.via != nil {
+		c, err = h.dialVia(addr, deadline)
+	} else {
+		d := h.bind.dialer("tcp", addr)
+		d.Deadline = deadline
+		c, err = d.Dial("tcp", addr)
+	}
+	if err != nil || len(header) == 0 {
+		return c, err
+	}
+	c.SetWriteDeadline(deadline)
+	if _, err := c.Write(header); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetWriteDeadline(time.Time{})
+	return c, nil
+}
 
-		case conn := <-t.yield:
+// dialTLS makes a new TLS connection to addr, starting with header, and accounts for its handshake.
+// Like dialing, the handshake must be done before deadline.
+func (h *host) dialTLS(addr string, deadline time.Time, header []byte) (*dns.Conn, error) {
+	c, err := h.dialTCP(addr, deadline, header)
+	if err != nil {
+		return nil, err
+	}
 
-			SocketGauge.WithLabelValues(t.host.addr).Set(float64(t.Len() + 1))
+	cfg := h.tlsConfig
+	if cfg.ServerName == "" {
+		// As tls.Dial does.
+		name, _, _ := net.SplitHostPort(addr)
+		cfg = cfg.Clone()
+		cfg.ServerName = name
+	}
+	tc := tls.Client(c, cfg)
+	tc.SetDeadline(deadline)
+	start := time.Now()
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	TLSHandshakeDuration.WithLabelValues(h.id, h.addr).Observe(time.Since(start).Seconds())
+	TLSHandshakeCount.WithLabelValues(h.id, h.addr, strconv.FormatBool(tc.ConnectionState().DidResume)).Add(1)
+	return &dns.Conn{Conn: tc}, nil
+}
 
-			// no proto here, infer from config and conn
-			if _, ok := conn.c.Conn.(*net.UDPConn); ok {
-				t.conns["udp"] = append(t.conns["udp"], &persistConn{conn.c, time.Now()})
-				continue Wait
+// shrink evicts the oldest cached conns, of any protocol, until the cache holds no more than maxMem.
+func (t *transport) shrink() {
+	for atomic.LoadInt64(&t.mem) > t.maxMem {
+		var (
+			oldest *connShard
+			proto  string
+			used   time.Time
+		)
+		for i := range t.shards {
+			s := &t.shards[i]
+			s.Lock()
+			if len(s.conns) > 0 && (oldest == nil || s.conns[0].used.Before(used)) {
+				oldest, proto, used = s, cacheProtos[i], s.conns[0].used
 			}
+			s.Unlock()
+		}
+		if oldest == nil {
+			return
+		}
 
-			if t.host.tlsConfig == nil {
-				t.conns["tcp"] = append(t.conns["tcp"], &persistConn{conn.c, time.Now()})
-				continue Wait
-			}
+		var c *dns.Conn
+		oldest.Lock()
+		if len(oldest.conns) > 0 && oldest.conns[0].used.Equal(used) {
+			c = oldest.conns[0].c
+			oldest.conns[0] = nil
+			oldest.conns = oldest.conns[1:]
+			t.account(-1, -connSize(proto))
+		}
+		n := len(oldest.conns)
+		oldest.Unlock()
+		if c != nil {
+			c.Close()
+			t.updateGauges(proto, n)
+		}
+	}
+}
 
-			t.conns["tcp-tls"] = append(t.conns["tcp-tls"], &persistConn{conn.c, time.Now()})
+// cleanup closes all cached connections.
+func (t *transport) cleanup() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		conns := s.conns
+		s.conns = nil
+		t.account(-int64(len(conns)), -int64(len(conns))*connSize(cacheProtos[i]))
+		s.Unlock()
 
-		case <-t.stop:
-			return
+		for _, pc := range conns {
+			pc.c.Close()
 		}
+		t.updateGauges(cacheProtos[i], 0)
 	}
 }
 
+// updateGauges sets the gauges of the cache, with n the number of cached conns of type proto.
+func (t *transport) updateGauges(proto string, n int) {
+	t.host.sockets(t.Len())
+	ConnCacheBytes.WithLabelValues(t.host.id, t.host.addr).Set(float64(atomic.LoadInt64(&t.mem)))
+	ConnCacheSize.WithLabelValues(t.host.id, t.host.addr, proto).Set(float64(n))
+}
+
 func (t *transport) Dial(proto string) (*dns.Conn, error) {
-	t.dial <- proto
-	c := <-t.ret
-	return c.c, c.err
+	return t.DialContext(context.Background(), proto)
+}
+
+// DialContext is like Dial, but stops waiting for the connection when ctx is done. A connection that
+// is still being dialed then goes to the cache when it's ready.
+func (t *transport) DialContext(ctx context.Context, proto string) (*dns.Conn, error) {
+	if atomic.LoadInt32(&t.stopped) == 1 {
+		return nil, errStopped
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c := t.cached(proto)
+	select {
+	case t.taken <- struct{}{}:
+	default:
+	}
+	if c != nil {
+		ConnCacheHits.WithLabelValues(t.host.id, t.host.addr, proto).Add(1)
+		return c, nil
+	}
+	ConnCacheMisses.WithLabelValues(t.host.id, t.host.addr, proto).Add(1)
+
+	done := ctx.Done()
+	if done == nil {
+		return t.host.dial(proto)
+	}
+	ret := make(chan connErr, 1) // buffered, so the dialer never blocks on a caller that went away
+	GoroutineGauge.WithLabelValues(t.host.id, t.host.addr, "dial").Inc()
+	go func() {
+		defer GoroutineGauge.WithLabelValues(t.host.id, t.host.addr, "dial").Dec()
+
+		c, err := t.host.dial(proto)
+		ret <- connErr{c, err}
+	}()
+	select {
+	case c := <-ret:
+		return c.c, c.err
+	case <-done:
+		go func() {
+			if c := <-ret; c.err == nil {
+				t.Yield(c.c)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// connProto returns the protocol of c, "udp", "tcp" or "tcp-tls".
+func connProto(c *dns.Conn) string {
+	switch conn := c.Conn.(type) {
+	case *net.UDPConn:
+		return "udp"
+	case *tls.Conn:
+		return "tcp-tls"
+	case *dialedConn:
+		return conn.proto
+	}
+	return "tcp"
 }
 
 func (t *transport) Yield(c *dns.Conn) {
-	t.yield <- connErr{c, nil}
+	proto := connProto(c)
+	size := connSize(proto)
+	if t.maxMem > 0 && size > t.maxMem {
+		c.Close()
+		return
+	}
+
+	var evicted *dns.Conn
+	s := t.shard(proto)
+	s.Lock()
+	if atomic.LoadInt32(&t.stopped) == 1 {
+		s.Unlock()
+		c.Close()
+		return
+	}
+	if t.maxIdle > 0 && len(s.conns) >= t.maxIdle {
+		// Evict the least recently used one, the conns are in the order they were yielded.
+		evicted = s.conns[0].c
+		s.conns[0] = nil
+		s.conns = s.conns[1:]
+		t.account(-1, -size)
+	}
+	s.conns = append(s.conns, &persistConn{c, time.Now()})
+	t.account(1, size)
+	n := len(s.conns)
+	s.Unlock()
+
+	if evicted != nil {
+		evicted.Close()
+	}
+	if t.maxMem > 0 {
+		t.shrink()
+	}
+	t.updateGauges(proto, n)
 }
 
-// Stop stops the transports.
-func (t *transport) Stop() { t.stop <- true }
+// Reset closes all cached connections, a subsequent Dial will make a new connection.
+func (t *transport) Reset() { t.cleanup() }
+
+// Stop stops the transports and returns when all cached connections are closed. It must only be
+// called once.
+func (t *transport) Stop() {
+	atomic.StoreInt32(&t.stopped, 1)
+	t.cleanup()
+}
+
+// connSize returns the approximate amount of memory a cached connection of type proto holds on to. This
+// includes kernel socket buffers and, for TLS, the record buffers.
+func connSize(proto string) int64 {
+	switch proto {
+	case "udp":
+		return 4 << 10
+	case "tcp":
+		return 8 << 10
+	}
+	return 40 << 10
+}
@@ -0,0 +1,199 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConnCacheMetrics(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(newHost(s.Addr))
+	tr.host.expire = 10 * time.Second
+	defer tr.Stop()
+
+	c1, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Yield(c1)
+	c2, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Errorf("Expected the cached connection")
+	}
+	m := new(dto.Metric)
+	ConnCacheSize.WithLabelValues(tr.host.id, s.Addr, "udp").Write(m)
+	if x := m.GetGauge().GetValue(); x != 0 {
+		t.Errorf("Expected no cached connections while it's in use, got: %f", x)
+	}
+	c2.Close()
+
+	if x := counterValue(ConnCacheMisses, tr.host.id, s.Addr, "udp"); x != 1 {
+		t.Errorf("Expected 1 miss, got: %f", x)
+	}
+	if x := counterValue(ConnCacheHits, tr.host.id, s.Addr, "udp"); x != 1 {
+		t.Errorf("Expected 1 hit, got: %f", x)
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(newHost(s.Addr))
+	tr.host.expire = 10 * time.Second
+	tr.maxIdle = 2
+	defer tr.Stop()
+
+	var conns []*dns.Conn
+	for i := 0; i < 3; i++ {
+		c, err := tr.Dial("udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		tr.Yield(c)
+	}
+
+	// The first one yielded was evicted, the others come out of the cache.
+	for _, want := range conns[1:] {
+		c, err := tr.Dial("udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != want {
+			t.Error("Expected a cached connection, in the order they were yielded")
+		}
+		c.Close()
+	}
+	if _, err := conns[0].Write([]byte{0, 0}); err == nil {
+		t.Error("Expected the least recently used connection to be closed")
+	}
+}
+
+func TestMaxConnMemory(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nmax_conn_memory 12K\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	tr := f.proxies[0].transport
+	tr.host.expire = 10 * time.Second
+	if tr.maxMem != 12<<10 {
+		t.Fatalf("Expected a cap of %d bytes, got: %d", 12<<10, tr.maxMem)
+	}
+
+	// Three UDP conns fill the cap.
+	var conns []*dns.Conn
+	for i := 0; i < 3; i++ {
+		c, err := tr.Dial("udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		tr.Yield(c)
+	}
+	if x := tr.Len(); x != 3 {
+		t.Fatalf("Expected 3 cached connections, got: %d", x)
+	}
+
+	// A TCP conn takes the room of the two oldest UDP ones.
+	c, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Yield(c)
+	if x := tr.Len(); x != 2 {
+		t.Errorf("Expected 2 cached connections, got: %d", x)
+	}
+	m := new(dto.Metric)
+	ConnCacheBytes.WithLabelValues(tr.host.id, s.Addr).Write(m)
+	if x := m.GetGauge().GetValue(); x != 12<<10 {
+		t.Errorf("Expected %d cached bytes, got: %f", 12<<10, x)
+	}
+	for i, c := range conns {
+		_, err := c.Write([]byte{0, 0})
+		if evicted := err != nil; evicted != (i < 2) {
+			t.Errorf("Expected conn %d evicted %t, got %t", i, i < 2, evicted)
+		}
+	}
+}
+
+func TestProtoExpire(t *testing.T) {
+	h := newHost("127.0.0.1:53")
+	h.expire = 10 * time.Second
+	h.protoExpire = map[string]time.Duration{"udp": time.Second}
+
+	if d := h.idle("udp"); d != time.Second {
+		t.Errorf("Expected the UDP expire of 1s, got: %s", d)
+	}
+	if d := h.idle("tcp"); d != 10*time.Second {
+		t.Errorf("Expected the expire of 10s for TCP, got: %s", d)
+	}
+}
+
+func counterValue(c *prometheus.CounterVec, labels ...string) float64 {
+	m := new(dto.Metric)
+	c.WithLabelValues(labels...).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func BenchmarkTransportParallel(b *testing.B) {
+	tr := newTransport(newHost("127.0.0.1:53"))
+	tr.host.expire = time.Minute
+	defer tr.Stop()
+
+	// Enough connections for every goroutine to find one cached.
+	var conns []*dns.Conn
+	for i := 0; i < 256; i++ {
+		c, err := tr.Dial("udp")
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		tr.Yield(c)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := tr.Dial("udp")
+			if err != nil {
+				b.Fatal(err)
+			}
+			tr.Yield(c)
+		}
+	})
+}
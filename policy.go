@@ -0,0 +1,222 @@
+package forward
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Policy orders the upstreams for a query: they are tried in the order of the returned list.
+type Policy interface {
+	List(proxies []*Proxy) []*Proxy
+	String() string
+}
+
+// ClientPolicy is a Policy that orders the upstreams by the query, e.g. by the client that sent it.
+// When the policy of a Forward implements it, ListFor is used instead of List.
+type ClientPolicy interface {
+	Policy
+	ListFor(state request.Request, proxies []*Proxy) []*Proxy
+}
+
+// order returns proxies ordered by policy for the query in state, the backups last.
+func order(policy Policy, state request.Request, proxies []*Proxy) []*Proxy {
+	if cp, ok := policy.(ClientPolicy); ok {
+		return backupsLast(cp.ListFor(state, proxies))
+	}
+	return backupsLast(policy.List(proxies))
+}
+
+// backupsLast moves the backups in list after the other proxies, keeping their order.
+func backupsLast(list []*Proxy) []*Proxy {
+	i := 0
+	for i < len(list) && !list[i].backup {
+		i++
+	}
+	j := i
+	for j < len(list) && list[j].backup {
+		j++
+	}
+	if j == len(list) {
+		return list // no backups, or they are last already
+	}
+	tiered := make([]*Proxy, 0, len(list))
+	for _, p := range list {
+		if !p.backup {
+			tiered = append(tiered, p)
+		}
+	}
+	for _, p := range list {
+		if p.backup {
+			tiered = append(tiered, p)
+		}
+	}
+	return tiered
+}
+
+// random is the default policy, it shuffles the upstreams taking their weights into account.
+type random struct{}
+
+func (random) List(proxies []*Proxy) []*Proxy { return shuffle(proxies) }
+func (random) String() string                 { return "random" }
+
+// roundRobin starts every query at the next upstream.
+type roundRobin struct {
+	next uint32
+}
+
+func (r *roundRobin) List(proxies []*Proxy) []*Proxy {
+	if len(proxies) < 2 {
+		return proxies
+	}
+	i := int(atomic.AddUint32(&r.next, 1) % uint32(len(proxies)))
+	list := make([]*Proxy, 0, len(proxies))
+	list = append(list, proxies[i:]...)
+	return append(list, proxies[:i]...)
+}
+
+func (r *roundRobin) String() string { return "round_robin" }
+
+// leastConn puts the upstreams with the fewest exchanges in progress first, ties are broken randomly.
+type leastConn struct{}
+
+func (leastConn) List(proxies []*Proxy) []*Proxy {
+	list := make([]*Proxy, len(proxies))
+	for i, j := range rand.Perm(len(proxies)) {
+		list[i] = proxies[j]
+	}
+	inflight := make(map[*Proxy]int64, len(list))
+	for _, p := range list {
+		inflight[p] = atomic.LoadInt64(&p.inflight)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return inflight[list[i]] < inflight[list[j]] })
+	return list
+}
+
+func (leastConn) String() string { return "least_conn" }
+
+// sequential keeps the configured order: the first upstream gets all queries, the next one is only
+// tried when it fails or is down.
+type sequential struct{}
+
+func (sequential) List(proxies []*Proxy) []*Proxy { return proxies }
+func (sequential) String() string                 { return "sequential" }
+
+// affinity sends the queries of a client to the same upstream, which keeps the upstream's cache warm
+// for it. The upstreams are ordered by weighted rendezvous hashing of the client, its address or the
+// subnet of its EDNS Client Subnet option, with their addresses: every query of a client falls over
+// in the same order, and when an upstream goes away only its clients move.
+type affinity struct{}
+
+func (affinity) List(proxies []*Proxy) []*Proxy { return shuffle(proxies) } // the client is unknown
+
+func (affinity) ListFor(state request.Request, proxies []*Proxy) []*Proxy {
+	if len(proxies) < 2 {
+		return proxies
+	}
+	key := clientKey(state)
+	type scored struct {
+		p     *Proxy
+		score float64
+	}
+	list := make([]scored, len(proxies))
+	for i, p := range proxies {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(p.host.addr))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53) // in (0, 1)
+		list[i] = scored{p, float64(p.weight) / -math.Log(u)}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].score > list[j].score })
+
+	ordered := make([]*Proxy, len(list))
+	for i := range list {
+		ordered[i] = list[i].p
+	}
+	return ordered
+}
+
+func (affinity) String() string { return "client_affinity" }
+
+// latency puts the upstreams with the lowest expected latency first: the moving average of their RTT,
+// where a lost exchange counts as the read timeout. Upstreams without an RTT yet come first, so they
+// get measured. With a chance of explore, a random other upstream is tried first instead, which keeps
+// the averages of the slower ones fresh.
+type latency struct {
+	explore float64
+}
+
+// latencyExplore is the default share of queries the latency policy sends to another upstream.
+const latencyExplore = 0.05
+
+func (l *latency) List(proxies []*Proxy) []*Proxy {
+	if len(proxies) < 2 {
+		return proxies
+	}
+	list := make([]*Proxy, len(proxies))
+	for i, j := range rand.Perm(len(proxies)) {
+		list[i] = proxies[j]
+	}
+	expected := make(map[*Proxy]float64, len(list))
+	for _, p := range list {
+		expected[p] = p.host.score.latency(p.host.readTimeout)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return expected[list[i]] < expected[list[j]] })
+	if l.explore > 0 && rand.Float64() < l.explore {
+		i := 1 + rand.Intn(len(list)-1)
+		list[0], list[i] = list[i], list[0]
+	}
+	return list
+}
+
+func (l *latency) String() string { return "latency" }
+
+// clientKey returns what identifies the client of state for affinity: the subnet of its EDNS Client
+// Subnet option or else its address.
+func clientKey(state request.Request) string {
+	if o := state.Req.IsEdns0(); o != nil {
+		for _, s := range o.Option {
+			if e, ok := s.(*dns.EDNS0_SUBNET); ok {
+				return e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+			}
+		}
+	}
+	if state.W == nil {
+		return ""
+	}
+	return state.IP()
+}
+
+// newPolicy returns the policy called name, or nil if there is none.
+func newPolicy(name string) Policy {
+	switch name {
+	case "random":
+		return random{}
+	case "round_robin":
+		return &roundRobin{}
+	case "least_conn":
+		return leastConn{}
+	case "sequential":
+		return sequential{}
+	case "client_affinity":
+		return affinity{}
+	case "latency":
+		return &latency{explore: latencyExplore}
+	}
+	return nil
+}
+
+// SetPolicy sets the policy that orders the upstreams for each query.
+func (f *Forward) SetPolicy(p Policy) {
+	f.Lock()
+	f.policy = p
+	f.Unlock()
+}
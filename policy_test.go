@@ -0,0 +1,218 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestPolicy(t *testing.T) {
+	proxies := []*Proxy{NewProxy("10.0.0.1:53"), NewProxy("10.0.0.2:53"), NewProxy("10.0.0.3:53")}
+	for _, p := range proxies {
+		defer p.close()
+	}
+
+	if list := (sequential{}).List(proxies); list[0] != proxies[0] || list[2] != proxies[2] {
+		t.Errorf("Expected sequential to keep the order")
+	}
+
+	rr := &roundRobin{}
+	first := map[*Proxy]int{}
+	for i := 0; i < 6; i++ {
+		list := rr.List(proxies)
+		if len(list) != 3 {
+			t.Fatalf("Expected 3 proxies, got %d", len(list))
+		}
+		first[list[0]]++
+	}
+	for _, p := range proxies {
+		if first[p] != 2 {
+			t.Errorf("Expected round_robin to start at %s twice, got %d", p.host.addr, first[p])
+		}
+	}
+
+	proxies[0].inflight, proxies[1].inflight, proxies[2].inflight = 5, 0, 2
+	for i := 0; i < 10; i++ {
+		list := (leastConn{}).List(proxies)
+		if list[0] != proxies[1] || list[1] != proxies[2] || list[2] != proxies[0] {
+			t.Fatalf("Expected least_conn to order on in-flight exchanges")
+		}
+	}
+}
+
+func TestSetupPolicy(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 127.0.0.2 {\npolicy sequential\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.policy.String() != "sequential" {
+		t.Errorf("Expected policy sequential, got: %s", f.policy)
+	}
+	if list := f.list(questionState("example.org.")); list[0].host.addr != "127.0.0.1:53" {
+		t.Errorf("Expected 127.0.0.1:53 first, got: %s", list[0].host.addr)
+	}
+
+	c = caddy.NewTestController("dns", "forward . 127.0.0.1 {\npolicy fastest\n}\n")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("Expected error for an unknown policy")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	proxies := []*Proxy{NewProxy("10.0.0.1:53"), NewProxy("10.0.0.2:53"), NewProxy("10.0.0.3:53")}
+	for _, p := range proxies {
+		defer p.close()
+	}
+	ok := new(dns.Msg)
+	for i := 0; i < 20; i++ {
+		proxies[0].host.observe(ok, nil, 50*time.Millisecond)
+		proxies[1].host.observe(ok, nil, 10*time.Millisecond)
+		proxies[2].host.observe(ok, nil, 5*time.Millisecond)
+		proxies[2].host.observe(nil, errors.New("timeout"), 0) // fast but lossy
+	}
+
+	l := &latency{}
+	for i := 0; i < 10; i++ {
+		list := l.List(proxies)
+		if list[0] != proxies[1] || list[1] != proxies[0] || list[2] != proxies[2] {
+			t.Fatalf("Expected the upstreams ordered on expected latency, got %s %s %s", list[0].host.addr, list[1].host.addr, list[2].host.addr)
+		}
+	}
+
+	fresh := NewProxy("10.0.0.4:53")
+	defer fresh.close()
+	if list := l.List(append(proxies, fresh)); list[0] != fresh {
+		t.Errorf("Expected the upstream without an RTT first, got %s", list[0].host.addr)
+	}
+
+	l.explore = 1
+	for i := 0; i < 10; i++ {
+		if list := l.List(proxies); list[0] == proxies[1] {
+			t.Fatalf("Expected another upstream first when exploring")
+		}
+	}
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\npolicy latency 10%\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if p, ok := f.policy.(*latency); !ok || p.explore != 0.1 {
+		t.Errorf("Expected policy latency exploring 10%%, got: %v", f.policy)
+	}
+	for _, input := range []string{"policy latency 200", "policy latency 5 5", "policy random 5"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	proxies := []*Proxy{NewProxy("10.0.0.1:53"), NewProxy("10.0.0.2:53"), NewProxy("10.0.0.3:53")}
+	for _, p := range proxies {
+		defer p.close()
+	}
+
+	client := func(i int) request.Request {
+		state := questionState("example.org.")
+		state.Req.SetEdns0(4096, false)
+		o := state.Req.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 168, byte(i), 0)})
+		return state
+	}
+
+	first := map[*Proxy]int{}
+	for i := 0; i < 100; i++ {
+		list := (affinity{}).ListFor(client(i), proxies)
+		if again := (affinity{}).ListFor(client(i), proxies); !reflect.DeepEqual(list, again) {
+			t.Fatalf("Expected client %d to get the same order every time", i)
+		}
+		first[list[0]]++
+
+		// Without its upstream, a client falls over to its second one; the others stay put.
+		rest := make([]*Proxy, 0, 2)
+		for _, p := range proxies {
+			if p != proxies[0] {
+				rest = append(rest, p)
+			}
+		}
+		want := list[0]
+		if want == proxies[0] {
+			want = list[1]
+		}
+		if got := (affinity{}).ListFor(client(i), rest)[0]; got != want {
+			t.Errorf("Expected client %d to go to %s, got: %s", i, want.host.addr, got.host.addr)
+		}
+	}
+	for _, p := range proxies {
+		if first[p] == 0 {
+			t.Errorf("Expected some clients to go to %s first", p.host.addr)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 127.0.0.2 {\nbackup 127.0.0.3 127.0.0.4\npolicy round_robin\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	backups := map[*Proxy]int{}
+	for i := 0; i < 4; i++ {
+		list := f.list(questionState("example.org."))
+		if len(list) != 4 {
+			t.Fatalf("Expected 4 proxies, got %d", len(list))
+		}
+		for j, p := range list {
+			if p.backup != (j >= 2) {
+				t.Fatalf("Expected the backups last, got %s at %d", p.host.addr, j)
+			}
+		}
+		backups[list[2]]++
+	}
+	if len(backups) != 2 {
+		t.Errorf("Expected round_robin to rotate the backups too, got: %v", backups)
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nbackup\n}\n")); err == nil {
+		t.Error("Expected an error for backup without upstreams")
+	}
+}
+
+func TestBackupFailover(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := pc.LocalAddr().String()
+	pc.Close()
+
+	f := New()
+	primary, backup := NewProxy(down), NewProxy(s.Addr)
+	backup.backup = true
+	f.SetProxy(backup)
+	f.SetProxy(primary)
+	defer f.Close()
+
+	_, info, err := f.ForwardWithInfo(questionState("example.org."))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if info.Upstream != s.Addr || info.Attempts != 2 {
+		t.Errorf("Expected the backup to answer after the primary failed, got %s after %d attempts", info.Upstream, info.Attempts)
+	}
+}
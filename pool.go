@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// bufPool holds the buffers queries are packed into and replies are read into, so an exchange doesn't
+// allocate them each time: at high query rates they are most of the garbage.
+var bufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, dns.MaxMsgSize)
+	return &b
+}}
+
+// writeMsg packs m into a pooled buffer and writes it to conn. Unlike conn.WriteMsg it doesn't do TSIG,
+// forward never signs its queries.
+func writeMsg(conn *dns.Conn, m *dns.Msg) error {
+	b := bufPool.Get().(*[]byte)
+	defer bufPool.Put(b)
+	out, err := m.PackBuffer(*b)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(out)
+	return err
+}
+
+// readMsg reads a message from conn into a pooled buffer and unpacks it. Like conn.ReadMsg, it returns the
+// message along with the error when it can't be unpacked entirely, and ErrSecret for TSIG signed ones.
+func readMsg(conn *dns.Conn) (*dns.Msg, error) {
+	b := bufPool.Get().(*[]byte)
+	defer bufPool.Put(b)
+	n, err := conn.Read(*b)
+	if err != nil {
+		return nil, err
+	}
+	if n < 12 { // not even a header
+		return nil, dns.ErrShortRead
+	}
+	m := new(dns.Msg)
+	err = m.Unpack((*b)[:n])
+	detach(m)
+	if err != nil {
+		return m, err
+	}
+	if m.IsTsig() != nil {
+		return m, dns.ErrSecret
+	}
+	return m, nil
+}
+
+// detach copies the EDNS0 options of m that miekg/dns unpacks as slices of the buffer, which goes back
+// to the pool.
+func detach(m *dns.Msg) {
+	o := m.IsEdns0()
+	if o == nil {
+		return
+	}
+	for _, e := range o.Option {
+		switch e := e.(type) {
+		case *dns.EDNS0_DAU:
+			e.AlgCode = append([]uint8(nil), e.AlgCode...)
+		case *dns.EDNS0_DHU:
+			e.AlgCode = append([]uint8(nil), e.AlgCode...)
+		case *dns.EDNS0_N3U:
+			e.AlgCode = append([]uint8(nil), e.AlgCode...)
+		case *dns.EDNS0_PADDING:
+			e.Padding = append([]byte(nil), e.Padding...)
+		}
+	}
+}
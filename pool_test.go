@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestPooledMsg(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: []byte{1, 2, 3}})
+	go writeMsg(&dns.Conn{Conn: c1}, m)
+
+	ret, err := readMsg(&dns.Conn{Conn: c2})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	b := bufPool.Get().(*[]byte)
+	for i := range *b {
+		(*b)[i] = 0xff
+	}
+	bufPool.Put(b)
+
+	if ret.Question[0].Name != "example.org." {
+		t.Errorf("Expected the query for example.org., got: %s", ret)
+	}
+	if p := ret.IsEdns0().Option[0].(*dns.EDNS0_PADDING).Padding; !bytes.Equal(p, []byte{1, 2, 3}) {
+		t.Errorf("Expected the padding not to share the pooled buffer, got: %v", p)
+	}
+}
+
+func BenchmarkConnect(b *testing.B) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	defer p.close()
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.connect(context.Background(), state, false, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// PrefetchFunc is called when an upstream answer has a TTL lower than the configured threshold. The
+// cache plugin, or an embedder, can use this to refresh qname and qtype before the answer expires. It
+// is called synchronously in the query path, so it should not block.
+type PrefetchFunc func(state request.Request, ttl uint32)
+
+// SetPrefetchFunc sets the function called when a low TTL answer is seen.
+func (f *Forward) SetPrefetchFunc(fn PrefetchFunc) { f.prefetch = fn }
+
+// SetPrefetchTTL sets the TTL below which answers trigger a prefetch hint, 0 disables hints.
+func (f *Forward) SetPrefetchTTL(ttl uint32) { f.prefetchTTL = ttl }
+
+// prefetchHint publishes a hint if the lowest TTL in the answer section of ret is below the threshold.
+func (f *Forward) prefetchHint(state request.Request, ret *dns.Msg) {
+	if f.prefetchTTL == 0 || ret.Rcode != dns.RcodeSuccess || len(ret.Answer) == 0 {
+		return
+	}
+
+	ttl := ret.Answer[0].Header().Ttl
+	for _, rr := range ret.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl >= f.prefetchTTL {
+		return
+	}
+
+	PrefetchHintCount.WithLabelValues(f.id).Add(1)
+	if f.prefetch != nil {
+		f.prefetch(state, ttl)
+	}
+}
@@ -0,0 +1,71 @@
+package forward
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// probe is a query with a known answer. An upstream that returns something else, i.e. because of a
+// captive portal, NXDOMAIN rewriting or a hijacked route, is considered untrustworthy.
+type probe struct {
+	name  string
+	qtype uint16
+	want  string // expected rdata of one of the answer RRs, or an rcode, e.g. NXDOMAIN
+}
+
+// newProbe returns a probe for name and type, expecting the answer want.
+func newProbe(name, typ, want string) (*probe, error) {
+	qtype, ok := dns.StringToType[strings.ToUpper(typ)]
+	if !ok {
+		return nil, fmt.Errorf("unknown type in probe: %q", typ)
+	}
+	return &probe{name: dns.Fqdn(name), qtype: qtype, want: want}, nil
+}
+
+// match returns true if m carries the expected answer.
+func (p *probe) match(m *dns.Msg) bool {
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(p.want)]; ok {
+		return m.Rcode == rcode
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != p.qtype {
+			continue
+		}
+		if strings.TrimPrefix(rr.String(), rr.Header().String()) == p.want {
+			return true
+		}
+	}
+	return false
+}
+
+// runProbe sends the probe to h and updates the trust state. Errors are left to the health check.
+func (h *host) runProbe() {
+	m := new(dns.Msg)
+	m.SetQuestion(h.probe.name, h.probe.qtype)
+
+	ret, err := h.exchangeOnce(h.client, m, h.addr)
+	if err != nil {
+		return
+	}
+
+	if h.probe.match(ret) {
+		if atomic.SwapUint32(&h.untrusted, 0) == 1 {
+			h.log.info(h.id, "probe_matched", fmt.Sprintf("probe of %s matches again, trusting it", h),
+				Field{"upstream", h.addr}, Field{"tag", h.tag})
+		}
+		UntrustedGauge.WithLabelValues(h.id, h.addr).Set(0)
+		return
+	}
+
+	if atomic.SwapUint32(&h.untrusted, 1) == 0 {
+		h.log.warning(h.id, "probe_mismatch", fmt.Sprintf("probe of %s returned an unexpected answer for %s, not trusting it", h, h.probe.name),
+			Field{"upstream", h.addr}, Field{"tag", h.tag}, Field{"probe", h.probe.name})
+	}
+	UntrustedGauge.WithLabelValues(h.id, h.addr).Set(1)
+}
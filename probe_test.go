@@ -0,0 +1,46 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestProbe(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "probe.example.org." {
+			ret.Answer = append(ret.Answer, test.A("probe.example.org. IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		name, want string
+		untrusted  uint32
+	}{
+		{"probe.example.org.", "127.0.0.1", 0},
+		{"probe.example.org.", "127.0.0.2", 1},
+		{"nxdomain.example.org.", "NXDOMAIN", 1},
+		{"nxdomain.example.org.", "NOERROR", 0},
+	}
+
+	for i, tc := range tests {
+		pr, err := newProbe(tc.name, "A", tc.want)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		h := newHost(s.Addr)
+		h.probe = pr
+		h.SetClient()
+		h.Check()
+
+		if h.untrusted != tc.untrusted {
+			t.Errorf("Test %d: expected untrusted to be %d, got: %d", i, tc.untrusted, h.untrusted)
+		}
+	}
+}
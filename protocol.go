@@ -24,7 +24,20 @@ const (
 	TLS
 )
 
+// defaultPort is the port used for each protocol when none is given.
+var defaultPort = map[int]string{
+	DNS: "53",
+	TLS: "853",
+}
+
 const (
 	_dns = "dns"
 	_tls = "tls"
+
+	_https = "https"
+	_quic  = "quic"
+	_grpc  = "grpc"
+	_mdns  = "mdns"
+	_sdns  = "sdns"
+	_srv   = "srv"
 )
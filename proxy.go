@@ -2,23 +2,62 @@ package forward
 
 import (
 	"crypto/tls"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 // Proxy defines an upstream host.
 type Proxy struct {
+	inflight int64 // number of exchanges in progress, first for 64 bit alignment
+
 	host *host
 
 	transport *transport
+	mux       *mux // if not nil, TCP and TLS queries are multiplexed over it instead of using transport
+
+	maint maintenance
+
+	group  string // upstream group this proxy belongs to, "" is the default group
+	backup bool   // only tried after all other proxies of its group are down or failed
+	tls    bool   // needs the TLS config of the Forward, used during setup
+
+	weight        int    // relative share of the queries
+	maxfails      uint32 // overrides the max_fails of the Forward when ownMaxfails is set
+	ownMaxfails   bool
+	tlsServerName string    // overrides the tls_servername of the Forward, used during setup
+	tlsHashes     [][]byte  // certificate hashes from a DNS stamp, used during setup
+	tlsCA         *caFile   // overrides the CA certificates of the Forward, used during setup
+	tlsCert       *certFile // overrides the client certificate of the Forward, used during setup
+	preferUDP     bool      // use UDP even when the client used TCP
+	stateless     bool      // don't cache connections, every query gets a fresh one
+	noPoolUDP     bool      // don't cache UDP sockets
+	warmConns     int       // if > 0, connections kept dialed ahead of the queries
+
+	mdns *mdns // if not nil, resolve with multicast DNS instead of over the transport
+
+	hostname string // name the upstream was given by, its address is resolved with the bootstrap resolvers
+	source   string // where the upstream was learned from, e.g. "dhcp", "" for the configured ones
+
+	limit    *tokenBucket // if not nil, the max_qps of the upstream
+	ownLimit bool         // limit was set for this upstream, the max_qps of the Forward doesn't apply
 
 	// copied from Forward.
-	hcInterval time.Duration
-	forceTCP   bool
+	hcInterval    time.Duration
+	ownHcInterval bool          // hcInterval was set for this upstream, it's not copied
+	hcBackoff     time.Duration // if set, the maximum health check interval when checks fail
+	hcJitter      float64       // spread each health check interval randomly by up to this fraction
+	hcSkipActive  bool          // don't health check while queries get answers
+	forceTCP      bool
 
-	stop chan bool
+	stop      chan bool
+	closeOnce sync.Once
+	checks    sync.WaitGroup // the health checking goroutines
+	checked   chan struct{}  // if not nil, closed when the first health check is done
 
 	sync.RWMutex
 }
@@ -30,6 +69,7 @@ func NewProxy(addr string) *Proxy {
 	p := &Proxy{
 		host:       host,
 		hcInterval: hcDuration,
+		weight:     1,
 		stop:       make(chan bool),
 		transport:  newTransport(host),
 	}
@@ -42,36 +82,182 @@ func (p *Proxy) SetTLSConfig(cfg *tls.Config) { p.host.tlsConfig = cfg }
 // SetExpire sets the expire duration in the lower p.host.
 func (p *Proxy) SetExpire(expire time.Duration) { p.host.expire = expire }
 
-func (p *Proxy) close() { p.stop <- true }
+// SetProtoExpire sets the expire duration of the connections of type proto ("udp", "tcp" or "tcp-tls")
+// in the lower p.host, overriding the one set with SetExpire.
+func (p *Proxy) SetProtoExpire(proto string, expire time.Duration) {
+	if p.host.protoExpire == nil {
+		p.host.protoExpire = make(map[string]time.Duration)
+	}
+	p.host.protoExpire[proto] = expire
+}
+
+// SetMaxIdleConns sets the cap on the number of cached connections per protocol in the lower p.transport.
+func (p *Proxy) SetMaxIdleConns(n int) { p.transport.maxIdle = n }
+
+// SetTimeouts sets the dial, read and write timeouts in the lower p.host.
+func (p *Proxy) SetTimeouts(dial, read, write time.Duration) {
+	p.host.dialTimeout, p.host.readTimeout, p.host.writeTimeout = dial, read, write
+}
+
+// SetMaxConnMemory sets the cap on the approximate memory held by cached connections in the lower p.transport.
+func (p *Proxy) SetMaxConnMemory(n int64) { p.transport.maxMem = n }
+
+// close stops the health checking and the transport of p. It returns when the cached connections are
+// closed and the health checking has stopped, which may wait for a check in progress. It is safe to
+// call close more than once.
+func (p *Proxy) close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.transport.Stop()
+		if p.mux != nil {
+			p.mux.close()
+		}
+		if p.host.exch != nil {
+			p.host.exch.close()
+		}
+	})
+	p.checks.Wait()
+}
+
+// startHealthCheck health checks p in a goroutine of its own, until p is closed. With warm_conns,
+// another one keeps the connections dialed.
+func (p *Proxy) startHealthCheck() {
+	p.checks.Add(1)
+	go func() {
+		defer p.checks.Done()
+		p.healthCheck()
+	}()
+	if proto, ok := p.warmProto(); ok {
+		p.checks.Add(1)
+		go func() {
+			defer p.checks.Done()
+			p.keepWarm(proto)
+		}()
+	}
+}
 
 // Dial connects to the host in p with the configured transport.
 func (p *Proxy) Dial(proto string) (*dns.Conn, error) { return p.transport.Dial(proto) }
 
-// Yield returns the connection to the pool.
-func (p *Proxy) Yield(c *dns.Conn) { p.transport.Yield(c) }
+// DialContext is like Dial, but gives up when ctx is done.
+func (p *Proxy) DialContext(ctx context.Context, proto string) (*dns.Conn, error) {
+	return p.transport.DialContext(ctx, proto)
+}
 
-// Down returns if this proxy is up or down.
-func (p *Proxy) Down(maxfails uint32) bool { return p.host.down(maxfails) }
+// Yield returns the connection to the pool, or closes it if p is stateless, or if it's a UDP one and p
+// doesn't pool those.
+func (p *Proxy) Yield(c *dns.Conn) {
+	if p.stateless || (p.noPoolUDP && connProto(c) == "udp") {
+		c.Close()
+		return
+	}
+	p.transport.Yield(c)
+}
 
-func (p *Proxy) healthCheck() {
+// Reset closes all cached connections of p, also those of DoH, DoQ and gRPC upstreams.
+func (p *Proxy) Reset() {
+	p.transport.Reset()
+	if p.mux != nil {
+		p.mux.reset()
+	}
+	if p.host.exch != nil {
+		p.host.exch.reset()
+	}
+}
+
+// Down returns if this proxy is up or down. A proxy is down when it's in a maintenance window, when
+// its health checks fail or when it fails the known-answer probe.
+func (p *Proxy) Down(maxfails uint32) bool {
+	reason := p.downReason(maxfails)
+	p.setDown(reason)
+	return reason != ""
+}
+
+// setDown records whether the queries see p as down, for reason, or up when reason is "". Only the
+// change from up to down is counted in DownCount, not every query that skips p. The healthy expvar
+// follows the changes.
+func (p *Proxy) setDown(reason string) {
+	if reason == "" {
+		if atomic.CompareAndSwapUint32(&p.host.wasDown, 1, 0) {
+			p.host.publishHealthy()
+		}
+		return
+	}
+	if atomic.CompareAndSwapUint32(&p.host.wasDown, 0, 1) {
+		DownCount.WithLabelValues(p.host.id, p.host.addr, reason).Add(1)
+		p.host.publishHealthy()
+	}
+}
+
+// downReason returns why p is down, one of the reasons of DownCount, or "" if it's up.
+func (p *Proxy) downReason(maxfails uint32) string {
+	if p.ownMaxfails {
+		maxfails = p.maxfails
+	}
+	switch {
+	case p.maint.down(time.Now()):
+		return "maintenance"
+	case p.host.down(maxfails):
+		return "health"
+	case atomic.LoadUint32(&p.host.untrusted) == 1:
+		return "untrusted"
+	case p.host.servfails.exceeded(time.Now()):
+		return "servfail"
+	}
+	return ""
+}
 
-	// stop channel
+// setHealthClient sets the client for the health checks of p, which go over the transport that p
+// uses for queries: TLS when it has a TLS config, and TCP with force_tcp.
+func (p *Proxy) setHealthClient() {
 	p.host.SetClient()
+	if p.forceTCP && p.host.client.Net == "udp" {
+		p.host.client.Net = "tcp"
+	}
+	p.host.client.Dialer = p.host.bind.dialer(p.host.client.Net, p.host.addr)
+}
+
+func (p *Proxy) healthCheck() {
+	if p.mdns != nil {
+		return
+	}
+	GoroutineGauge.WithLabelValues(p.host.id, p.host.addr, "healthcheck").Inc()
+	defer GoroutineGauge.WithLabelValues(p.host.id, p.host.addr, "healthcheck").Dec()
+
+	p.setHealthClient()
 
 	p.host.Check()
-	tick := time.NewTicker(p.hcInterval)
+	if p.checked != nil {
+		close(p.checked)
+	}
+	timer := time.NewTimer(p.jitter(p.host.nextCheck(p.hcInterval, p.hcBackoff)))
+	defer timer.Stop()
 	for {
 		select {
-		case <-tick.C:
-			p.host.Check()
+		case <-timer.C:
+			if !p.hcSkipActive || !p.host.active(p.hcInterval) {
+				p.host.Check()
+			}
+			timer.Reset(p.jitter(p.host.nextCheck(p.hcInterval, p.hcBackoff)))
 		case <-p.stop:
 			return
 		}
 	}
 }
 
+// jitter returns d moved randomly by up to the health check jitter of p, so upstreams (and forward
+// blocks) with the same interval don't all get checked at the same time.
+func (p *Proxy) jitter(d time.Duration) time.Duration {
+	if p.hcJitter == 0 {
+		return d
+	}
+	return d + time.Duration((2*rand.Float64()-1)*p.hcJitter*float64(d))
+}
+
 const (
 	dialTimeout = 4 * time.Second
 	timeout     = 2 * time.Second
 	hcDuration  = 2 * time.Second
+
+	admissionTimeout = timeout
 )
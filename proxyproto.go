@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// proxySig starts every PROXY protocol version 2 header.
+var proxySig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyLocal = 0x20 // version 2, LOCAL: the connection is our own, e.g. a health check
+	proxyProxy = 0x21 // version 2, PROXY: the connection is on behalf of the addresses in the header
+
+	proxyTCP4 = 0x11
+	proxyTCP6 = 0x21
+)
+
+// proxyHeader returns the PROXY protocol v2 header for a connection on behalf of a client at src,
+// that connected to dst. If either isn't a TCP or UDP address a LOCAL header is returned, which
+// carries no addresses.
+func proxyHeader(src, dst net.Addr) []byte {
+	sip, sport := addrPort(src)
+	dip, dport := addrPort(dst)
+	if sip == nil || dip == nil {
+		return localHeader()
+	}
+
+	family, size := byte(proxyTCP6), net.IPv6len
+	if s4, d4 := sip.To4(), dip.To4(); s4 != nil && d4 != nil {
+		family, size = proxyTCP4, net.IPv4len
+		sip, dip = s4, d4
+	} else {
+		sip, dip = sip.To16(), dip.To16() // a mix is sent as IPv6, with the IPv4 address mapped
+	}
+
+	h := make([]byte, 0, len(proxySig)+4+2*size+4)
+	h = append(h, proxySig...)
+	h = append(h, proxyProxy, family, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(2*size+4))
+	h = append(h, sip...)
+	h = append(h, dip...)
+	h = append(h, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+	return h
+}
+
+// localHeader returns the PROXY protocol v2 header for a connection of our own.
+func localHeader() []byte {
+	return append(append([]byte{}, proxySig...), proxyLocal, 0, 0, 0)
+}
+
+func addrPort(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// dialFor returns a connection of type proto to send the query of state over. With the PROXY
+// protocol a TCP or TLS connection announces the client of state, so it's a new one that isn't
+// shared with other clients.
+func (p *Proxy) dialFor(ctx context.Context, state request.Request, proto string) (*dns.Conn, error) {
+	if !p.host.proxyProtocol || proto == "udp" {
+		return p.DialContext(ctx, proto)
+	}
+	return p.host.dialHeader(proto, proxyHeader(state.W.RemoteAddr(), state.W.LocalAddr()))
+}
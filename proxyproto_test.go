@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestProxyHeader(t *testing.T) {
+	w4, w6 := &test.ResponseWriter{}, &test.ResponseWriter6{}
+
+	h := proxyHeader(w4.RemoteAddr(), w4.LocalAddr())
+	want := append(append([]byte{}, proxySig...), 0x21, 0x11, 0, 12, 10, 240, 0, 1, 127, 0, 0, 1, 0x9d, 0x14, 0, 53)
+	if !bytes.Equal(h, want) {
+		t.Errorf("Expected IPv4 header %v, got %v", want, h)
+	}
+
+	h = proxyHeader(w6.RemoteAddr(), w6.LocalAddr())
+	if len(h) != len(proxySig)+4+36 || h[13] != 0x21 || binary.BigEndian.Uint16(h[14:]) != 36 {
+		t.Errorf("Expected IPv6 header, got %v", h)
+	}
+	if src := net.IP(h[16:32]); !src.Equal(w6.RemoteAddr().(*net.UDPAddr).IP) {
+		t.Errorf("Expected source %s, got %s", w6.RemoteAddr(), src)
+	}
+
+	// An IPv4 client of an IPv6 listener is mapped.
+	h = proxyHeader(w4.RemoteAddr(), w6.LocalAddr())
+	if h[13] != 0x21 || !net.IP(h[16:32]).Equal(net.ParseIP("10.240.0.1")) {
+		t.Errorf("Expected mapped IPv6 header, got %v", h)
+	}
+
+	if h := proxyHeader(nil, w4.LocalAddr()); !bytes.Equal(h, localHeader()) || h[12] != 0x20 {
+		t.Errorf("Expected LOCAL header, got %v", h)
+	}
+}
+
+// proxyProtocolServer answers DNS over TCP after a PROXY protocol v2 header, whose command and
+// source address it sends on headers.
+func proxyProtocolServer(t *testing.T, headers chan<- string) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 16)
+				if _, err := io.ReadFull(c, buf); err != nil || !bytes.Equal(buf[:12], proxySig) {
+					headers <- "bad"
+					return
+				}
+				body := make([]byte, binary.BigEndian.Uint16(buf[14:]))
+				io.ReadFull(c, body)
+				switch {
+				case buf[12] == proxyLocal:
+					headers <- "local"
+				case buf[13] == proxyTCP4:
+					headers <- net.JoinHostPort(net.IP(body[:4]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(body[8:]))))
+				default:
+					headers <- "unexpected"
+					return
+				}
+				conn := &dns.Conn{Conn: c}
+				for {
+					r, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(r)
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestProxyProtocol(t *testing.T) {
+	headers := make(chan string, 10)
+	addr, stop := proxyProtocolServer(t, headers)
+	defer stop()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+addr+" {\nforce_tcp\nproxy_protocol\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+
+	next := func() string {
+		select {
+		case h := <-headers:
+			return h
+		case <-time.After(time.Second):
+			return "no header, connection was reused"
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.connect(context.Background(), questionState("example.org."), false, false); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if h := next(); h != "10.240.0.1:40212" {
+			t.Errorf("Expected the client in the header, got %s", h)
+		}
+	}
+
+	p.setHealthClient()
+	if err := p.host.send(); err != nil {
+		t.Errorf("Expected no error for the health check, got: %s", err)
+	}
+	if h := next(); h != "local" {
+		t.Errorf("Expected a LOCAL header for the health check, got %s", h)
+	}
+
+	for _, input := range []string{"proxy_protocol yes", "proxy_protocol\nmultiplex"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
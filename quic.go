@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+)
+
+// doq sends queries with DNS-over-QUIC (RFC 9250): each query gets its own stream on a QUIC
+// connection to the upstream, which is kept until it's idle for expire. With a session ticket from an
+// earlier connection, a new one sends its first queries in 0-RTT.
+type doq struct {
+	addr string // host:port of the upstream
+
+	mu     sync.Mutex
+	conn   *quic.Conn
+	closed bool // set by close, a connection dialed after that is closed right away
+}
+
+// DoQ error codes, RFC 9250 section 4.3.
+const (
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+const doqPort = "853"
+
+// newDoQProxy returns a proxy for the DoQ upstream to, quic://ADDR with an optional port.
+func newDoQProxy(to string) (*Proxy, error) {
+	addr := strings.TrimPrefix(to, _quic+"://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), doqPort)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid DNS-over-QUIC upstream: %s", to)
+	}
+
+	p := NewProxy(_quic + "://" + addr)
+	p.host.exch = &doq{addr: addr}
+	p.tls = true
+	return p, nil
+}
+
+// connection returns the QUIC connection to the upstream of h, dialing one if there is none or
+// the last one was closed. The dial is done without holding the lock, so queries on a working
+// connection don't wait for it; when several queries dial at the same time, the first connection
+// is kept.
+func (d *doq) connection(ctx context.Context, h *host) (*quic.Conn, error) {
+	d.mu.Lock()
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		conn := d.conn
+		d.mu.Unlock()
+		return conn, nil
+	}
+	d.mu.Unlock()
+
+	conn, err := d.dial(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.closed:
+		conn.CloseWithError(doqNoError, "")
+		return nil, errStopped
+	case d.conn != nil && d.conn.Context().Err() == nil:
+		conn.CloseWithError(doqNoError, "")
+		return d.conn, nil
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+// dial makes a new QUIC connection to the upstream of h.
+func (d *doq) dial(ctx context.Context, h *host) (*quic.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := h.bind.dialer("udp", d.addr)
+	laddr := ""
+	if dialer.LocalAddr != nil {
+		laddr = dialer.LocalAddr.String()
+	}
+	lc := net.ListenConfig{Control: dialer.Control}
+	pc, err := lc.ListenPacket(ctx, "udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := h.tlsConfig
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"doq"}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		cfg.ServerName, _, _ = net.SplitHostPort(d.addr)
+	}
+	qcfg := &quic.Config{HandshakeIdleTimeout: h.dialTimeout, MaxIdleTimeout: h.expire}
+
+	dctx, cancel := context.WithTimeout(ctx, h.dialTimeout)
+	defer cancel()
+	conn, err := quic.DialEarly(dctx, pc, raddr, cfg, qcfg)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+	return conn, nil
+}
+
+// exchange sends req to the upstream of h on a new stream and returns the reply. When the cached
+// connection turns out to be closed, e.g. by the upstream after its idle timeout, a new one is dialed.
+func (d *doq) exchange(ctx context.Context, h *host, req *dns.Msg) (*dns.Msg, error) {
+	// The ID is 0 on the wire, RFC 9250 section 4.2.1.
+	id := req.Id
+	req.Id = 0
+	buf, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+
+	var stream *quic.Stream
+	for try := 0; ; try++ {
+		conn, err := d.connection(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		if stream, err = conn.OpenStreamSync(ctx); err == nil {
+			break
+		}
+		if try > 0 || conn.Context().Err() == nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(h.writeTimeout + h.readTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	stream.SetDeadline(deadline)
+
+	ret, err := d.roundTrip(stream, msg)
+	if err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return nil, ctxErr(ctx, err)
+	}
+	ret.Id = id
+	return ret, nil
+}
+
+// roundTrip writes the query msg, with its length, to stream, closes the sending side of stream as
+// RFC 9250 requires and reads the reply.
+func (d *doq) roundTrip(stream *quic.Stream, msg []byte) (*dns.Msg, error) {
+	if _, err := stream.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(stream, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d *doq) proto() string { return _quic }
+
+func (d *doq) clone() exchanger { return &doq{addr: d.addr} }
+
+// reset closes the connection to the upstream, the next query dials a new one.
+func (d *doq) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		d.conn.CloseWithError(doqNoError, "")
+		d.conn = nil
+	}
+}
+
+// close closes the connection to the upstream.
+func (d *doq) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.conn != nil {
+		d.conn.CloseWithError(doqNoError, "")
+		d.conn = nil
+	}
+}
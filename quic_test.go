@@ -0,0 +1,140 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+)
+
+func TestDoQ(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "dns.test")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var n [2]byte
+					if _, err := io.ReadFull(stream, n[:]); err != nil {
+						stream.Close()
+						continue
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+					io.ReadFull(stream, buf)
+					req := new(dns.Msg)
+					if err := req.Unpack(buf); err != nil || req.Id != 0 {
+						stream.CancelWrite(doqRequestCancelled)
+						continue
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(req)
+					ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+					out, _ := ret.Pack()
+					binary.BigEndian.PutUint16(n[:], uint16(len(out)))
+					stream.Write(append(n[:], out...))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	p, err := newDoQProxy("quic://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	p.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "dns.test"})
+	f := New()
+	f.SetProxy(p)
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		resp, info, err := f.ForwardWithInfo(state)
+		if err != nil {
+			t.Fatalf("Expected to receive reply, got: %s", err)
+		}
+		if resp.Id != state.Req.Id {
+			t.Errorf("Expected ID %d, got: %d", state.Req.Id, resp.Id)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Expected one RR in the answer section, got: %s", resp)
+		}
+		if info.Proto != "quic" || info.Upstream != "quic://"+l.Addr().String() {
+			t.Errorf("Expected quic to %s, got: %s to %s", l.Addr(), info.Proto, info.Upstream)
+		}
+	}
+
+	p.host.SetClient()
+	if err := p.host.send(); err != nil {
+		t.Errorf("Expected health check to succeed, got: %s", err)
+	}
+
+	// A connection dialed after close, e.g. by a query in progress, isn't kept.
+	d := p.host.exch.(*doq)
+	d.close()
+	if _, err := d.connection(context.Background(), p.host); err != errStopped {
+		t.Errorf("Expected %q after close, got: %v", errStopped, err)
+	}
+	if d.conn != nil {
+		t.Errorf("Expected no connection after close")
+	}
+}
+
+func TestSetupDoQ(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		expectedAddr string
+	}{
+		{"forward . quic://dns.example.net", false, "quic://dns.example.net:853"},
+		{"forward . quic://10.0.0.1:8853", false, "quic://10.0.0.1:8853"},
+		{"forward . quic://[::1]", false, "quic://[::1]:853"},
+		{"forward . quic://", true, ""},
+	}
+
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+			continue
+		}
+		if addr := f.proxies[0].host.addr; addr != tc.expectedAddr {
+			t.Errorf("Test %d: expected %s, got: %s", i, tc.expectedAddr, addr)
+		}
+		f.Close()
+	}
+}
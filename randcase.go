@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"crypto/rand"
+
+	"github.com/miekg/dns"
+)
+
+// withRandomCase returns a copy of req with the case of the letters of its query name randomized
+// (draft-vixie-dnsext-dns0x20), or req itself when it has no question. A spoofed reply now has to
+// guess these bits as well as the ID and the port.
+func withRandomCase(req *dns.Msg) *dns.Msg {
+	if len(req.Question) == 0 {
+		return req
+	}
+	name := []byte(req.Question[0].Name)
+	bits := make([]byte, (len(name)+7)/8)
+	rand.Read(bits)
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c >= 'a' && c <= 'z' && bits[i/8]&(1<<uint(i%8)) != 0 {
+			c -= 'a' - 'A'
+		}
+		name[i] = c
+	}
+
+	m := req.Copy()
+	m.Question[0].Name = string(name)
+	return m
+}
+
+// checkCase returns an error if the question of ret doesn't have the exact query name of req. A
+// reply without a question passes, like with checkReply.
+func checkCase(req, ret *dns.Msg) error {
+	if len(req.Question) == 0 || len(ret.Question) == 0 || ret.Question[0].Name == req.Question[0].Name {
+		return nil
+	}
+	return &mismatchError{reason: "case", reply: ret}
+}
+
+// restoreCase gives the question of ret, and the records owned by the query name of req, the query
+// name of the client's query orig again.
+func restoreCase(orig, req, ret *dns.Msg) {
+	if len(orig.Question) == 0 || len(ret.Question) == 0 {
+		return
+	}
+	name, sent := orig.Question[0].Name, req.Question[0].Name
+	ret.Question[0].Name = name
+	for _, rrs := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Name == sent {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestWithRandomCase(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www-1.ExAmple.org.", dns.TypeA)
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		m := withRandomCase(req)
+		name := m.Question[0].Name
+		if !strings.EqualFold(name, req.Question[0].Name) || !strings.Contains(name, "-1.") {
+			t.Fatalf("Expected the same name in another case, got %s", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected random cases, got %v", seen)
+	}
+	if req.Question[0].Name != "www-1.ExAmple.org." {
+		t.Errorf("Expected the query to be left alone, got %s", req.Question[0].Name)
+	}
+}
+
+func TestRandomCase(t *testing.T) {
+	// Every reply is preceded by one with the question in lower case, like a spoofed reply that
+	// guessed the ID.
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		spoofed := new(dns.Msg)
+		spoofed.SetReply(r)
+		spoofed.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		w.WriteMsg(spoofed)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nrandomize_case\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+
+	state := questionState("example.org.")
+	corrupted := 0
+	for i := 0; i < 5; i++ {
+		skipped := 0
+		ctx := context.WithValue(context.Background(), mismatchKey{}, func(_ *Proxy, err *mismatchError) {
+			if err.reason == "case" {
+				skipped++
+			}
+		})
+		ret, err := p.connect(ctx, state, false, false)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		if ret.Question[0].Name != "example.org." || ret.Answer[0].Header().Name != "example.org." {
+			t.Errorf("Expected the case of the client, got: %s", ret)
+		}
+		corrupted += skipped
+	}
+	if corrupted == 0 {
+		t.Errorf("Expected replies in lower case to be discarded")
+	}
+}
@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the queries sent to an upstream to qps per second, with bursts of up to a
+// second's worth.
+type tokenBucket struct {
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	sync.Mutex
+}
+
+// newTokenBucket returns a full tokenBucket for qps queries per second, or nil if qps is 0.
+func newTokenBucket(qps float64) *tokenBucket {
+	if qps <= 0 {
+		return nil
+	}
+	burst := qps
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{qps: qps, burst: burst, tokens: burst}
+}
+
+// clone returns a full tokenBucket with the rate of b.
+func (b *tokenBucket) clone() *tokenBucket {
+	if b == nil {
+		return nil
+	}
+	return newTokenBucket(b.qps)
+}
+
+// allow takes a token from b if it has one and returns true if it did. A nil b allows everything.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowed returns true if b has a token now, without taking it. A nil b allows everything.
+func (b *tokenBucket) allowed(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.fill(now)
+	return b.tokens >= 1
+}
+
+// fill adds the tokens b earned since it was last used. The caller holds the lock.
+func (b *tokenBucket) fill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.qps
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// throttled returns true if p is at its max_qps and can't take another query now, which is counted.
+// It doesn't take a token, so it can be used to pick upstreams; spend does when a query is sent.
+func (p *Proxy) throttled() bool {
+	if p.limit.allowed(time.Now()) {
+		return false
+	}
+	ThrottleCount.WithLabelValues(p.host.id, p.host.addr).Add(1)
+	return true
+}
+
+// spend takes a token from the max_qps bucket of p for a query that is sent to it. When another query
+// took the last token since throttled was asked, this one is sent anyway.
+func (p *Proxy) spend() { p.limit.allow(time.Now()) }
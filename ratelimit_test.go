@@ -0,0 +1,173 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+	now := time.Unix(1000, 0)
+	if !b.allow(now) || !b.allow(now) || b.allow(now) {
+		t.Fatalf("Expected a burst of 2")
+	}
+	if b.allow(now.Add(400 * time.Millisecond)) {
+		t.Errorf("Expected no token after 400ms")
+	}
+	if !b.allow(now.Add(600 * time.Millisecond)) {
+		t.Errorf("Expected a token after 600ms")
+	}
+	if !b.allow(now.Add(time.Hour)) || !b.allow(now.Add(time.Hour)) || b.allow(now.Add(time.Hour)) {
+		t.Errorf("Expected the burst to be capped at 2")
+	}
+
+	slow := newTokenBucket(0.5)
+	if !slow.allow(now) || slow.allow(now.Add(time.Second)) || !slow.allow(now.Add(2*time.Second)) {
+		t.Errorf("Expected a query every 2s")
+	}
+
+	var none *tokenBucket
+	if !none.allow(now) || newTokenBucket(0) != nil {
+		t.Errorf("Expected no limit without max_qps")
+	}
+}
+
+func TestMaxQPS(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	s2 := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s2.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+	_, port2, _ := net.SplitHostPort(s2.Addr)
+	first, second := "127.0.0.1:"+port, "127.0.0.1:"+port2
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+first+" max_qps=1 "+second+" {\npolicy sequential\nmax_qps 0.1 SERVFAIL\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	for _, p := range f.proxies {
+		p.host.resetFails()
+	}
+	if f.proxies[0].limit.qps != 1 || f.proxies[1].limit.qps != 0.1 {
+		t.Fatalf("Expected max_qps 1 and 0.1, got %f and %f", f.proxies[0].limit.qps, f.proxies[1].limit.qps)
+	}
+
+	for i, want := range []string{first, second} {
+		_, info, err := f.ForwardWithInfo(questionState("example.org."))
+		if err != nil {
+			t.Fatalf("Query %d: expected no error, got: %s", i, err)
+		}
+		if info.Upstream != want {
+			t.Errorf("Query %d: expected %s to answer, got %s", i, want, info.Upstream)
+		}
+	}
+
+	before := counterValue(ThrottleCount, f.proxies[0].host.id, first)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL when all upstreams are at their max_qps, got: %v", rec.Msg)
+	}
+	if x := counterValue(ThrottleCount, f.proxies[0].host.id, first); x != before+1 {
+		t.Errorf("Expected a throttled query, got %f", x-before)
+	}
+
+	for _, input := range []string{"forward . 127.0.0.1 max_qps=0", "forward . 127.0.0.1 {\nmax_qps\n}", "forward . 127.0.0.1 {\nmax_qps -1\n}", "forward . 127.0.0.1 {\nmax_qps 10 NXDOMAIN\n}"} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+// left returns the tokens left in b.
+func (b *tokenBucket) left() float64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.tokens
+}
+
+// stalledDialer never connects, until ctx is done.
+type stalledDialer struct{}
+
+func (stalledDialer) DialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestMaxQPSHedge(t *testing.T) {
+	// dnstest servers share a handler, it tells the slow one apart by address.
+	var slow atomic.Value
+	slow.Store("")
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.LocalAddr().String() == slow.Load().(string) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+	slow.Store(a.Addr)
+
+	// a is slow to reply, the query is hedged to b: each spends one token.
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+a.Addr+" "+b.Addr+" {\npolicy sequential\nmax_qps 1\nhedge 20ms\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	pa, pb := f.proxies[0], f.proxies[1]
+	if _, _, err := f.ForwardWithInfo(questionState("example.org.")); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	// The buckets fill up at 1 per second, the query took a fraction of that.
+	if x, y := pa.limit.left(), pb.limit.left(); x >= 0.5 || x < 0 || y >= 0.5 || y < 0 {
+		t.Errorf("Expected one token spent at each upstream, have %.2f and %.2f left", x, y)
+	}
+
+	// The dial to a stalls, b is dialed and connects first: only b spends a token.
+	f2, err := parseForward(caddy.NewTestController("dns", "forward . "+a.Addr+" "+b.Addr+" {\npolicy sequential\nforce_tcp\nmax_qps 1\nhedge 1s\nhappy_eyeballs 20ms\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f2.Close()
+	pa, pb = f2.proxies[0], f2.proxies[1]
+	pa.SetDialer(stalledDialer{})
+	_, info, err := f2.ForwardWithInfo(questionState("example.org."))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if info.Upstream != b.Addr {
+		t.Errorf("Expected %s to answer, got %s", b.Addr, info.Upstream)
+	}
+	if x := pa.limit.left(); x < 1 {
+		t.Errorf("Expected the upstream that wasn't queried to keep its token, has %.2f", x)
+	}
+	if y := pb.limit.left(); y >= 0.5 || y < 0 {
+		t.Errorf("Expected one token spent at the upstream that was queried, has %.2f left", y)
+	}
+}
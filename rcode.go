@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// What to do with a reply carrying a specific rcode.
+const (
+	rcodePass        = "pass"        // relay it verbatim, the default
+	rcodeServfail    = "servfail"    // answer the client with SERVFAIL
+	rcodeNext        = "next"        // try the next upstream
+	rcodeFallthrough = "fallthrough" // as next, but when no upstream has a better reply go to the next plugin
+)
+
+// parseRcode returns the rcode named s, which may also be a number.
+func parseRcode(s string) (int, error) {
+	s = strings.ToUpper(s)
+	if rc, ok := rcodeAliases[s]; ok {
+		return rc, nil
+	}
+	if rc, ok := dns.StringToRcode[s]; ok {
+		return rc, nil
+	}
+	rc, err := strconv.Atoi(s)
+	if err != nil || rc < 0 || rc > 0xFFF {
+		return 0, fmt.Errorf("unknown rcode: %s", s)
+	}
+	return rc, nil
+}
+
+// rcodeAliases are the names of rcodes missing from dns.StringToRcode.
+var rcodeAliases = map[string]int{
+	"NOTIMP":  dns.RcodeNotImplemented,
+	"BADVERS": dns.RcodeBadVers,
+}
+
+// fullRcode returns the rcode of ret, including the extended bits in the OPT record.
+func fullRcode(ret *dns.Msg) int {
+	rc := ret.Rcode
+	if opt := ret.IsEdns0(); opt != nil {
+		rc |= opt.ExtendedRcode() << 4
+	}
+	return rc
+}
+
+// rcodeAction returns what to do with ret.
+func (f *Forward) rcodeAction(ret *dns.Msg) string {
+	if len(f.rcodes) == 0 {
+		return rcodePass
+	}
+	if a, ok := f.rcodes[fullRcode(ret)]; ok {
+		return a
+	}
+	return rcodePass
+}
+
+// fallReason returns why the query that resulted in ret or err should be handed to the next plugin:
+// "no_healthy" when no upstream could be reached and "rcode" when all replied with a fallthrough rcode.
+// It returns "" when the client should get ret or err.
+func (f *Forward) fallReason(ret *dns.Msg, err error) string {
+	switch {
+	case err == errNoHealthy:
+		return "no_healthy"
+	case err == nil && f.rcodeAction(ret) == rcodeFallthrough:
+		return "rcode"
+	}
+	return ""
+}
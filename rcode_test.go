@@ -0,0 +1,176 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestRcodeAction(t *testing.T) {
+	var queries int32
+	notimp := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			atomic.AddInt32(&queries, 1)
+		}
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(ret)
+	})
+	defer notimp.Close()
+
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nrcode NOTIMP next\nrcode yxdomain servfail\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.rcodes[dns.RcodeYXDomain] != rcodeServfail {
+		t.Errorf("Expected YXDOMAIN to map to servfail, got: %q", f.rcodes[dns.RcodeYXDomain])
+	}
+
+	g := New()
+	g.rcodes = f.rcodes
+	g.SetProxy(NewProxy(notimp.Addr))
+	g.SetProxy(NewProxy(notimp.Addr))
+	defer g.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, err := g.Forward(state)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if resp.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("Expected the last NOTIMP to be relayed, got: %d", resp.Rcode)
+	}
+	if x := atomic.LoadInt32(&queries); x != 2 {
+		t.Errorf("Expected both upstreams to be tried, got: %d", x)
+	}
+
+	for _, input := range []string{"forward . 127.0.0.1 {\nrcode NOPE next\n}\n", "forward . 127.0.0.1 {\nrcode NOTIMP drop\n}\n"} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestRcodeNextRecovers(t *testing.T) {
+	// dnstest servers share a handler, count the queries to have each upstream give another rcode.
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		if r.Question[0].Name != "example.org." {
+			ret.SetReply(r) // health check
+			w.WriteMsg(ret)
+			return
+		}
+		switch atomic.AddInt32(&queries, 1) {
+		case 1:
+			ret.SetRcode(r, dns.RcodeServerFailure)
+		case 2:
+			ret.SetRcode(r, dns.RcodeRefused)
+		default:
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nrcode SERVFAIL REFUSED next\n}\n")
+	g, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if g.rcodes[dns.RcodeServerFailure] != rcodeNext || g.rcodes[dns.RcodeRefused] != rcodeNext {
+		t.Errorf("Expected SERVFAIL and REFUSED to map to next, got: %v", g.rcodes)
+	}
+	g.Close()
+
+	f := New()
+	f.rcodes = g.rcodes
+	f.SetPolicy(sequential{})
+	for i := 0; i < 3; i++ {
+		f.SetProxy(NewProxy(s.Addr))
+	}
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, info, err := f.ForwardWithInfo(state)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Expected the answer of the third upstream, got: %s", resp)
+	}
+	if info.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, got: %d", info.Attempts)
+	}
+}
+
+func TestFallthrough(t *testing.T) {
+	refused := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(ret)
+	})
+	defer refused.Close()
+	// Nothing listens here anymore (dnstest servers share a handler, so not one of those).
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	tests := []struct {
+		to     string
+		zones  fall.F
+		rcodes map[int]string
+		next   bool
+	}{
+		{downAddr, fall.Root, nil, true},
+		{downAddr, fall.F{Zones: []string{"example.net."}}, nil, false},
+		{downAddr, fall.F{}, nil, false},
+		{refused.Addr, fall.Root, map[int]string{dns.RcodeRefused: rcodeFallthrough}, true},
+		{refused.Addr, fall.Root, map[int]string{dns.RcodeRefused: rcodeNext}, false},
+		{refused.Addr, fall.Root, nil, false},
+	}
+	for i, tc := range tests {
+		f := New()
+		f.from = "."
+		f.fallThrough, f.rcodes = tc.zones, tc.rcodes
+		f.Next = test.NextHandler(dns.RcodeYXDomain, nil)
+		f.SetProxy(NewProxy(tc.to))
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rcode, _ := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, m)
+		f.Close()
+		if next := rcode == dns.RcodeYXDomain; next != tc.next {
+			t.Errorf("Test %d: expected the next plugin to be called to be %t, got rcode %d", i, tc.next, rcode)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nfallthrough example.org\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.fallThrough.Zones) != 1 || f.fallThrough.Zones[0] != "example.org." {
+		t.Errorf("Expected fallthrough for example.org., got: %v", f.fallThrough.Zones)
+	}
+	c = caddy.NewTestController("dns", "forward . 127.0.0.1 {\nrcode REFUSED fallthrough\n}\n")
+	if _, err := parseForward(c); err == nil {
+		t.Error("Expected an error for the fallthrough rcode action without fallthrough")
+	}
+}
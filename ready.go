@@ -0,0 +1,34 @@
+package forward
+
+// Health is the state of the upstreams of a Forward at one moment.
+type Health struct {
+	Upstreams int               // number of upstreams
+	Up        int               // upstreams that queries are sent to
+	Down      map[string]string // why each upstream that is down is: maintenance, health, untrusted or servfail
+}
+
+// Health returns the current state of the upstreams of f. Unlike sending queries, it doesn't count
+// the upstreams that are down in the metrics.
+func (f *Forward) Health() Health {
+	proxies := f.snapshot()
+	h := Health{Upstreams: len(proxies), Down: make(map[string]string)}
+	for _, p := range proxies {
+		if reason := p.downReason(f.maxfails); reason != "" {
+			h.Down[p.host.addr] = reason
+			continue
+		}
+		h.Up++
+	}
+	return h
+}
+
+// Ready implements the readiness interface of the ready plugin of CoreDNS: f is ready when at least
+// one of its upstreams is up.
+func (f *Forward) Ready() bool {
+	for _, p := range f.snapshot() {
+		if p.downReason(f.maxfails) == "" {
+			return true
+		}
+	}
+	return false
+}
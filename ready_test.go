@@ -0,0 +1,39 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	f := New()
+	defer f.Close()
+	if f.Ready() {
+		t.Errorf("Expected a Forward without upstreams not to be ready")
+	}
+
+	proxies, err := ParseProxies("127.0.0.1:53", "127.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range proxies {
+		f.AddProxy(p)
+		atomic.StoreUint32(&p.host.fails, f.maxfails+1)
+	}
+	if f.Ready() {
+		t.Errorf("Expected not to be ready with all upstreams down")
+	}
+	before := counterValue(DownCount, proxies[0].host.id, "127.0.0.1:53", "health")
+
+	proxies[1].host.resetFails()
+	if !f.Ready() {
+		t.Errorf("Expected to be ready with an upstream up")
+	}
+	h := f.Health()
+	if h.Upstreams != 2 || h.Up != 1 || len(h.Down) != 1 || h.Down["127.0.0.1:53"] != "health" {
+		t.Errorf("Expected 127.0.0.1:53 down for its health checks, got: %+v", h)
+	}
+	if x := counterValue(DownCount, proxies[0].host.id, "127.0.0.1:53", "health"); x != before {
+		t.Errorf("Expected readiness checks not to be counted as down, got %f more", x-before)
+	}
+}
@@ -0,0 +1,126 @@
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// redactor hides query names and client addresses in what we log.
+type redactor struct {
+	qname string // "full", "hash", "truncate" or "none"
+	v4    int    // prefix length to keep of IPv4 client addresses
+	v6    int    // same for IPv6
+}
+
+var (
+	defaultRedactor = redactor{qname: "full", v4: 32, v6: 128}
+	privateRedactor = redactor{qname: "none", v4: 0, v6: 0}
+)
+
+// hashKey keys the qname hashes, so they can't be reversed with a dictionary of names. Hashes are
+// stable while the process runs.
+var hashKey = func() []byte {
+	k := make([]byte, 32)
+	rand.Read(k)
+	return k
+}()
+
+// name returns qname as it may be logged.
+func (r redactor) name(qname string) string {
+	switch r.qname {
+	case "hash":
+		h := hmac.New(sha256.New, hashKey)
+		h.Write([]byte(strings.ToLower(qname)))
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	case "truncate":
+		labels := dns.SplitDomainName(qname)
+		if len(labels) <= 2 {
+			return qname
+		}
+		return "*." + strings.Join(labels[len(labels)-2:], ".") + "."
+	case "none":
+		return "<redacted>"
+	}
+	return qname
+}
+
+// ip returns the client address ip as it may be logged.
+func (r redactor) ip(ip string) string {
+	i := net.ParseIP(ip)
+	if i == nil {
+		return ip
+	}
+	if r.v4 == 0 && r.v6 == 0 {
+		return "<redacted>"
+	}
+	if i4 := i.To4(); i4 != nil {
+		if r.v4 >= 32 {
+			return ip
+		}
+		return i4.Mask(net.CIDRMask(r.v4, 32)).String()
+	}
+	if r.v6 >= 128 {
+		return ip
+	}
+	return i.Mask(net.CIDRMask(r.v6, 128)).String()
+}
+
+// msg returns m as it may be logged, e.g. to dnstap: a copy with the names of the question and of
+// the records as name returns them, and an ECS address masked like ip. It returns m itself when
+// nothing is hidden.
+func (r redactor) msg(m *dns.Msg) *dns.Msg {
+	if r.qname == "full" && r.v4 >= 32 && r.v6 >= 128 {
+		return m
+	}
+	m = m.Copy()
+	for i := range m.Question {
+		m.Question[i].Name = r.fqdn(m.Question[i].Name)
+	}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			o, ok := rr.(*dns.OPT)
+			if !ok {
+				rr.Header().Name = r.fqdn(rr.Header().Name)
+				continue
+			}
+			// Copy shares the options, replace them instead of changing them.
+			opts := make([]dns.EDNS0, len(o.Option))
+			for i, s := range o.Option {
+				opts[i] = s
+				if e, ok := s.(*dns.EDNS0_SUBNET); ok {
+					opts[i] = r.subnet(e)
+				}
+			}
+			o.Option = opts
+		}
+	}
+	return m
+}
+
+// fqdn is name, for a name that has to stay a domain name.
+func (r redactor) fqdn(qname string) string {
+	if r.qname == "full" {
+		return qname
+	}
+	return dns.Fqdn(r.name(qname))
+}
+
+// subnet returns a copy of e with at most as many bits of the address as r keeps.
+func (r redactor) subnet(e *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	e2 := *e
+	bits, size := r.v4, 32
+	if e.Family == 2 {
+		bits, size = r.v6, 128
+	}
+	if bits < int(e.SourceNetmask) {
+		e2.SourceNetmask = uint8(bits)
+		e2.Address = e.Address.Mask(net.CIDRMask(bits, size))
+	}
+	return &e2
+}
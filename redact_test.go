@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestRedactor(t *testing.T) {
+	r := redactor{qname: "truncate", v4: 24, v6: 48}
+	if x := r.name("www.corp.example.org."); x != "*.example.org." {
+		t.Errorf("Expected *.example.org., got: %s", x)
+	}
+	if x := r.name("example.org."); x != "example.org." {
+		t.Errorf("Expected example.org., got: %s", x)
+	}
+	if x := r.ip("10.1.2.3"); x != "10.1.2.0" {
+		t.Errorf("Expected 10.1.2.0, got: %s", x)
+	}
+	if x := r.ip("2001:db8:1:2::1"); x != "2001:db8:1::" {
+		t.Errorf("Expected 2001:db8:1::, got: %s", x)
+	}
+
+	r.qname = "hash"
+	h := r.name("example.org.")
+	if h == "example.org." || h != r.name("EXAMPLE.org.") {
+		t.Errorf("Expected a stable, case insensitive hash, got: %s", h)
+	}
+
+	if x := defaultRedactor.ip("10.1.2.3"); x != "10.1.2.3" {
+		t.Errorf("Expected the address as is, got: %s", x)
+	}
+}
+
+func TestSetupPrivacy(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nprivacy\nlog_qname full\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if x := f.redact.name("example.org."); x != "<redacted>" {
+		t.Errorf("Expected privacy to override log_qname, got: %s", x)
+	}
+	if x := f.redact.ip("10.1.2.3"); x != "<redacted>" {
+		t.Errorf("Expected no client address, got: %s", x)
+	}
+}
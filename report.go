@@ -0,0 +1,179 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reporter is an Exporter that aggregates what it sees per upstream and periodically writes a
+// summary to the log, a file or a webhook.
+type reporter struct {
+	interval time.Duration
+	dest     string // "log", a file name or a http(s) URL
+	log      *logger
+
+	start    time.Time
+	stats    map[string]*upstreamStats
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	sync.Mutex
+}
+
+type upstreamStats struct {
+	requests  int
+	rcodes    map[string]int
+	durs      []time.Duration // a sample of the durations, at most maxReportSamples
+	failovers int
+	hcFails   int
+}
+
+// report is the summary written every interval.
+type report struct {
+	ID        string                    `json:"id"`
+	Start     time.Time                 `json:"start"`
+	End       time.Time                 `json:"end"`
+	Upstreams map[string]upstreamReport `json:"upstreams"`
+}
+
+type upstreamReport struct {
+	QPS                 float64        `json:"qps"`
+	Rcodes              map[string]int `json:"rcodes"`
+	P50                 float64        `json:"p50_ms"`
+	P90                 float64        `json:"p90_ms"`
+	P99                 float64        `json:"p99_ms"`
+	Failovers           int            `json:"failovers"`
+	HealthcheckFailures int            `json:"healthcheck_failures"`
+}
+
+func newReporter(interval time.Duration, dest string) *reporter {
+	return &reporter{interval: interval, dest: dest, start: time.Now(), stats: make(map[string]*upstreamStats), stop: make(chan struct{})}
+}
+
+// get returns the stats of upstream to, the caller must hold the lock.
+func (r *reporter) get(to string) *upstreamStats {
+	s, ok := r.stats[to]
+	if !ok {
+		s = &upstreamStats{rcodes: make(map[string]int)}
+		r.stats[to] = s
+	}
+	return s
+}
+
+// Request records an exchange with upstream to. Like HealthcheckFailure it ignores id, a reporter
+// belongs to a single Forward.
+func (r *reporter) Request(id, to, rcode string, d time.Duration) {
+	r.Lock()
+	s := r.get(to)
+	s.requests++
+	s.rcodes[rcode]++
+	// Reservoir sampling keeps the sample uniform over the interval.
+	if len(s.durs) < maxReportSamples {
+		s.durs = append(s.durs, d)
+	} else if i := rand.Intn(s.requests); i < maxReportSamples {
+		s.durs[i] = d
+	}
+	r.Unlock()
+}
+
+func (r *reporter) HealthcheckFailure(id, to string) {
+	r.Lock()
+	r.get(to).hcFails++
+	r.Unlock()
+}
+
+func (r *reporter) Sockets(id, to string, n int) {}
+
+// failover records that an exchange with upstream to failed and the next upstream was tried.
+func (r *reporter) failover(to string) {
+	r.Lock()
+	r.get(to).failovers++
+	r.Unlock()
+}
+
+// run writes a report every interval until r is stopped.
+func (r *reporter) run(id string) {
+	tick := time.NewTicker(r.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			r.write(r.summary(id, time.Now()))
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// summary returns the report for the interval ending at now and starts a new interval.
+func (r *reporter) summary(id string, now time.Time) report {
+	r.Lock()
+	stats, start := r.stats, r.start
+	r.stats, r.start = make(map[string]*upstreamStats), now
+	r.Unlock()
+
+	rep := report{ID: id, Start: start, End: now, Upstreams: make(map[string]upstreamReport, len(stats))}
+	secs := now.Sub(start).Seconds()
+	for to, s := range stats {
+		sort.Slice(s.durs, func(i, j int) bool { return s.durs[i] < s.durs[j] })
+		u := upstreamReport{Rcodes: s.rcodes, Failovers: s.failovers, HealthcheckFailures: s.hcFails}
+		if secs > 0 {
+			u.QPS = float64(s.requests) / secs
+		}
+		u.P50, u.P90, u.P99 = percentile(s.durs, 0.5), percentile(s.durs, 0.9), percentile(s.durs, 0.99)
+		rep.Upstreams[to] = u
+	}
+	return rep
+}
+
+// percentile returns the p-th percentile of the sorted durs in milliseconds.
+func percentile(durs []time.Duration, p float64) float64 {
+	if len(durs) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(durs)))
+	if i >= len(durs) {
+		i = len(durs) - 1
+	}
+	return float64(durs[i]) / float64(time.Millisecond)
+}
+
+// write sends rep to the destination of r, errors are logged.
+func (r *reporter) write(rep report) {
+	buf, err := json.Marshal(rep)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case r.dest == "log":
+		r.log.info(rep.ID, "report", fmt.Sprintf("Report: %s", buf), Field{"report", rep})
+	case strings.HasPrefix(r.dest, "http://") || strings.HasPrefix(r.dest, "https://"):
+		resp, err := reportClient.Post(r.dest, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			r.log.warning(rep.ID, "report_failed", fmt.Sprintf("Failed to send report to %s: %s", r.dest, err), Field{"destination", r.dest}, Field{"error", err})
+			return
+		}
+		resp.Body.Close()
+	default:
+		fh, err := os.OpenFile(r.dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			r.log.warning(rep.ID, "report_failed", fmt.Sprintf("Failed to write report to %s: %s", r.dest, err), Field{"destination", r.dest}, Field{"error", err})
+			return
+		}
+		fh.Write(append(buf, '\n'))
+		fh.Close()
+	}
+}
+
+var reportClient = &http.Client{Timeout: 5 * time.Second}
+
+const maxReportSamples = 1024
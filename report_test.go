@@ -0,0 +1,37 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReporterSummary(t *testing.T) {
+	r := newReporter(time.Minute, "log")
+	start := r.start
+
+	for i := 1; i <= 100; i++ {
+		r.Request("test", "10.0.0.1:53", "NOERROR", time.Duration(i)*time.Millisecond)
+	}
+	r.Request("test", "10.0.0.1:53", "SERVFAIL", time.Millisecond)
+	r.failover("10.0.0.2:53")
+	r.HealthcheckFailure("test", "10.0.0.2:53")
+
+	rep := r.summary("test", start.Add(10*time.Second))
+	u := rep.Upstreams["10.0.0.1:53"]
+	if u.QPS < 10 || u.QPS > 10.2 {
+		t.Errorf("Expected about 10.1 qps, got: %f", u.QPS)
+	}
+	if u.Rcodes["NOERROR"] != 100 || u.Rcodes["SERVFAIL"] != 1 {
+		t.Errorf("Expected the rcodes to be counted, got: %v", u.Rcodes)
+	}
+	if u.P50 < 45 || u.P50 > 55 || u.P99 < 95 {
+		t.Errorf("Expected p50 about 50ms and p99 about 99ms, got: %f and %f", u.P50, u.P99)
+	}
+	if d := rep.Upstreams["10.0.0.2:53"]; d.Failovers != 1 || d.HealthcheckFailures != 1 {
+		t.Errorf("Expected a failover and a health check failure, got: %+v", d)
+	}
+
+	if rep := r.summary("test", start.Add(20*time.Second)); len(rep.Upstreams) != 0 {
+		t.Errorf("Expected a new interval to start empty, got: %v", rep.Upstreams)
+	}
+}
@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// read reads the reply to req from conn, until deadline. Over UDP, when nothing came back within twice the
+// smoothed RTT of the upstream, req is sent once more: a single lost packet is much cheaper to
+// recover from this way than by waiting for the timeout and trying the next upstream. It returns
+// true if req was retransmitted. There is no retransmit when the
+// deadline doesn't leave room for it.
+func (p *Proxy) read(conn *dns.Conn, req *dns.Msg, deadline time.Time, skip func(*mismatchError)) (*dns.Msg, bool, error) {
+	rto := p.host.rto()
+	if _, udp := conn.Conn.(*net.UDPConn); !udp || rto == 0 || time.Now().Add(2*rto).After(deadline) {
+		conn.SetReadDeadline(deadline)
+		ret, err := readMatch(conn, req, p.host.randomCase, skip)
+		return ret, false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(rto))
+	ret, err := readMatch(conn, req, p.host.randomCase, skip)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		return ret, false, err
+	}
+
+	RetransmitCount.WithLabelValues(p.host.id, p.host.addr).Add(1)
+	conn.SetWriteDeadline(deadline)
+	if err := writeMsg(conn, req); err != nil {
+		return nil, true, err
+	}
+	conn.SetReadDeadline(deadline)
+	ret, err = readMatch(conn, req, p.host.randomCase, skip)
+	return ret, true, err
+}
+
+// readMatch reads the reply to req from conn. Over UDP, replies that don't match req, e.g. a late
+// reply to an earlier query on a cached socket or a spoofed one, are passed to skip and reading goes
+// on until the deadline of conn. If exact, the query name must match in case too. Over TCP the reply
+// is returned as is, a mismatch there means the connection is broken.
+func readMatch(conn *dns.Conn, req *dns.Msg, exact bool, skip func(*mismatchError)) (*dns.Msg, error) {
+	_, udp := conn.Conn.(*net.UDPConn)
+	for {
+		ret, err := readMsg(conn)
+		if ret == nil || !udp {
+			return ret, err
+		}
+		mismatch := checkReply(req, ret)
+		if mismatch == nil && exact {
+			mismatch = checkCase(req, ret)
+		}
+		merr, ok := mismatch.(*mismatchError)
+		if !ok {
+			return ret, err
+		}
+		if skip != nil {
+			skip(merr)
+		}
+	}
+}
+
+// rto returns how long to wait for a UDP reply from h before retransmitting, or 0 if we don't know
+// h's RTT yet or if retransmitting wouldn't leave enough time for the second attempt.
+func (h *host) rto() time.Duration {
+	h.score.Lock()
+	srtt := h.score.rtt
+	h.score.Unlock()
+
+	if srtt == 0 {
+		return 0
+	}
+	rto := 2 * time.Duration(srtt*float64(time.Second))
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > h.readTimeout/2 {
+		return 0
+	}
+	return rto
+}
+
+const minRTO = 20 * time.Millisecond
@@ -0,0 +1,167 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestRetransmit(t *testing.T) {
+	var seen int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.AddInt32(&seen, 1) == 1 {
+			return // drop the first one
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr)
+	defer p.close()
+	p.host.score.rtt = 0.001 // 1ms, a retransmit after minRTO
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	if _, err := p.connect(context.Background(), state, false, false); err != nil {
+		t.Fatalf("Expected the retransmit to get a reply, got: %s", err)
+	}
+	if x := atomic.LoadInt32(&seen); x != 2 {
+		t.Errorf("Expected 2 queries, got: %d", x)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	// The first query for example.org. is "lost".
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." && atomic.AddInt32(&queries, 1) == 1 {
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.maxRetries = 1
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	_, info, err := f.ForwardWithInfo(state)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got: %s", err)
+	}
+	if info.Attempts != 2 {
+		t.Errorf("Expected 2 attempts, got: %d", info.Attempts)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			return // never answers
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.maxRetries = 3
+	f.queryTimeout = 200 * time.Millisecond
+	f.SetProxy(NewProxy(s.Addr))
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	_, info, err := f.ForwardWithInfo(state)
+	if err != errDeadline {
+		t.Fatalf("Expected the query deadline to pass, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected to give up after the query timeout, took: %s", d)
+	}
+	if info.Attempts != 1 {
+		t.Errorf("Expected a single attempt, got: %d", info.Attempts)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			return // never answers
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	_, _, err := f.forward(ctx, state)
+	if err != context.Canceled {
+		t.Fatalf("Expected the exchange to be canceled, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected to stop right after the cancel, took: %s", d)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			return // never answers
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	for i := 0; i < 2; i++ {
+		p := NewProxy(s.Addr)
+		p.SetTimeouts(dialTimeout, 100*time.Millisecond, timeout)
+		f.SetProxy(p)
+	}
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	_, info, err := f.ForwardWithInfo(state)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected both upstreams to time out after 100ms, took: %s", d)
+	}
+	if info.Attempts != 2 {
+		t.Errorf("Expected 2 attempts, got: %d", info.Attempts)
+	}
+}
@@ -0,0 +1,78 @@
+package forward
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+)
+
+// route sends the names in zone to a subset of the upstreams.
+type route struct {
+	zone  string
+	addrs map[string]bool // protected by the mutex of the Forward
+}
+
+// zoneGroup returns the group of the upstreams of a zone, they only get the queries for that zone. It
+// has a space so it can't clash with a group from the Corefile.
+func zoneGroup(zone string) string { return "zone " + zone }
+
+// inRoute returns true if name is in the zone of one of the routes.
+func (f *Forward) inRoute(name string) bool {
+	for _, r := range f.routes {
+		if plugin.Name(r.zone).Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// routed returns the upstreams, ordered by the policy, of the route with the longest zone the name in state is in. If
+// no route matches, it returns nil.
+func (f *Forward) routed(state request.Request) []*Proxy {
+	name := state.Name()
+	if len(f.routes) == 0 {
+		return nil
+	}
+
+	f.RLock()
+	defer f.RUnlock()
+
+	var best *route
+	for _, r := range f.routes {
+		if plugin.Name(r.zone).Matches(name) && (best == nil || len(r.zone) > len(best.zone)) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	var proxies []*Proxy
+	for _, p := range f.proxies {
+		if best.addrs[p.host.addr] {
+			proxies = append(proxies, p)
+		}
+	}
+	return order(f.policy, state, proxies)
+}
+
+// swapRoutes renames from to to in all routes, with more than one to from is replaced by all of
+// them. The caller must hold the lock.
+func (f *Forward) swapRoutes(from string, to ...string) {
+	for _, r := range f.routes {
+		if r.addrs[from] {
+			delete(r.addrs, from)
+			for _, t := range to {
+				r.addrs[t] = true
+			}
+		}
+	}
+}
+
+// copyRoutes adds to to all routes that have from. The caller must hold the lock.
+func (f *Forward) copyRoutes(from, to string) {
+	for _, r := range f.routes {
+		if r.addrs[from] {
+			r.addrs[to] = true
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestRouted(t *testing.T) {
+	input := "forward example.com 10.0.0.1 10.0.0.2 10.0.0.3 {\nroute corp.example.com 10.0.0.1 10.0.0.2\nroute lab.corp.example.com 10.0.0.3\n}\n"
+	c := caddy.NewTestController("dns", input)
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		expected map[string]bool
+	}{
+		{"www.example.com.", nil},
+		{"a.corp.example.com.", map[string]bool{"10.0.0.1:53": true, "10.0.0.2:53": true}},
+		{"a.lab.corp.example.com.", map[string]bool{"10.0.0.3:53": true}},
+	}
+	for i, tc := range tests {
+		list := f.routed(questionState(tc.name))
+		if len(list) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d upstreams, got: %d", i, len(tc.expected), len(list))
+			continue
+		}
+		for _, p := range list {
+			if !tc.expected[p.host.addr] {
+				t.Errorf("Test %d: unexpected upstream %s", i, p.host.addr)
+			}
+		}
+	}
+
+	for _, input := range []string{
+		"forward example.com 10.0.0.1 {\nroute example.org 10.0.0.1\n}\n",
+		"forward example.com 10.0.0.1 {\nroute corp.example.com 10.0.0.9\n}\n",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestZone(t *testing.T) {
+	input := "forward example.com 10.0.0.1 {\nzone corp.example 10.0.0.2\nzone lab.corp.example 10.0.0.3 10.0.0.4\n}\n"
+	f, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		match    bool
+		expected []string // upstreams of the route, nil if none matches
+	}{
+		{"www.example.com.", true, nil},
+		{"a.corp.example.", true, []string{"10.0.0.2:53"}},
+		{"a.lab.corp.example.", true, []string{"10.0.0.3:53", "10.0.0.4:53"}},
+		{"example.org.", false, nil},
+	}
+	for i, tc := range tests {
+		state := questionState(tc.name)
+		if m := f.match(state); m != tc.match {
+			t.Errorf("Test %d: expected match to be %t, got: %t", i, tc.match, m)
+		}
+		list := f.routed(questionState(tc.name))
+		if len(list) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d upstreams, got: %d", i, len(tc.expected), len(list))
+			continue
+		}
+		for _, p := range list {
+			if p.host.addr != tc.expected[0] && p.host.addr != tc.expected[len(tc.expected)-1] {
+				t.Errorf("Test %d: unexpected upstream %s", i, p.host.addr)
+			}
+		}
+	}
+
+	// The upstreams of the zones don't get the other queries.
+	if list := f.list(questionState("example.org.")); len(list) != 1 || list[0].host.addr != "10.0.0.1:53" {
+		t.Errorf("Expected only 10.0.0.1:53 for the other queries, got: %v", list)
+	}
+
+	for _, input := range []string{
+		"forward example.com 10.0.0.1 {\nzone corp.example\n}\n",
+		"forward example.com 10.0.0.1 {\nzone corp.example 10.0.0.2\nzone corp.example 10.0.0.3\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package forward
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// score keeps moving averages of what we see from an upstream. Combined with the health check
+// results they give a single figure between 0 (unusable) and 1 (perfect).
+type score struct {
+	rtt      float64 // seconds
+	loss     float64 // fraction of exchanges that failed
+	servfail float64 // fraction of replies that were SERVFAIL or REFUSED
+
+	sync.Mutex
+}
+
+// scoreWeight is the weight given to a new observation in the moving averages.
+const scoreWeight = 0.1
+
+// observe adds the outcome of an exchange that took rtt to the averages.
+func (s *score) observe(ret *dns.Msg, err error, rtt time.Duration) {
+	loss, bad := 0.0, 0.0
+	if err != nil {
+		loss = 1
+	} else if ret.Rcode == dns.RcodeServerFailure || ret.Rcode == dns.RcodeRefused {
+		bad = 1
+	}
+
+	s.Lock()
+	s.loss += scoreWeight * (loss - s.loss)
+	if err == nil {
+		s.rtt += scoreWeight * (rtt.Seconds() - s.rtt)
+		s.servfail += scoreWeight * (bad - s.servfail)
+	}
+	s.Unlock()
+}
+
+// latency returns the expected time an exchange takes in seconds: the average RTT, with lost
+// exchanges counted as taking timeout. It's 0 before anything was observed.
+func (s *score) latency(timeout time.Duration) float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.rtt*(1-s.loss) + s.loss*timeout.Seconds()
+}
+
+// value returns the score given the number of failed health checks.
+func (s *score) value(fails uint32) float64 {
+	s.Lock()
+	rtt, loss, servfail := s.rtt, s.loss, s.servfail
+	s.Unlock()
+
+	latency := 1 - rtt/timeout.Seconds()
+	if latency < 0 {
+		latency = 0
+	}
+	return latency * (1 - loss) * (1 - servfail) / float64(1+fails)
+}
+
+// observe records the outcome of an exchange with h and updates its score.
+func (h *host) observe(ret *dns.Msg, err error, rtt time.Duration) {
+	if err == context.Canceled {
+		return // we gave up, that says nothing about h
+	}
+	h.score.observe(ret, err, rtt)
+	HealthScore.WithLabelValues(h.id, h.addr).Set(h.Score())
+}
+
+// Score returns the current score of h.
+func (h *host) Score() float64 { return h.score.value(atomic.LoadUint32(&h.fails)) }
+
+// Score returns the health score of p: a figure between 0 and 1 combining latency, loss rate, the
+// fraction of SERVFAIL and REFUSED replies and the health check results. Higher is better.
+func (p *Proxy) Score() float64 { return p.host.Score() }
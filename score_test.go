@@ -0,0 +1,36 @@
+package forward
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestScore(t *testing.T) {
+	s := new(score)
+	if x := s.value(0); x != 1 {
+		t.Errorf("Expected a fresh score of 1, got: %f", x)
+	}
+
+	ok := new(dns.Msg)
+	for i := 0; i < 10; i++ {
+		s.observe(ok, nil, 10*time.Millisecond)
+	}
+	good := s.value(0)
+	if good < 0.9 {
+		t.Errorf("Expected a score above 0.9, got: %f", good)
+	}
+	if x := s.value(2); x >= good {
+		t.Errorf("Expected failed health checks to lower the score, got: %f", x)
+	}
+
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	s.observe(servfail, nil, 10*time.Millisecond)
+	s.observe(nil, errors.New("timeout"), timeout)
+	if x := s.value(0); x >= good {
+		t.Errorf("Expected SERVFAIL and loss to lower the score, got: %f", x)
+	}
+}
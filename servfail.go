@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+// servfailRate tracks the share of SERVFAIL replies of an upstream to the clients' queries over a
+// trailing window. An upstream whose share is above the threshold is down, even when its health
+// checks pass, until enough of the window has passed without them.
+type servfailRate struct {
+	percent float64 // the upstream is down above this share of SERVFAIL replies
+	min     int64   // replies in the window needed before the share counts
+
+	secs      []int64 // the unix second each bucket is counting
+	replies   []int64
+	servfails []int64
+
+	sync.Mutex
+}
+
+// Defaults of servfail_rate.
+const (
+	servfailWindow = time.Minute
+	servfailMin    = 20
+)
+
+// newServfailRate returns a servfailRate with a threshold of percent over a window of w, rounded
+// down to whole seconds, that needs min replies.
+func newServfailRate(percent float64, w time.Duration, min int64) *servfailRate {
+	n := int(w / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &servfailRate{percent: percent, min: min, secs: make([]int64, n), replies: make([]int64, n), servfails: make([]int64, n)}
+}
+
+// clone returns a servfailRate with the settings of s and nothing counted yet.
+func (s *servfailRate) clone() *servfailRate {
+	if s == nil {
+		return nil
+	}
+	return newServfailRate(s.percent, time.Duration(len(s.secs))*time.Second, s.min)
+}
+
+// mark counts a reply at now, servfail says whether it was SERVFAIL. A nil s counts nothing.
+func (s *servfailRate) mark(now time.Time, servfail bool) {
+	if s == nil {
+		return
+	}
+	sec := now.Unix()
+	i := int(sec % int64(len(s.secs)))
+	s.Lock()
+	if s.secs[i] != sec {
+		s.secs[i], s.replies[i], s.servfails[i] = sec, 0, 0
+	}
+	s.replies[i]++
+	if servfail {
+		s.servfails[i]++
+	}
+	s.Unlock()
+}
+
+// exceeded returns true if the share of SERVFAIL replies in the window ending at now is above the
+// threshold of s.
+func (s *servfailRate) exceeded(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	oldest := now.Unix() - int64(len(s.secs))
+	replies, servfails := int64(0), int64(0)
+	s.Lock()
+	for i := range s.secs {
+		if s.secs[i] > oldest {
+			replies += s.replies[i]
+			servfails += s.servfails[i]
+		}
+	}
+	s.Unlock()
+	return replies > 0 && replies >= s.min && float64(servfails)*100 > s.percent*float64(replies)
+}
@@ -0,0 +1,93 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestServfailRate(t *testing.T) {
+	s := newServfailRate(50, 10*time.Second, 4)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		s.mark(now, true)
+	}
+	if s.exceeded(now) {
+		t.Errorf("Expected too few replies to count")
+	}
+	s.mark(now.Add(time.Second), false)
+	if !s.exceeded(now.Add(time.Second)) {
+		t.Errorf("Expected 75%% SERVFAIL to exceed 50%%")
+	}
+	s.mark(now.Add(2*time.Second), false)
+	s.mark(now.Add(2*time.Second), false)
+	if s.exceeded(now.Add(2 * time.Second)) {
+		t.Errorf("Expected 50%% SERVFAIL not to exceed 50%%")
+	}
+
+	s = newServfailRate(50, 10*time.Second, 1)
+	s.mark(now, true)
+	if !s.exceeded(now.Add(9 * time.Second)) {
+		t.Errorf("Expected the SERVFAIL to be in the window")
+	}
+	if s.exceeded(now.Add(10 * time.Second)) {
+		t.Errorf("Expected the window to have cleared")
+	}
+
+	var none *servfailRate
+	none.mark(now, true)
+	if none.exceeded(now) {
+		t.Errorf("Expected no servfail_rate to never exceed")
+	}
+}
+
+func TestServfailRateDown(t *testing.T) {
+	var badPort atomic.Value
+	badPort.Store("")
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if _, port, _ := net.SplitHostPort(w.LocalAddr().String()); port == badPort.Load().(string) {
+			ret.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(ret)
+	}
+	s := dnstest.NewServer(handler)
+	defer s.Close()
+	s2 := dnstest.NewServer(handler) // the handler is shared anyway
+	defer s2.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+	_, port2, _ := net.SplitHostPort(s2.Addr)
+	bad := "127.0.0.1:" + port
+	badPort.Store(port)
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1:"+port+" 127.0.0.1:"+port2+" {\npolicy sequential\nservfail_rate 50% 1m 3\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		ret, info, err := f.ForwardWithInfo(questionState("example.org."))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		wantBad := i < 3
+		if (info.Upstream == bad) != wantBad || (ret.Rcode == dns.RcodeServerFailure) != wantBad {
+			t.Errorf("Query %d: expected the SERVFAILing upstream only until it's down, got %s from %s", i, dns.RcodeToString[ret.Rcode], info.Upstream)
+		}
+	}
+
+	for _, input := range []string{"servfail_rate", "servfail_rate 120", "servfail_rate 50 10ms", "servfail_rate 50 1m 0", "servfail_rate 50 1m 3 4"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
@@ -1,18 +1,23 @@
 package forward
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/dnsutil"
-	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 
 	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
 )
 
 func init() {
@@ -27,9 +32,35 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("foward", err)
 	}
+	if f.id == "" {
+		f.id = fmt.Sprintf("%s#%d", dnsserver.GetConfig(c).Zone, c.ServerBlockIndex)
+	}
+	for _, p := range f.proxies {
+		p.host.id = f.id
+		p.host.exporter = f.exporter
+		p.host.log = f.log
+	}
+	if f.reporter != nil {
+		f.reporter.log = f.log
+	}
+	if f.canary != nil {
+		f.canary.proxy.host.id = f.id
+	}
+	if f.buckets != nil {
+		if err := setBuckets(f.buckets); err != nil {
+			return plugin.Error("forward", err)
+		}
+	}
 	if f.Len() > max {
 		return plugin.Error("forward", fmt.Errorf("more than %d TOs configured: %d", max, f.Len()))
 	}
+	config := dnsserver.GetConfig(c)
+	for _, err := range f.validate(config.ListenHost, config.Port) {
+		if f.strict {
+			return plugin.Error("forward", err)
+		}
+		f.log.warning(f.id, "config_problem", err.Error(), Field{"error", err})
+	}
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		f.Next = next
@@ -37,6 +68,7 @@ func setup(c *caddy.Controller) error {
 	})
 
 	c.OnStartup(func() error {
+		f.Adopt(retired(f.id))
 		once.Do(func() {
 			m := dnsserver.GetConfig(c).Handler("prometheus")
 			if m == nil {
@@ -48,7 +80,43 @@ func setup(c *caddy.Controller) error {
 				x.MustRegister(RequestDuration)
 				x.MustRegister(HealthcheckFailureCount)
 				x.MustRegister(SocketGauge)
+				x.MustRegister(ConnCacheBytes)
+				x.MustRegister(ConnCacheSize)
+				x.MustRegister(ConnCacheHits)
+				x.MustRegister(ConnCacheMisses)
+				x.MustRegister(GoroutineGauge)
+				x.MustRegister(InstanceInfo)
+				x.MustRegister(DownCount)
+				x.MustRegister(PrefetchHintCount)
+				x.MustRegister(UntrustedGauge)
+				x.MustRegister(AuditCount)
+				x.MustRegister(MirrorCount)
+				x.MustRegister(ShedCount)
+				x.MustRegister(RejectCount)
+				x.MustRegister(FilteredCount)
+				x.MustRegister(ThrottleCount)
+				x.MustRegister(FallthroughCount)
+				x.MustRegister(CoalescedCount)
+				x.MustRegister(EDNSFallbackCount)
+				x.MustRegister(SpoofCount)
+				x.MustRegister(HealthScore)
+				x.MustRegister(HealthyGauge)
+				x.MustRegister(FailsGauge)
+				x.MustRegister(BytesCount)
+				x.MustRegister(PeakQPS)
+				x.MustRegister(RetransmitCount)
+				x.MustRegister(ErrorReportCount)
+				x.MustRegister(HedgeCount)
+				x.MustRegister(TLSHandshakeCount)
+				x.MustRegister(TLSHandshakeDuration)
+				x.MustRegister(ResponseSize)
+				x.MustRegister(TruncatedCount)
+				x.MustRegister(TransportRequestCount)
+				x.MustRegister(UpstreamErrorCount)
 			}
+			bucketsMu.Lock()
+			registered = true
+			bucketsMu.Unlock()
 		})
 		return f.OnStartup()
 	})
@@ -56,33 +124,118 @@ func setup(c *caddy.Controller) error {
 	c.OnShutdown(func() error {
 		return f.OnShutdown()
 	})
+	c.OnRestart(func() error {
+		f.stopAdmin() // free the address for the new instance
+		retire(f)
+		return nil
+	})
 
 	return nil
 }
 
 // OnStartup starts a goroutines for all proxies.
 func (f *Forward) OnStartup() (err error) {
-	if f.hcInterval == 0 {
-		for _, p := range f.proxies {
-			p.host.fails = 0
+	f.Lock()
+	f.running = true
+	f.Unlock()
+
+	if f.admin != "" {
+		if err := f.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if f.reporter != nil {
+		go f.reporter.run(f.id)
+	}
+	if f.netWatch || f.hasNames() || f.discovers() {
+		f.stop = make(chan struct{})
+	}
+	if f.netWatch {
+		go watchNetwork(f.stop, f.onNetworkChange, func(err error) {
+			f.log.warning(f.id, "network_watch_failed", fmt.Sprintf("Can't watch the network, falling back to polling: %s", err), Field{"error", err})
+		})
+	}
+	if f.hasNames() {
+		go f.reresolve(f.stop)
+	}
+	for _, p := range f.snapshot() {
+		InstanceInfo.WithLabelValues(f.id, p.host.addr, p.host.tag).Set(1)
+		if p.host.tag != "" {
+			expTags.Set(p.host.expKey(), tagVar(p.host.tag))
 		}
-		return nil
 	}
 
-	for _, p := range f.proxies {
-		go p.healthCheck()
+	var checked []*Proxy
+	for _, p := range f.snapshot() {
+		if p.hcInterval == 0 {
+			p.host.resetFails()
+			continue
+		}
+		if f.hcStartup > 0 && p.mdns == nil {
+			p.checked = make(chan struct{})
+			checked = append(checked, p)
+		}
+		p.startHealthCheck()
+	}
+	if len(checked) > 0 {
+		f.awaitChecks(checked, f.hcStartup)
+	}
+
+	if f.dhcp != nil {
+		// setUpstreams starts the health checks of the proxies it adds.
+		last := f.dhcp.fingerprint()
+		f.learnDHCP(f.dhcp, "dhcp")
+		go f.watchDHCP(f.stop, f.dhcp, "dhcp", last)
+	}
+	if len(f.srv) > 0 {
+		f.learnSRV()
+		go f.watchSRV(f.stop)
+	}
+	if f.resolvConf != nil {
+		last := f.resolvConf.fingerprint()
+		f.learnDHCP(f.resolvConf, sourceResolvConf)
+		go f.watchDHCP(f.stop, f.resolvConf, sourceResolvConf, last)
 	}
 	return nil
 }
 
 // OnShutdown stops all configured proxies.
 func (f *Forward) OnShutdown() error {
-	if f.hcInterval == 0 {
-		return nil
-	}
+	f.Lock()
+	f.running = false
+	next := f.successor
+	f.Unlock()
+	forget(f)
 
-	for _, p := range f.proxies {
-		p.close()
+	// Close the proxies at the same time, each may wait for a health check in progress. When another
+	// instance took over, they're drained instead.
+	var wg sync.WaitGroup
+	for _, p := range f.snapshot() {
+		if next == nil || !next.hasUpstream(p.host.addr, p.host.tag) {
+			InstanceInfo.DeleteLabelValues(f.id, p.host.addr, p.host.tag)
+		}
+		if next != nil {
+			go p.drain(drainTimeout)
+			continue
+		}
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.close()
+		}(p)
+	}
+	if f.canary != nil {
+		f.canary.proxy.close()
+	}
+	wg.Wait()
+	f.stopAdmin()
+	f.bgCancel()
+	if f.reporter != nil {
+		f.reporter.stopOnce.Do(func() { close(f.reporter.stop) })
+	}
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
 	}
 	return nil
 }
@@ -94,9 +247,9 @@ func (f *Forward) Close() {
 
 func parseForward(c *caddy.Controller) (*Forward, error) {
 	f := New()
+	f.id = "" // set by parseBlock or defaulted in setup
 
-	protocols := map[int]int{}
-
+	var all []string
 	for c.Next() {
 		if !c.Args(&f.from) {
 			return f, c.ArgErr()
@@ -104,42 +257,30 @@ func parseForward(c *caddy.Controller) (*Forward, error) {
 		f.from = plugin.Host(f.from).Normalize()
 
 		to := c.RemainingArgs()
-		if len(to) == 0 {
-			return f, c.ArgErr()
-		}
-
-		// A bit fiddly, but first check if we've got protocols and if so add them back in when we create the proxies.
-		protocols = make(map[int]int)
-		for i := range to {
-			protocols[i], to[i] = protocol(to[i])
-		}
-
-		// If parseHostPortOrFile expands a file with a lot of nameserver our accounting in protocols doesn't make
-		// any sense anymore... For now: lets don't care.
-		toHosts, err := dnsutil.ParseHostPortOrFile(to...)
-		if err != nil {
-			return f, err
-		}
+		if len(to) > 0 {
+			to, err := resolveNamed(to)
+			if err != nil {
+				return f, err
+			}
+			all = append(all, to...)
 
-		for i, h := range toHosts {
-			// Double check the port, if e.g. is 53 and the transport is TLS make it 853.
-			// This can be somewhat annoying because you *can't* have TLS on port 53 then.
-			switch protocols[i] {
-			case TLS:
-				h1, p, err := net.SplitHostPort(h)
-				if err != nil {
-					break
-				}
+			srv, to := srvUpstreams(to)
+			f.srv = append(f.srv, srv...)
 
-				if p == "53" {
-					h = net.JoinHostPort(h1, "853")
+			proxies, err := parseUpstreams(to)
+			if err != nil {
+				return f, err
+			}
+			if files := resolvFiles(to); len(files) > 0 {
+				// Keep the name servers of these files in sync with them.
+				if f.resolvConf == nil {
+					f.resolvConf = new(dhcp)
 				}
+				f.resolvConf.files = append(f.resolvConf.files, files...)
+				addrs, _ := (&dhcp{files: files}).servers()
+				markSource(proxies, addrs, sourceResolvConf)
 			}
-
-			// We can't set tlsConfig here, because we haven't parsed it yet.
-			// We set it below at the end of parseBlock.
-			p := NewProxy(h)
-			f.proxies = append(f.proxies, p)
+			f.proxies = append(f.proxies, proxies...)
 		}
 
 		for c.NextBlock() {
@@ -149,19 +290,232 @@ func parseForward(c *caddy.Controller) (*Forward, error) {
 		}
 	}
 
+	if len(f.proxies) == 0 && !f.discovers() {
+		return f, c.ArgErr()
+	}
+	if len(f.srv) > 0 && f.bootstrap == nil {
+		return f, fmt.Errorf("upstream %s%s needs a bootstrap resolver", _srv+"://", f.srv[0])
+	}
+	if f.maxTTL > 0 && f.minTTL > f.maxTTL {
+		return f, fmt.Errorf("min_ttl can't be higher than max_ttl")
+	}
+	if f.forceTCP && f.preferUDP {
+		return f, fmt.Errorf("force_tcp and prefer_udp can't both be set")
+	}
+	if f.via != nil && f.preferUDP {
+		return f, fmt.Errorf("via and prefer_udp can't both be set, only TCP goes through the proxy")
+	}
+	if f.proxyProtocol && f.multiplex > 0 {
+		return f, fmt.Errorf("proxy_protocol and multiplex can't both be set, a connection carries one client")
+	}
+	if f.failWindow > 0 {
+		for _, p := range f.proxies {
+			if f.failWindow <= p.hcInterval || f.failWindow <= f.hcBackoff {
+				return f, fmt.Errorf("fail_window must be longer than the health check interval and its backoff: %s", f.failWindow)
+			}
+		}
+	}
+	if f.hedge >= f.readTimeout {
+		return f, fmt.Errorf("hedge delay must be less than the read_timeout of %s: %s", f.readTimeout, f.hedge)
+	}
+	for rc, action := range f.rcodes {
+		if action == rcodeFallthrough && f.fallThrough.Zones == nil {
+			return f, fmt.Errorf("rcode %s fallthrough needs the fallthrough option", rcodeString(rc))
+		}
+	}
+	if err := f.resolveNames(); err != nil {
+		return f, err
+	}
+	if f.id != "" {
+		setNamed(f.id, all)
+	}
+	if f.privacy {
+		f.redact = privateRedactor
+		f.errReport = nil // reports carry the query name
+	}
+
 	if f.tlsServerName != "" {
 		f.tlsConfig.ServerName = f.tlsServerName
 	}
 	for i := range f.proxies {
-		// Only set this for proxies that need it.
-		if protocols[i] == TLS {
-			f.proxies[i].SetTLSConfig(f.tlsConfig)
+		f.configure(f.proxies[i])
+		if f.maxConnMem > 0 {
+			f.proxies[i].SetMaxConnMemory(f.maxConnMem / int64(len(f.proxies)))
+		}
+	}
+	if f.splitGroup != "" && !f.hasGroup(f.splitGroup) {
+		return f, fmt.Errorf("unknown group in split: %s", f.splitGroup)
+	}
+	if f.canary != nil {
+		if f.canary.proxy.tls {
+			f.canary.proxy.SetTLSConfig(f.tlsConfig)
 		}
-		f.proxies[i].SetExpire(f.expire)
+		f.canary.proxy.SetExpire(f.expire)
+		f.canary.proxy.SetTimeouts(f.dialTimeout, f.readTimeout, f.writeTimeout)
+		f.canary.proxy.host.fails = 0 // not health checked
 	}
 	return f, nil
 }
 
+// parseTo returns the proxies for the upstreams in to.
+func parseTo(to []string) ([]*Proxy, error) {
+	var (
+		proxies []*Proxy
+		rest    []string
+	)
+	for _, t := range to {
+		switch {
+		case strings.HasPrefix(t, _tls+"://") && strings.Contains(t, "#"):
+			// tls://9.9.9.9#dns.quad9.net, as tls_servername=dns.quad9.net.
+			i := strings.LastIndex(t, "#")
+			if i == len(t)-1 {
+				return nil, fmt.Errorf("empty TLS server name in %s", t)
+			}
+			ps, err := parseTo([]string{t[:i]})
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range ps {
+				p.tlsServerName = t[i+1:]
+			}
+			proxies = append(proxies, ps...)
+		case strings.HasPrefix(t, _mdns+"://"):
+			p, err := newMDNSProxy(t[len(_mdns)+3:])
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, p)
+		case strings.HasPrefix(t, _https+"://"):
+			p, err := newDoHProxy(t)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, p)
+		case strings.HasPrefix(t, _quic+"://"):
+			p, err := newDoQProxy(t)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, p)
+		case strings.HasPrefix(t, _grpc+"://"):
+			p, err := newGRPCProxy(t)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, p)
+		case strings.HasPrefix(t, _sdns+"://"):
+			st, err := decodeStamp(t)
+			if err != nil {
+				return nil, err
+			}
+			up, err := st.upstream()
+			if err != nil {
+				return nil, err
+			}
+			ps, err := parseTo([]string{up})
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range ps {
+				p.tlsServerName, p.tlsHashes = st.host, st.hashes
+			}
+			proxies = append(proxies, ps...)
+		case isHostUpstream(t):
+			name, addr, _ := hostUpstream(t)
+			p := NewProxy(addr) // the address is set when the name is resolved
+			p.hostname, p.tls = name, true
+			proxies = append(proxies, p)
+		default:
+			rest = append(rest, t)
+		}
+	}
+	if len(rest) == 0 {
+		return proxies, nil
+	}
+
+	addrs, tls, err := normalizeTo(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range addrs {
+		// We can't set tlsConfig here, because we haven't parsed it yet.
+		// We set it at the end of parseForward.
+		p := NewProxy(addrs[i])
+		p.tls = tls[i]
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// normalizeTo returns the host:port addresses for the upstreams in to, and whether they use TLS.
+func normalizeTo(to []string) ([]string, []bool, error) {
+	to, err := expandTo(to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A bit fiddly, but first check if we've got protocols and if so add them back in when we create the proxies.
+	protocols := make(map[int]int)
+	for i := range to {
+		protocols[i], to[i] = protocol(to[i])
+		if net.ParseIP(to[i]) != nil {
+			to[i] = net.JoinHostPort(to[i], defaultPort[protocols[i]])
+		}
+	}
+
+	// If parseHostPortOrFile expands a file with a lot of nameserver our accounting in protocols doesn't make
+	// any sense anymore... For now: lets don't care.
+	toHosts, err := dnsutil.ParseHostPortOrFile(to...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tls := make([]bool, len(toHosts))
+	for i, h := range toHosts {
+		proto, ok := protocols[i]
+		if !ok {
+			proto = DNS // from a resolv.conf file
+		}
+		tls[i] = proto == TLS
+
+		// An explicit port that is the default of another protocol is most likely a mistake.
+		_, p, err := net.SplitHostPort(h)
+		if err != nil {
+			continue
+		}
+		for other, port := range defaultPort {
+			if other != proto && port == p && defaultPort[proto] != p {
+				return nil, nil, fmt.Errorf("port %s of %s is the default port of another protocol", p, h)
+			}
+		}
+	}
+	return toHosts, tls, nil
+}
+
+// lookup returns the configured proxies for upstream to.
+func (f *Forward) lookup(to string) ([]*Proxy, error) {
+	var addrs []string
+	if _, addr, ok := hostUpstream(to); ok {
+		addrs = []string{addr}
+	} else {
+		var err error
+		if addrs, _, err = normalizeTo([]string{to}); err != nil {
+			return nil, err
+		}
+	}
+	var proxies []*Proxy
+	for _, p := range f.proxies {
+		if p.host.addr == addrs[0] {
+			proxies = append(proxies, p)
+		}
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("unknown upstream: %s", to)
+	}
+	return proxies, nil
+}
+
 func parseBlock(c *caddy.Controller, f *Forward) error {
 	switch c.Val() {
 	case "except":
@@ -169,10 +523,52 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		if len(ignore) == 0 {
 			return c.ArgErr()
 		}
-		for i := 0; i < len(ignore); i++ {
-			ignore[i] = plugin.Host(ignore[i]).Normalize()
+		for _, i := range ignore {
+			f.ignored = append(f.ignored, plugin.Host(i).Normalize())
+		}
+	case "clients", "except_clients":
+		opt := c.Val()
+		nets := c.RemainingArgs()
+		if len(nets) == 0 {
+			return c.ArgErr()
+		}
+		for _, s := range nets {
+			n := parseClientNet(s)
+			if n == nil {
+				return c.Errf("not a client network: %s", s)
+			}
+			if opt == "clients" {
+				f.clients = append(f.clients, n)
+			} else {
+				f.exceptClients = append(f.exceptClients, n)
+			}
+		}
+	case "opcodes":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		f.opcodes = make(map[int]bool)
+		for _, a := range args {
+			op, err := parseOpcode(a)
+			if err != nil {
+				return err
+			}
+			f.opcodes[op] = true
+		}
+	case "classes":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		f.classes = make(map[uint16]bool)
+		for _, a := range args {
+			cl, err := parseClass(a)
+			if err != nil {
+				return err
+			}
+			f.classes[cl] = true
 		}
-		f.ignored = ignore
 	case "max_fails":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -182,6 +578,51 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return err
 		}
 		f.maxfails = uint32(n)
+	case "fail_window":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("fail_window must be positive: %s", dur)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.failWindow = dur
+	case "max_retries":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return c.Errf("max_retries can't be negative: %d", n)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.maxRetries = n
+	case "query_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("query_timeout can't be negative or zero: %s", dur)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.queryTimeout = dur
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -192,8 +633,120 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		}
 		f.hcInterval = dur
 		for i := range f.proxies {
-			f.proxies[i].hcInterval = dur
+			if !f.proxies[i].ownHcInterval {
+				f.proxies[i].hcInterval = dur
+			}
+		}
+		if !c.NextArg() {
+			return nil
+		}
+		if c.Val() != "zone" {
+			return c.Errf("unknown health_check mode: '%s'", c.Val())
+		}
+		hc := f.healthQuery()
+		hc.name, hc.qtype, hc.rd = f.from, dns.TypeSOA, false
+		if c.NextArg() {
+			switch strings.ToUpper(c.Val()) {
+			case "SOA":
+			case "NS":
+				hc.qtype = dns.TypeNS
+			default:
+				return c.Errf("health_check zone type must be SOA or NS: '%s'", c.Val())
+			}
+		}
+		if hc.healthy == nil {
+			hc.healthy = map[int]bool{dns.RcodeSuccess: true}
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "health_backoff":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("health_backoff can't be negative or zero: %s", dur)
+		}
+		f.hcBackoff = dur
+		if len(args) == 2 {
+			n, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil || n == 0 {
+				return c.Errf("invalid number of successful health checks: '%s'", args[1])
+			}
+			f.hcRise = uint32(n)
+		}
+	case "health_jitter":
+		if !c.NextArg() {
+			return c.ArgErr()
 		}
+		n, err := parsePercent(c.Val())
+		if err != nil {
+			return err
+		}
+		if n > 50 {
+			return c.Errf("health_jitter can't be more than 50%%: %s", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.hcJitter = n / 100
+	case "health_skip_active":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.hcSkipActive = true
+	case "health_startup":
+		f.hcStartup = hcStartupTimeout
+		if !c.NextArg() {
+			break
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("health_startup can't be negative or zero: %s", dur)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.hcStartup = dur
+	case "health_query":
+		args := c.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			return c.Errf("unknown health_query type: '%s'", args[1])
+		}
+		hc := f.healthQuery()
+		hc.name, hc.qtype, hc.rd = dns.Fqdn(args[0]), qtype, false
+		if len(args) == 3 {
+			if args[2] != "recursion" {
+				return c.Errf("unknown health_query flag: '%s'", args[2])
+			}
+			hc.rd = true
+		}
+	case "health_rcodes":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		healthy := make(map[int]bool, len(args))
+		for _, a := range args {
+			rc, err := parseRcode(a)
+			if err != nil {
+				return err
+			}
+			healthy[rc] = true
+		}
+		f.healthQuery().healthy = healthy
 	case "force_tcp":
 		if c.NextArg() {
 			return c.ArgErr()
@@ -202,15 +755,38 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		for i := range f.proxies {
 			f.proxies[i].forceTCP = true
 		}
+	case "prefer_udp":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.preferUDP = true
+	case "no_pool_udp":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.noPoolUDP = true
 	case "tls":
 		args := c.RemainingArgs()
-		if len(args) != 3 {
+		if len(args) == 0 || len(args) > 3 {
 			return c.ArgErr()
 		}
 
-		tlsConfig, err := pkgtls.NewTLSConfig(args[0], args[1], args[2])
-		if err != nil {
-			return err
+		tlsConfig := new(tls.Config)
+		if len(args) >= 2 {
+			cert, err := newCertFile(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			tlsConfig.GetClientCertificate = cert.get
+		}
+		if len(args) != 2 {
+			ca, err := newCAFile(args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			// For the TLS configs that don't verify with f.tlsCA, e.g. of the mirror.
+			tlsConfig.RootCAs, _ = ca.roots()
+			f.tlsCA = ca
 		}
 		f.tlsConfig = tlsConfig
 	case "tls_servername":
@@ -219,20 +795,986 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		}
 		f.tlsServerName = c.Val()
 	case "expire":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			f.expire = dur
+			break
+		}
+		proto := args[0]
+		switch proto {
+		case "tls":
+			proto = "tcp-tls"
+		case "udp", "tcp":
+		default:
+			return c.Errf("unknown protocol for expire: '%s'", args[0])
+		}
+		if f.protoExpire == nil {
+			f.protoExpire = make(map[string]time.Duration)
+		}
+		f.protoExpire[proto] = dur
+	case "max_idle_conns":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		dur, err := time.ParseDuration(c.Val())
+		n, err := strconv.Atoi(c.Val())
 		if err != nil {
 			return err
 		}
-		f.expire = dur
-
-	default:
-		return c.Errf("unknown property '%s'", c.Val())
-	}
-
-	return nil
+		if n < 0 {
+			return c.Errf("max_idle_conns can't be negative: %d", n)
+		}
+		f.maxIdleConns = n
+	case "warm_conns":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return c.Errf("warm_conns must be positive: %d", n)
+		}
+		f.warmConns = n
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "dial_timeout", "read_timeout", "write_timeout":
+		opt := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("%s can't be negative or zero: %s", opt, dur)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		switch opt {
+		case "dial_timeout":
+			f.dialTimeout = dur
+		case "read_timeout":
+			f.readTimeout = dur
+		case "write_timeout":
+			f.writeTimeout = dur
+		}
+	case "accounting":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < time.Second {
+			return c.Errf("accounting window can't be less than a second: %s", dur)
+		}
+		f.accountWindow = dur
+	case "servfail_rate":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		percent, err := parsePercent(args[0])
+		if err != nil {
+			return err
+		}
+		window, min := servfailWindow, int64(servfailMin)
+		if len(args) > 1 {
+			if window, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+			if window < time.Second {
+				return c.Errf("servfail_rate window can't be less than a second: %s", window)
+			}
+		}
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return c.Errf("servfail_rate minimum must be positive: %d", n)
+			}
+			min = int64(n)
+		}
+		f.servfailRate = newServfailRate(percent, window, min)
+	case "strict":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.strict = true
+	case "name":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		f.id = c.Val()
+	case "log_qname":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "full", "hash", "truncate":
+			f.redact.qname = c.Val()
+		default:
+			return c.Errf("unknown log_qname mode: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "bind":
+		b, err := parseBind(c.RemainingArgs())
+		if err != nil {
+			return err
+		}
+		f.bind = b
+	case "via":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		v, err := parseVia(c.Val())
+		if err != nil {
+			return err
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.via = v
+	case "bootstrap":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, a := range args {
+			h := a
+			if host, _, err := net.SplitHostPort(a); err == nil {
+				h = host
+			}
+			if net.ParseIP(h) == nil {
+				return c.Errf("bootstrap resolver must be an IP address: '%s'", a)
+			}
+		}
+		servers, _, err := normalizeTo(args)
+		if err != nil {
+			return err
+		}
+		f.bootstrap = newBootstrap(servers)
+	case "prefer_ip":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "v4", "v6", "v4only", "v6only", "v6first", "any":
+			f.preferIP = c.Val()
+		default:
+			return c.Errf("unknown prefer_ip '%s', must be v4, v6, v4only, v6only, v6first or any", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "latency_buckets":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		f.buckets = make([]float64, len(args))
+		for i, a := range args {
+			d, err := time.ParseDuration(a)
+			if err != nil {
+				return err
+			}
+			f.buckets[i] = d.Seconds()
+			if d <= 0 || i > 0 && f.buckets[i] <= f.buckets[i-1] {
+				return c.Errf("latency_buckets must be positive and increasing: '%s'", a)
+			}
+		}
+	case "dnstap_payload":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "full", "metadata":
+			f.tapPayload = c.Val()
+		default:
+			return c.Errf("unknown dnstap_payload: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "dhcp":
+		files := c.RemainingArgs()
+		if len(files) == 0 {
+			return c.ArgErr()
+		}
+		f.dhcp = &dhcp{files: files}
+	case "error_reporting":
+		agent := ""
+		if c.NextArg() {
+			agent = c.Val()
+			if !isHostname(agent) {
+				return c.Errf("invalid error reporting agent domain: '%s'", agent)
+			}
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.errReport = newErrReporter(agent)
+	case "log_format":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "text":
+			if f.log != nil {
+				f.log.json = false
+			}
+		case "json":
+			if f.log == nil {
+				f.log = &logger{}
+			}
+			f.log.json = true
+		default:
+			return c.Errf("unknown log_format: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "log_queries":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if f.log == nil {
+			f.log = &logger{}
+		}
+		f.log.queries = true
+	case "log_level":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		level, err := parseLevel(c.Val())
+		if err != nil {
+			return c.Errf("unknown log_level: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if f.log == nil {
+			f.log = &logger{}
+		}
+		f.log.level = level
+	case "log_ratelimit":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return c.Errf("log_ratelimit can't be negative: %s", d)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if f.log == nil {
+			f.log = &logger{}
+		}
+		f.log.rate = d
+	case "network_watch":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.netWatch = true
+	case "privacy":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.privacy = true
+	case "log_client_mask":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		v4, err := strconv.Atoi(args[0])
+		if err != nil || v4 < 0 || v4 > 32 {
+			return c.Errf("invalid IPv4 prefix length: '%s'", args[0])
+		}
+		f.redact.v4 = v4
+		if len(args) == 2 {
+			v6, err := strconv.Atoi(args[1])
+			if err != nil || v6 < 0 || v6 > 128 {
+				return c.Errf("invalid IPv6 prefix length: '%s'", args[1])
+			}
+			f.redact.v6 = v6
+		}
+	case "maintenance":
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return c.ArgErr()
+		}
+		proxies, err := f.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		sched, err := parseSchedule(args[1])
+		if err != nil {
+			return err
+		}
+		dur, err := time.ParseDuration(args[2])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.maint.add(window{sched: sched, duration: dur})
+		}
+	case "policy":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		policy := newPolicy(c.Val())
+		if policy == nil {
+			return c.Errf("unknown policy: '%s'", c.Val())
+		}
+		if l, ok := policy.(*latency); ok && c.NextArg() {
+			n, err := parsePercent(c.Val())
+			if err != nil {
+				return err
+			}
+			l.explore = n / 100
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.policy = policy
+	case "no_healthy_reply":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "SERVFAIL":
+			f.noHealthyRcode = dns.RcodeServerFailure
+		case "REFUSED":
+			f.noHealthyRcode = dns.RcodeRefused
+		case "NOERROR":
+			f.noHealthyRcode = dns.RcodeSuccess
+		default:
+			return c.Errf("unknown no_healthy_reply rcode: '%s'", args[0])
+		}
+		ttl := defaultNoHealthyTTL
+		if len(args) == 2 {
+			if f.noHealthyRcode != dns.RcodeSuccess {
+				return c.Errf("a no_healthy_reply TTL needs NOERROR: '%s'", args[1])
+			}
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return err
+			}
+			if dur < time.Second {
+				return c.Errf("no_healthy_reply TTL must be at least 1s: '%s'", args[1])
+			}
+			ttl = dur
+		}
+		f.noHealthyTTL = uint32(ttl.Seconds())
+	case "min_ttl", "max_ttl":
+		opt := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < time.Second {
+			return c.Errf("%s must be at least 1s: '%s'", opt, c.Val())
+		}
+		if opt == "min_ttl" {
+			f.minTTL = uint32(dur.Seconds())
+		} else {
+			f.maxTTL = uint32(dur.Seconds())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "prefetch_hint":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < time.Second {
+			return c.Errf("prefetch_hint must be at least 1s: '%s'", c.Val())
+		}
+		f.prefetchTTL = uint32(dur.Seconds())
+	case "spoof_log":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		f.spoofLog = 1
+		if len(args) == 1 {
+			n, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return c.Errf("spoof_log must be positive: '%s'", args[0])
+			}
+			f.spoofLog = n
+		}
+	case "statsd":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		prefix := "coredns.forward"
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		e, err := NewStatsdExporter(args[0], prefix)
+		if err != nil {
+			return err
+		}
+		f.addExporter(e)
+	case "hedge":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("hedge delay can't be negative or zero: %s", dur)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.hedge = dur
+	case "happy_eyeballs":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		f.happyEyeballs = happyEyeballsDelay
+		if len(args) == 1 {
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if dur <= 0 {
+				return c.Errf("happy_eyeballs delay can't be negative or zero: %s", dur)
+			}
+			f.happyEyeballs = dur
+		}
+	case "fallthrough":
+		f.fallThrough.SetZonesFromArgs(c.RemainingArgs())
+	case "rcode":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		action := args[len(args)-1]
+		switch action {
+		case rcodePass, rcodeServfail, rcodeNext, rcodeFallthrough:
+		default:
+			return c.Errf("unknown rcode action: '%s'", action)
+		}
+		if f.rcodes == nil {
+			f.rcodes = make(map[int]string)
+		}
+		for _, a := range args[:len(args)-1] {
+			rc, err := parseRcode(a)
+			if err != nil {
+				return err
+			}
+			f.rcodes[rc] = action
+		}
+	case "report":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if dur < time.Second {
+			return c.Errf("report interval can't be less than a second: %s", dur)
+		}
+		dest := "log"
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		f.reporter = newReporter(dur, dest)
+		f.addExporter(f.reporter)
+	case "probe":
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return c.ArgErr()
+		}
+		p, err := newProbe(args[0], args[1], args[2])
+		if err != nil {
+			return err
+		}
+		f.probe = p
+	case "admission":
+		args := c.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		inflight, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		queue, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		if inflight <= 0 || queue < 0 {
+			return c.Errf("invalid admission limits: '%s %s'", args[0], args[1])
+		}
+		dur := admissionTimeout
+		if len(args) == 3 {
+			if dur, err = time.ParseDuration(args[2]); err != nil {
+				return err
+			}
+		}
+		f.admission = newAdmission(inflight, queue, dur)
+	case "ecs":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "pass":
+			if len(args) > 1 {
+				return c.ArgErr()
+			}
+			f.ecs = nil
+		case "strip":
+			if len(args) > 1 {
+				return c.ArgErr()
+			}
+			f.ecs = &ecs{strip: true}
+		case "add":
+			if len(args) > 3 {
+				return c.ArgErr()
+			}
+			e := &ecs{add: true, v4: ecsV4, v6: ecsV6}
+			for i, max := range []int{32, 128} {
+				if len(args) < i+2 {
+					break
+				}
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					return err
+				}
+				if n < 0 || n > max {
+					return c.Errf("ecs prefix length must be between 0 and %d: %d", max, n)
+				}
+				if i == 0 {
+					e.v4 = uint8(n)
+				} else {
+					e.v6 = uint8(n)
+				}
+			}
+			f.ecs = e
+		default:
+			return c.Errf("unknown ecs mode: '%s'", args[0])
+		}
+	case "bufsize":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 512 || n > 65535 {
+			return c.Errf("bufsize must be between 512 and 65535: %d", n)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.bufsize = uint16(n)
+	case "reply_flags":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "preserve":
+			f.normalize = false
+		case "normalize":
+			f.normalize = true
+		default:
+			return c.Errf("unknown reply_flags mode: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "edns_strip":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		var codes *map[uint16]bool
+		switch args[0] {
+		case "query":
+			codes = &f.stripQuery
+		case "reply":
+			codes = &f.stripReply
+		default:
+			return c.Errf("unknown edns_strip direction: '%s'", args[0])
+		}
+		if *codes == nil {
+			*codes = make(map[uint16]bool)
+		}
+		for _, a := range args[1:] {
+			code, err := ednsCode(a)
+			if err != nil {
+				return err
+			}
+			(*codes)[code] = true
+		}
+	case "cookies":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.cookies = true
+	case "coalesce":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.coalesce = newCoalescer()
+	case "max_concurrent":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return c.Errf("max_concurrent must be positive: %d", n)
+		}
+		f.rejectRcode = dns.RcodeRefused
+		if len(args) == 2 {
+			switch args[1] {
+			case "REFUSED":
+			case "SERVFAIL":
+				f.rejectRcode = dns.RcodeServerFailure
+			default:
+				return c.Errf("unknown max_concurrent rcode: '%s'", args[1])
+			}
+		}
+		f.maxConcurrent = int64(n)
+	case "max_qps":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return c.Errf("max_qps must be positive: %s", args[0])
+		}
+		if len(args) == 2 {
+			switch args[1] {
+			case "REFUSED":
+			case "SERVFAIL":
+				f.throttleRcode = dns.RcodeServerFailure
+			default:
+				return c.Errf("unknown max_qps rcode: '%s'", args[1])
+			}
+		}
+		f.maxQPS = n
+	case "audit":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := parsePercent(c.Val())
+		if err != nil {
+			return err
+		}
+		f.auditPercent = n
+	case "mirror":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		proxies, err := parseTo(args[:1])
+		if err != nil {
+			return err
+		}
+		n, err := parsePercent(args[1])
+		if err != nil {
+			return err
+		}
+		f.canary = newCanary(proxies[0], n)
+	case "group":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		if f.hasGroup(args[0]) {
+			return c.Errf("duplicate group: '%s'", args[0])
+		}
+		proxies, err := parseTo(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.group = args[0]
+		}
+		f.proxies = append(f.proxies, proxies...)
+	case "backup":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		proxies, err := parseTo(args)
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.backup = true
+		}
+		f.proxies = append(f.proxies, proxies...)
+	case "route":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		zone := plugin.Host(args[0]).Normalize()
+		if !plugin.Name(f.from).Matches(zone) {
+			return c.Errf("route '%s' is not a subdomain of '%s'", zone, f.from)
+		}
+		r := &route{zone: zone, addrs: make(map[string]bool)}
+		for _, to := range args[1:] {
+			proxies, err := f.lookup(to)
+			if err != nil {
+				return err
+			}
+			for _, p := range proxies {
+				r.addrs[p.host.addr] = true
+			}
+		}
+		f.routes = append(f.routes, r)
+	case "admin":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+			return err
+		}
+		f.admin = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "zone":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		zone := plugin.Host(args[0]).Normalize()
+		for _, r := range f.routes {
+			if r.zone == zone {
+				return c.Errf("duplicate zone: '%s'", zone)
+			}
+		}
+		proxies, err := parseTo(args[1:])
+		if err != nil {
+			return err
+		}
+		r := &route{zone: zone, addrs: make(map[string]bool)}
+		for _, p := range proxies {
+			p.group = zoneGroup(zone)
+			r.addrs[p.host.addr] = true
+		}
+		f.proxies = append(f.proxies, proxies...)
+		f.routes = append(f.routes, r)
+	case "split":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		n, err := parsePercent(args[1])
+		if err != nil {
+			return err
+		}
+		f.splitGroup, f.splitPercent = args[0], n
+	case "fallback":
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		proxies, err := f.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			chain, err := newFallback(args[1:])
+			if err != nil {
+				return err
+			}
+			p.host.chain = chain
+			if chain.has("tcp-tls") {
+				p.tls = true
+			}
+		}
+	case "max_conn_memory":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := parseSize(c.Val())
+		if err != nil {
+			return err
+		}
+		f.maxConnMem = n
+	case "edns_keepalive":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.ednsKeepalive = true
+	case "padding":
+		f.padding = padBlock
+		if !c.NextArg() {
+			break
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > 4096 {
+			return c.Errf("padding block size must be between 1 and 4096: %d", n)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.padding = n
+	case "doh_proxy":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if c.Val() == "none" {
+			f.dohProxy = noProxy
+		} else {
+			u, err := url.Parse(c.Val())
+			if err != nil {
+				return err
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return c.Errf("doh_proxy must be an http:// or https:// URL or none: '%s'", c.Val())
+			}
+			f.dohProxy = http.ProxyURL(u)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "doh_header":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		if f.dohHeader == nil {
+			f.dohHeader = make(http.Header)
+		}
+		f.dohHeader.Add(args[0], args[1])
+	case "doh_request_id":
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+			f.dohReqID = "X-Request-ID"
+		case 1:
+			f.dohReqID = args[0]
+		default:
+			return c.ArgErr()
+		}
+	case "proxy_protocol":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.proxyProtocol = true
+	case "randomize_case":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.randomCase = true
+	case "multiplex":
+		f.multiplex = muxConns
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return c.Errf("multiplex connections must be positive: %d", n)
+			}
+			f.multiplex = n
+		}
+
+	default:
+		return c.Errf("unknown property '%s'", c.Val())
+	}
+
+	return nil
+}
+
+// parseSize parses s as a number of bytes, s may carry a K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size: %d", n)
+	}
+	return n * mult, nil
+}
+
+// parsePercent parses s as a percentage between 0 and 100, a trailing % is allowed.
+func parsePercent(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > 100 {
+		return 0, fmt.Errorf("percentage must be between 0 and 100: %s", s)
+	}
+	return n, nil
 }
 
 const max = 15 // Maximum number of upstreams.
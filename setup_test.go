@@ -1,11 +1,19 @@
 package forward
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
 	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 func TestSetupForward(t *testing.T) {
@@ -23,9 +31,19 @@ func TestSetupForward(t *testing.T) {
 		{"forward . 127.0.0.1 {\nexcept miek.nl\n}\n", false, ".", nil, 2, false, ""},
 		{"forward . 127.0.0.1 {\nmax_fails 3\n}\n", false, ".", nil, 3, false, ""},
 		{"forward . 127.0.0.1 {\nforce_tcp\n}\n", false, ".", nil, 2, true, ""},
+		{"forward . 127.0.0.1 {\naudit 5%\n}\n", false, ".", nil, 2, false, ""},
+		{"forward . 127.0.0.1 {\nmaintenance 127.0.0.1 \"0 3 * * 0\" 2h\n}\n", false, ".", nil, 2, false, ""},
+		{"forward example.org 127.0.0.1 {\nhealth_check 1s zone NS\n}\n", false, "example.org.", nil, 2, false, ""},
+		{"forward . 127.0.0.1 {\nerror_reporting agent.example.net\n}\n", false, ".", nil, 2, false, ""},
 		// negative
 		{"forward . a27.0.0.1", true, "", nil, 0, false, "not an IP"},
 		{"forward . 127.0.0.1 {\nblaatl\n}\n", true, "", nil, 0, false, "unknown property"},
+		{"forward . 127.0.0.1 {\naudit 101\n}\n", true, "", nil, 0, false, "between 0 and 100"},
+		{"forward . 127.0.0.1 {\nmaintenance 10.0.0.1 \"0 3 * * 0\" 2h\n}\n", true, "", nil, 0, false, "unknown upstream"},
+		{"forward . 127.0.0.1 {\nhealth_check 1s zone TXT\n}\n", true, "", nil, 0, false, "SOA or NS"},
+		{"forward . 127.0.0.1 {\nhealth_check 1s apex\n}\n", true, "", nil, 0, false, "unknown health_check mode"},
+		{"forward . 127.0.0.1 {\nerror_reporting agent.example.net extra\n}\n", true, "", nil, 0, false, "Wrong argument count"},
+		{"forward . tls://127.0.0.1:53", true, "", nil, 0, false, "default port of another protocol"},
 	}
 
 	for i, test := range tests {
@@ -62,3 +80,462 @@ func TestSetupForward(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupMaxConnMemory(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedMem int64
+	}{
+		{"forward . 127.0.0.1", false, 0},
+		{"forward . 127.0.0.1 {\nmax_conn_memory 4096\n}\n", false, 4096},
+		{"forward . 127.0.0.1 {\nmax_conn_memory 2M\n}\n", false, 2 << 20},
+		{"forward . 127.0.0.1 {\nmax_conn_memory -1\n}\n", true, 0},
+		{"forward . 127.0.0.1 {\nmax_conn_memory 2Q\n}\n", true, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+		}
+		if !test.shouldErr && f.maxConnMem != test.expectedMem {
+			t.Errorf("Test %d: expected: %d, got: %d", i, test.expectedMem, f.maxConnMem)
+		}
+	}
+}
+
+func TestSetupName(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nname resolvers\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.ID() != "resolvers" {
+		t.Errorf("Expected ID %q, got: %q", "resolvers", f.ID())
+	}
+}
+
+func TestSetupExpand(t *testing.T) {
+	os.Setenv("FORWARD_TEST_UPSTREAMS", "10.0.0.9, tls://10.0.0.10")
+	defer os.Unsetenv("FORWARD_TEST_UPSTREAMS")
+
+	tests := []struct {
+		input     string
+		expected  []string
+		shouldErr bool
+	}{
+		{"forward . 10.0.0.1-10.0.0.3:1053", []string{"10.0.0.1:1053", "10.0.0.2:1053", "10.0.0.3:1053"}, false},
+		{"forward . tls://10.0.0.1-10.0.0.2", []string{"10.0.0.1:853", "10.0.0.2:853"}, false},
+		{"forward . ${FORWARD_TEST_UPSTREAMS}", []string{"10.0.0.9:53", "10.0.0.10:853"}, false},
+		{"forward . 10.0.0.1 tls://10.0.0.2 tls://10.0.0.3:1853", []string{"10.0.0.1:53", "10.0.0.2:853", "10.0.0.3:1853"}, false},
+		{"forward . 10.0.0.3-10.0.0.1", nil, true},
+		{"forward . ${FORWARD_TEST_UNSET}", nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %v", i, err)
+		}
+		var addrs []string
+		for _, p := range f.proxies {
+			addrs = append(addrs, p.host.addr)
+		}
+		if !reflect.DeepEqual(addrs, test.expected) {
+			t.Errorf("Test %d: expected %v, got: %v", i, test.expected, addrs)
+		}
+	}
+}
+
+func TestSetupUpstreamOptions(t *testing.T) {
+	input := "forward . 10.0.0.1-10.0.0.2 weight=3 max_fails=5 tag=dc1 tls://10.0.0.3 tls_servername=dns.example.org force_tcp=true"
+	c := caddy.NewTestController("dns", input)
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.proxies) != 3 {
+		t.Fatalf("Expected 3 proxies, got: %d", len(f.proxies))
+	}
+	for _, p := range f.proxies[:2] {
+		if p.weight != 3 || p.maxfails != 5 || !p.ownMaxfails || p.host.tag != "dc1" {
+			t.Errorf("Expected options to apply to %s, got weight %d, max_fails %d, tag %q", p.host.addr, p.weight, p.maxfails, p.host.tag)
+		}
+	}
+	if s := f.proxies[0].host.String(); s != "10.0.0.1:53 [dc1]" {
+		t.Errorf("Expected the tag in the name, got: %s", s)
+	}
+	p := f.proxies[2]
+	if p.weight != 1 || p.ownMaxfails || !p.forceTCP {
+		t.Errorf("Expected defaults and force_tcp for %s", p.host.addr)
+	}
+	if p.host.tlsConfig.ServerName != "dns.example.org" {
+		t.Errorf("Expected servername %q, got: %q", "dns.example.org", p.host.tlsConfig.ServerName)
+	}
+	if f.tlsConfig.ServerName != "" {
+		t.Errorf("Expected the block's TLS config to be untouched, got: %q", f.tlsConfig.ServerName)
+	}
+
+	c = caddy.NewTestController("dns", `forward . "tls://9.9.9.9#dns.quad9.net" "tls://149.112.112.112:853#dns.quad9.net" "tls://1.1.1.1#cloudflare-dns.com"`)
+	if f, err = parseForward(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for i, want := range []string{"dns.quad9.net", "dns.quad9.net", "cloudflare-dns.com"} {
+		if s := f.proxies[i].host.tlsConfig.ServerName; s != want {
+			t.Errorf("Test %d: expected servername %q, got: %q", i, want, s)
+		}
+	}
+	if a := f.proxies[1].host.addr; a != "149.112.112.112:853" {
+		t.Errorf("Expected the name to be stripped from the address, got: %s", a)
+	}
+	for _, input := range []string{`forward . "tls://9.9.9.9#"`, `forward . "9.9.9.9#dns.quad9.net"`} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+
+	for _, input := range []string{"forward . weight=2 10.0.0.1", "forward . 10.0.0.1 color=blue", "forward . 10.0.0.1 weight=0"} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestSetupNamed(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 10.0.0.1 weight=2 10.0.0.2 {\nname fleet-test\n}\n")
+	if _, err := parseForward(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "forward . @fleet-test 10.0.0.3")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.proxies) != 3 {
+		t.Fatalf("Expected 3 proxies, got: %d", len(f.proxies))
+	}
+	if f.proxies[0].weight != 2 {
+		t.Errorf("Expected the options to come along, got weight: %d", f.proxies[0].weight)
+	}
+
+	c = caddy.NewTestController("dns", "forward . @unknown-test")
+	if _, err := parseForward(c); err == nil {
+		t.Error("Expected error for an unknown name")
+	}
+}
+
+func TestSetupLatencyBuckets(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nlatency_buckets 500us 1ms 2.5ms 1s\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := []float64{0.0005, 0.001, 0.0025, 1}; !reflect.DeepEqual(f.buckets, expected) {
+		t.Errorf("Expected buckets %v, got: %v", expected, f.buckets)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nlatency_buckets\n}\n",
+		"forward . 127.0.0.1 {\nlatency_buckets 1ms 1ms\n}\n",
+		"forward . 127.0.0.1 {\nlatency_buckets 0s 1ms\n}\n",
+		"forward . 127.0.0.1 {\nlatency_buckets 1\n}\n",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestSetBuckets(t *testing.T) {
+	rd, b, r := RequestDuration, buckets, registered
+	defer func() { RequestDuration, buckets, registered = rd, b, r }()
+
+	buckets, registered = nil, false
+	if err := setBuckets([]float64{0.001, 0.01}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if RequestDuration == rd {
+		t.Errorf("Expected RequestDuration to be replaced")
+	}
+	if err := setBuckets([]float64{0.001, 0.01}); err != nil {
+		t.Errorf("Expected no error for the same buckets, got: %v", err)
+	}
+	if err := setBuckets([]float64{0.002}); err == nil {
+		t.Errorf("Expected error for other buckets")
+	}
+
+	buckets, registered = nil, true
+	if err := setBuckets([]float64{0.001}); err == nil {
+		t.Errorf("Expected error after registration")
+	}
+}
+
+func TestSetupRetries(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nmax_retries 2\nquery_timeout 3s\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.maxRetries != 2 || f.queryTimeout != 3*time.Second {
+		t.Errorf("Expected 2 retries and a 3s query timeout, got: %d and %s", f.maxRetries, f.queryTimeout)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nmax_retries -1\n}\n",
+		"forward . 127.0.0.1 {\nmax_retries\n}\n",
+		"forward . 127.0.0.1 {\nquery_timeout 0s\n}\n",
+		"forward . 127.0.0.1 {\nquery_timeout 1s 2s\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSetupTimeouts(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\ndial_timeout 1s\nread_timeout 300ms\nwrite_timeout 100ms\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	h := f.proxies[0].host
+	if h.dialTimeout != time.Second || h.readTimeout != 300*time.Millisecond || h.writeTimeout != 100*time.Millisecond {
+		t.Errorf("Expected timeouts of 1s, 300ms and 100ms, got: %s, %s and %s", h.dialTimeout, h.readTimeout, h.writeTimeout)
+	}
+
+	f, err = parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	h = f.proxies[0].host
+	if h.dialTimeout != dialTimeout || h.readTimeout != timeout || h.writeTimeout != timeout {
+		t.Errorf("Expected the default timeouts, got: %s, %s and %s", h.dialTimeout, h.readTimeout, h.writeTimeout)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\ndial_timeout 0s\n}\n",
+		"forward . 127.0.0.1 {\nread_timeout -1s\n}\n",
+		"forward . 127.0.0.1 {\nwrite_timeout\n}\n",
+		"forward . 127.0.0.1 {\nread_timeout 1s 2s\n}\n",
+		"forward . 127.0.0.1 {\nread_timeout 100ms\nhedge 200ms\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSetupPreferUDP(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 127.0.0.2 {\nprefer_udp\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	for _, p := range f.proxies {
+		if !p.preferUDP {
+			t.Errorf("Expected %s to prefer UDP", p.host.addr)
+		}
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nprefer_udp yes\n}\n",
+		"forward . 127.0.0.1 {\nprefer_udp\nforce_tcp\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSetupMaxConcurrent(t *testing.T) {
+	tests := []struct {
+		input     string
+		max       int64
+		rcode     int
+		shouldErr bool
+	}{
+		{"forward . 127.0.0.1 {\nmax_concurrent 100\n}\n", 100, dns.RcodeRefused, false},
+		{"forward . 127.0.0.1 {\nmax_concurrent 10 SERVFAIL\n}\n", 10, dns.RcodeServerFailure, false},
+		{"forward . 127.0.0.1 {\nmax_concurrent 0\n}\n", 0, 0, true},
+		{"forward . 127.0.0.1 {\nmax_concurrent 10 NXDOMAIN\n}\n", 0, 0, true},
+		{"forward . 127.0.0.1 {\nmax_concurrent\n}\n", 0, 0, true},
+	}
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", tc.input))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if f.maxConcurrent != tc.max || f.rejectRcode != tc.rcode {
+			t.Errorf("Test %d: expected %d and %s, got: %d and %s", i, tc.max, dns.RcodeToString[tc.rcode], f.maxConcurrent, dns.RcodeToString[f.rejectRcode])
+		}
+	}
+}
+
+func TestSetupCookies(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 127.0.0.2 {\ncookies\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.proxies[0].host.cookie == nil || f.proxies[1].host.cookie == nil {
+		t.Fatal("Expected cookies for all upstreams")
+	}
+	if f.proxies[0].host.cookie.client == f.proxies[1].host.cookie.client {
+		t.Error("Expected each upstream to get its own client cookie")
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\ncookies yes\n}\n")); err == nil {
+		t.Error("Expected error for an argument to cookies")
+	}
+}
+
+func TestSetupMultiplex(t *testing.T) {
+	tests := []struct {
+		input     string
+		conns     int
+		shouldErr bool
+	}{
+		{"forward . 127.0.0.1\n", 0, false},
+		{"forward . 127.0.0.1 {\nmultiplex\n}\n", muxConns, false},
+		{"forward . 127.0.0.1 {\nmultiplex 8\n}\n", 8, false},
+		{"forward . 127.0.0.1 {\nmultiplex 0\n}\n", 0, true},
+		{"forward . 127.0.0.1 {\nmultiplex 1 2\n}\n", 0, true},
+	}
+	for i, test := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		p := f.proxies[0]
+		if test.conns == 0 {
+			if p.mux != nil {
+				t.Errorf("Test %d: expected no multiplexing", i)
+			}
+			continue
+		}
+		if p.mux == nil || p.mux.max != test.conns {
+			t.Errorf("Test %d: expected multiplexing over %d connections, got: %v", i, test.conns, p.mux)
+		}
+	}
+}
+
+func TestSetupEDNSKeepalive(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nedns_keepalive\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if !f.proxies[0].host.ednsKeepalive {
+		t.Error("Expected edns_keepalive to be set for the upstream")
+	}
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nedns_keepalive 10\n}\n")); err == nil {
+		t.Error("Expected error for an argument to edns_keepalive")
+	}
+}
+
+func TestSetupExpire(t *testing.T) {
+	f, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nexpire 20s\nexpire udp 5s\nexpire tls 1m\nmax_idle_conns 4\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	h := f.proxies[0].host
+	for proto, want := range map[string]time.Duration{"udp": 5 * time.Second, "tcp": 20 * time.Second, "tcp-tls": time.Minute} {
+		if d := h.idle(proto); d != want {
+			t.Errorf("Expected expire %s for %s, got: %s", want, proto, d)
+		}
+	}
+	if n := f.proxies[0].transport.maxIdle; n != 4 {
+		t.Errorf("Expected max_idle_conns 4, got: %d", n)
+	}
+
+	for _, input := range []string{
+		"forward . 127.0.0.1 {\nexpire quic 5s\n}\n",
+		"forward . 127.0.0.1 {\nexpire udp\n}\n",
+		"forward . 127.0.0.1 {\nexpire udp 5s 6s\n}\n",
+		"forward . 127.0.0.1 {\nmax_idle_conns -1\n}\n",
+	} {
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSetupDiscoveryOnly(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resolv := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(resolv, []byte("# no name servers yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . srv://_dns._udp.example.org {\nbootstrap 127.0.0.1\n}")); err != nil {
+		t.Errorf("Expected no error for a block with only srv://, got: %v", err)
+	}
+	if _, err := parseForward(caddy.NewTestController("dns", "forward .")); err == nil {
+		t.Errorf("Expected error for a block without upstreams")
+	}
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+resolv+" {\nhealth_check 0s\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error for an empty resolv.conf, got: %v", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.OnShutdown()
+
+	query := func() int {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := f.ServeDNS(context.Background(), rec, m)
+		if rec.Msg != nil {
+			return rec.Msg.Rcode
+		}
+		return rcode
+	}
+	if rcode := query(); rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL before an upstream is learned, got %s", dns.RcodeToString[rcode])
+	}
+	// As learnDHCP does when the file gets a name server.
+	f.setUpstreams(sourceResolvConf, []string{s.Addr}, nil)
+	if rcode := query(); rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR once an upstream is learned, got %s", dns.RcodeToString[rcode])
+	}
+}
@@ -0,0 +1,98 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// mismatchError is returned when a reply doesn't belong to the query we sent. On a connected socket
+// this is either a stale reply or a spoofing attempt. Replies from unexpected sources never reach us,
+// because the kernel filters them for connected sockets.
+type mismatchError struct {
+	reason string // "id" or "question"
+	reply  *dns.Msg
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("reply does not match query (%s): id %d", e.reason, e.reply.Id)
+}
+
+// checkReply returns an error if ret is not a reply to req.
+func checkReply(req, ret *dns.Msg) error {
+	if ret.Id != req.Id {
+		return &mismatchError{reason: "id", reply: ret}
+	}
+	if len(req.Question) == 0 {
+		return nil
+	}
+	if len(ret.Question) == 0 {
+		// Some servers don't copy the question for errors, e.g. FORMERR, accept those.
+		if ret.Rcode != dns.RcodeSuccess {
+			return nil
+		}
+		return &mismatchError{reason: "question", reply: ret}
+	}
+	q, r := req.Question[0], ret.Question[0]
+	if q.Qtype != r.Qtype || q.Qclass != r.Qclass || !strings.EqualFold(q.Name, r.Name) {
+		return &mismatchError{reason: "question", reply: ret}
+	}
+	return nil
+}
+
+// spoofed accounts for the mismatched reply in err.
+func (f *Forward) spoofed(state request.Request, p *Proxy, err *mismatchError) {
+	subnet := ""
+	if !f.privacy {
+		subnet = clientSubnet(state.IP())
+	}
+	SpoofCount.WithLabelValues(p.host.id, p.host.addr, subnet, err.reason).Add(1)
+
+	if f.spoofLog == 0 || atomic.AddUint64(&f.spoofSeen, 1)%f.spoofLog != 0 {
+		return
+	}
+	q := "<none>"
+	if len(err.reply.Question) > 0 {
+		r := err.reply.Question[0]
+		q = f.redact.name(r.Name) + " " + dns.Type(r.Qtype).String()
+	}
+	f.log.warning(f.id, "reply_mismatch", fmt.Sprintf("Discarded reply from %s for client %s: %s mismatch, query id %d %s, reply id %d %s",
+		p.host, f.redact.ip(state.IP()), err.reason, state.Req.Id, f.redact.name(state.Name()), err.reply.Id, q),
+		Field{"upstream", p.host.addr}, Field{"client", f.redact.ip(state.IP())}, Field{"reason", err.reason},
+		Field{"qid", state.Req.Id}, Field{"qname", f.redact.name(state.Name())}, Field{"reply_id", err.reply.Id}, Field{"reply_question", q})
+}
+
+// clientSubnet returns the /24 (IPv4) or /48 (IPv6) network of ip.
+func clientSubnet(ip string) string {
+	i := net.ParseIP(ip)
+	if i == nil {
+		return ""
+	}
+	if i4 := i.To4(); i4 != nil {
+		return (&net.IPNet{IP: i4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: i.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+type mismatchKey struct{}
+
+// mismatchContext returns a context in which the replies the proxies skip while waiting for the
+// reply to state are accounted for with spoofed.
+func (f *Forward) mismatchContext(ctx context.Context, state request.Request) context.Context {
+	return context.WithValue(ctx, mismatchKey{}, func(p *Proxy, err *mismatchError) { f.spoofed(state, p, err) })
+}
+
+// mismatchFromContext returns the function for p to pass skipped replies to, or nil.
+func mismatchFromContext(ctx context.Context, p *Proxy) func(*mismatchError) {
+	fn, ok := ctx.Value(mismatchKey{}).(func(*Proxy, *mismatchError))
+	if !ok {
+		return nil
+	}
+	return func(err *mismatchError) { fn(p, err) }
+}
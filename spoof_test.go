@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestCheckReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	ok := new(dns.Msg)
+	ok.SetReply(req)
+	ok.Question[0].Name = "ExAmPlE.org."
+
+	wrongID := ok.Copy()
+	wrongID.Id++
+
+	wrongType := ok.Copy()
+	wrongType.Question[0].Qtype = dns.TypeAAAA
+
+	tests := []struct {
+		ret    *dns.Msg
+		reason string
+	}{
+		{ok, ""},
+		{wrongID, "id"},
+		{wrongType, "question"},
+	}
+	for i, tc := range tests {
+		err := checkReply(req, tc.ret)
+		if tc.reason == "" {
+			if err != nil {
+				t.Errorf("Test %d: expected no error, got: %s", i, err)
+			}
+			continue
+		}
+		merr, isMismatch := err.(*mismatchError)
+		if !isMismatch || merr.reason != tc.reason {
+			t.Errorf("Test %d: expected %s mismatch, got: %v", i, tc.reason, err)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	if x := clientSubnet("10.1.2.3"); x != "10.1.2.0/24" {
+		t.Errorf("Expected 10.1.2.0/24, got: %s", x)
+	}
+	if x := clientSubnet("2001:db8:1:2::1"); x != "2001:db8:1::/48" {
+		t.Errorf("Expected 2001:db8:1::/48, got: %s", x)
+	}
+}
+
+func TestSkipMismatch(t *testing.T) {
+	// Every reply is preceded by one with the wrong ID, like a late reply to an earlier query.
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		stale := new(dns.Msg)
+		stale.SetReply(r)
+		stale.Id++
+		w.WriteMsg(stale)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr))
+	defer f.Close()
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, info, err := f.ForwardWithInfo(state)
+	if err != nil {
+		t.Fatalf("Expected to receive the matching reply, got: %s", err)
+	}
+	if resp.Id != state.Req.Id || len(resp.Answer) != 1 {
+		t.Errorf("Expected the matching reply, got: %s", resp)
+	}
+	if info.Attempts != 1 {
+		t.Errorf("Expected a single attempt, got: %d", info.Attempts)
+	}
+}
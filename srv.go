@@ -0,0 +1,123 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// srvUpstreams returns the names of the upstreams in to given as srv://NAME, and the others.
+func srvUpstreams(to []string) (names, rest []string) {
+	for _, t := range to {
+		if strings.HasPrefix(t, _srv+"://") {
+			names = append(names, dns.Fqdn(t[len(_srv)+3:]))
+			continue
+		}
+		rest = append(rest, t)
+	}
+	return names, rest
+}
+
+// lookupSRV returns the addresses, as host:port, of the targets of the SRV records of name with the
+// lowest priority, and their weights. The targets are resolved with b.
+func (b *bootstrap) lookupSRV(name string) ([]string, map[string]int, error) {
+	var (
+		srvs []*dns.SRV
+		err  error
+	)
+	for _, s := range b.servers {
+		if srvs, err = querySRV(s, name); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up %s: %s", name, err)
+	}
+	if len(srvs) == 0 {
+		return nil, nil, fmt.Errorf("no SRV records for %s", name)
+	}
+
+	lowest := srvs[0].Priority
+	for _, srv := range srvs {
+		if srv.Priority < lowest {
+			lowest = srv.Priority
+		}
+	}
+	var addrs []string
+	weights := make(map[string]int)
+	for _, srv := range srvs {
+		if srv.Priority != lowest {
+			continue
+		}
+		ips, err := b.resolve(strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			return nil, nil, err
+		}
+		a := net.JoinHostPort(ips[0], strconv.Itoa(int(srv.Port)))
+		if _, ok := weights[a]; ok {
+			continue
+		}
+		w := int(srv.Weight)
+		if w == 0 {
+			w = 1
+		}
+		addrs = append(addrs, a)
+		weights[a] = w
+	}
+	return addrs, weights, nil
+}
+
+// querySRV asks server for the SRV records of name.
+func querySRV(server, name string) ([]*dns.SRV, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSRV)
+	c := &dns.Client{Timeout: dialTimeout}
+	ret, _, err := c.Exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Rcode != dns.RcodeSuccess && ret.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s from %s", rcodeString(ret.Rcode), server)
+	}
+	var srvs []*dns.SRV
+	for _, rr := range ret.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, srv)
+		}
+	}
+	return srvs, nil
+}
+
+// learnSRV makes the targets of the SRV records of the srv:// upstreams the upstreams learned from
+// them. When a lookup fails the upstreams learned earlier are kept.
+func (f *Forward) learnSRV() {
+	for _, name := range f.srv {
+		addrs, weights, err := f.bootstrap.lookupSRV(name)
+		if err != nil {
+			f.log.warning(f.id, "srv_failed", fmt.Sprintf("Keeping the upstreams of %s: %s", name, err),
+				Field{"name", name}, Field{"error", err})
+			continue
+		}
+		f.setUpstreams(_srv+"://"+name, addrs, weights)
+	}
+}
+
+// watchSRV looks up the srv:// upstreams every srvPoll, until stop is closed.
+func (f *Forward) watchSRV(stop <-chan struct{}) {
+	tick := time.NewTicker(srvPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			f.learnSRV()
+		case <-stop:
+			return
+		}
+	}
+}
+
+const srvPoll = 30 * time.Second
@@ -0,0 +1,79 @@
+package forward
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestSRVUpstreams(t *testing.T) {
+	var second int32 // set to 1 to change the SRV answer
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch r.Question[0].Name {
+		case "_dns._udp.resolvers.example.":
+			if atomic.LoadInt32(&second) == 0 {
+				ret.Answer = append(ret.Answer,
+					test.SRV("_dns._udp.resolvers.example. 60 IN SRV 10 3 5353 ns1.resolvers.example."),
+					test.SRV("_dns._udp.resolvers.example. 60 IN SRV 10 1 53 ns2.resolvers.example."),
+					test.SRV("_dns._udp.resolvers.example. 60 IN SRV 20 1 53 ns3.resolvers.example."))
+			} else {
+				ret.Answer = append(ret.Answer,
+					test.SRV("_dns._udp.resolvers.example. 60 IN SRV 10 5 5353 ns1.resolvers.example."))
+			}
+		case "ns1.resolvers.example.":
+			if r.Question[0].Qtype == dns.TypeA {
+				ret.Answer = append(ret.Answer, test.A("ns1.resolvers.example. 60 IN A 10.0.0.1"))
+			}
+		case "ns2.resolvers.example.":
+			if r.Question[0].Qtype == dns.TypeA {
+				ret.Answer = append(ret.Answer, test.A("ns2.resolvers.example. 60 IN A 10.0.0.2"))
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . srv://_dns._udp.resolvers.example {\nbootstrap "+s.Addr+"\nhealth_check 0s\n}")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.OnShutdown()
+
+	weights := func() map[string]int {
+		w := make(map[string]int)
+		for _, p := range f.snapshot() {
+			w[p.host.addr] = p.weight
+		}
+		return w
+	}
+	// ns3 has a higher priority value and isn't used.
+	if w := weights(); !reflect.DeepEqual(w, map[string]int{"10.0.0.1:5353": 3, "10.0.0.2:53": 1}) {
+		t.Fatalf("Expected the targets with the lowest priority and their weights, got: %v", w)
+	}
+
+	atomic.StoreInt32(&second, 1)
+	f.learnSRV()
+	if w := weights(); !reflect.DeepEqual(w, map[string]int{"10.0.0.1:5353": 5}) {
+		t.Errorf("Expected the upstreams to follow the SRV records, got: %v", w)
+	}
+	if p := f.snapshot()[0]; p.Down(f.maxfails) {
+		t.Errorf("Expected %s to stay up when its weight changes", p.host.addr)
+	}
+
+	c = caddy.NewTestController("dns", "forward . srv://_dns._udp.resolvers.example")
+	if _, err := parseForward(c); err == nil {
+		t.Error("Expected error for an srv:// upstream without bootstrap resolver")
+	}
+}
@@ -0,0 +1,143 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// stamp is a decoded DNS stamp, https://dnscrypt.info/stamps-specifications.
+type stamp struct {
+	proto  byte
+	props  uint64
+	addr   string
+	hashes [][]byte // SHA256 digests of TBS certificates, one must be in the chain
+	host   string   // TLS server name
+}
+
+// Stamp protocol identifiers.
+const (
+	stampPlain    = 0x00
+	stampDNSCrypt = 0x01
+	stampDoH      = 0x02
+	stampDoT      = 0x03
+	stampDoQ      = 0x04
+)
+
+var stampProtos = map[byte]string{stampPlain: "plain DNS", stampDNSCrypt: "DNSCrypt", stampDoH: "DNS-over-HTTPS", stampDoT: "DNS-over-TLS", stampDoQ: "DNS-over-QUIC"}
+
+// decodeStamp decodes the sdns:// stamp in s.
+func decodeStamp(s string) (*stamp, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, _sdns+"://"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, err)
+	}
+	if len(b) < 9 {
+		return nil, fmt.Errorf("invalid stamp %s: too short", s)
+	}
+	st := &stamp{proto: b[0], props: binary.LittleEndian.Uint64(b[1:9])}
+	r := bytes.NewReader(b[9:])
+
+	if st.proto != stampPlain && st.proto != stampDoT {
+		name, ok := stampProtos[st.proto]
+		if !ok {
+			name = fmt.Sprintf("protocol %d", st.proto)
+		}
+		return nil, fmt.Errorf("stamp %s is for %s, which is not supported", s, name)
+	}
+
+	addr, err := readLP(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, err)
+	}
+	st.addr = string(addr)
+	if st.proto == stampPlain {
+		return st, nil
+	}
+
+	if st.hashes, err = readVLP(r); err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, err)
+	}
+	host, err := readLP(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, err)
+	}
+	st.host = string(host)
+	return st, nil
+}
+
+// upstream returns the stamp as an upstream in the TO syntax.
+func (st *stamp) upstream() (string, error) {
+	addr := st.addr
+	if addr == "" {
+		if st.proto != stampDoT || st.host == "" {
+			return "", fmt.Errorf("stamp without an address")
+		}
+		return _tls + "://" + st.host, nil // resolved with the bootstrap resolvers
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1] // IPv6 without a port
+	}
+	if st.proto == stampDoT {
+		return _tls + "://" + addr, nil
+	}
+	return _dns + "://" + addr, nil
+}
+
+// readLP reads a length prefixed string.
+func readLP(r *bytes.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil || r.Len() < int(n) {
+		return nil, errStampShort
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
+
+// readVLP reads a set of length prefixed strings, the high bit of the length means another follows.
+func readVLP(r *bytes.Reader) ([][]byte, error) {
+	var set [][]byte
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, errStampShort
+		}
+		if r.Len() < int(n&0x7f) {
+			return nil, errStampShort
+		}
+		b := make([]byte, n&0x7f)
+		if len(b) > 0 {
+			r.Read(b)
+			set = append(set, b)
+		}
+		if n&0x80 == 0 {
+			return set, nil
+		}
+	}
+}
+
+var errStampShort = errors.New("truncated")
+
+// verifyHashes returns a function for tls.Config.VerifyPeerCertificate that checks one of the
+// certificates in the verified chains has a TBS certificate with one of the SHA256 hashes.
+func verifyHashes(hashes [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawTBSCertificate)
+				for _, h := range hashes {
+					if bytes.Equal(sum[:], h) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no certificate matches the hashes from the stamp")
+	}
+}
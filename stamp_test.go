@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// makeStamp returns a DoT stamp for addr and host with hash.
+func makeStamp(proto byte, addr, host string, hash []byte) string {
+	b := []byte{proto, 0, 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, byte(len(addr)))
+	b = append(b, addr...)
+	if proto == stampDoT {
+		b = append(b, byte(len(hash)))
+		b = append(b, hash...)
+		b = append(b, byte(len(host)))
+		b = append(b, host...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestSetupStamp(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xaa}, 32)
+	input := "forward . " + makeStamp(stampDoT, "9.9.9.9", "dns.quad9.net", hash) + " " + makeStamp(stampPlain, "[2001:db8::1]", "", nil)
+	c := caddy.NewTestController("dns", input)
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.proxies) != 2 {
+		t.Fatalf("Expected 2 proxies, got: %d", len(f.proxies))
+	}
+
+	dot := f.proxies[0]
+	if dot.host.addr != "9.9.9.9:853" || dot.host.tlsConfig == nil {
+		t.Errorf("Expected a TLS upstream at 9.9.9.9:853, got: %s", dot.host.addr)
+	}
+	if dot.host.tlsConfig.ServerName != "dns.quad9.net" || dot.host.tlsConfig.VerifyPeerCertificate == nil {
+		t.Errorf("Expected the server name and hashes from the stamp")
+	}
+	if plain := f.proxies[1]; plain.host.addr != "[2001:db8::1]:53" || plain.host.tlsConfig != nil {
+		t.Errorf("Expected a plain upstream at [2001:db8::1]:53, got: %s", plain.host.addr)
+	}
+
+	for _, input := range []string{
+		"forward . " + makeStamp(stampDoH, "9.9.9.9", "", nil),
+		"forward . " + makeStamp(stampDoT, "", "dns.quad9.net", hash),
+		"forward . sdns://AwAAAA",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package forward
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SwapProxy replaces the proxy for address from with a new one for address to, i.e. when re-resolution
+// of an upstream yields a new IP. The new proxy inherits the settings of the old one, it is health
+// checked and a connection is dialed before it receives traffic. Only then is the old proxy removed from
+// rotation, it is closed after its in-flight exchanges are done. If the new proxy can't be brought up
+// within warmTimeout, an error is returned and the old one is kept.
+func (f *Forward) SwapProxy(from, to string) error {
+	var old *Proxy
+	for _, p := range f.snapshot() {
+		if p.host.addr == from {
+			old = p
+			break
+		}
+	}
+	if old == nil {
+		return fmt.Errorf("no proxy for %s", from)
+	}
+
+	p := old.clone(to)
+	if p.hcInterval > 0 && !p.warm(warmTimeout) {
+		p.close()
+		return fmt.Errorf("proxy for %s did not come up within %s", to, warmTimeout)
+	}
+
+	f.Lock()
+	proxies := make([]*Proxy, 0, len(f.proxies))
+	for _, q := range f.proxies {
+		if q != old {
+			proxies = append(proxies, q)
+		}
+	}
+	f.proxies = append(proxies, p)
+	f.swapRoutes(from, to)
+	f.Unlock()
+
+	InstanceInfo.WithLabelValues(f.id, to, p.host.tag).Set(1)
+	InstanceInfo.DeleteLabelValues(f.id, from, old.host.tag)
+
+	if p.hcInterval > 0 {
+		p.startHealthCheck()
+	} else {
+		p.host.resetFails()
+	}
+	go old.drain(drainTimeout)
+
+	return nil
+}
+
+// addClone adds a proxy for address to with the settings of p, which also takes the routes of p. As
+// with SwapProxy, it's health checked before it receives traffic.
+func (f *Forward) addClone(p *Proxy, to string) error {
+	n := p.clone(to)
+	if n.hcInterval > 0 && !n.warm(warmTimeout) {
+		n.close()
+		return fmt.Errorf("proxy for %s did not come up within %s", to, warmTimeout)
+	}
+
+	f.Lock()
+	f.proxies = append(f.proxies[:len(f.proxies):len(f.proxies)], n)
+	f.copyRoutes(p.host.addr, to)
+	f.Unlock()
+
+	InstanceInfo.WithLabelValues(f.id, to, n.host.tag).Set(1)
+	if n.hcInterval > 0 {
+		n.startHealthCheck()
+	} else {
+		n.host.resetFails()
+	}
+	return nil
+}
+
+// clone returns a new proxy for addr with the same settings as p.
+func (p *Proxy) clone(addr string) *Proxy {
+	n := NewProxy(addr)
+	n.host.id = p.host.id
+	n.host.exporter = p.host.exporter
+	n.host.log = p.host.log
+	n.host.probe = p.host.probe
+	n.host.hc = p.host.hc
+	n.host.checker = p.host.checker
+	if _, ok := p.host.checker.(*tcpCheck); ok {
+		n.host.checker = &tcpCheck{n.host}
+	}
+	n.host.rise = p.host.rise
+	if p.host.cookie != nil {
+		n.host.cookie = newCookie()
+	}
+	if p.mux != nil {
+		n.mux = newMux(n.host, p.mux.max)
+	}
+	n.host.ednsKeepalive = p.host.ednsKeepalive
+	n.host.padding = p.host.padding
+	n.host.proxyProtocol = p.host.proxyProtocol
+	n.host.randomCase = p.host.randomCase
+	n.host.servfails = p.host.servfails.clone()
+	n.host.failWindow = p.host.failWindow
+	if p.host.chain != nil {
+		n.host.chain = &fallback{protos: p.host.chain.protos}
+	}
+	if p.host.exch != nil {
+		n.host.exch = p.host.exch.clone()
+	}
+	n.host.tlsConfig = p.host.tlsConfig
+	n.host.expire = p.host.expire
+	n.host.protoExpire = p.host.protoExpire
+	n.transport.maxIdle = p.transport.maxIdle
+	n.SetTimeouts(p.host.dialTimeout, p.host.readTimeout, p.host.writeTimeout)
+	n.host.bind = p.host.bind
+	n.host.via = p.host.via
+	n.host.dialer = p.host.dialer
+	n.host.meter = newMeter(p.host.meter.window())
+	n.group = p.group
+	n.backup = p.backup
+	n.host.tag = p.host.tag
+	n.weight = p.weight
+	n.maxfails, n.ownMaxfails = p.maxfails, p.ownMaxfails
+	n.limit, n.ownLimit = p.limit.clone(), p.ownLimit
+	n.tlsServerName = p.tlsServerName
+	n.tlsHashes = p.tlsHashes
+	n.tlsCA = p.tlsCA
+	n.tlsCert = p.tlsCert
+	n.preferUDP = p.preferUDP
+	n.stateless = p.stateless
+	n.noPoolUDP = p.noPoolUDP
+	n.warmConns = p.warmConns
+	n.mdns = p.mdns
+	n.hostname = p.hostname
+	n.source = p.source
+	n.hcInterval, n.ownHcInterval = p.hcInterval, p.ownHcInterval
+	n.hcBackoff = p.hcBackoff
+	n.hcJitter = p.hcJitter
+	n.hcSkipActive = p.hcSkipActive
+	n.forceTCP = p.forceTCP
+	n.transport.maxMem = p.transport.maxMem
+	p.maint.Lock()
+	n.maint.windows = p.maint.windows
+	p.maint.Unlock()
+	return n
+}
+
+// warm health checks p until the check succeeds and then dials a connection to have it cached. It
+// returns false if p isn't healthy after timeout.
+func (p *Proxy) warm(timeout time.Duration) bool {
+	p.setHealthClient()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		p.host.Check()
+		if atomic.LoadUint32(&p.host.fails) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(p.hcInterval)
+	}
+
+	if p.host.exch != nil {
+		return true // the exchanger has connected for the health check
+	}
+	if c, err := p.Dial(p.defaultProto()); err == nil {
+		p.Yield(c)
+	}
+	return true
+}
+
+// defaultProto returns the transport p uses for clients that come in over UDP.
+func (p *Proxy) defaultProto() string {
+	if p.host.exch != nil {
+		return p.host.exch.proto()
+	}
+	if p.host.chain != nil {
+		return p.host.chain.current()
+	}
+	if p.host.tlsConfig != nil {
+		return "tcp-tls"
+	}
+	if p.forceTCP {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// drain waits until p has no exchanges in progress, or timeout has passed, and then closes it.
+func (p *Proxy) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&p.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.close()
+}
+
+const (
+	warmTimeout  = 5 * time.Second
+	drainTimeout = 2 * timeout
+)
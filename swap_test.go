@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestSwapProxy(t *testing.T) {
+	s1 := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s1.Close()
+	s2 := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+	defer s2.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s1.Addr))
+	defer f.Close()
+
+	if err := f.SwapProxy("127.0.0.1:1", s2.Addr); err == nil {
+		t.Errorf("Expected error when swapping unknown proxy, got none")
+	}
+	if err := f.SwapProxy(s1.Addr, s2.Addr); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if f.Len() != 1 {
+		t.Errorf("Expected 1 proxy, got: %d", f.Len())
+	}
+
+	state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	state.Req.SetQuestion("example.org.", dns.TypeA)
+	resp, err := f.Forward(state)
+	if err != nil {
+		t.Fatal("Expected to receive reply, but didn't")
+	}
+	if len(resp.Answer) == 0 {
+		t.Fatalf("Expected to at least one RR in the answer section, got none: %s", resp)
+	}
+	if resp.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Expected 127.0.0.2, got: %s", resp.Answer[0].(*dns.A).A.String())
+	}
+}
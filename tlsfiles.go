@@ -0,0 +1,146 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certFile is a client certificate and key loaded from files. They are loaded again for a handshake
+// when one of the files changed, so certificates can be rotated without a reload.
+type certFile struct {
+	cert, key string
+
+	sync.Mutex
+	loaded *tls.Certificate
+	mod    time.Time // of the newest of the files when they were loaded
+}
+
+// newCertFile returns the certFile for cert and key, the files must be usable now.
+func newCertFile(cert, key string) (*certFile, error) {
+	c := &certFile{cert: cert, key: key}
+	if _, err := c.get(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns the certificate, for tls.Config.GetClientCertificate. When the files changed but can't
+// be loaded, e.g. because only one of them was written yet, the certificate loaded earlier is used.
+func (c *certFile) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	mod, err := modTime(c.cert, c.key)
+	c.Lock()
+	defer c.Unlock()
+	if err == nil && mod.After(c.mod) {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(c.cert, c.key); err == nil {
+			c.loaded, c.mod = &cert, mod
+		}
+	}
+	if c.loaded == nil {
+		return nil, fmt.Errorf("failed to load client certificate %s: %s", c.cert, err)
+	}
+	return c.loaded, nil
+}
+
+// caFile is a bundle of CA certificates loaded from a file, it's loaded again for a handshake when
+// the file changed.
+type caFile struct {
+	file string
+
+	sync.Mutex
+	pool *x509.CertPool
+	mod  time.Time
+}
+
+// newCAFile returns the caFile for file, the file must be usable now.
+func newCAFile(file string) (*caFile, error) {
+	ca := &caFile{file: file}
+	if _, err := ca.roots(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// roots returns the CA certificates. When the file changed but can't be loaded, the certificates
+// loaded earlier are returned.
+func (ca *caFile) roots() (*x509.CertPool, error) {
+	mod, err := modTime(ca.file)
+	ca.Lock()
+	defer ca.Unlock()
+	if err == nil && mod.After(ca.mod) {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(ca.file); err == nil {
+			pool := x509.NewCertPool()
+			if pool.AppendCertsFromPEM(pem) {
+				ca.pool, ca.mod = pool, mod
+			} else {
+				err = errors.New("no certificates found")
+			}
+		}
+	}
+	if ca.pool == nil {
+		return nil, fmt.Errorf("failed to load CA certificates %s: %s", ca.file, err)
+	}
+	return ca.pool, nil
+}
+
+// verify returns a function for tls.Config.VerifyPeerCertificate that verifies the certificate of
+// the upstream for name with the current CA certificates, and then calls next, if not nil, with the
+// verified chains. It must be used with InsecureSkipVerify, as the roots of the tls.Config can't
+// change.
+func (ca *caFile) verify(name string, next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if name == "" {
+			return errors.New("no server name to verify the certificate for")
+		}
+		if len(raw) == 0 {
+			return errors.New("no certificate from the upstream")
+		}
+		roots, err := ca.roots()
+		if err != nil {
+			return err
+		}
+		opts := x509.VerifyOptions{Roots: roots, DNSName: name, Intermediates: x509.NewCertPool()}
+		var leaf *x509.Certificate
+		for i, r := range raw {
+			cert, err := x509.ParseCertificate(r)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+				continue
+			}
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := leaf.Verify(opts)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return next(raw, chains)
+		}
+		return nil
+	}
+}
+
+// modTime returns the modification time of the newest of files.
+func modTime(files ...string) (time.Time, error) {
+	var mod time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
@@ -0,0 +1,339 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key signed by ca, for the server name if it's not empty and for a
+// client otherwise.
+func (ca *testCA) issue(t *testing.T, serial int64, name string) (certPEM, keyPEM []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if name != "" {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+// mutualTLSServer answers DNS queries over TLS from clients with a certificate signed by ca. The serial
+// of the last client certificate is stored in serial.
+func mutualTLSServer(t *testing.T, ca *testCA, serial *int64) (addr string, stop func()) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return tlsServer(t, ca, &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		// A resumed session keeps the client certificate of the first handshake.
+		SessionTicketsDisabled: true,
+	}, serial)
+}
+
+// tlsServer answers DNS queries over TLS with cfg and a certificate for dns.test signed by ca. The
+// serial of the last client certificate, if any, is stored in serial.
+func tlsServer(t *testing.T, ca *testCA, cfg *tls.Config, serial *int64) (addr string, stop func()) {
+	certPEM, keyPEM := ca.issue(t, 2, "dns.test")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				tc := c.(*tls.Conn)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+					atomic.StoreInt64(serial, certs[0].SerialNumber.Int64())
+				}
+				co := &dns.Conn{Conn: tc}
+				for {
+					r, err := co.ReadMsg()
+					if err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(r)
+					co.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func writeFile(t *testing.T, name string, data []byte, mod time.Time) {
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, mod, mod)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	var serial int64
+	addr, stop := mutualTLSServer(t, ca, &serial)
+	defer stop()
+
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	certPEM, keyPEM := ca.issue(t, 10, "")
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+
+	c := caddy.NewTestController("dns", "forward . tls://"+addr+" {\ntls "+certFile+" "+keyFile+" "+caFile+"\ntls_servername dns.test\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+
+	query := func() error {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		_, err := p.connect(context.Background(), state, false, false)
+		return err
+	}
+	if err := query(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if s := atomic.LoadInt64(&serial); s != 10 {
+		t.Errorf("Expected the client certificate with serial 10, got: %d", s)
+	}
+
+	// A rotated certificate is used for the next connection.
+	certPEM, keyPEM = ca.issue(t, 11, "")
+	later := time.Now().Add(time.Minute)
+	writeFile(t, certFile, certPEM, later)
+	writeFile(t, keyFile, keyPEM, later)
+	p.Reset()
+	if err := query(); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if s := atomic.LoadInt64(&serial); s != 11 {
+		t.Errorf("Expected the rotated client certificate with serial 11, got: %d", s)
+	}
+
+	// Without a client certificate the upstream refuses us.
+	c = caddy.NewTestController("dns", "forward . tls://"+addr+" {\ntls "+caFile+"\ntls_servername dns.test\n}\n")
+	if f, err = parseForward(c); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p = f.proxies[0]
+	defer p.close()
+	if err := query(); err == nil {
+		t.Error("Expected an error without a client certificate")
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newTestCA(t), newTestCA(t)
+	var serial int64
+	addr, stop := mutualTLSServer(t, ca, &serial)
+	defer stop()
+
+	caFile, otherFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "other.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	writeFile(t, otherFile, other.pem, time.Now())
+	certPEM, keyPEM := ca.issue(t, 10, "")
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"tls://" + addr + " tls_ca=" + caFile + " {\ntls " + certFile + " " + keyFile + " " + otherFile + "\n", true},
+		{"tls://" + addr + " tls_ca=" + otherFile + " {\ntls " + certFile + " " + keyFile + " " + caFile + "\n", false},
+		{"tls://" + addr + " tls_servername=other.test {\ntls " + certFile + " " + keyFile + " " + caFile + "\n", false},
+	}
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", "forward . "+tc.input+"tls_servername dns.test\n}\n"))
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		p := f.proxies[0]
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		_, err = p.connect(context.Background(), state, false, false)
+		p.close()
+		if tc.ok && err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("Test %d: expected the certificate of the upstream not to verify", i)
+		}
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . tls://"+addr+" tls_ca="+filepath.Join(dir, "missing.pem")+"\n")); err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+}
+
+func TestTLSResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	var serial int64
+	addr, stop := tlsServer(t, ca, new(tls.Config), &serial)
+	defer stop()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . tls://"+addr+" {\ntls "+caFile+"\ntls_servername dns.test\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+
+	for i := 0; i < 3; i++ {
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		if _, err := p.connect(context.Background(), state, false, false); err != nil {
+			t.Fatalf("Expected no error, got: %s", err)
+		}
+		p.Reset() // the next query needs a new connection
+	}
+
+	if n := counterValue(TLSHandshakeCount, p.host.id, addr, "false"); n != 1 {
+		t.Errorf("Expected 1 full handshake, got: %f", n)
+	}
+	if n := counterValue(TLSHandshakeCount, p.host.id, addr, "true"); n != 2 {
+		t.Errorf("Expected 2 resumed handshakes, got: %f", n)
+	}
+}
+
+func TestTLSPerUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	var serial int64
+	addr, stop := mutualTLSServer(t, ca, &serial)
+	defer stop()
+
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	otherCert, otherKey := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	certPEM, keyPEM := ca.issue(t, 10, "")
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	certPEM, keyPEM = ca.issue(t, 20, "")
+	writeFile(t, otherCert, certPEM, time.Now())
+	writeFile(t, otherKey, keyPEM, time.Now())
+
+	input := "forward . \"tls://" + addr + "#dns.test\" tls_cert=" + otherCert + "," + otherKey + " tls://" + addr + " {\ntls " + certFile + " " + keyFile + " " + caFile + "\ntls_servername dns.test\n}\n"
+	f, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	for i, want := range []int64{20, 10} {
+		p := f.proxies[i]
+		state := request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+		state.Req.SetQuestion("example.org.", dns.TypeA)
+		_, err := p.connect(context.Background(), state, false, false)
+		p.close()
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if s := atomic.LoadInt64(&serial); s != want {
+			t.Errorf("Test %d: expected the client certificate with serial %d, got: %d", i, want, s)
+		}
+	}
+	if f.tlsConfig.GetClientCertificate == nil {
+		t.Error("Expected the block's client certificate to be untouched")
+	}
+
+	if _, err := parseForward(caddy.NewTestController("dns", "forward . tls://"+addr+" tls_cert="+otherCert+"\n")); err == nil {
+		t.Error("Expected an error for tls_cert without a key")
+	}
+}
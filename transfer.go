@@ -0,0 +1,132 @@
+package forward
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// isTransfer returns true if state asks for a zone transfer that's streamed: AXFR or IXFR over TCP. An
+// IXFR over UDP is forwarded like any other query, the client retries over TCP if it's truncated.
+func isTransfer(state request.Request) bool {
+	qtype := state.QType()
+	return (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR) && state.Proto() == "tcp"
+}
+
+// transfer relays the zone transfer of state from the first upstream that is up, writing each message
+// to w as it comes in. Until the first message is written the next upstream is tried when one fails;
+// after that an error ends the transfer, and the client retries it.
+func (f *Forward) transfer(ctx context.Context, w dns.ResponseWriter, state request.Request) (int, error) {
+	list := f.routed(state)
+	if list == nil {
+		list = f.list(state)
+	}
+	err := errNoHealthy
+	for _, p := range list {
+		if p.mdns != nil || p.host.exch != nil || p.Down(f.maxfails) {
+			continue // those can't stream messages
+		}
+		var started bool
+		started, err = p.transfer(ctx, w, state)
+		if err == nil {
+			return 0, nil
+		}
+		f.log.warning(f.id, "transfer_failed", fmt.Sprintf("Zone transfer of %s from %s failed: %s", state.Name(), p.host, err),
+			Field{"upstream", p.host.addr}, Field{"zone", state.Name()}, Field{"error", err})
+		if started {
+			return 0, nil // the reply is partly written, nothing else can be
+		}
+	}
+	return dns.RcodeServerFailure, err
+}
+
+// transfer sends the transfer request of state to p over a TCP or TLS connection and writes the
+// messages of the reply to w until the transfer is done. It returns true if it wrote any.
+func (p *Proxy) transfer(ctx context.Context, w dns.ResponseWriter, state request.Request) (bool, error) {
+	start := time.Now()
+	proto := p.proto(state, true)
+	if proto == "udp" {
+		proto = "tcp"
+	}
+	conn, err := p.dialFor(ctx, state, proto)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close() // the end of a transfer is no place to leave a connection for the next query
+
+	conn.SetWriteDeadline(attemptDeadline(ctx, p.host.writeTimeout))
+	if err := writeMsg(conn, state.Req); err != nil {
+		return false, ctxErr(ctx, err)
+	}
+	end := &xfrEnd{}
+	for n := 0; ; n++ {
+		conn.SetReadDeadline(attemptDeadline(ctx, p.host.readTimeout))
+		ret, err := readMsg(conn)
+		if err != nil {
+			return n > 0, ctxErr(ctx, err)
+		}
+		// Only the first message must have the question.
+		if n == 0 {
+			if err := checkReply(state.Req, ret); err != nil {
+				return false, err
+			}
+		} else if ret.Id != state.Req.Id {
+			return true, &mismatchError{reason: "id", reply: ret}
+		}
+		if err := w.WriteMsg(ret); err != nil {
+			return true, err
+		}
+		if n == 0 {
+			p.host.request(rcodeString(ret.Rcode), time.Since(start))
+		}
+		if ret.Rcode != dns.RcodeSuccess || end.done(state.Req, ret) {
+			return true, nil
+		}
+	}
+}
+
+// xfrEnd finds the end of an AXFR or IXFR reply, as miekg/dns does when it transfers a zone in: an
+// AXFR ends with the SOA it started with, an incremental IXFR with that SOA the third time.
+type xfrEnd struct {
+	started bool
+	serial  uint32 // serial of the first SOA, the upstream's current one
+	incr    bool   // the IXFR reply is incremental, not a full zone
+	seen    int    // times the first SOA was seen
+}
+
+// done returns true if m is the last message of the reply to req.
+func (x *xfrEnd) done(req, m *dns.Msg) bool {
+	if !x.started {
+		x.started = true
+		if len(m.Answer) == 0 {
+			return true // not a transfer, e.g. an error without the rcode to say so
+		}
+		soa, ok := m.Answer[0].(*dns.SOA)
+		if !ok {
+			return true
+		}
+		x.serial = soa.Serial
+		if len(m.Answer) == 1 && req.Question[0].Qtype == dns.TypeIXFR {
+			return true // the zone didn't change
+		}
+	}
+	for _, rr := range m.Answer {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Serial != x.serial {
+			x.incr = req.Question[0].Qtype == dns.TypeIXFR
+			continue
+		}
+		x.seen++
+		if (!x.incr && x.seen == 2) || x.seen == 3 {
+			return true
+		}
+	}
+	return false
+}
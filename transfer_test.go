@@ -0,0 +1,128 @@
+package forward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// xfrWriter is a TCP client that keeps all messages written to it.
+type xfrWriter struct {
+	test.ResponseWriter
+	msgs []*dns.Msg
+}
+
+func (w *xfrWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.240.0.1"), Port: 40212}
+}
+
+func (w *xfrWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func TestTransfer(t *testing.T) {
+	var notifyOPT int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Opcode == dns.OpcodeNotify {
+			if r.IsEdns0() != nil {
+				atomic.StoreInt32(&notifyOPT, 1)
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+			return
+		}
+		if _, tcp := w.RemoteAddr().(*net.TCPAddr); !tcp || r.Question[0].Qtype != dns.TypeAXFR {
+			ret := new(dns.Msg)
+			ret.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(ret)
+			return
+		}
+		soa := test.SOA("example.org. 300 IN SOA ns.example.org. admin.example.org. 2024010101 7200 3600 1209600 300")
+		for _, rrs := range [][]dns.RR{
+			{soa, test.A("a.example.org. 300 IN A 127.0.0.1")},
+			{test.A("b.example.org. 300 IN A 127.0.0.2")},
+			{soa},
+		} {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = rrs
+			w.WriteMsg(ret)
+		}
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\necs add\ncoalesce\nopcodes QUERY NOTIFY\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	f.proxies[0].host.resetFails()
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	w := &xfrWriter{}
+	if _, err := f.ServeDNS(context.TODO(), w, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if len(w.msgs) != 3 {
+		t.Fatalf("Expected the 3 messages of the transfer, got %d", len(w.msgs))
+	}
+	if last := w.msgs[2]; len(last.Answer) != 1 || last.Answer[0].Header().Rrtype != dns.TypeSOA || last.Id != m.Id {
+		t.Errorf("Expected the transfer to end with the SOA, got: %s", last)
+	}
+
+	n := new(dns.Msg)
+	n.SetNotify("example.org.")
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, n); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if rec.Msg == nil || rec.Msg.Opcode != dns.OpcodeNotify || rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the NOTIFY to be acknowledged, got: %v", rec.Msg)
+	}
+	if atomic.LoadInt32(&notifyOPT) != 0 {
+		t.Errorf("Expected the NOTIFY to be forwarded without an added OPT RR")
+	}
+}
+
+func TestXfrEnd(t *testing.T) {
+	soa := func(serial uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: serial}
+	}
+	a := test.A("a.example.org. 300 IN A 127.0.0.1")
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("example.org.", 1, "ns.example.org.", "admin.example.org.")
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.org.")
+
+	tests := []struct {
+		req  *dns.Msg
+		msgs [][]dns.RR
+		done int // index of the message that ends the transfer
+	}{
+		{axfr, [][]dns.RR{{soa(3), a, soa(3)}}, 0},
+		{axfr, [][]dns.RR{{soa(3), a}, {a}, {soa(3)}}, 2},
+		{ixfr, [][]dns.RR{{soa(3)}}, 0},
+		{ixfr, [][]dns.RR{{soa(3), a}, {soa(3)}}, 1},                                         // a full zone
+		{ixfr, [][]dns.RR{{soa(3), soa(1), a, soa(2)}, {a, soa(2), soa(3), a}, {soa(3)}}, 2}, // two increments
+	}
+	for i, tc := range tests {
+		x := &xfrEnd{}
+		for j, rrs := range tc.msgs {
+			m := new(dns.Msg)
+			m.Answer = rrs
+			if done := x.done(tc.req, m); done != (j == tc.done) {
+				t.Errorf("Test %d: expected message %d to end the transfer: %t, got %t", i, j, j == tc.done, done)
+			}
+		}
+	}
+}
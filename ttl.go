@@ -0,0 +1,22 @@
+package forward
+
+import "github.com/miekg/dns"
+
+// clampTTL raises the TTLs of the records in all sections of m to at least min and lowers them to
+// at most max, a max of 0 means no maximum. The OPT record, whose TTL holds flags, is left alone.
+func clampTTL(m *dns.Msg, min, max uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl < min {
+				h.Ttl = min
+			}
+			if max > 0 && h.Ttl > max {
+				h.Ttl = max
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestClampTTL(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. 5 IN A 127.0.0.1"), test.A("example.org. 600 IN A 127.0.0.2"))
+		ret.Ns = append(ret.Ns, test.NS("example.org. 86400 IN NS ns.example.org."))
+		ret.Extra = append(ret.Extra, test.A("ns.example.org. 120 IN A 127.0.0.53"))
+		ret.SetEdns0(4096, true)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nmin_ttl 1m\nmax_ttl 1h\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	f.proxies[0].host.resetFails()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	ret := rec.Msg
+	for _, tc := range []struct {
+		rr  dns.RR
+		ttl uint32
+	}{
+		{ret.Answer[0], 60}, {ret.Answer[1], 600}, {ret.Ns[0], 3600}, {ret.Extra[0], 120},
+	} {
+		if tc.rr.Header().Ttl != tc.ttl {
+			t.Errorf("Expected a TTL of %d, got: %s", tc.ttl, tc.rr)
+		}
+	}
+	if o := ret.IsEdns0(); o == nil || !o.Do() {
+		t.Errorf("Expected the OPT record to keep its DO bit, got: %v", o)
+	}
+
+	for _, input := range []string{"min_ttl", "min_ttl 500ms", "max_ttl 1h 2h", "min_ttl 1h\nmax_ttl 1m"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
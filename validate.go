@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validate returns the problems found in the configuration of f. The server f runs in listens on
+// host and port, the host may be empty.
+func (f *Forward) validate(host, port string) []error {
+	var errs []error
+
+	seen := make(map[string]bool)
+	for _, p := range f.proxies {
+		if seen[p.host.addr] {
+			errs = append(errs, fmt.Errorf("duplicate upstream: %s", p.host.addr))
+		}
+		seen[p.host.addr] = true
+
+		if isListener(p.host.addr, host, port) {
+			errs = append(errs, fmt.Errorf("upstream %s is this server", p.host.addr))
+		}
+		if p.tlsServerName != "" && !isHostname(p.tlsServerName) {
+			errs = append(errs, fmt.Errorf("invalid tls_servername of %s: %q", p.host.addr, p.tlsServerName))
+		}
+	}
+
+	if f.tlsServerName != "" {
+		if !isHostname(f.tlsServerName) {
+			errs = append(errs, fmt.Errorf("invalid tls_servername: %q", f.tlsServerName))
+		}
+	}
+	return errs
+}
+
+// isListener returns true if addr is the address a server listening on host and port receives
+// queries on. An empty or unspecified host listens on all addresses, of which we only check the
+// loopback ones.
+func isListener(addr, host, port string) bool {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil || p != port {
+		return false
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return false
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		return ip.IsLoopback() || ip.IsUnspecified()
+	}
+	return ip.Equal(net.ParseIP(host))
+}
+
+// isHostname returns true if s is a name a TLS certificate can be issued for.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(s, ".") {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, r := range l {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
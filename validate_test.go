@@ -0,0 +1,34 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		input    string
+		host     string
+		problems int
+	}{
+		{"forward . 10.0.0.1 10.0.0.2", "", 0},
+		{"forward . 10.0.0.1 10.0.0.1:53", "", 1},
+		{"forward . 127.0.0.1", "", 1},
+		{"forward . 127.0.0.1", "10.0.0.1", 0},
+		{"forward . 10.0.0.1", "10.0.0.1", 1},
+		{"forward . 127.0.0.1:1053", "", 0},
+		{"forward . tls://10.0.0.1 {\ntls_servername dns.example.org\n}\n", "", 0},
+		{"forward . tls://10.0.0.1 {\ntls_servername \"not a name\"\n}\n", "", 1},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %v", i, err)
+		}
+		if errs := f.validate(test.host, "53"); len(errs) != test.problems {
+			t.Errorf("Test %d: expected %d problems, got: %v", i, test.problems, errs)
+		}
+	}
+}
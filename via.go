@@ -0,0 +1,242 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// via is a proxy server that the TCP connections to the upstreams are tunneled through: SOCKS5
+// (RFC 1928), optionally with a username and password (RFC 1929), or HTTP CONNECT.
+type via struct {
+	scheme         string // "socks5" or "http"
+	addr           string // host:port of the proxy server
+	auth           bool   // authenticate with user and password
+	user, password string
+}
+
+// parseVia returns the via for s, socks5://[USER:PASSWORD@]HOST:PORT or
+// http://[USER:PASSWORD@]HOST:PORT.
+func parseVia(s string) (*via, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("proxy must be socks5:// or http://: '%s'", s)
+	}
+	if u.Port() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("proxy must be a host and port: '%s'", s)
+	}
+	v := &via{scheme: u.Scheme, addr: u.Host}
+	if u.User != nil {
+		v.auth, v.user = true, u.User.Username()
+		v.password, _ = u.User.Password()
+		if len(v.user) > 255 || len(v.password) > 255 {
+			return nil, fmt.Errorf("proxy username and password can be at most 255 bytes")
+		}
+	}
+	return v, nil
+}
+
+// String returns the proxy server of v, without the credentials.
+func (v *via) String() string { return v.scheme + "://" + v.addr }
+
+// dial connects to addr, host:port, through v before deadline. The connection to v is made with d.
+func (v *via) dial(d *net.Dialer, addr string, deadline time.Time) (net.Conn, error) {
+	d.Deadline = deadline
+	c, err := d.Dial("tcp", v.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(deadline)
+	if v.scheme == "socks5" {
+		err = v.socks5(c, addr)
+	} else {
+		err = v.connect(c, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("via %s: %s", v, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// socks5 asks the SOCKS5 server on c to connect to addr.
+func (v *via) socks5(c net.Conn, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	methods := []byte{5, 1, socksNoAuth}
+	if v.auth {
+		methods = []byte{5, 2, socksNoAuth, socksPassword}
+	}
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	switch {
+	case buf[0] != 5:
+		return errors.New("not a SOCKS5 server")
+	case buf[1] == socksPassword && v.auth:
+		auth := append([]byte{1, byte(len(v.user))}, v.user...)
+		auth = append(append(auth, byte(len(v.password))), v.password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	case buf[1] != socksNoAuth:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = append(req, byte(p>>8), byte(p))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksErrors) {
+			return errors.New(socksErrors[reply[1]])
+		}
+		return fmt.Errorf("SOCKS5 error %d", reply[1])
+	}
+	// Skip the bound address and port.
+	n := 0
+	switch reply[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
+
+// SOCKS5 authentication methods.
+const (
+	socksNoAuth   = 0
+	socksPassword = 2
+)
+
+var socksErrors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// connect asks the HTTP proxy on c to connect to addr.
+func (v *via) connect(c net.Conn, addr string) error {
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if v.auth {
+		cred := base64.StdEncoding.EncodeToString([]byte(v.user + ":" + v.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	// The upstream doesn't send anything before we do, so nothing after the response is buffered.
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// dialVia connects to addr through the proxy of h, before deadline.
+func (h *host) dialVia(addr string, deadline time.Time) (net.Conn, error) {
+	return h.via.dial(h.bind.dialer("tcp", h.via.addr), addr, deadline)
+}
+
+// dialContextVia is dialVia for an http.Transport.
+func (h *host) dialContextVia(ctx context.Context, network, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(h.dialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return h.dialVia(addr, deadline)
+}
+
+// exchangeOnce sends m to h with client, or through the proxy or the Dialer of h over the transport
+// of client when it has one. It's for the health checks and probes, which don't use the cached
+// connections. With the PROXY protocol their TCP and TLS connections start with a LOCAL header.
+func (h *host) exchangeOnce(client *dns.Client, m *dns.Msg, addr string) (*dns.Msg, error) {
+	proto := client.Net
+	var header []byte
+	if h.proxyProtocol && proto != "udp" {
+		header = localHeader()
+	}
+	if h.via == nil && header == nil && h.dialer == nil {
+		ret, _, err := client.Exchange(m, addr)
+		return ret, err
+	}
+	if proto == "udp" && h.via != nil {
+		proto = "tcp"
+	}
+	conn, err := h.dialHeader(proto, header)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.writeTimeout + h.readTimeout))
+	if err := conn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	return conn.ReadMsg()
+}
@@ -0,0 +1,189 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// socks5Server is a SOCKS5 proxy that wants user and password, if user isn't "".
+func socks5Server(t *testing.T, user, password string) (addr string, stop func()) {
+	return proxyServer(t, func(c net.Conn) string {
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return ""
+		}
+		io.ReadFull(c, buf[:buf[1]])
+		if user == "" {
+			c.Write([]byte{5, 0})
+		} else {
+			c.Write([]byte{5, 2})
+			io.ReadFull(c, buf[:2])
+			u := make([]byte, buf[1])
+			io.ReadFull(c, u)
+			io.ReadFull(c, buf[:1])
+			p := make([]byte, buf[0])
+			io.ReadFull(c, p)
+			if string(u) != user || string(p) != password {
+				c.Write([]byte{1, 1})
+				return ""
+			}
+			c.Write([]byte{1, 0})
+		}
+		io.ReadFull(c, buf[:4])
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(c, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(c, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(c, buf[:2])
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	})
+}
+
+// connectServer is an HTTP CONNECT proxy that wants the basic credentials auth, if it isn't "".
+func connectServer(t *testing.T, auth string) (addr string, stop func()) {
+	return proxyServer(t, func(c net.Conn) string {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil || req.Method != "CONNECT" {
+			return ""
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return ""
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+		return req.Host
+	})
+}
+
+// proxyServer accepts connections, has handshake return the address to connect to and then relays.
+func proxyServer(t *testing.T, handshake func(c net.Conn) string) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				to := handshake(c)
+				if to == "" {
+					return
+				}
+				up, err := net.Dial("tcp", to)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestVia(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+	to := "127.0.0.1:" + port
+
+	socks, stopSocks := socks5Server(t, "", "")
+	defer stopSocks()
+	socksAuth, stopSocksAuth := socks5Server(t, "user", "secret")
+	defer stopSocksAuth()
+	connect, stopConnect := connectServer(t, "user:secret")
+	defer stopConnect()
+
+	tests := []struct {
+		via string
+		ok  bool
+	}{
+		{"socks5://" + socks, true},
+		{"socks5://user:secret@" + socksAuth, true},
+		{"socks5://user:wrong@" + socksAuth, false},
+		{"socks5://" + socksAuth, false},
+		{"http://user:secret@" + connect, true},
+		{"http://" + connect, false},
+	}
+	for i, tc := range tests {
+		f, err := parseForward(caddy.NewTestController("dns", "forward . "+to+" {\nvia "+tc.via+"\n}\n"))
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		p := f.proxies[0]
+		if p.proto(questionState("example.org."), false) != "tcp" {
+			t.Errorf("Test %d: expected queries over TCP", i)
+		}
+		p.setHealthClient()
+		hcErr := p.host.send()
+		_, err = p.connect(context.Background(), questionState("example.org."), false, false)
+		p.close()
+		if tc.ok && (err != nil || hcErr != nil) {
+			t.Errorf("Test %d: expected no error, got: %v and %v", i, err, hcErr)
+		}
+		if !tc.ok && (err == nil || hcErr == nil) {
+			t.Errorf("Test %d: expected the proxy to refuse us", i)
+		}
+	}
+
+	// TLS goes through the tunnel too.
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	var serial int64
+	tlsAddr, stopTLS := tlsServer(t, ca, new(tls.Config), &serial)
+	defer stopTLS()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	f, err := parseForward(caddy.NewTestController("dns", "forward . tls://"+tlsAddr+" {\ntls "+caFile+"\ntls_servername dns.test\nvia socks5://"+socks+"\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	p := f.proxies[0]
+	defer p.close()
+	if _, err := p.connect(context.Background(), questionState("example.org."), false, false); err != nil {
+		t.Errorf("Expected no error over TLS, got: %s", err)
+	}
+
+	for _, input := range []string{"via", "via ftp://127.0.0.1:21", "via socks5://127.0.0.1", "via socks5://127.0.0.1:1080/path", "via socks5://127.0.0.1:1080\nprefer_udp"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . "+to+" {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package forward
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// warmProto returns the protocol of the connections warm_conns keeps dialed to p, the one its queries
+// usually go over, and false if p doesn't keep any: without warm_conns, or when p doesn't send
+// queries over cached connections.
+func (p *Proxy) warmProto() (string, bool) {
+	if p.warmConns == 0 || p.host.exch != nil || p.mdns != nil || p.mux != nil || p.host.chain != nil ||
+		p.stateless || p.host.proxyProtocol {
+		return "", false
+	}
+	switch {
+	case p.host.tlsConfig != nil:
+		return "tcp-tls", true
+	case p.forceTCP:
+		return "tcp", true
+	case p.noPoolUDP:
+		return "", false
+	}
+	return "udp", true
+}
+
+// keepWarm keeps warmConns connections of type proto to p in the cache, so queries don't wait for a
+// dial or a TLS handshake. Connections are dialed again when queries take them and before the cached
+// ones expire. It returns when p is closed.
+func (p *Proxy) keepWarm(proto string) {
+	GoroutineGauge.WithLabelValues(p.host.id, p.host.addr, "warm").Inc()
+	defer GoroutineGauge.WithLabelValues(p.host.id, p.host.addr, "warm").Dec()
+
+	tick := time.NewTicker(warmInterval)
+	defer tick.Stop()
+	for {
+		p.topUp(proto)
+		select {
+		case <-tick.C:
+		case <-p.transport.taken:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// topUp dials connections of type proto to p until warmConns of them are cached, capped by
+// max_idle_conns. It gives up when p is failing its health checks or a dial fails.
+func (p *Proxy) topUp(proto string) {
+	want := p.warmConns
+	if max := p.transport.maxIdle; max > 0 && want > max {
+		want = max
+	}
+	margin := warmInterval
+	if idle := p.host.idle(proto); margin > idle/2 {
+		margin = idle / 2
+	}
+	for n := p.transport.fresh(proto, margin); n < want; n++ {
+		if atomic.LoadUint32(&p.host.fails) > 0 || atomic.LoadInt32(&p.transport.stopped) == 1 {
+			return
+		}
+		c, err := p.host.dial(proto)
+		if err != nil {
+			return
+		}
+		p.transport.Yield(c)
+	}
+}
+
+// fresh closes the cached conns of type proto that expire within margin and returns how many are left.
+func (t *transport) fresh(proto string, margin time.Duration) int {
+	s := t.shard(proto)
+	size := connSize(proto)
+	idle := t.host.idle(proto)
+
+	var expiring []*dns.Conn
+	s.Lock()
+	// The conns are in the order they were yielded, the oldest first.
+	for len(s.conns) > 0 && time.Since(s.conns[0].used)+margin >= idle {
+		expiring = append(expiring, s.conns[0].c)
+		s.conns[0] = nil
+		s.conns = s.conns[1:]
+		t.account(-1, -size)
+	}
+	n := len(s.conns)
+	s.Unlock()
+
+	if len(expiring) > 0 {
+		for _, c := range expiring {
+			c.Close()
+		}
+		t.updateGauges(proto, n)
+	}
+	return n
+}
+
+const warmInterval = 1 * time.Second
@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestWarmConns(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := parseForward(caddy.NewTestController("dns", "forward . "+s.Addr+" {\nforce_tcp\nwarm_conns 2\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	p := f.proxies[0]
+	proto, ok := p.warmProto()
+	if !ok || proto != "tcp" {
+		t.Fatalf("Expected warm tcp connections, got %q %t", proto, ok)
+	}
+
+	p.topUp(proto)
+	if n := p.transport.Len(); n != 0 {
+		t.Errorf("Expected no connections to an upstream that isn't healthy yet, got %d", n)
+	}
+	p.host.resetFails()
+	p.topUp(proto)
+	if n := p.transport.Len(); n != 2 {
+		t.Fatalf("Expected 2 warm connections, got %d", n)
+	}
+	c, err := p.Dial(proto)
+	if err != nil {
+		t.Fatalf("Expected a cached connection, got: %s", err)
+	}
+	defer c.Close()
+	p.topUp(proto)
+	if n := p.transport.Len(); n != 2 {
+		t.Errorf("Expected the taken connection to be replaced, got %d", n)
+	}
+
+	p.SetExpire(100 * time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if n := p.transport.fresh(proto, 50*time.Millisecond); n != 0 {
+		t.Errorf("Expected the connections about to expire to be closed, got %d", n)
+	}
+
+	for _, input := range []string{"warm_conns", "warm_conns 0", "warm_conns two", "warm_conns 2 3"} {
+		if _, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n")); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+	f, err = parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 https://dns.example/dns-query {\nwarm_conns 2\nno_pool_udp\n}\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	defer f.Close()
+	for _, p := range f.proxies {
+		if _, ok := p.warmProto(); ok {
+			t.Errorf("Expected no warm connections to %s", p.host.addr)
+		}
+	}
+}